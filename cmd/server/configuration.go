@@ -6,6 +6,8 @@ import (
 	"os"
 
 	"mock-my-mta/http"
+	"mock-my-mta/imap"
+	"mock-my-mta/pop3"
 	"mock-my-mta/smtp"
 	"mock-my-mta/storage"
 )
@@ -17,16 +19,31 @@ var defaultConfigurationData []byte
 
 // Configuration holds the application configurations
 type Configuration struct {
-	Smtpd    smtp.Configuration                  `json:"smtpd"`
-	Httpd    http.Configuration                  `json:"httpd"`
-	Storages []storage.StorageLayerConfiguration `json:"storages"`
-	Logging  LoggingConfiguration                `json:"logging"`
+	Smtpd     smtp.Configuration                  `json:"smtpd"`
+	Httpd     http.Configuration                  `json:"httpd"`
+	Pop3d     pop3.Configuration                  `json:"pop3d"`
+	Imapd     imap.Configuration                  `json:"imapd"`
+	Storages  []storage.StorageLayerConfiguration `json:"storages"`
+	Snapshots SnapshotsConfiguration              `json:"snapshots"`
+	Sieve     SieveConfiguration                  `json:"sieve"`
+	Retention storage.RetentionConfiguration      `json:"retention"`
+	Logging   LoggingConfiguration                `json:"logging"`
 }
 
 type LoggingConfiguration struct {
 	Level string `json:"level"`
 }
 
+// SnapshotsConfiguration is where the named snapshots of the emails are kept.
+type SnapshotsConfiguration struct {
+	Folder string `json:"folder"`
+}
+
+// SieveConfiguration is where the Sieve scripts and folders of the mailboxes are kept.
+type SieveConfiguration struct {
+	File string `json:"file"`
+}
+
 func parseConfiguration(data []byte) (Configuration, error) {
 	var config Configuration
 	err := json.Unmarshal(data, &config)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"mock-my-mta/storage"
+)
+
+// runFsck runs the fsck and reindex subcommands: the storage layers are compared
+// with the root layer and, with -repair or reindex, repaired. The exit code is 1
+// when differences remain.
+func runFsck(storageEngine *storage.Engine, command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	repair := flags.Bool("repair", command == "reindex", "repair the layers from the root layer")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	report, err := storageEngine.Fsck(context.Background(), *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printFsckReport(os.Stdout, report)
+	}
+	if !report.Consistent() {
+		return 1
+	}
+	return 0
+}
+
+func printFsckReport(w io.Writer, report storage.FsckReport) {
+	fmt.Fprintf(w, "root %v storage: %d emails\n", report.Root, report.Emails)
+	for _, layer := range report.Layers {
+		if layer.Skipped != "" {
+			fmt.Fprintf(w, "layer %d (%v): skipped, %v\n", layer.Index, layer.Layer, layer.Skipped)
+			continue
+		}
+		fmt.Fprintf(w, "layer %d (%v): %d emails, %d missing, %d extra, %d mismatched, %d repaired\n",
+			layer.Index, layer.Layer, layer.Emails, len(layer.Missing), len(layer.Extra), len(layer.Mismatched), layer.Repaired)
+		for _, emailID := range layer.Missing {
+			fmt.Fprintf(w, "  missing    %v\n", emailID)
+		}
+		for _, emailID := range layer.Extra {
+			fmt.Fprintf(w, "  extra      %v\n", emailID)
+		}
+		for _, emailID := range layer.Mismatched {
+			fmt.Fprintf(w, "  mismatched %v\n", emailID)
+		}
+		for _, message := range layer.Errors {
+			fmt.Fprintf(w, "  error      %v\n", message)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"net/mail"
 	"os"
 	"os/signal"
@@ -12,15 +15,19 @@ import (
 	"time"
 
 	mtahttp "mock-my-mta/http"
+	"mock-my-mta/imap"
 	"mock-my-mta/log"
+	"mock-my-mta/pop3"
+	"mock-my-mta/sieve"
 	"mock-my-mta/smtp"
 	"mock-my-mta/storage"
+	"mock-my-mta/storage/mbox"
 )
 
 func main() {
 	var initWithTestData string
 	var configurationFile string
-	flag.StringVar(&initWithTestData, "init-with-test-data", "", "Folder containing test data emails")
+	flag.StringVar(&initWithTestData, "init-with-test-data", "", "Folder containing test data emails (.eml and .mbox files)")
 	flag.StringVar(&configurationFile, "config", "", "Configuration file")
 	flag.Parse()
 
@@ -44,6 +51,12 @@ func main() {
 
 	// Environment variable overrides
 	applyEnvOverrides(&config)
+	if config.Snapshots.Folder == "" {
+		config.Snapshots.Folder = "snapshots"
+	}
+	if config.Sieve.File == "" {
+		config.Sieve.File = "sieve.json"
+	}
 
 	log.SetMinimumLogLevel(log.ParseLogLevel(config.Logging.Level))
 	log.Logf(log.INFO, "starting mock-my-mta")
@@ -53,6 +66,21 @@ func main() {
 		log.Logf(log.FATAL, "error: failed to create storage: %v", err)
 	}
 
+	// Subcommands: check, repair, snapshot or restore the storage, then exit
+	switch command := flag.Arg(0); command {
+	case "fsck", "reindex":
+		code := runFsck(storageEngine, command, flag.Args()[1:])
+		storageEngine.Close()
+		os.Exit(code)
+	case "snapshot", "restore":
+		code := runSnapshot(storageEngine, config.Snapshots.Folder, command, flag.Args()[1:])
+		storageEngine.Close()
+		os.Exit(code)
+	case "":
+	default:
+		log.Logf(log.FATAL, "error: unknown command %q (fsck, reindex, snapshot or restore)", command)
+	}
+
 	if len(initWithTestData) > 0 {
 		log.Logf(log.INFO, "loading test data from %q", initWithTestData)
 		err := loadTestData(storageEngine, initWithTestData)
@@ -81,10 +109,59 @@ func main() {
 	smtpServer := smtp.NewServer(config.Smtpd, storageEngine)
 	httpServer := mtahttp.NewServer(config.Httpd, config.Smtpd.Relays, storageEngine)
 
-	// Wire SMTP → WebSocket notification
-	smtpServer.SetOnNewEmail(func(emailID string) {
+	// Share Sieve scripts between the HTTP API (configuration) and SMTP (delivery)
+	sieveStore := sieve.NewStore()
+	if err := sieveStore.SetFile(config.Sieve.File); err != nil {
+		log.Logf(log.FATAL, "error: failed to load the sieve scripts: %v", err)
+	}
+	smtpServer.SetSieveStore(sieveStore)
+	httpServer.SetSieveStore(sieveStore)
+
+	// Share the email flags (read state) between the web UI and IMAP
+	flagStore := storage.NewFlagStore()
+	if err := flagStore.SetPersister(storageEngine); err != nil {
+		log.Logf(log.WARNING, "cannot load the email flags from the storage: %v", err)
+	}
+	httpServer.SetFlagStore(flagStore)
+	httpServer.SetSnapshotStore(storage.NewSnapshotStore(config.Snapshots.Folder, storageEngine, flagStore))
+
+	// Optional IMAP server, any password accepted like SMTP AUTH
+	var imapServer *imap.Server
+	if len(config.Imapd.Addr) > 0 {
+		imapServer = imap.NewServer(config.Imapd, storageEngine)
+		imapServer.SetTLSConfig(smtp.GenerateSelfSignedTLS())
+		imapServer.SetFlagStore(flagStore)
+		imapServer.SetSieveStore(sieveStore)
+	}
+
+	// Wire SMTP, watched folders and retention → WebSocket (and IMAP IDLE) notification
+	notifyNewEmail := func(emailID string) {
 		mtahttp.BroadcastEvent("new_email", map[string]string{"id": emailID})
+		if imapServer != nil {
+			imapServer.NotifyNewEmail(emailID)
+		}
+	}
+	smtpServer.SetOnNewEmail(notifyNewEmail)
+	storageEngine.SetOnNewEmail(notifyNewEmail)
+	// Every deletion goes through the engine: HTTP, JMAP, IMAP, POP3, watched
+	// folders and retention
+	storageEngine.SetOnDeleteEmail(func(emailID string) {
+		flagStore.Delete(emailID)
+		mtahttp.BroadcastEvent("delete_email", map[string]string{"id": emailID})
+		if imapServer != nil {
+			imapServer.NotifyDeleteEmail(emailID)
+		}
+	})
+	storageEngine.SetOnDeleteAllEmails(func() {
+		flagStore.Clear()
+		if imapServer != nil {
+			imapServer.NotifyDeleteEmail("")
+		}
 	})
+	// Delete the oldest emails beyond the retention limits, notified as above
+	if err := storageEngine.StartRetention(config.Retention); err != nil {
+		log.Logf(log.FATAL, "error: %v", err)
+	}
 	// Wire SMTP behavior settings from HTTP settings API
 	smtpServer.SetGetBehavior(func() smtp.SmtpBehavior {
 		s := mtahttp.GetSmtpSettings()
@@ -109,6 +186,26 @@ func main() {
 		}
 	}()
 
+	// Optional POP3 server, any password accepted like SMTP AUTH
+	var pop3Server *pop3.Server
+	if len(config.Pop3d.Addr) > 0 {
+		pop3Server = pop3.NewServer(config.Pop3d, storageEngine)
+		pop3Server.SetTLSConfig(smtp.GenerateSelfSignedTLS())
+		go func() {
+			if err := pop3Server.ListenAndServe(); err != nil {
+				log.Logf(log.FATAL, "POP3 server error: %v", err)
+			}
+		}()
+	}
+
+	if imapServer != nil {
+		go func() {
+			if err := imapServer.ListenAndServe(); err != nil {
+				log.Logf(log.FATAL, "IMAP server error: %v", err)
+			}
+		}()
+	}
+
 	// Graceful shutdown on QUIT/TERM/INT signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -121,6 +218,18 @@ func main() {
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log.Logf(log.ERROR, "HTTP server shutdown error: %v", err)
 	}
+	if pop3Server != nil {
+		if err := pop3Server.Shutdown(); err != nil {
+			log.Logf(log.ERROR, "POP3 server shutdown error: %v", err)
+		}
+	}
+	if imapServer != nil {
+		if err := imapServer.Shutdown(); err != nil {
+			log.Logf(log.ERROR, "IMAP server shutdown error: %v", err)
+		}
+	}
+	// the servers no longer write: stop the janitor, apply the writes queued for the async layers
+	storageEngine.Close()
 	log.Logf(log.INFO, "servers stopped")
 }
 
@@ -133,7 +242,7 @@ func loadTestData(storageEngine *storage.Engine, testDataDir string) error {
 		if info.IsDir() {
 			return nil
 		}
-		if filepath.Ext(path) == ".eml" {
+		if ext := filepath.Ext(path); ext == ".eml" || ext == ".mbox" {
 			filenames = append(filenames, path)
 		}
 		return nil
@@ -147,19 +256,44 @@ func loadTestData(storageEngine *storage.Engine, testDataDir string) error {
 			log.Logf(log.ERROR, "error: cannot read email from file %q: %v", filename, err)
 			continue
 		}
-		email, err := mail.ReadMessage(file)
-		if err != nil {
-			log.Logf(log.ERROR, "error: cannot parse email from file %q: %v", filename, err)
-			continue
+		if filepath.Ext(filename) == ".mbox" {
+			loadTestMbox(storageEngine, file, filename)
+		} else {
+			loadTestEmail(storageEngine, file, filename)
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// loadTestMbox loads every email of an mbox file.
+func loadTestMbox(storageEngine *storage.Engine, file io.Reader, filename string) {
+	reader := mbox.NewReader(file)
+	for i := 1; ; i++ {
+		message, err := reader.Next()
+		if err == io.EOF {
+			return
 		}
-		mailUUID, err := storageEngine.Set(email)
 		if err != nil {
-			log.Logf(log.ERROR, "error: cannot store email from file %q: %v", filename, err)
-			continue
+			log.Logf(log.ERROR, "error: cannot read mbox file %q: %v", filename, err)
+			return
 		}
-		log.Logf(log.INFO, "loaded email %v from file %q", mailUUID, filename)
+		loadTestEmail(storageEngine, bytes.NewReader(message.Raw), fmt.Sprintf("%v#%d", filename, i))
 	}
-	return nil
+}
+
+func loadTestEmail(storageEngine *storage.Engine, reader io.Reader, source string) {
+	email, err := mail.ReadMessage(reader)
+	if err != nil {
+		log.Logf(log.ERROR, "error: cannot parse email from file %q: %v", source, err)
+		return
+	}
+	mailUUID, err := storageEngine.Set(email)
+	if err != nil {
+		log.Logf(log.ERROR, "error: cannot store email from file %q: %v", source, err)
+		return
+	}
+	log.Logf(log.INFO, "loaded email %v from file %q", mailUUID, source)
 }
 
 // applyEnvOverrides lets environment variables override JSON config values.
@@ -171,12 +305,27 @@ func applyEnvOverrides(config *Configuration) {
 	if v := os.Getenv("MOCKMYMTA_HTTP_ADDR"); v != "" {
 		config.Httpd.Addr = v
 	}
+	if v := os.Getenv("MOCKMYMTA_POP3_ADDR"); v != "" {
+		config.Pop3d.Addr = v
+	}
+	if v := os.Getenv("MOCKMYMTA_IMAP_ADDR"); v != "" {
+		config.Imapd.Addr = v
+	}
 	if v := os.Getenv("MOCKMYMTA_LOG_LEVEL"); v != "" {
 		config.Logging.Level = v
 	}
 	if v := os.Getenv("MOCKMYMTA_HTTP_DEBUG"); v == "true" || v == "1" {
 		config.Httpd.Debug = true
 	}
+	if v := os.Getenv("MOCKMYMTA_SNAPSHOTS_FOLDER"); v != "" {
+		config.Snapshots.Folder = v
+	}
+	if v := os.Getenv("MOCKMYMTA_SIEVE_FILE"); v != "" {
+		config.Sieve.File = v
+	}
+	if v := os.Getenv("MOCKMYMTA_SMTP_RECORD_DIR"); v != "" {
+		config.Smtpd.RecordDir = v
+	}
 	if v := os.Getenv("MOCKMYMTA_SMTP_MAX_MESSAGE_SIZE"); v != "" {
 		if size, err := strconv.Atoi(v); err == nil {
 			config.Smtpd.MaxMessageSize = size
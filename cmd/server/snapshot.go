@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"mock-my-mta/storage"
+)
+
+// runSnapshot runs the snapshot and restore subcommands, on a named snapshot of
+// the snapshots folder or on an archive file:
+//
+//	snapshot [-list] [-file archive.tar.gz] [name]
+//	restore [-file archive.tar.gz] [name]
+func runSnapshot(storageEngine *storage.Engine, folder string, command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	file := flags.String("file", "", "archive file instead of a named snapshot")
+	list := flags.Bool("list", false, "list the named snapshots")
+	flags.Parse(args)
+	name := flags.Arg(0)
+
+	flagStore := storage.NewFlagStore()
+	if err := flagStore.SetPersister(storageEngine); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot load the email flags: %v\n", err)
+	}
+	snapshots := storage.NewSnapshotStore(folder, storageEngine, flagStore)
+	ctx := context.Background()
+
+	if *list {
+		infos, err := snapshots.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		for _, info := range infos {
+			fmt.Printf("%-24v %10d bytes  %v\n", info.Name, info.Size, info.Created.Local().Format("2006-01-02 15:04:05"))
+		}
+		return 0
+	}
+	if (name == "") == (*file == "") {
+		fmt.Fprintf(os.Stderr, "error: %v needs a snapshot name or -file\n", command)
+		return 2
+	}
+
+	var err error
+	var emails int
+	switch {
+	case command == "snapshot" && name != "":
+		var info storage.SnapshotInfo
+		if info, err = snapshots.Save(ctx, name); err == nil {
+			fmt.Printf("snapshot %v saved (%d bytes)\n", info.Name, info.Size)
+		}
+	case command == "snapshot":
+		err = writeFile(*file, func(w io.Writer) error {
+			emails, err = snapshots.Write(ctx, w)
+			return err
+		})
+		if err == nil {
+			fmt.Printf("%d emails saved into %v\n", emails, *file)
+		}
+	case name != "":
+		if emails, err = snapshots.RestoreNamed(ctx, name); err == nil {
+			fmt.Printf("%d emails restored from snapshot %v\n", emails, name)
+		}
+	default:
+		var archive *os.File
+		if archive, err = os.Open(*file); err == nil {
+			emails, err = snapshots.Restore(ctx, archive)
+			archive.Close()
+		}
+		if err == nil {
+			fmt.Printf("%d emails restored from %v\n", emails, *file)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// writeFile writes the file with write, removing it on error.
+func writeFile(filename string, write func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
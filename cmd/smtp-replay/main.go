@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mock-my-mta/smtp"
+)
+
+// smtp-replay replays recorded SMTP sessions (the transcripts saved by the server
+// when smtpd.record_dir is set) or captured emails (.eml) against an SMTP server,
+// and reports the replies differing from the recorded ones.
+func main() {
+	var addr, compare string
+	var speed float64
+	var timeout time.Duration
+	var insecure bool
+	flag.StringVar(&addr, "addr", "localhost:1025", "SMTP server to replay the sessions against")
+	flag.Float64Var(&speed, "speed", 1, "timing acceleration (2 = twice as fast, 0 = no delay)")
+	flag.StringVar(&compare, "compare", smtp.CompareCode, "reply comparison: code, text or none")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "maximum wait for each reply")
+	flag.BoolVar(&insecure, "insecure", true, "do not verify the server certificate after STARTTLS")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <transcript.smtp|email.eml> [...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid address %q: %v\n", addr, err)
+		os.Exit(2)
+	}
+	options := smtp.ReplayOptions{
+		Speed:     speed,
+		Compare:   compare,
+		Timeout:   timeout,
+		TLSConfig: &tls.Config{ServerName: host, InsecureSkipVerify: insecure},
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		transcript, err := loadTranscript(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			failed = true
+			continue
+		}
+		result, err := smtp.ReplayTranscript(addr, transcript, options)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %v: %v\n", path, err)
+			failed = true
+		case len(result.Mismatches) > 0:
+			fmt.Printf("FAIL %v: %d commands, %d replies, %d mismatches\n", path, result.Commands, result.Replies, len(result.Mismatches))
+			failed = true
+		default:
+			fmt.Printf("ok   %v: %d commands, %d replies\n", path, result.Commands, result.Replies)
+		}
+		for _, mismatch := range result.Mismatches {
+			fmt.Printf("     %v\n", mismatch)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadTranscript reads a transcript, or builds one from a captured email.
+func loadTranscript(path string) (*smtp.Transcript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".eml") {
+		return smtp.NewTranscriptFromEmail(data)
+	}
+	return smtp.ParseTranscript(bytes.NewReader(data))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"mock-my-mta/storage"
+)
+
+// storage-encode rewrites in place the .eml files of a FILESYSTEM storage folder
+// with the given compression and encryption, for instance to encrypt a folder
+// written before the encryption was configured. The server must use the same
+// parameters afterwards.
+func main() {
+	var folder, layout, compression, encryption, keyFile, keyEnv string
+	var quiet bool
+	flag.StringVar(&folder, "folder", "data", "storage folder")
+	flag.StringVar(&layout, "layout", "flat", "storage layout: flat or date")
+	flag.StringVar(&compression, "compression", "none", "compression: none, gzip or zstd")
+	flag.StringVar(&encryption, "encryption", "", "encryption: none or aes-256-gcm (default aes-256-gcm with a key)")
+	flag.StringVar(&keyFile, "key-file", "", "file holding the AES-256 key, hexadecimal or base64 encoded")
+	flag.StringVar(&keyEnv, "key-env", "", "environment variable holding the AES-256 key")
+	flag.BoolVar(&quiet, "quiet", false, "do not show the progress")
+	flag.Parse()
+
+	parameters := map[string]string{
+		"folder":              folder,
+		"type":                "eml",
+		"layout":              layout,
+		"compression":         compression,
+		"encryption":          encryption,
+		"encryption_key_file": keyFile,
+		"encryption_key_env":  keyEnv,
+	}
+	progress := func(done int, total int) {
+		if !quiet && (done%100 == 0 || done == total) {
+			fmt.Fprintf(os.Stderr, "\r%d/%d files", done, total)
+		}
+	}
+	recoded, err := storage.RecodeFilesystemFolder(parameters, progress)
+	if !quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d files rewritten in %v\n", recoded, folder)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"mock-my-mta/storage"
+)
+
+// parametersFlag collects the repeated key=value parameters of a layer.
+type parametersFlag map[string]string
+
+func (p parametersFlag) String() string {
+	var pairs []string
+	for key, value := range p {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p parametersFlag) Set(value string) error {
+	key, parameter, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	p[key] = parameter
+	return nil
+}
+
+// storage-migrate copies the emails of a storage layer into another one, of any
+// type, keeping their IDs: a MailHog folder into a compressed eml folder, an
+// SQLITE database into a BOLT one... The emails already in the destination are
+// skipped, so an interrupted migration is resumed by running it again.
+func main() {
+	var fromType, toType string
+	var overwrite, quiet bool
+	fromParameters, toParameters := parametersFlag{}, parametersFlag{}
+	flag.StringVar(&fromType, "from", "", "source storage type: FILESYSTEM, SQLITE, BOLT or S3")
+	flag.Var(fromParameters, "from-param", "source storage parameter, key=value (repeatable)")
+	flag.StringVar(&toType, "to", "", "destination storage type: FILESYSTEM, SQLITE, BOLT or S3")
+	flag.Var(toParameters, "to-param", "destination storage parameter, key=value (repeatable)")
+	flag.BoolVar(&overwrite, "overwrite", false, "write again the emails already in the destination")
+	flag.BoolVar(&quiet, "quiet", false, "do not show the progress")
+	flag.Parse()
+	if fromType == "" || toType == "" {
+		fmt.Fprintln(os.Stderr, "error: -from and -to are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// stop cleanly on interruption: running again resumes the migration
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	source := storage.StorageLayerConfiguration{Type: strings.ToUpper(fromType), Parameters: fromParameters}
+	destination := storage.StorageLayerConfiguration{Type: strings.ToUpper(toType), Parameters: toParameters}
+	options := storage.MigrateOptions{
+		Overwrite: overwrite,
+		Progress: func(done int, total int) {
+			if !quiet && (done%100 == 0 || done == total) {
+				fmt.Fprintf(os.Stderr, "\r%d/%d emails", done, total)
+			}
+		},
+	}
+	result, err := storage.Migrate(ctx, source, destination, options)
+	if !quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	for _, message := range result.Errors {
+		fmt.Fprintf(os.Stderr, "error: %v\n", message)
+	}
+	fmt.Printf("%d emails: %d copied, %d already migrated, %d failed, %d with flags\n",
+		result.Total, result.Copied, result.Skipped, len(result.Errors), result.Flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
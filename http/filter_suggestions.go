@@ -62,11 +62,21 @@ var filterSyntaxEntries = []FilterSyntaxEntry{
 		Suggestion:  "mailbox:<name>",
 		Description: "Search for emails in a specific mailbox.",
 	},
+	{
+		Command:     "in",
+		Suggestion:  "in:<folder>",
+		Description: "Search for emails filed into a folder by Sieve filtering (e.g., inbox, spam).",
+	},
 	{
 		Command:     "has",
 		Suggestion:  "has:attachment",
 		Description: "Search for emails that have attachments.",
 	},
+	{
+		Command:     "attachment_hash",
+		Suggestion:  "attachment_hash:<sha256>",
+		Description: "Search for emails with an attachment of the given SHA-256 (the hash of its decoded content).",
+	},
 	{
 		Command:     "before",
 		Suggestion:  "before:<YYYY-MM-DD>",
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/mail"
@@ -17,7 +18,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
@@ -26,8 +26,10 @@ import (
 	"github.com/gorilla/mux"
 
 	"mock-my-mta/log"
+	"mock-my-mta/sieve"
 	"mock-my-mta/smtp"
 	"mock-my-mta/storage"
+	"mock-my-mta/storage/mbox"
 	"mock-my-mta/storage/multipart"
 )
 
@@ -38,8 +40,14 @@ type Server struct {
 
 	relayConfigurations smtp.RelayConfigurations
 
-	store    storage.Storage
-	readEmails sync.Map // tracks which email IDs have been read
+	store storage.Storage
+	flags *storage.FlagStore // read state (\Seen) shared with the mailbox access protocols
+
+	sieveStore *sieve.Store // per-mailbox Sieve scripts and folders
+
+	snapshots *storage.SnapshotStore // snapshots of the emails, nil when not available
+
+	done chan struct{} // closed on shutdown, ends the streaming responses
 }
 
 // embed static directory
@@ -60,6 +68,9 @@ func NewServer(config Configuration, relayConfigurations smtp.RelayConfiguration
 		startTime:           time.Now(),
 		relayConfigurations: relayConfigurations,
 		store:               store,
+		flags:               storage.NewFlagStore(),
+		sieveStore:          sieve.NewStore(),
+		done:                make(chan struct{}),
 	}
 
 	// Create a new Gorilla Mux router
@@ -72,8 +83,14 @@ func NewServer(config Configuration, relayConfigurations smtp.RelayConfiguration
 
 	// Mailboxes
 	apiRouter.HandleFunc("/mailboxes", s.getMailboxes).Methods("GET")
+	apiRouter.HandleFunc("/mailboxes/{mailbox}/folders", s.getFolders).Methods("GET")
+	apiRouter.HandleFunc("/mailboxes/{mailbox}/folders", s.createFolder).Methods("POST")
+	apiRouter.HandleFunc("/mailboxes/{mailbox}/sieve", s.getSieveScript).Methods("GET")
+	apiRouter.HandleFunc("/mailboxes/{mailbox}/sieve", s.putSieveScript).Methods("PUT")
+	apiRouter.HandleFunc("/mailboxes/{mailbox}/sieve", s.deleteSieveScript).Methods("DELETE")
 	// Emails
 	apiRouter.HandleFunc("/emails/wait", s.waitForEmail).Methods("GET")
+	apiRouter.HandleFunc("/emails/export", s.exportEmails).Methods("GET")
 	apiRouter.HandleFunc("/emails/", s.getEmails).Methods("GET")
 	apiRouter.HandleFunc("/emails/", s.deleteEmails).Methods("DELETE")
 	apiRouter.HandleFunc("/emails/bulk-delete", s.bulkDeleteEmails).Methods("POST")
@@ -100,6 +117,14 @@ func NewServer(config Configuration, relayConfigurations smtp.RelayConfiguration
 	apiRouter.HandleFunc("/settings", handleGetSettings).Methods("GET")
 	apiRouter.HandleFunc("/settings", handlePutSettings).Methods("PUT")
 	apiRouter.HandleFunc("/read-status", s.resetReadStatus).Methods("DELETE")
+	apiRouter.HandleFunc("/admin/fsck", s.fsck).Methods("GET", "POST")
+	apiRouter.HandleFunc("/snapshot", s.downloadSnapshot).Methods("GET")
+	apiRouter.HandleFunc("/snapshot", s.restoreSnapshot).Methods("PUT")
+	apiRouter.HandleFunc("/snapshots", s.listSnapshots).Methods("GET")
+	apiRouter.HandleFunc("/snapshots/{name}", s.downloadSnapshot).Methods("GET")
+	apiRouter.HandleFunc("/snapshots/{name}", s.saveSnapshot).Methods("POST")
+	apiRouter.HandleFunc("/snapshots/{name}", s.deleteSnapshot).Methods("DELETE")
+	apiRouter.HandleFunc("/snapshots/{name}/restore", s.restoreSnapshot).Methods("POST")
 	// WebSocket for real-time notifications
 	apiRouter.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(w, r)
@@ -109,6 +134,12 @@ func NewServer(config Configuration, relayConfigurations smtp.RelayConfiguration
 		writeErrorResponse(w, http.StatusNotFound, "Not Found: %v", r.URL.Path)
 	})
 
+	// JMAP session, API, blob download and push
+	r.HandleFunc("/.well-known/jmap", s.getJMAPSession).Methods("GET")
+	r.HandleFunc("/jmap/api", s.handleJMAPRequest).Methods("POST")
+	r.HandleFunc("/jmap/download/{account_id}/{blob_id}/{name}", s.downloadJMAPBlob).Methods("GET")
+	r.HandleFunc("/jmap/eventsource", s.getJMAPEventSource).Methods("GET")
+
 	// serve pprof routes (only in debug mode)
 	if config.Debug {
 		log.Logf(log.INFO, "debug mode enabled: pprof endpoints available at /debug/pprof/")
@@ -156,10 +187,17 @@ func NewServer(config Configuration, relayConfigurations smtp.RelayConfiguration
 		w.Write(content)
 	})
 
+	// the request contexts are canceled on shutdown, stopping their searches
+	baseContext, cancel := context.WithCancel(context.Background())
 	s.server = &http.Server{
-		Addr:    config.Addr,
-		Handler: r,
+		Addr:        config.Addr,
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return baseContext },
 	}
+	s.server.RegisterOnShutdown(func() {
+		close(s.done)
+		cancel()
+	})
 	return s
 }
 
@@ -213,6 +251,11 @@ func getFileSystem(staticDir string, debug bool) fs.FS {
 	}
 }
 
+// SetFlagStore shares the read state with the mailbox access protocols (IMAP).
+func (s *Server) SetFlagStore(flags *storage.FlagStore) {
+	s.flags = flags
+}
+
 func (s *Server) ListenAndServe() error {
 	log.Logf(log.INFO, "starting http server on %v", s.addr)
 	return s.server.ListenAndServe()
@@ -226,7 +269,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 func (s *Server) getMailboxes(w http.ResponseWriter, r *http.Request) {
 	// Get all mailboxes
 	logf(generateRequestID(), r, log.DEBUG, "getting mailboxes")
-	mailboxes, err := s.store.GetMailboxes()
+	mailboxes, err := storage.GetMailboxesContext(r.Context(), s.store)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "cannot get mailboxes: %v", err)
 		return
@@ -250,7 +293,7 @@ func (s *Server) getEmailByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Mark as read
-	s.readEmails.Store(emailID, true)
+	s.flags.SetRead(emailID, true)
 	email.IsRead = true
 
 	writeJSONResponse(w, email)
@@ -269,9 +312,8 @@ func (s *Server) deleteEmailByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Write the response
+	// Write the response; the storage notifies the deletion
 	w.WriteHeader(http.StatusNoContent)
-	BroadcastEvent("delete_email", map[string]string{"id": emailID})
 }
 
 type RelayData struct {
@@ -413,15 +455,62 @@ func (s *Server) downloadEmail(w http.ResponseWriter, r *http.Request) {
 	emailID := vars["email_id"]
 	logf(generateRequestID(), r, log.DEBUG, "downloading email: %v", emailID)
 
-	rawEmail, err := s.store.GetRawEmail(emailID)
+	content, err := storage.OpenRawEmail(s.store, emailID)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "cannot get raw email (id=%v): %v", emailID, err)
 		return
 	}
+	defer content.Close()
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "cannot read raw email (id=%v): %v", emailID, err)
+		return
+	}
 
+	// the content of an email ID does not change
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, emailID, size))
 	w.Header().Set("Content-Type", "message/rfc822")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.eml\"", emailID))
-	w.Write(rawEmail)
+	// ServeContent sets Content-Length, and answers range and conditional requests
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// exportEmails writes the emails matching the query as an mbox file.
+func (s *Server) exportEmails(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	logf(generateRequestID(), r, log.DEBUG, "exporting emails with query: %q", query)
+
+	emailHeaders, _, err := storage.SearchEmailsContext(r.Context(), s.store, query, 1, -1)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, "cannot search emails: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"emails.mbox\"")
+	writer := mbox.NewWriter(w)
+	for _, emailHeader := range emailHeaders {
+		if r.Context().Err() != nil {
+			// the client is gone
+			return
+		}
+		rawEmail, err := storage.GetRawEmailContext(r.Context(), s.store, emailHeader.ID)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			// the response has started: skip the email
+			log.Logf(log.WARNING, "cannot export email %v: %v", emailHeader.ID, err)
+			continue
+		}
+		if err := writer.WriteMessage(rawEmail); err != nil {
+			log.Logf(log.WARNING, "cannot export emails: %v", err)
+			return
+		}
+	}
 }
 
 func (s *Server) getMimeTree(w http.ResponseWriter, r *http.Request) {
@@ -468,17 +557,21 @@ func (s *Server) getAttachmentContent(w http.ResponseWriter, r *http.Request) {
 	attachmentID := vars["attachment_id"]
 	logf(generateRequestID(), r, log.DEBUG, "getting attachment content by email ID: %v, attachment ID: %v", emailID, attachmentID)
 
-	// Get the attachment content by ID
-	attachment, err := s.store.GetAttachment(emailID, attachmentID)
+	// Open the attachment content by ID
+	attachment, content, err := storage.OpenAttachment(s.store, emailID, attachmentID)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "cannot get attachment %v for email %v: %v", attachmentID, emailID, err)
 		return
 	}
+	defer content.Close()
 
 	// Write the response
+	if attachment.Hash != "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, attachment.Hash))
+	}
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, attachment.Filename))
 	w.Header().Set("Content-Type", attachment.ContentType)
-	w.Write(attachment.Data)
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
 func (s *Server) getPartByCID(w http.ResponseWriter, r *http.Request) {
@@ -492,7 +585,7 @@ func (s *Server) getPartByCID(w http.ResponseWriter, r *http.Request) {
 	rawEmail, err := s.store.GetRawEmail(emailID)
 	if err != nil {
 		logf(requestID, r, log.ERROR, "cannot get raw email (id=%v): %v", emailID, err)
-		if strings.Contains(err.Error(), "not found") { // Basic check, could be more robust
+		if storage.IsNotFound(err) {
 			writeErrorResponse(w, http.StatusNotFound, "email not found: %v", emailID)
 		} else {
 			writeErrorResponse(w, http.StatusInternalServerError, "cannot get raw email (id=%v): %v", emailID, err)
@@ -610,7 +703,7 @@ func (s *Server) bulkRelayEmails(w http.ResponseWriter, r *http.Request) {
 
 	result := BulkResult{}
 	for _, id := range request.IDs {
-		rawEmail, err := s.store.GetRawEmail(id)
+		rawEmail, err := storage.GetRawEmailContext(r.Context(), s.store, id)
 		if err != nil {
 			result.Failed = append(result.Failed, id)
 			continue
@@ -644,7 +737,7 @@ func (s *Server) bulkMarkRead(w http.ResponseWriter, r *http.Request) {
 
 	result := BulkResult{}
 	for _, id := range request.IDs {
-		s.readEmails.Store(id, true)
+		s.flags.SetRead(id, true)
 		result.Succeeded = append(result.Succeeded, id)
 	}
 	writeJSONResponse(w, result)
@@ -660,7 +753,7 @@ func (s *Server) bulkMarkUnread(w http.ResponseWriter, r *http.Request) {
 
 	result := BulkResult{}
 	for _, id := range request.IDs {
-		s.readEmails.Delete(id)
+		s.flags.SetRead(id, false)
 		result.Succeeded = append(result.Succeeded, id)
 	}
 	writeJSONResponse(w, result)
@@ -683,14 +776,14 @@ func (s *Server) getEmails(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Perform the search
-	emailHeaders, totalMatches, err := s.store.SearchEmails(query, page, pageSize)
+	emailHeaders, totalMatches, err := storage.SearchEmailsContext(r.Context(), s.store, query, page, pageSize)
 	if err != nil {
 		writeErrorResponse(w, http.StatusInternalServerError, "cannot search emails: %v", err)
 		return
 	}
 	// Inject read status
 	for i := range emailHeaders {
-		if _, ok := s.readEmails.Load(emailHeaders[i].ID); ok {
+		if s.flags.IsRead(emailHeaders[i].ID) {
 			emailHeaders[i].IsRead = true
 		}
 	}
@@ -744,7 +837,7 @@ func parsePageParameters(r *http.Request) (int, int, error) {
 
 func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
 	// Quick health check — verify storage is accessible
-	_, _, err := s.store.SearchEmails("", 1, 1)
+	_, _, err := storage.SearchEmailsContext(r.Context(), s.store, "", 1, 1)
 	if err != nil {
 		writeErrorResponse(w, http.StatusServiceUnavailable, "storage unhealthy: %v", err)
 		return
@@ -753,14 +846,36 @@ func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) resetReadStatus(w http.ResponseWriter, r *http.Request) {
-	s.readEmails = sync.Map{}
+	s.flags.ResetRead()
 	BroadcastEvent("read_status_reset", nil)
 	writeJSONResponse(w, map[string]string{"status": "ok"})
 }
 
+// fsck compares the storage layers with the root layer: GET reports the
+// differences, POST repairs them.
+func (s *Server) fsck(w http.ResponseWriter, r *http.Request) {
+	requestID := generateRequestID()
+	checker, ok := s.store.(interface {
+		Fsck(ctx context.Context, repair bool) (storage.FsckReport, error)
+	})
+	if !ok {
+		writeErrorResponse(w, http.StatusNotImplemented, "the storage cannot be checked")
+		return
+	}
+	repair := r.Method == http.MethodPost
+	logf(requestID, r, log.INFO, "checking the storage layers (repair=%v)", repair)
+	report, err := checker.Fsck(r.Context(), repair)
+	if err != nil {
+		logf(requestID, r, log.ERROR, "cannot check the storage layers: %v", err)
+		writeErrorResponse(w, http.StatusInternalServerError, "cannot check the storage layers: %v", err)
+		return
+	}
+	writeJSONResponse(w, report)
+}
+
 func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 	emailCount := 0
-	emails, total, err := s.store.SearchEmails("", 1, 1)
+	emails, total, err := storage.SearchEmailsContext(r.Context(), s.store, "", 1, 1)
 	if err == nil {
 		emailCount = total
 		_ = emails
@@ -773,6 +888,21 @@ func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 		"email_count": emailCount,
 		"http_addr":   s.addr,
 	}
+	if cached, ok := s.store.(interface{ CacheStats() []storage.CacheStats }); ok {
+		if cacheStats := cached.CacheStats(); len(cacheStats) > 0 {
+			stats["cache"] = cacheStats
+		}
+	}
+	if queued, ok := s.store.(interface{ WriteQueueStats() []storage.WriteQueueStats }); ok {
+		if queueStats := queued.WriteQueueStats(); len(queueStats) > 0 {
+			stats["write_queues"] = queueStats
+		}
+	}
+	if retained, ok := s.store.(interface{ RetentionStats() *storage.RetentionStats }); ok {
+		if retentionStats := retained.RetentionStats(); retentionStats != nil {
+			stats["retention"] = retentionStats
+		}
+	}
 	writeJSONResponse(w, stats)
 }
 
@@ -797,12 +927,14 @@ func (s *Server) waitForEmail(w http.ResponseWriter, r *http.Request) {
 	requestID := generateRequestID()
 	logf(requestID, r, log.DEBUG, "waiting for email matching %q (timeout=%v)", query, timeout)
 
-	deadline := time.After(timeout)
+	// the searches stop at the deadline, or when the client is gone
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
 	buildResponse := func(r *http.Request) *WaitForEmailResponse {
-		return s.findMatchingEmails(r, query)
+		return s.findMatchingEmails(ctx, r, query)
 	}
 
 	// Check immediately before starting the loop
@@ -813,11 +945,12 @@ func (s *Server) waitForEmail(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		select {
-		case <-deadline:
+		case <-ctx.Done():
+			if r.Context().Err() != nil {
+				return
+			}
 			writeErrorResponse(w, http.StatusRequestTimeout, "no email matching %q within %v", query, timeout)
 			return
-		case <-r.Context().Done():
-			return
 		case <-ticker.C:
 			if resp := buildResponse(r); resp != nil {
 				logf(requestID, r, log.DEBUG, "found %d matching email(s)", resp.TotalMatches)
@@ -835,8 +968,8 @@ type WaitForEmailResponse struct {
 	URL          string              `json:"url"`           // deep link to view the email
 }
 
-func (s *Server) findMatchingEmails(r *http.Request, query string) *WaitForEmailResponse {
-	emails, total, err := s.store.SearchEmails(query, 1, 1)
+func (s *Server) findMatchingEmails(ctx context.Context, r *http.Request, query string) *WaitForEmailResponse {
+	emails, total, err := storage.SearchEmailsContext(ctx, s.store, query, 1, 1)
 	if err != nil || total == 0 || len(emails) == 0 {
 		return nil
 	}
@@ -1,10 +1,13 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -47,7 +50,7 @@ func (m *mockStorage) GetEmailByID(emailID string) (storage.EmailHeader, error)
 	}
 	email, ok := m.emails[emailID]
 	if !ok {
-		return storage.EmailHeader{}, fmt.Errorf("email not found: %s", emailID)
+		return storage.EmailHeader{}, &storage.NotFoundError{EmailID: emailID, Layer: "mock"}
 	}
 	return email, nil
 }
@@ -61,7 +64,7 @@ func (m *mockStorage) DeleteEmailByID(emailID string) error {
 		return m.err
 	}
 	if _, ok := m.emails[emailID]; !ok {
-		return fmt.Errorf("email not found: %s", emailID)
+		return &storage.NotFoundError{EmailID: emailID, Layer: "mock"}
 	}
 	delete(m.emails, emailID)
 	return nil
@@ -73,7 +76,7 @@ func (m *mockStorage) GetBodyVersion(emailID string, version storage.EmailVersio
 	}
 	versions, ok := m.bodies[emailID]
 	if !ok {
-		return "", fmt.Errorf("email not found: %s", emailID)
+		return "", &storage.NotFoundError{EmailID: emailID, Layer: "mock"}
 	}
 	body, ok := versions[version]
 	if !ok {
@@ -88,7 +91,7 @@ func (m *mockStorage) GetAttachments(emailID string) ([]storage.AttachmentHeader
 	}
 	atts, ok := m.attachments[emailID]
 	if !ok {
-		return nil, fmt.Errorf("email not found: %s", emailID)
+		return nil, &storage.NotFoundError{EmailID: emailID, Layer: "mock"}
 	}
 	return atts, nil
 }
@@ -100,7 +103,7 @@ func (m *mockStorage) GetAttachment(emailID string, attachmentID string) (storag
 	key := emailID + "/" + attachmentID
 	att, ok := m.attachment[key]
 	if !ok {
-		return storage.Attachment{}, fmt.Errorf("attachment not found: %s/%s", emailID, attachmentID)
+		return storage.Attachment{}, &storage.NotFoundError{EmailID: emailID, AttachmentID: attachmentID, Layer: "mock"}
 	}
 	return att, nil
 }
@@ -122,7 +125,7 @@ func (m *mockStorage) GetRawEmail(emailID string) ([]byte, error) {
 	}
 	raw, ok := m.rawEmails[emailID]
 	if !ok {
-		return nil, fmt.Errorf("email not found: %s", emailID)
+		return nil, &storage.NotFoundError{EmailID: emailID, Layer: "mock"}
 	}
 	return raw, nil
 }
@@ -374,6 +377,64 @@ func TestDownloadEmail_Success(t *testing.T) {
 	}
 }
 
+func TestDownloadEmail_RangeAndETag(t *testing.T) {
+	store := newMockStorage()
+	store.rawEmails["test-123"] = []byte("From: a@b.com\r\nSubject: Test\r\n\r\nBody")
+	srv := newTestServer(store)
+
+	req := httptest.NewRequest("GET", "/api/emails/test-123/download", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if cl := rr.Header().Get("Content-Length"); cl != "36" {
+		t.Errorf("expected Content-Length 36, got %q", cl)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag != `"test-123-36"` {
+		t.Errorf("unexpected ETag %q", etag)
+	}
+
+	req = httptest.NewRequest("GET", "/api/emails/test-123/download", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "From" {
+		t.Errorf("expected partial content \"From\", got %d %q", rr.Code, rr.Body.String())
+	}
+	if cr := rr.Header().Get("Content-Range"); cr != "bytes 0-3/36" {
+		t.Errorf("unexpected Content-Range %q", cr)
+	}
+
+	req = httptest.NewRequest("GET", "/api/emails/test-123/download", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status 304, got %d", rr.Code)
+	}
+}
+
+func TestExportEmails(t *testing.T) {
+	store := newMockStorage()
+	store.emails["test-123"] = storage.EmailHeader{ID: "test-123"}
+	store.rawEmails["test-123"] = []byte("From: a@b.com\r\nSubject: Test\r\n\r\nFrom the body\r\n")
+	srv := newTestServer(store)
+
+	req := httptest.NewRequest("GET", "/api/emails/export?query=subject:Test", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/mbox" {
+		t.Errorf("expected Content-Type application/mbox, got %q", ct)
+	}
+	body := rr.Body.String()
+	if !strings.HasPrefix(body, "From a@b.com ") || !strings.HasSuffix(body, "\r\n>From the body\r\n\n") {
+		t.Errorf("unexpected mbox %q", body)
+	}
+}
+
 func TestGetHeaders_NotFound(t *testing.T) {
 	store := newMockStorage()
 	srv := newTestServer(store)
@@ -759,6 +820,58 @@ func TestWaitForEmail_Timeout(t *testing.T) {
 	}
 }
 
+// blockingStorage is a mockStorage whose searches run until their context is
+// done, reporting its error.
+type blockingStorage struct {
+	*mockStorage
+	stopped chan error
+}
+
+func (b *blockingStorage) SearchEmailsContext(ctx context.Context, query string, page, pageSize int) ([]storage.EmailHeader, int, error) {
+	<-ctx.Done()
+	b.stopped <- ctx.Err()
+	return nil, 0, ctx.Err()
+}
+
+func (b *blockingStorage) GetMailboxesContext(ctx context.Context) ([]storage.Mailbox, error) {
+	<-ctx.Done()
+	b.stopped <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestWaitForEmail_TimeoutStopsSearch(t *testing.T) {
+	store := &blockingStorage{mockStorage: newMockStorage(), stopped: make(chan error, 1)}
+	srv := newTestServer(store)
+
+	req := httptest.NewRequest("GET", "/api/emails/wait?query=nonexistent&timeout=100ms", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestTimeout {
+		t.Errorf("expected 408, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := <-store.stopped; err != context.DeadlineExceeded {
+		t.Errorf("expected the search to stop at the deadline, got %v", err)
+	}
+}
+
+func TestSearchEmails_ClientGone(t *testing.T) {
+	store := &blockingStorage{mockStorage: newMockStorage(), stopped: make(chan error, 1)}
+	srv := newTestServer(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/api/emails/?query=slow", nil).WithContext(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	srv.server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := <-store.stopped; err != context.Canceled {
+		t.Errorf("expected the search to be canceled, got %v", err)
+	}
+}
+
 func TestWaitForEmail_InvalidTimeout(t *testing.T) {
 	store := newMockStorage()
 	srv := newTestServer(store)
@@ -784,3 +897,206 @@ func TestGetPartByCID_EmailNotFound(t *testing.T) {
 		t.Errorf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
 	}
 }
+
+func TestSieveScript_Lifecycle(t *testing.T) {
+	store := newMockStorage()
+	srv := newTestServer(store)
+
+	req := httptest.NewRequest("GET", "/api/mailboxes/bob@example.com/sieve", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/api/mailboxes/bob@example.com/sieve", strings.NewReader(`{"script":"fileinto \"Spam\";"}`))
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for script without require, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	script := `require \"fileinto\"; if header :contains \"subject\" \"promo\" { fileinto \"Promotions\"; }`
+	req = httptest.NewRequest("PUT", "/api/mailboxes/bob@example.com/sieve", strings.NewReader(`{"script":"`+script+`"}`))
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/mailboxes/bob@example.com/sieve", nil)
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	var response SieveScriptResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	if !strings.Contains(response.Script, "Promotions") {
+		t.Errorf("unexpected script %q", response.Script)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/mailboxes/bob@example.com/sieve", nil)
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", rr.Code)
+	}
+}
+
+func TestFolders(t *testing.T) {
+	store := newMockStorage()
+	srv := newTestServer(store)
+
+	req := httptest.NewRequest("POST", "/api/mailboxes/bob@example.com/folders", strings.NewReader(`{"name":"Receipts"}`))
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/mailboxes/bob@example.com/folders", nil)
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	var folders []string
+	if err := json.Unmarshal(rr.Body.Bytes(), &folders); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	expected := []string{"Inbox", "Spam", "Receipts"}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected %v, got %v", expected, folders)
+	}
+}
+
+// checkedStorage is a mockStorage reporting the repair requested to Fsck.
+type checkedStorage struct {
+	*mockStorage
+	repair bool
+}
+
+func (c *checkedStorage) Fsck(ctx context.Context, repair bool) (storage.FsckReport, error) {
+	c.repair = repair
+	return storage.FsckReport{Root: "FILESYSTEM", Emails: 2, Layers: []storage.LayerReport{{Layer: "SQLITE", Missing: []string{"e2"}}}}, nil
+}
+
+func TestFsck(t *testing.T) {
+	store := &checkedStorage{mockStorage: newMockStorage()}
+	srv := newTestServer(store)
+
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "/api/admin/fsck", nil)
+		rr := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %d: %s", method, rr.Code, rr.Body.String())
+		}
+		if store.repair != (method == "POST") {
+			t.Errorf("%v: unexpected repair %v", method, store.repair)
+		}
+		var report storage.FsckReport
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("could not unmarshal: %v", err)
+		}
+		if len(report.Layers) != 1 || !reflect.DeepEqual(report.Layers[0].Missing, []string{"e2"}) {
+			t.Errorf("unexpected report %+v", report)
+		}
+	}
+
+	srv = newTestServer(newMockStorage())
+	req := httptest.NewRequest("GET", "/api/admin/fsck", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", rr.Code)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	engine, err := storage.NewEngine([]storage.StorageLayerConfiguration{{Type: "MEMORY", Scope: []string{storage.ScopeAll}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := mail.ReadMessage(strings.NewReader("From: sender@example.com\r\nTo: rcpt@example.com\r\nSubject: snapshot\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailID, err := engine.Set(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(engine)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	if rr := serve("POST", "/api/snapshots/base"); rr.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501 without snapshot store, got %d", rr.Code)
+	}
+	srv.SetSnapshotStore(storage.NewSnapshotStore(t.TempDir(), engine, storage.NewFlagStore()))
+
+	if rr := serve("POST", "/api/snapshots/base"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr := serve("GET", "/api/snapshots")
+	var list []storage.SnapshotInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Name != "base" {
+		t.Errorf("unexpected snapshots %s, %v", rr.Body.String(), err)
+	}
+	if err := engine.DeleteEmailByID(emailID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = serve("POST", "/api/snapshots/base/restore")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response SnapshotRestoreResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || response.Emails != 1 {
+		t.Errorf("unexpected response %s, %v", rr.Body.String(), err)
+	}
+	if _, err := engine.GetEmailByID(emailID); err != nil {
+		t.Errorf("expected the email restored: %v", err)
+	}
+
+	if rr := serve("GET", "/api/snapshots/base"); rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/gzip" {
+		t.Errorf("unexpected download %d %v", rr.Code, rr.Header())
+	}
+	if rr := serve("POST", "/api/snapshots/unknown/restore"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+	if rr := serve("POST", "/api/snapshots/.hidden"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+	if rr := serve("DELETE", "/api/snapshots/base"); rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+}
+
+// retainedStorage is a mockStorage with a retention janitor.
+type retainedStorage struct {
+	*mockStorage
+}
+
+func (r *retainedStorage) RetentionStats() *storage.RetentionStats {
+	return &storage.RetentionStats{Runs: 2, Deleted: 3, ByAge: 3}
+}
+
+func TestGetStats_Retention(t *testing.T) {
+	srv := newTestServer(&retainedStorage{mockStorage: newMockStorage()})
+
+	req := httptest.NewRequest("GET", "/api/stats", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+
+	var stats struct {
+		Retention *storage.RetentionStats `json:"retention"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("could not unmarshal: %v", err)
+	}
+	if stats.Retention == nil || stats.Retention.Runs != 2 || stats.Retention.ByAge != 3 {
+		t.Errorf("unexpected retention stats %+v", stats.Retention)
+	}
+}
@@ -0,0 +1,1539 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mock-my-mta/log"
+	"mock-my-mta/sieve"
+	"mock-my-mta/storage"
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
+)
+
+// JMAP (RFC 8620 core, RFC 8621 mail) exposes the captured emails in a single
+// account. Each recipient mailbox is a JMAP Mailbox with the "inbox" role,
+// its Sieve folders being child Mailboxes. JMAP Ids only allow the base64url
+// alphabet, so storage IDs are encoded with a one-letter type prefix.
+const (
+	jmapCapabilityCore = "urn:ietf:params:jmap:core"
+	jmapCapabilityMail = "urn:ietf:params:jmap:mail"
+	jmapAccountID      = "mock"
+
+	jmapMaxCallsInRequest = 32
+	jmapMaxObjectsInGet   = 1000
+	jmapMaxObjectsInSet   = 1000
+)
+
+// JMAPSession is the session resource of GET /.well-known/jmap.
+type JMAPSession struct {
+	Capabilities    map[string]interface{} `json:"capabilities"`
+	Accounts        map[string]JMAPAccount `json:"accounts"`
+	PrimaryAccounts map[string]string      `json:"primaryAccounts"`
+	Username        string                 `json:"username"`
+	APIURL          string                 `json:"apiUrl"`
+	DownloadURL     string                 `json:"downloadUrl"`
+	UploadURL       string                 `json:"uploadUrl"`
+	EventSourceURL  string                 `json:"eventSourceUrl"`
+	State           string                 `json:"state"`
+}
+
+type JMAPAccount struct {
+	Name                string                 `json:"name"`
+	IsPersonal          bool                   `json:"isPersonal"`
+	IsReadOnly          bool                   `json:"isReadOnly"`
+	AccountCapabilities map[string]interface{} `json:"accountCapabilities"`
+}
+
+// JMAPRequest is the body of POST /jmap/api.
+type JMAPRequest struct {
+	Using       []string            `json:"using"`
+	MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	CreatedIDs  map[string]string   `json:"createdIds,omitempty"`
+}
+
+// JMAPResponse holds the [name, arguments, call ID] responses of the method calls.
+type JMAPResponse struct {
+	MethodResponses [][]interface{}   `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// JMAPMailbox is a Mailbox object (RFC 8621 section 2).
+type JMAPMailbox struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	ParentID      *string           `json:"parentId"`
+	Role          *string           `json:"role"`
+	SortOrder     int               `json:"sortOrder"`
+	TotalEmails   int               `json:"totalEmails"`
+	UnreadEmails  int               `json:"unreadEmails"`
+	TotalThreads  int               `json:"totalThreads"`
+	UnreadThreads int               `json:"unreadThreads"`
+	MyRights      JMAPMailboxRights `json:"myRights"`
+	IsSubscribed  bool              `json:"isSubscribed"`
+}
+
+type JMAPMailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+// JMAPEmailAddress is an EmailAddress object, the name being null if empty.
+type JMAPEmailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// JMAPBodyPart is an EmailBodyPart object. The text and HTML bodies are the
+// decoded body versions of the storage, attachments are the storage attachments.
+type JMAPBodyPart struct {
+	PartID      string  `json:"partId"`
+	BlobID      string  `json:"blobId"`
+	Size        int     `json:"size"`
+	Type        string  `json:"type"`
+	Charset     *string `json:"charset"`
+	Name        *string `json:"name"`
+	Disposition *string `json:"disposition"`
+}
+
+type JMAPBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+// jmapDefaultEmailProperties are the properties returned by Email/get when none are requested.
+var jmapDefaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+	"textBody", "htmlBody", "attachments",
+}
+
+// jmapMethodError is a method-level error response.
+type jmapMethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func newJMAPMethodError(errorType string, format string, args ...interface{}) *jmapMethodError {
+	return &jmapMethodError{Type: errorType, Description: fmt.Sprintf(format, args...)}
+}
+
+// jmapSetError is the error of one object of a /set method.
+type jmapSetError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+// jmapEmail is a parsed email and its storage header.
+type jmapEmail struct {
+	header storage.EmailHeader
+	mp     *multipart.Multipart
+	size   int
+}
+
+// jmapMailboxKey identifies a JMAP Mailbox: the Inbox folder is the recipient mailbox itself.
+type jmapMailboxKey struct {
+	mailbox string
+	folder  string
+}
+
+func jmapEncodeID(prefix string, value string) string {
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func jmapDecodeID(prefix string, id string) (string, bool) {
+	if !strings.HasPrefix(id, prefix) {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(id[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func jmapEmailID(emailID string) string {
+	return jmapEncodeID("E", emailID)
+}
+
+func jmapMailboxID(key jmapMailboxKey) string {
+	if strings.EqualFold(key.folder, multipart.DefaultFolder) {
+		return jmapEncodeID("M", strings.ToLower(key.mailbox))
+	}
+	return jmapEncodeID("M", strings.ToLower(key.mailbox)+"/"+strings.ToLower(key.folder))
+}
+
+// jmapBlobID identifies the raw email, or one of its body versions or attachments.
+func jmapBlobID(emailID string, attachmentID string) string {
+	if attachmentID == "" {
+		return jmapEncodeID("B", emailID)
+	}
+	return jmapEncodeID("B", emailID+"/"+attachmentID)
+}
+
+// jmapState is the state of all the objects: the number of broadcast events.
+func jmapState() string {
+	return strconv.FormatUint(eventSequence(), 10)
+}
+
+// jmapBaseURL returns the URL of the server as seen by the client.
+func jmapBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := r.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+		scheme = forwarded
+	}
+	return scheme + "://" + r.Host
+}
+
+func (s *Server) getJMAPSession(w http.ResponseWriter, r *http.Request) {
+	logf(generateRequestID(), r, log.DEBUG, "getting jmap session")
+	baseURL := jmapBaseURL(r)
+	session := JMAPSession{
+		Capabilities: map[string]interface{}{
+			jmapCapabilityCore: map[string]interface{}{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        10 << 20,
+				"maxConcurrentRequests": 8,
+				"maxCallsInRequest":     jmapMaxCallsInRequest,
+				"maxObjectsInGet":       jmapMaxObjectsInGet,
+				"maxObjectsInSet":       jmapMaxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			jmapCapabilityMail: map[string]interface{}{},
+		},
+		Accounts: map[string]JMAPAccount{
+			jmapAccountID: {
+				Name:       "mock-my-mta",
+				IsPersonal: true,
+				AccountCapabilities: map[string]interface{}{
+					jmapCapabilityMail: map[string]interface{}{
+						"maxMailboxesPerEmail":       nil,
+						"maxMailboxDepth":            2,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      []string{"receivedAt", "sentAt", "size", "from", "subject"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{
+			jmapCapabilityCore: jmapAccountID,
+			jmapCapabilityMail: jmapAccountID,
+		},
+		Username:       "mock-my-mta",
+		APIURL:         baseURL + "/jmap/api",
+		DownloadURL:    baseURL + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:      baseURL + "/jmap/upload/{accountId}",
+		EventSourceURL: baseURL + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State:          jmapState(),
+	}
+	writeJSONResponse(w, session)
+}
+
+// writeJMAPProblem writes a request-level error (RFC 7807 problem details).
+func writeJMAPProblem(w http.ResponseWriter, status int, problemType string, detail string) {
+	log.Logf(log.ERROR, "error: jmap request: %v (status=%v)", detail, status)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   problemType,
+		"status": status,
+		"detail": detail,
+	})
+}
+
+func (s *Server) handleJMAPRequest(w http.ResponseWriter, r *http.Request) {
+	var request JMAPRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJMAPProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notJSON", fmt.Sprintf("cannot parse request body: %v", err))
+		return
+	}
+	for _, capability := range request.Using {
+		if capability != jmapCapabilityCore && capability != jmapCapabilityMail {
+			writeJMAPProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:unknownCapability", fmt.Sprintf("unknown capability %q", capability))
+			return
+		}
+	}
+	if len(request.MethodCalls) > jmapMaxCallsInRequest {
+		writeJMAPProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", fmt.Sprintf("more than %d method calls", jmapMaxCallsInRequest))
+		return
+	}
+
+	response := JMAPResponse{MethodResponses: [][]interface{}{}, CreatedIDs: request.CreatedIDs}
+	for _, call := range request.MethodCalls {
+		var name, callID string
+		var args map[string]json.RawMessage
+		if len(call) != 3 || json.Unmarshal(call[0], &name) != nil || json.Unmarshal(call[1], &args) != nil || json.Unmarshal(call[2], &callID) != nil {
+			writeJMAPProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", "invalid method call")
+			return
+		}
+		logf(generateRequestID(), r, log.DEBUG, "jmap method %v (call %v)", name, callID)
+		result, methodErr := s.callJMAPMethod(r.Context(), name, args, response.MethodResponses)
+		if methodErr != nil {
+			response.MethodResponses = append(response.MethodResponses, []interface{}{"error", methodErr, callID})
+			continue
+		}
+		response.MethodResponses = append(response.MethodResponses, []interface{}{name, result, callID})
+	}
+	response.SessionState = jmapState()
+	writeJSONResponse(w, response)
+}
+
+func (s *Server) callJMAPMethod(ctx context.Context, name string, args map[string]json.RawMessage, previous [][]interface{}) (interface{}, *jmapMethodError) {
+	if err := resolveJMAPReferences(args, previous); err != nil {
+		return nil, err
+	}
+	if name == "Core/echo" {
+		return args, nil
+	}
+	var accountID string
+	if err := json.Unmarshal(args["accountId"], &accountID); err != nil || accountID != jmapAccountID {
+		return nil, newJMAPMethodError("accountNotFound", "unknown account %s", args["accountId"])
+	}
+	data, _ := json.Marshal(args)
+	switch name {
+	case "Mailbox/get":
+		return s.jmapMailboxGet(ctx, data)
+	case "Email/get":
+		return s.jmapEmailGet(ctx, data)
+	case "Email/query":
+		return s.jmapEmailQuery(ctx, data)
+	case "Email/set":
+		return s.jmapEmailSet(data)
+	}
+	return nil, newJMAPMethodError("unknownMethod", "unknown method %v", name)
+}
+
+// resolveJMAPReferences replaces the "#name" result references of the arguments
+// with the values they point to in the previous responses (RFC 8620 section 3.7).
+func resolveJMAPReferences(args map[string]json.RawMessage, previous [][]interface{}) *jmapMethodError {
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		var reference struct {
+			ResultOf string `json:"resultOf"`
+			Name     string `json:"name"`
+			Path     string `json:"path"`
+		}
+		if err := json.Unmarshal(value, &reference); err != nil {
+			return newJMAPMethodError("invalidResultReference", "invalid result reference %v: %v", key, err)
+		}
+		if _, found := args[key[1:]]; found {
+			return newJMAPMethodError("invalidArguments", "both %v and %v are set", key, key[1:])
+		}
+		var result interface{}
+		found := false
+		for _, response := range previous {
+			if response[2] == reference.ResultOf && response[0] == reference.Name {
+				data, _ := json.Marshal(response[1])
+				json.Unmarshal(data, &result)
+				found = true
+			}
+		}
+		if !found {
+			return newJMAPMethodError("invalidResultReference", "no %v response for call %v", reference.Name, reference.ResultOf)
+		}
+		resolved, err := evaluateJSONPointer(result, reference.Path)
+		if err != nil {
+			return newJMAPMethodError("invalidResultReference", "%v", err)
+		}
+		data, _ := json.Marshal(resolved)
+		args[key[1:]] = data
+		delete(args, key)
+	}
+	return nil
+}
+
+// evaluateJSONPointer evaluates a JSON pointer, "*" mapping the rest of the path over an array.
+func evaluateJSONPointer(value interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	token, rest, hasRest := strings.Cut(path[1:], "/")
+	if hasRest {
+		rest = "/" + rest
+	}
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, found := v[token]
+		if !found {
+			return nil, fmt.Errorf("no %q property", token)
+		}
+		return evaluateJSONPointer(child, rest)
+	case []interface{}:
+		if token == "*" {
+			results := []interface{}{}
+			for _, item := range v {
+				result, err := evaluateJSONPointer(item, rest)
+				if err != nil {
+					return nil, err
+				}
+				if values, isArray := result.([]interface{}); isArray {
+					results = append(results, values...)
+				} else {
+					results = append(results, result)
+				}
+			}
+			return results, nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(v) {
+			return nil, fmt.Errorf("invalid array index %q", token)
+		}
+		return evaluateJSONPointer(v[index], rest)
+	}
+	return nil, fmt.Errorf("cannot evaluate %q on a scalar value", token)
+}
+
+// loadJMAPEmail reads and parses an email of the storage.
+func (s *Server) loadJMAPEmail(ctx context.Context, emailID string) (*jmapEmail, error) {
+	header, err := s.store.GetEmailByID(emailID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := storage.GetRawEmailContext(ctx, s.store, emailID)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &jmapEmail{header: header, mp: mp, size: len(raw)}, nil
+}
+
+// loadAllJMAPEmails returns all the emails, newest first, stopping when the
+// context is done.
+func (s *Server) loadAllJMAPEmails(ctx context.Context) ([]*jmapEmail, error) {
+	emailHeaders, _, err := storage.SearchEmailsContext(ctx, s.store, "", 1, -1)
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]*jmapEmail, 0, len(emailHeaders))
+	for _, emailHeader := range emailHeaders {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		email, err := s.loadJMAPEmail(ctx, emailHeader.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Logf(log.WARNING, "jmap: skipping email %v: %v", emailHeader.ID, err)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// mailboxKeys returns the JMAP Mailboxes of the email.
+func (e *jmapEmail) mailboxKeys() []jmapMailboxKey {
+	var keys []jmapMailboxKey
+	for _, placement := range e.mp.GetFolderPlacements() {
+		keys = append(keys, jmapMailboxKey{mailbox: placement.Mailbox, folder: placement.Folder})
+	}
+	return keys
+}
+
+func (s *Server) jmapMailboxGet(ctx context.Context, data []byte) (interface{}, *jmapMethodError) {
+	var args struct {
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, newJMAPMethodError("invalidArguments", "%v", err)
+	}
+	emails, err := s.loadAllJMAPEmails(ctx)
+	if err != nil {
+		return nil, newJMAPMethodError("serverFail", "cannot read emails: %v", err)
+	}
+
+	// mailboxes of the storage and of the Sieve store, plus the folders emails were filed into
+	mailboxes := make(map[string]*JMAPMailbox)
+	var order []string
+	addMailbox := func(key jmapMailboxKey) *JMAPMailbox {
+		id := jmapMailboxID(key)
+		if mailbox, found := mailboxes[id]; found {
+			return mailbox
+		}
+		mailbox := &JMAPMailbox{
+			ID:   id,
+			Name: key.mailbox,
+			MyRights: JMAPMailboxRights{
+				MayReadItems:   true,
+				MayRemoveItems: true,
+				MaySetSeen:     true,
+				MaySetKeywords: true,
+			},
+			IsSubscribed: true,
+		}
+		if strings.EqualFold(key.folder, multipart.DefaultFolder) {
+			role := "inbox"
+			mailbox.Role = &role
+		} else {
+			parentID := jmapMailboxID(jmapMailboxKey{mailbox: key.mailbox, folder: multipart.DefaultFolder})
+			mailbox.Name = key.folder
+			mailbox.ParentID = &parentID
+			mailbox.SortOrder = 1
+			if strings.EqualFold(key.folder, sieve.FolderSpam) {
+				role := "junk"
+				mailbox.Role = &role
+			}
+		}
+		mailboxes[id] = mailbox
+		order = append(order, id)
+		return mailbox
+	}
+	storageMailboxes, err := storage.GetMailboxesContext(ctx, s.store)
+	if err != nil {
+		return nil, newJMAPMethodError("serverFail", "cannot get mailboxes: %v", err)
+	}
+	for _, storageMailbox := range storageMailboxes {
+		for _, folder := range s.sieveStore.GetFolders(storageMailbox.Name) {
+			addMailbox(jmapMailboxKey{mailbox: storageMailbox.Name, folder: folder})
+		}
+	}
+	for _, email := range emails {
+		for _, key := range email.mailboxKeys() {
+			if !strings.EqualFold(key.folder, multipart.DefaultFolder) {
+				addMailbox(jmapMailboxKey{mailbox: key.mailbox, folder: multipart.DefaultFolder})
+			}
+			mailbox := addMailbox(key)
+			mailbox.TotalEmails++
+			mailbox.TotalThreads++
+			if !s.flags.IsRead(email.header.ID) {
+				mailbox.UnreadEmails++
+				mailbox.UnreadThreads++
+			}
+		}
+	}
+
+	ids := order
+	if args.IDs != nil {
+		ids = *args.IDs
+	}
+	if len(ids) > jmapMaxObjectsInGet {
+		return nil, newJMAPMethodError("requestTooLarge", "more than %d ids", jmapMaxObjectsInGet)
+	}
+	list := []interface{}{}
+	notFound := []string{}
+	for _, id := range ids {
+		mailbox, found := mailboxes[id]
+		if !found {
+			notFound = append(notFound, id)
+			continue
+		}
+		object, err := filterJMAPProperties(mailbox, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, object)
+	}
+	return map[string]interface{}{
+		"accountId": jmapAccountID,
+		"state":     jmapState(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// filterJMAPProperties keeps the requested properties of an object (all if nil), and its id.
+func filterJMAPProperties(object interface{}, properties []string) (interface{}, *jmapMethodError) {
+	if properties == nil {
+		return object, nil
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, newJMAPMethodError("serverFail", "%v", err)
+	}
+	var values map[string]interface{}
+	json.Unmarshal(data, &values)
+	filtered := map[string]interface{}{"id": values["id"]}
+	for _, property := range properties {
+		value, found := values[property]
+		if !found {
+			return nil, newJMAPMethodError("invalidArguments", "unknown property %q", property)
+		}
+		filtered[property] = value
+	}
+	return filtered, nil
+}
+
+// jmapKeywordFromFlag returns the JMAP keyword of an IMAP flag, "" if it has none.
+func jmapKeywordFromFlag(flag string) string {
+	switch flag {
+	case storage.FlagSeen:
+		return "$seen"
+	case `\Flagged`:
+		return "$flagged"
+	case `\Answered`:
+		return "$answered"
+	case `\Draft`:
+		return "$draft"
+	}
+	if strings.HasPrefix(flag, `\`) {
+		return ""
+	}
+	return strings.ToLower(flag)
+}
+
+// jmapFlagFromKeyword returns the IMAP flag stored for a JMAP keyword.
+func jmapFlagFromKeyword(keyword string) string {
+	keyword = strings.ToLower(keyword)
+	switch keyword {
+	case "$seen":
+		return storage.FlagSeen
+	case "$flagged":
+		return `\Flagged`
+	case "$answered":
+		return `\Answered`
+	case "$draft":
+		return `\Draft`
+	}
+	return keyword
+}
+
+// isValidJMAPKeyword checks the keyword characters (RFC 8621 section 4.1.1).
+func isValidJMAPKeyword(keyword string) bool {
+	if keyword == "" || len(keyword) > 255 {
+		return false
+	}
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+		if c < 0x21 || c > 0x7e || strings.IndexByte(`(){]%*"\`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) jmapKeywords(emailID string) map[string]bool {
+	keywords := map[string]bool{}
+	for _, flag := range s.flags.GetFlags(emailID) {
+		if keyword := jmapKeywordFromFlag(flag); keyword != "" {
+			keywords[keyword] = true
+		}
+	}
+	return keywords
+}
+
+func jmapAddresses(addresses []mail.Address) []JMAPEmailAddress {
+	if len(addresses) == 0 {
+		return nil
+	}
+	result := make([]JMAPEmailAddress, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, JMAPEmailAddress{Name: jmapOptionalString(address.Name), Email: address.Address})
+	}
+	return result
+}
+
+func jmapOptionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// jmapHeaderValue returns the first decoded value of a header field.
+func jmapHeaderValue(headers map[string][]string, name string) string {
+	for key, values := range headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func jmapHeaderAddresses(headers map[string][]string, name string) []JMAPEmailAddress {
+	value := jmapHeaderValue(headers, name)
+	if value == "" {
+		return nil
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil
+	}
+	list := make([]mail.Address, 0, len(addresses))
+	for _, address := range addresses {
+		list = append(list, *address)
+	}
+	return jmapAddresses(list)
+}
+
+// jmapMessageIDs parses a list of message IDs, removing the angle brackets.
+func jmapMessageIDs(value string) []string {
+	var ids []string
+	for _, id := range strings.Fields(value) {
+		ids = append(ids, strings.Trim(id, "<>"))
+	}
+	return ids
+}
+
+// jmapEmailProperties returns all the properties of an email.
+func (s *Server) jmapEmailProperties(email *jmapEmail, bodyValues func(partID string) bool, maxBodyValueBytes int) (map[string]interface{}, error) {
+	emailID := email.header.ID
+	headers := email.mp.GetAllHeaders()
+
+	mailboxIDs := map[string]bool{}
+	for _, key := range email.mailboxKeys() {
+		mailboxIDs[jmapMailboxID(key)] = true
+	}
+
+	values := map[string]JMAPBodyValue{}
+	textBody := []JMAPBodyPart{}
+	htmlBody := []JMAPBodyPart{}
+	charset := "utf-8"
+	for _, version := range []struct {
+		name        string
+		versionType storage.EmailVersionType
+		contentType string
+	}{
+		{"plain-text", storage.EmailVersionPlainText, "text/plain"},
+		{"html", storage.EmailVersionHtml, "text/html"},
+	} {
+		hasVersion := false
+		for _, bodyVersion := range email.header.BodyVersions {
+			hasVersion = hasVersion || bodyVersion == version.name
+		}
+		if !hasVersion {
+			continue
+		}
+		body, err := s.store.GetBodyVersion(emailID, version.versionType)
+		if err != nil {
+			return nil, err
+		}
+		part := JMAPBodyPart{
+			PartID:  version.name,
+			BlobID:  jmapBlobID(emailID, version.name),
+			Size:    len(body),
+			Type:    version.contentType,
+			Charset: &charset,
+		}
+		if version.versionType == storage.EmailVersionPlainText {
+			textBody = append(textBody, part)
+		} else {
+			htmlBody = append(htmlBody, part)
+		}
+		if bodyValues(version.name) {
+			value := JMAPBodyValue{Value: body}
+			if maxBodyValueBytes > 0 && len(body) > maxBodyValueBytes {
+				value.Value, value.IsTruncated = body[:maxBodyValueBytes], true
+			}
+			values[version.name] = value
+		}
+	}
+	// a single version is used for both the text and the HTML body
+	if len(textBody) == 0 {
+		textBody = htmlBody
+	}
+	if len(htmlBody) == 0 {
+		htmlBody = textBody
+	}
+
+	attachments := []JMAPBodyPart{}
+	if email.header.HasAttachments {
+		attachmentHeaders, err := s.store.GetAttachments(emailID)
+		if err != nil {
+			return nil, err
+		}
+		for _, attachment := range attachmentHeaders {
+			disposition := "attachment"
+			attachments = append(attachments, JMAPBodyPart{
+				PartID:      "attachment-" + attachment.ID,
+				BlobID:      jmapBlobID(emailID, attachment.ID),
+				Size:        attachment.Size,
+				Type:        attachment.ContentType,
+				Name:        jmapOptionalString(attachment.Filename),
+				Disposition: &disposition,
+			})
+		}
+	}
+
+	var messageID, inReplyTo, references []string
+	messageID = jmapMessageIDs(jmapHeaderValue(headers, "Message-Id"))
+	inReplyTo = jmapMessageIDs(jmapHeaderValue(headers, "In-Reply-To"))
+	references = jmapMessageIDs(jmapHeaderValue(headers, "References"))
+
+	var from []JMAPEmailAddress
+	if address := email.mp.GetFrom(); address.Address != "" {
+		from = jmapAddresses([]mail.Address{address})
+	}
+
+	return map[string]interface{}{
+		"id":            jmapEmailID(emailID),
+		"blobId":        jmapBlobID(emailID, ""),
+		"threadId":      jmapEncodeID("T", emailID),
+		"mailboxIds":    mailboxIDs,
+		"keywords":      s.jmapKeywords(emailID),
+		"size":          email.size,
+		"receivedAt":    email.header.Date.UTC().Format(time.RFC3339),
+		"messageId":     messageID,
+		"inReplyTo":     inReplyTo,
+		"references":    references,
+		"sender":        jmapHeaderAddresses(headers, "Sender"),
+		"from":          from,
+		"to":            jmapAddresses(email.mp.GetTos()),
+		"cc":            jmapAddresses(email.mp.GetCCs()),
+		"bcc":           jmapHeaderAddresses(headers, "Bcc"),
+		"replyTo":       jmapHeaderAddresses(headers, "Reply-To"),
+		"subject":       email.header.Subject,
+		"sentAt":        email.header.Date.Format(time.RFC3339),
+		"hasAttachment": email.header.HasAttachments,
+		"preview":       email.header.Preview,
+		"bodyValues":    values,
+		"textBody":      textBody,
+		"htmlBody":      htmlBody,
+		"attachments":   attachments,
+	}, nil
+}
+
+func (s *Server) jmapEmailGet(ctx context.Context, data []byte) (interface{}, *jmapMethodError) {
+	var args struct {
+		IDs                 *[]string `json:"ids"`
+		Properties          []string  `json:"properties"`
+		FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+		FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+		FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+		MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, newJMAPMethodError("invalidArguments", "%v", err)
+	}
+	properties := args.Properties
+	if properties == nil {
+		properties = jmapDefaultEmailProperties
+	}
+	bodyValues := func(partID string) bool {
+		return args.FetchAllBodyValues ||
+			(args.FetchTextBodyValues && partID == "plain-text") ||
+			(args.FetchHTMLBodyValues && partID == "html")
+	}
+
+	var ids []string
+	if args.IDs != nil {
+		ids = *args.IDs
+	} else {
+		emailHeaders, _, err := storage.SearchEmailsContext(ctx, s.store, "", 1, jmapMaxObjectsInGet)
+		if err != nil {
+			return nil, newJMAPMethodError("serverFail", "cannot read emails: %v", err)
+		}
+		for _, emailHeader := range emailHeaders {
+			ids = append(ids, jmapEmailID(emailHeader.ID))
+		}
+	}
+	if len(ids) > jmapMaxObjectsInGet {
+		return nil, newJMAPMethodError("requestTooLarge", "more than %d ids", jmapMaxObjectsInGet)
+	}
+
+	list := []interface{}{}
+	notFound := []string{}
+	for _, id := range ids {
+		emailID, valid := jmapDecodeID("E", id)
+		if !valid {
+			notFound = append(notFound, id)
+			continue
+		}
+		email, err := s.loadJMAPEmail(ctx, emailID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, newJMAPMethodError("serverFail", "%v", ctx.Err())
+			}
+			notFound = append(notFound, id)
+			continue
+		}
+		values, err := s.jmapEmailProperties(email, bodyValues, args.MaxBodyValueBytes)
+		if err != nil {
+			return nil, newJMAPMethodError("serverFail", "cannot read email %v: %v", emailID, err)
+		}
+		object := map[string]interface{}{"id": values["id"]}
+		for _, property := range properties {
+			value, found := values[property]
+			if !found {
+				return nil, newJMAPMethodError("invalidArguments", "unknown property %q", property)
+			}
+			object[property] = value
+		}
+		list = append(list, object)
+	}
+	return map[string]interface{}{
+		"accountId": jmapAccountID,
+		"state":     jmapState(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// JMAPFilter is a FilterOperator or a FilterCondition of Email/query.
+type JMAPFilter struct {
+	Operator   string       `json:"operator,omitempty"`
+	Conditions []JMAPFilter `json:"conditions,omitempty"`
+
+	InMailbox          string     `json:"inMailbox,omitempty"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan,omitempty"`
+	Before             *time.Time `json:"before,omitempty"`
+	After              *time.Time `json:"after,omitempty"`
+	MinSize            *int       `json:"minSize,omitempty"`
+	MaxSize            *int       `json:"maxSize,omitempty"`
+	HasKeyword         string     `json:"hasKeyword,omitempty"`
+	NotKeyword         string     `json:"notKeyword,omitempty"`
+	HasAttachment      *bool      `json:"hasAttachment,omitempty"`
+	Text               string     `json:"text,omitempty"`
+	From               string     `json:"from,omitempty"`
+	To                 string     `json:"to,omitempty"`
+	Cc                 string     `json:"cc,omitempty"`
+	Bcc                string     `json:"bcc,omitempty"`
+	Subject            string     `json:"subject,omitempty"`
+	Body               string     `json:"body,omitempty"`
+}
+
+// jmapCandidate is an email found by the search of an Email/query, read and
+// parsed only when a condition or the sort needs more than its header.
+type jmapCandidate struct {
+	ctx    context.Context
+	server *Server
+	header storage.EmailHeader
+	email  *jmapEmail
+	err    error
+}
+
+// full returns the parsed email, nil when it cannot be read.
+func (c *jmapCandidate) full() *jmapEmail {
+	if c.email == nil && c.err == nil {
+		if c.email, c.err = c.server.loadJMAPEmail(c.ctx, c.header.ID); c.err != nil && c.ctx.Err() == nil {
+			log.Logf(log.WARNING, "jmap: skipping email %v: %v", c.header.ID, c.err)
+		}
+	}
+	return c.email
+}
+
+// size returns the size of the raw email, 0 when it cannot be read.
+func (c *jmapCandidate) size() int {
+	if email := c.full(); email != nil {
+		return email.size
+	}
+	return 0
+}
+
+type jmapPredicate func(candidate *jmapCandidate) bool
+
+// jmapSearchQuery returns the search query of the conditions of the filter the
+// storage can answer. The emails it finds are a superset of the matches: the
+// operands of OR and NOT and the conditions on the dates are checked again by
+// the predicate of the filter, which alone checks the Mailboxes since Sieve
+// files emails for envelope recipients missing from the headers.
+func jmapSearchQuery(filter JMAPFilter) string {
+	switch filter.Operator {
+	case "AND":
+		var query []string
+		for _, condition := range filter.Conditions {
+			if conditionQuery := jmapSearchQuery(condition); conditionQuery != "" {
+				query = append(query, conditionQuery)
+			}
+		}
+		return strings.Join(query, " ")
+	case "":
+		query := jmapTextQuery(filter)
+		if filter.Before != nil {
+			// before:<day> is before the midnight starting the day
+			query = append(query, "before:"+filter.Before.UTC().AddDate(0, 0, 1).Format(time.DateOnly))
+		}
+		if filter.After != nil {
+			// after:<day> is after the midnight starting the day
+			query = append(query, "after:"+filter.After.UTC().AddDate(0, 0, -1).Format(time.DateOnly))
+		}
+		return strings.Join(query, " ")
+	}
+	return ""
+}
+
+// jmapTextQuery returns the search terms of the text conditions, matched as in
+// the web UI.
+func jmapTextQuery(filter JMAPFilter) []string {
+	var query []string
+	if filter.Text != "" {
+		query = append(query, matcher.QuoteValue(filter.Text))
+	}
+	if filter.Body != "" {
+		query = append(query, matcher.QuoteValue(filter.Body))
+	}
+	if filter.Subject != "" {
+		query = append(query, "subject:"+matcher.QuoteValue(filter.Subject))
+	}
+	if filter.HasAttachment != nil && *filter.HasAttachment {
+		query = append(query, "has:attachment")
+	}
+	return query
+}
+
+// jmapAddressesText returns the addresses as in a header, for the substring
+// conditions on the senders and recipients.
+func jmapAddressesText(addresses ...storage.EmailAddress) string {
+	texts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address.Name == "" {
+			texts = append(texts, address.Address)
+			continue
+		}
+		texts = append(texts, address.Name+" <"+address.Address+">")
+	}
+	return strings.ToLower(strings.Join(texts, ", "))
+}
+
+// compileJMAPFilter turns the filter into a predicate. The text conditions of
+// the filter already answered by the search query (searched) are not checked
+// again; the others use the matchers of the search syntax on the parsed email.
+func (s *Server) compileJMAPFilter(filter JMAPFilter, searched bool) (jmapPredicate, *jmapMethodError) {
+	if filter.Operator != "" {
+		predicates := make([]jmapPredicate, 0, len(filter.Conditions))
+		for _, condition := range filter.Conditions {
+			predicate, err := s.compileJMAPFilter(condition, searched && filter.Operator == "AND")
+			if err != nil {
+				return nil, err
+			}
+			predicates = append(predicates, predicate)
+		}
+		switch filter.Operator {
+		case "AND":
+			return func(candidate *jmapCandidate) bool {
+				for _, predicate := range predicates {
+					if !predicate(candidate) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		case "OR", "NOT":
+			return func(candidate *jmapCandidate) bool {
+				for _, predicate := range predicates {
+					if predicate(candidate) {
+						return filter.Operator == "OR"
+					}
+				}
+				return filter.Operator == "NOT"
+			}, nil
+		}
+		return nil, newJMAPMethodError("unsupportedFilter", "unknown operator %q", filter.Operator)
+	}
+
+	matchers, err := matcher.ParseQuery(strings.Join(jmapTextQuery(filter), " "))
+	if err != nil {
+		return nil, newJMAPMethodError("unsupportedFilter", "%v", err)
+	}
+	if searched {
+		matchers = nil
+	}
+	for _, keyword := range []string{filter.HasKeyword, filter.NotKeyword} {
+		if keyword != "" && !isValidJMAPKeyword(keyword) {
+			return nil, newJMAPMethodError("unsupportedFilter", "invalid keyword %q", keyword)
+		}
+	}
+
+	return func(candidate *jmapCandidate) bool {
+		header := candidate.header
+		// conditions on the header first
+		if filter.HasAttachment != nil && !*filter.HasAttachment && header.HasAttachments {
+			return false
+		}
+		if filter.Before != nil && !header.Date.Before(*filter.Before) {
+			return false
+		}
+		if filter.After != nil && header.Date.Before(*filter.After) {
+			return false
+		}
+		if filter.HasKeyword != "" && !s.flags.HasFlag(header.ID, jmapFlagFromKeyword(filter.HasKeyword)) {
+			return false
+		}
+		if filter.NotKeyword != "" && s.flags.HasFlag(header.ID, jmapFlagFromKeyword(filter.NotKeyword)) {
+			return false
+		}
+		for _, condition := range []struct{ value, addresses string }{
+			{filter.From, jmapAddressesText(header.From)},
+			{filter.To, jmapAddressesText(header.Tos...)},
+			{filter.Cc, jmapAddressesText(header.CCs...)},
+		} {
+			if condition.value != "" && !strings.Contains(condition.addresses, strings.ToLower(condition.value)) {
+				return false
+			}
+		}
+		if len(matchers) == 0 && filter.InMailbox == "" && len(filter.InMailboxOtherThan) == 0 &&
+			filter.MinSize == nil && filter.MaxSize == nil && filter.Bcc == "" {
+			return true
+		}
+
+		// then on the parsed email
+		email := candidate.full()
+		if email == nil || !email.mp.MatchAll(matchers) {
+			return false
+		}
+		if filter.InMailbox != "" || len(filter.InMailboxOtherThan) > 0 {
+			inMailbox, inOther := false, false
+			for _, key := range email.mailboxKeys() {
+				id := jmapMailboxID(key)
+				inMailbox = inMailbox || id == filter.InMailbox
+				excluded := false
+				for _, other := range filter.InMailboxOtherThan {
+					excluded = excluded || id == other
+				}
+				inOther = inOther || !excluded
+			}
+			if filter.InMailbox != "" && !inMailbox {
+				return false
+			}
+			if len(filter.InMailboxOtherThan) > 0 && !inOther {
+				return false
+			}
+		}
+		if filter.MinSize != nil && email.size < *filter.MinSize {
+			return false
+		}
+		if filter.MaxSize != nil && email.size >= *filter.MaxSize {
+			return false
+		}
+		if filter.Bcc != "" && !strings.Contains(strings.ToLower(jmapHeaderValue(email.mp.GetAllHeaders(), "Bcc")), strings.ToLower(filter.Bcc)) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// jmapComparators returns the comparison function of the Email/query sort.
+func jmapComparators(sortArgs []struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+}) (func(a, b *jmapCandidate) int, *jmapMethodError) {
+	type comparator struct {
+		compare   func(a, b *jmapCandidate) int
+		ascending bool
+	}
+	var comparators []comparator
+	for _, sortArg := range sortArgs {
+		var compare func(a, b *jmapCandidate) int
+		switch sortArg.Property {
+		case "receivedAt", "sentAt":
+			compare = func(a, b *jmapCandidate) int { return a.header.Date.Compare(b.header.Date) }
+		case "size":
+			compare = func(a, b *jmapCandidate) int { return a.size() - b.size() }
+		case "subject":
+			compare = func(a, b *jmapCandidate) int {
+				return strings.Compare(strings.ToLower(a.header.Subject), strings.ToLower(b.header.Subject))
+			}
+		case "from":
+			compare = func(a, b *jmapCandidate) int {
+				return strings.Compare(strings.ToLower(a.header.From.Address), strings.ToLower(b.header.From.Address))
+			}
+		default:
+			return nil, newJMAPMethodError("unsupportedSort", "cannot sort on %q", sortArg.Property)
+		}
+		comparators = append(comparators, comparator{compare: compare, ascending: sortArg.IsAscending == nil || *sortArg.IsAscending})
+	}
+	if len(comparators) == 0 {
+		// newest first, as in the web UI
+		comparators = append(comparators, comparator{
+			compare: func(a, b *jmapCandidate) int { return a.header.Date.Compare(b.header.Date) },
+		})
+	}
+	return func(a, b *jmapCandidate) int {
+		for _, c := range comparators {
+			result := c.compare(a, b)
+			if !c.ascending {
+				result = -result
+			}
+			if result != 0 {
+				return result
+			}
+		}
+		return strings.Compare(a.header.ID, b.header.ID)
+	}, nil
+}
+
+// jmapEmailQuery searches the storage with the conditions of the filter it can
+// answer, then checks the other conditions on the headers found, reading the
+// raw emails only for the conditions and the sort needing them.
+func (s *Server) jmapEmailQuery(ctx context.Context, data []byte) (interface{}, *jmapMethodError) {
+	var args struct {
+		Filter json.RawMessage `json:"filter"`
+		Sort   []struct {
+			Property    string `json:"property"`
+			IsAscending *bool  `json:"isAscending"`
+		} `json:"sort"`
+		Position       int     `json:"position"`
+		Anchor         *string `json:"anchor"`
+		Limit          *int    `json:"limit"`
+		CalculateTotal bool    `json:"calculateTotal"`
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, newJMAPMethodError("invalidArguments", "%v", err)
+	}
+	if args.Anchor != nil {
+		return nil, newJMAPMethodError("invalidArguments", "anchor is not supported")
+	}
+	if args.Limit != nil && *args.Limit < 0 {
+		return nil, newJMAPMethodError("invalidArguments", "negative limit")
+	}
+	query := ""
+	predicate := func(candidate *jmapCandidate) bool { return true }
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		var filter JMAPFilter
+		decoder := json.NewDecoder(bytes.NewReader(args.Filter))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&filter); err != nil {
+			return nil, newJMAPMethodError("unsupportedFilter", "%v", err)
+		}
+		var methodErr *jmapMethodError
+		if predicate, methodErr = s.compileJMAPFilter(filter, true); methodErr != nil {
+			return nil, methodErr
+		}
+		query = jmapSearchQuery(filter)
+	}
+	compare, methodErr := jmapComparators(args.Sort)
+	if methodErr != nil {
+		return nil, methodErr
+	}
+
+	emailHeaders, _, err := storage.SearchEmailsContext(ctx, s.store, query, 1, -1)
+	if err != nil {
+		if _, invalid := err.(matcher.InvalidQueryError); invalid {
+			return nil, newJMAPMethodError("unsupportedFilter", "%v", err)
+		}
+		return nil, newJMAPMethodError("serverFail", "cannot search emails: %v", err)
+	}
+	var matches []*jmapCandidate
+	for _, emailHeader := range emailHeaders {
+		if err := ctx.Err(); err != nil {
+			return nil, newJMAPMethodError("serverFail", "%v", err)
+		}
+		candidate := &jmapCandidate{ctx: ctx, server: s, header: emailHeader}
+		if predicate(candidate) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compare(matches[i], matches[j]) < 0
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, newJMAPMethodError("serverFail", "%v", err)
+	}
+
+	position := args.Position
+	if position < 0 {
+		position = max(len(matches)+position, 0)
+	}
+	position = min(position, len(matches))
+	end := len(matches)
+	if args.Limit != nil {
+		end = min(position+*args.Limit, end)
+	}
+	ids := []string{}
+	for _, candidate := range matches[position:end] {
+		ids = append(ids, jmapEmailID(candidate.header.ID))
+	}
+	result := map[string]interface{}{
+		"accountId":           jmapAccountID,
+		"queryState":          jmapState(),
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+	}
+	if args.CalculateTotal {
+		result["total"] = len(matches)
+	}
+	return result, nil
+}
+
+func (s *Server) jmapEmailSet(data []byte) (interface{}, *jmapMethodError) {
+	var args struct {
+		IfInState *string                               `json:"ifInState"`
+		Create    map[string]json.RawMessage            `json:"create"`
+		Update    map[string]map[string]json.RawMessage `json:"update"`
+		Destroy   []string                              `json:"destroy"`
+	}
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, newJMAPMethodError("invalidArguments", "%v", err)
+	}
+	oldState := jmapState()
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, newJMAPMethodError("stateMismatch", "state is %v", oldState)
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjectsInSet {
+		return nil, newJMAPMethodError("requestTooLarge", "more than %d objects", jmapMaxObjectsInSet)
+	}
+
+	notCreated := map[string]jmapSetError{}
+	for creationID := range args.Create {
+		notCreated[creationID] = jmapSetError{Type: "forbidden", Description: "emails can only be received over SMTP"}
+	}
+
+	updated := map[string]interface{}{}
+	notUpdated := map[string]jmapSetError{}
+	for id, patch := range args.Update {
+		emailID, valid := jmapDecodeID("E", id)
+		if valid {
+			_, err := s.store.GetEmailByID(emailID)
+			valid = err == nil
+		}
+		if !valid {
+			notUpdated[id] = jmapSetError{Type: "notFound"}
+			continue
+		}
+		if setErr := s.updateJMAPKeywords(emailID, patch); setErr != nil {
+			notUpdated[id] = *setErr
+			continue
+		}
+		updated[id] = nil
+		BroadcastEvent("flags_changed", map[string]interface{}{"id": emailID, "flags": s.flags.GetFlags(emailID)})
+	}
+
+	destroyed := []string{}
+	notDestroyed := map[string]jmapSetError{}
+	for _, id := range args.Destroy {
+		emailID, valid := jmapDecodeID("E", id)
+		if !valid {
+			notDestroyed[id] = jmapSetError{Type: "notFound"}
+			continue
+		}
+		if err := s.store.DeleteEmailByID(emailID); err != nil {
+			notDestroyed[id] = jmapSetError{Type: "notFound", Description: err.Error()}
+			continue
+		}
+		s.flags.Delete(emailID)
+		destroyed = append(destroyed, id)
+	}
+
+	return map[string]interface{}{
+		"accountId":    jmapAccountID,
+		"oldState":     oldState,
+		"newState":     jmapState(),
+		"created":      map[string]interface{}{},
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notCreated":   notCreated,
+		"notUpdated":   notUpdated,
+		"notDestroyed": notDestroyed,
+	}, nil
+}
+
+// updateJMAPKeywords applies a patch of the keywords ("keywords" or
+// "keywords/<keyword>"), the only mutable property of the emails.
+func (s *Server) updateJMAPKeywords(emailID string, patch map[string]json.RawMessage) *jmapSetError {
+	var set map[string]bool
+	add := map[string]bool{}
+	var invalid []string
+	for property, value := range patch {
+		switch {
+		case property == "keywords":
+			if err := json.Unmarshal(value, &set); err != nil {
+				invalid = append(invalid, property)
+				continue
+			}
+			for keyword, enabled := range set {
+				if !enabled || !isValidJMAPKeyword(keyword) {
+					invalid = append(invalid, property)
+				}
+			}
+		case strings.HasPrefix(property, "keywords/"):
+			keyword := strings.TrimPrefix(property, "keywords/")
+			var enabled *bool
+			if err := json.Unmarshal(value, &enabled); err != nil || !isValidJMAPKeyword(keyword) || (enabled != nil && !*enabled) {
+				invalid = append(invalid, property)
+				continue
+			}
+			add[keyword] = enabled != nil
+		default:
+			invalid = append(invalid, property)
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return &jmapSetError{Type: "invalidProperties", Description: "only keywords can be updated", Properties: invalid}
+	}
+
+	if set != nil {
+		// flags without JMAP keywords (\Deleted) are kept
+		var flags []string
+		for _, flag := range s.flags.GetFlags(emailID) {
+			if jmapKeywordFromFlag(flag) == "" {
+				flags = append(flags, flag)
+			}
+		}
+		for keyword := range set {
+			flags = append(flags, jmapFlagFromKeyword(keyword))
+		}
+		s.flags.SetFlags(emailID, flags...)
+	}
+	for keyword, enabled := range add {
+		if enabled {
+			s.flags.AddFlags(emailID, jmapFlagFromKeyword(keyword))
+		} else {
+			s.flags.RemoveFlags(emailID, jmapFlagFromKeyword(keyword))
+		}
+	}
+	return nil
+}
+
+// downloadJMAPBlob serves the raw email, a body version or an attachment.
+func (s *Server) downloadJMAPBlob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logf(generateRequestID(), r, log.DEBUG, "downloading jmap blob %v", vars["blob_id"])
+	if vars["account_id"] != jmapAccountID {
+		writeErrorResponse(w, http.StatusNotFound, "unknown account %v", vars["account_id"])
+		return
+	}
+	blob, valid := jmapDecodeID("B", vars["blob_id"])
+	if !valid {
+		writeErrorResponse(w, http.StatusNotFound, "unknown blob %v", vars["blob_id"])
+		return
+	}
+	emailID, partID, _ := strings.Cut(blob, "/")
+	contentType := r.URL.Query().Get("accept")
+	var content []byte
+	switch partID {
+	case "":
+		raw, err := s.store.GetRawEmail(emailID)
+		if err != nil {
+			writeErrorResponse(w, http.StatusNotFound, "cannot get email %v: %v", emailID, err)
+			return
+		}
+		content = raw
+		if contentType == "" {
+			contentType = "message/rfc822"
+		}
+	case "plain-text", "html":
+		versionType, _ := storage.ParseEmailVersionType(partID)
+		body, err := s.store.GetBodyVersion(emailID, versionType)
+		if err != nil {
+			writeErrorResponse(w, http.StatusNotFound, "cannot get body %v of email %v: %v", partID, emailID, err)
+			return
+		}
+		content = []byte(body)
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+			if partID == "html" {
+				contentType = "text/html; charset=utf-8"
+			}
+		}
+	default:
+		attachment, err := s.store.GetAttachment(emailID, partID)
+		if err != nil {
+			writeErrorResponse(w, http.StatusNotFound, "cannot get attachment %v of email %v: %v", partID, emailID, err)
+			return
+		}
+		content = attachment.Data
+		if contentType == "" {
+			contentType = attachment.ContentType
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", vars["name"]))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	w.Write(content)
+}
+
+// getJMAPEventSource pushes StateChange events (RFC 8620 section 7.3) when the
+// emails change, following the events broadcast to the WebSocket clients.
+func (s *Server) getJMAPEventSource(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorResponse(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	query := r.URL.Query()
+	types := map[string]bool{}
+	for _, dataType := range strings.Split(query.Get("types"), ",") {
+		if dataType == "*" || dataType == "" {
+			types["Email"], types["Mailbox"] = true, true
+		} else {
+			types[dataType] = true
+		}
+	}
+	closeAfterState := query.Get("closeafter") == "state"
+	ping := 0
+	if value := query.Get("ping"); value != "" {
+		var err error
+		if ping, err = strconv.Atoi(value); err != nil || ping < 0 {
+			writeErrorResponse(w, http.StatusBadRequest, "invalid ping interval %q", value)
+			return
+		}
+	}
+	logf(generateRequestID(), r, log.DEBUG, "jmap event source connected (types=%v)", query.Get("types"))
+
+	events := subscribeEvents()
+	defer unsubscribeEvents(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var pings <-chan time.Time
+	if ping > 0 {
+		// the interval is at least 5 seconds (RFC 8620 section 7.3)
+		ticker := time.NewTicker(time.Duration(max(ping, 5)) * time.Second)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-pings:
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%d}\n\n", max(ping, 5))
+			flusher.Flush()
+		case <-events:
+			state := jmapState()
+			changed := map[string]string{}
+			for _, dataType := range []string{"Email", "Mailbox"} {
+				if types[dataType] {
+					changed[dataType] = state
+				}
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			data, _ := json.Marshal(map[string]interface{}{
+				"@type":   "StateChange",
+				"changed": map[string]interface{}{jmapAccountID: changed},
+			})
+			fmt.Fprintf(w, "event: state\nid: %v\ndata: %s\n\n", state, data)
+			flusher.Flush()
+			if closeAfterState {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"mock-my-mta/storage"
+)
+
+const jmapTestEmailAlice = "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: Weekly report\r\nDate: Mon, 01 Jan 2024 10:00:00 +0000\r\nMessage-ID: <report@example.com>\r\n\r\nThe report is attached.\r\n"
+const jmapTestEmailCarol = "From: carol@example.com\r\nTo: bob@example.com\r\nSubject: Lunch\r\nDate: Tue, 02 Jan 2024 10:00:00 +0000\r\n\r\nNoon?\r\n"
+
+// newJMAPTestServer returns a server on a memory storage, with the IDs of the stored emails.
+func newJMAPTestServer(t *testing.T, emails ...string) (*Server, []string) {
+	engine, err := storage.NewEngine([]storage.StorageLayerConfiguration{{Type: "MEMORY"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, raw := range emails {
+		message, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := engine.Set(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return newTestServer(engine), ids
+}
+
+// callJMAP posts the method calls and returns the method responses.
+func callJMAP(t *testing.T, srv *Server, methodCalls string) [][]json.RawMessage {
+	t.Helper()
+	body := `{"using":["urn:ietf:params:jmap:core","urn:ietf:params:jmap:mail"],"methodCalls":` + methodCalls + `}`
+	req := httptest.NewRequest("POST", "/jmap/api", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.MethodResponses
+}
+
+func decodeJMAPResponse(t *testing.T, response []json.RawMessage, expectedName string, v interface{}) {
+	t.Helper()
+	var name string
+	json.Unmarshal(response[0], &name)
+	if name != expectedName {
+		t.Fatalf("expected %v response, got %v: %s", expectedName, name, response[1])
+	}
+	if err := json.Unmarshal(response[1], v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJMAPSession(t *testing.T) {
+	srv, _ := newJMAPTestServer(t)
+	req := httptest.NewRequest("GET", "/.well-known/jmap", nil)
+	req.Host = "mock.example.com:8025"
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+
+	var session JMAPSession
+	if err := json.Unmarshal(rr.Body.Bytes(), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.APIURL != "http://mock.example.com:8025/jmap/api" {
+		t.Errorf("unexpected API URL %q", session.APIURL)
+	}
+	if session.PrimaryAccounts[jmapCapabilityMail] != jmapAccountID {
+		t.Errorf("unexpected primary accounts %v", session.PrimaryAccounts)
+	}
+
+	req = httptest.NewRequest("POST", "/jmap/api", strings.NewReader(`{"using":["urn:example:unknown"],"methodCalls":[]}`))
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "unknownCapability") {
+		t.Errorf("expected unknownCapability, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestJMAPQueryAndGet(t *testing.T) {
+	srv, ids := newJMAPTestServer(t, jmapTestEmailAlice, jmapTestEmailCarol)
+	srv.flags.SetRead(ids[1], true)
+
+	responses := callJMAP(t, srv, `[
+		["Mailbox/get", {"accountId": "mock", "ids": null}, "m"],
+		["Email/query", {"accountId": "mock", "filter": {"operator": "OR", "conditions": [{"from": "alice"}, {"text": "noon"}]}, "sort": [{"property": "receivedAt", "isAscending": true}], "calculateTotal": true}, "q"],
+		["Email/get", {"accountId": "mock", "#ids": {"resultOf": "q", "name": "Email/query", "path": "/ids"}, "properties": ["subject", "from", "keywords", "mailboxIds", "messageId", "textBody", "bodyValues"], "fetchTextBodyValues": true}, "g"],
+		["Email/query", {"accountId": "mock", "filter": {"subject": "report", "notKeyword": "$seen"}}, "s"],
+		["Email/unknown", {"accountId": "mock"}, "u"]
+	]`)
+	if len(responses) != 5 {
+		t.Fatalf("expected 5 responses, got %d", len(responses))
+	}
+
+	var mailboxes struct {
+		List []JMAPMailbox `json:"list"`
+	}
+	decodeJMAPResponse(t, responses[0], "Mailbox/get", &mailboxes)
+	if len(mailboxes.List) != 2 {
+		t.Fatalf("expected the Inbox and Spam mailboxes of bob, got %+v", mailboxes.List)
+	}
+	inbox := mailboxes.List[0]
+	if inbox.Name != "bob@example.com" || inbox.Role == nil || *inbox.Role != "inbox" || inbox.TotalEmails != 2 || inbox.UnreadEmails != 1 {
+		t.Errorf("unexpected inbox %+v", inbox)
+	}
+
+	var query struct {
+		IDs   []string `json:"ids"`
+		Total int      `json:"total"`
+	}
+	decodeJMAPResponse(t, responses[1], "Email/query", &query)
+	if query.Total != 2 || len(query.IDs) != 2 || query.IDs[0] != jmapEmailID(ids[0]) {
+		t.Fatalf("unexpected query result %+v", query)
+	}
+
+	var emails struct {
+		List []struct {
+			ID         string                   `json:"id"`
+			Subject    string                   `json:"subject"`
+			From       []JMAPEmailAddress       `json:"from"`
+			Keywords   map[string]bool          `json:"keywords"`
+			MailboxIDs map[string]bool          `json:"mailboxIds"`
+			MessageID  []string                 `json:"messageId"`
+			TextBody   []JMAPBodyPart           `json:"textBody"`
+			BodyValues map[string]JMAPBodyValue `json:"bodyValues"`
+		} `json:"list"`
+	}
+	decodeJMAPResponse(t, responses[2], "Email/get", &emails)
+	if len(emails.List) != 2 {
+		t.Fatalf("expected 2 emails, got %d", len(emails.List))
+	}
+	alice := emails.List[0]
+	if alice.Subject != "Weekly report" || alice.From[0].Email != "alice@example.com" || *alice.From[0].Name != "Alice" {
+		t.Errorf("unexpected email %+v", alice)
+	}
+	if len(alice.MessageID) != 1 || alice.MessageID[0] != "report@example.com" {
+		t.Errorf("unexpected message ID %v", alice.MessageID)
+	}
+	if !alice.MailboxIDs[inbox.ID] {
+		t.Errorf("email should be in the inbox, got %v", alice.MailboxIDs)
+	}
+	if !strings.Contains(alice.BodyValues[alice.TextBody[0].PartID].Value, "report is attached") {
+		t.Errorf("unexpected body values %+v", alice.BodyValues)
+	}
+	if !emails.List[1].Keywords["$seen"] {
+		t.Errorf("read email should have the $seen keyword, got %v", emails.List[1].Keywords)
+	}
+
+	decodeJMAPResponse(t, responses[3], "Email/query", &query)
+	if len(query.IDs) != 1 || query.IDs[0] != jmapEmailID(ids[0]) {
+		t.Errorf("unexpected query result %+v", query)
+	}
+
+	var methodErr jmapMethodError
+	decodeJMAPResponse(t, responses[4], "error", &methodErr)
+	if methodErr.Type != "unknownMethod" {
+		t.Errorf("expected unknownMethod, got %v", methodErr.Type)
+	}
+}
+
+func TestJMAPEmailSet(t *testing.T) {
+	srv, ids := newJMAPTestServer(t, jmapTestEmailAlice, jmapTestEmailCarol)
+	alice, carol := jmapEmailID(ids[0]), jmapEmailID(ids[1])
+
+	responses := callJMAP(t, srv, `[
+		["Email/set", {"accountId": "mock", "update": {
+			"`+alice+`": {"keywords/$seen": true, "keywords/$flagged": true},
+			"`+carol+`": {"subject": "changed"},
+			"Eunknown": {"keywords": {}}
+		}, "destroy": ["`+carol+`"]}, "s"]
+	]`)
+	var result struct {
+		Updated    map[string]interface{}  `json:"updated"`
+		NotUpdated map[string]jmapSetError `json:"notUpdated"`
+		Destroyed  []string                `json:"destroyed"`
+	}
+	decodeJMAPResponse(t, responses[0], "Email/set", &result)
+	if _, found := result.Updated[alice]; !found {
+		t.Errorf("keywords should be updated, got %+v", result)
+	}
+	if result.NotUpdated[carol].Type != "invalidProperties" || result.NotUpdated["Eunknown"].Type != "notFound" {
+		t.Errorf("unexpected update errors %+v", result.NotUpdated)
+	}
+	if len(result.Destroyed) != 1 || result.Destroyed[0] != carol {
+		t.Errorf("unexpected destroyed emails %v", result.Destroyed)
+	}
+	if !srv.flags.IsRead(ids[0]) || !srv.flags.HasFlag(ids[0], `\Flagged`) {
+		t.Errorf("$seen and $flagged should be stored as flags, got %v", srv.flags.GetFlags(ids[0]))
+	}
+	if _, err := srv.store.GetEmailByID(ids[1]); err == nil {
+		t.Errorf("destroyed email should be deleted")
+	}
+
+	responses = callJMAP(t, srv, `[["Email/set", {"accountId": "mock", "update": {"`+alice+`": {"keywords": {"$draft": true}}}}, "s"]]`)
+	decodeJMAPResponse(t, responses[0], "Email/set", &result)
+	if srv.flags.IsRead(ids[0]) || !srv.flags.HasFlag(ids[0], `\Draft`) {
+		t.Errorf("keywords should be replaced, got %v", srv.flags.GetFlags(ids[0]))
+	}
+}
+
+func TestJMAPDownload(t *testing.T) {
+	srv, ids := newJMAPTestServer(t, jmapTestEmailAlice)
+	req := httptest.NewRequest("GET", "/jmap/download/mock/"+jmapBlobID(ids[0], "")+"/report.eml", nil)
+	rr := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Subject: Weekly report") {
+		t.Fatalf("unexpected download %d: %s", rr.Code, rr.Body.String())
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "message/rfc822" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+}
+
+func TestJMAPEventSource(t *testing.T) {
+	srv, _ := newJMAPTestServer(t)
+	httpServer := httptest.NewServer(srv.server.Handler)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/jmap/eventsource?types=Email&closeafter=state&ping=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	// the headers are sent once the stream is subscribed to the events
+	BroadcastEvent("new_email", map[string]string{"id": "test"})
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	stream := strings.Join(lines, "\n")
+	if !strings.Contains(stream, "event: state") || !strings.Contains(stream, `"@type":"StateChange"`) || !strings.Contains(stream, `"Email":`) {
+		t.Errorf("unexpected event stream %q", stream)
+	}
+	if strings.Contains(stream, `"Mailbox"`) {
+		t.Errorf("only Email changes were requested: %q", stream)
+	}
+}
+
+// readCountingStorage counts the raw emails read from the storage.
+type readCountingStorage struct {
+	storage.Storage
+	reads int
+}
+
+func (r *readCountingStorage) GetRawEmail(emailID string) ([]byte, error) {
+	r.reads++
+	return r.Storage.GetRawEmail(emailID)
+}
+
+func TestJMAPQueryReadsOnlyNeededEmails(t *testing.T) {
+	srv, ids := newJMAPTestServer(t, jmapTestEmailAlice, jmapTestEmailCarol)
+	store := &readCountingStorage{Storage: srv.store}
+	srv.store = store
+
+	for _, test := range []struct {
+		filter   string
+		expected []string
+		reads    int
+	}{
+		{`{"subject": "report"}`, []string{ids[0]}, 0},
+		{`{"from": "carol", "before": "2024-01-03T00:00:00Z"}`, []string{ids[1]}, 0},
+		{`{"operator": "AND", "conditions": [{"text": "noon"}, {"after": "2024-01-02T00:00:00Z"}]}`, []string{ids[1]}, 0},
+		{`{"operator": "NOT", "conditions": [{"text": "noon"}]}`, []string{ids[0]}, 2},
+		{`{"subject": "lunch", "minSize": 10}`, []string{ids[1]}, 1},
+	} {
+		store.reads = 0
+		responses := callJMAP(t, srv, `[["Email/query", {"accountId": "mock", "filter": `+test.filter+`}, "q"]]`)
+		var query struct {
+			IDs []string `json:"ids"`
+		}
+		decodeJMAPResponse(t, responses[0], "Email/query", &query)
+		if len(query.IDs) != len(test.expected) || query.IDs[0] != jmapEmailID(test.expected[0]) {
+			t.Errorf("%v: unexpected query result %+v", test.filter, query)
+		}
+		if store.reads != test.reads {
+			t.Errorf("%v: expected %d raw emails read, got %d", test.filter, test.reads, store.reads)
+		}
+	}
+}
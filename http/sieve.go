@@ -0,0 +1,86 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"mock-my-mta/log"
+	"mock-my-mta/sieve"
+)
+
+// SieveScriptRequest is the body of PUT /api/mailboxes/{mailbox}/sieve.
+type SieveScriptRequest struct {
+	Script string `json:"script"`
+}
+
+// SieveScriptResponse is returned by GET /api/mailboxes/{mailbox}/sieve.
+type SieveScriptResponse struct {
+	Mailbox string `json:"mailbox"`
+	Script  string `json:"script"`
+}
+
+// CreateFolderRequest is the body of POST /api/mailboxes/{mailbox}/folders.
+type CreateFolderRequest struct {
+	Name string `json:"name"`
+}
+
+// SetSieveStore shares the Sieve scripts with the SMTP server that evaluates them.
+func (s *Server) SetSieveStore(store *sieve.Store) {
+	s.sieveStore = store
+}
+
+func (s *Server) getSieveScript(w http.ResponseWriter, r *http.Request) {
+	mailbox := mux.Vars(r)["mailbox"]
+	logf(generateRequestID(), r, log.DEBUG, "getting sieve script of mailbox %v", mailbox)
+	script, found := s.sieveStore.GetScript(mailbox)
+	if !found {
+		writeErrorResponse(w, http.StatusNotFound, "no sieve script for mailbox %v", mailbox)
+		return
+	}
+	writeJSONResponse(w, SieveScriptResponse{Mailbox: mailbox, Script: script})
+}
+
+func (s *Server) putSieveScript(w http.ResponseWriter, r *http.Request) {
+	mailbox := mux.Vars(r)["mailbox"]
+	logf(generateRequestID(), r, log.DEBUG, "setting sieve script of mailbox %v", mailbox)
+	var request SieveScriptRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "cannot parse request body: %v", err)
+		return
+	}
+	if err := s.sieveStore.SetScript(mailbox, request.Script); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "invalid sieve script: %v", err)
+		return
+	}
+	writeJSONResponse(w, SieveScriptResponse{Mailbox: mailbox, Script: request.Script})
+}
+
+func (s *Server) deleteSieveScript(w http.ResponseWriter, r *http.Request) {
+	mailbox := mux.Vars(r)["mailbox"]
+	logf(generateRequestID(), r, log.DEBUG, "deleting sieve script of mailbox %v", mailbox)
+	s.sieveStore.DeleteScript(mailbox)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getFolders(w http.ResponseWriter, r *http.Request) {
+	mailbox := mux.Vars(r)["mailbox"]
+	logf(generateRequestID(), r, log.DEBUG, "getting folders of mailbox %v", mailbox)
+	writeJSONResponse(w, s.sieveStore.GetFolders(mailbox))
+}
+
+func (s *Server) createFolder(w http.ResponseWriter, r *http.Request) {
+	mailbox := mux.Vars(r)["mailbox"]
+	var request CreateFolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "cannot parse request body: %v", err)
+		return
+	}
+	logf(generateRequestID(), r, log.DEBUG, "creating folder %q in mailbox %v", request.Name, mailbox)
+	if err := s.sieveStore.CreateFolder(mailbox, request.Name); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "cannot create folder: %v", err)
+		return
+	}
+	writeJSONResponse(w, s.sieveStore.GetFolders(mailbox))
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mock-my-mta/log"
+	"mock-my-mta/storage"
+)
+
+// SnapshotRestoreResponse is returned by the restores of a snapshot.
+type SnapshotRestoreResponse struct {
+	Snapshot string `json:"snapshot,omitempty"` // name of a kept snapshot
+	Emails   int    `json:"emails"`
+}
+
+// SetSnapshotStore enables the snapshots of the emails.
+func (s *Server) SetSnapshotStore(snapshots *storage.SnapshotStore) {
+	s.snapshots = snapshots
+}
+
+// writeSnapshotError writes the error of a snapshot operation with its status.
+func writeSnapshotError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrInvalidSnapshotName):
+		writeErrorResponse(w, http.StatusBadRequest, "%v", err)
+	case errors.Is(err, os.ErrNotExist):
+		writeErrorResponse(w, http.StatusNotFound, "snapshot not found: %v", name)
+	default:
+		writeErrorResponse(w, http.StatusInternalServerError, "snapshot error: %v", err)
+	}
+}
+
+func (s *Server) snapshotsEnabled(w http.ResponseWriter) bool {
+	if s.snapshots == nil {
+		writeErrorResponse(w, http.StatusNotImplemented, "snapshots are not enabled")
+		return false
+	}
+	return true
+}
+
+// downloadSnapshot serves the archive of a kept snapshot, or a snapshot of the
+// current emails without name.
+func (s *Server) downloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logf(generateRequestID(), r, log.DEBUG, "downloading snapshot %q", name)
+	if name == "" {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="snapshot-%v.tar.gz"`, time.Now().UTC().Format("20060102-150405")))
+		if _, err := s.snapshots.Write(r.Context(), w); err != nil {
+			// the archive may be partly sent: the client sees a truncated archive
+			log.Logf(log.ERROR, "cannot write snapshot: %v", err)
+		}
+		return
+	}
+	file, err := s.snapshots.Open(name)
+	if err != nil {
+		writeSnapshotError(w, name, err)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		writeSnapshotError(w, name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.tar.gz"`, name))
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+// restoreSnapshot replaces the emails with those of a kept snapshot, or of the
+// archive in the body without name, and broadcasts a reset event.
+func (s *Server) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logf(generateRequestID(), r, log.INFO, "restoring snapshot %q", name)
+	var restored int
+	var err error
+	if name == "" {
+		restored, err = s.snapshots.Restore(r.Context(), r.Body)
+	} else {
+		restored, err = s.snapshots.RestoreNamed(r.Context(), name)
+	}
+	if err != nil {
+		writeSnapshotError(w, name, err)
+		return
+	}
+	response := SnapshotRestoreResponse{Snapshot: name, Emails: restored}
+	BroadcastEvent("reset", response)
+	writeJSONResponse(w, response)
+}
+
+// saveSnapshot keeps a snapshot of the current emails under the name.
+func (s *Server) saveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logf(generateRequestID(), r, log.INFO, "saving snapshot %q", name)
+	info, err := s.snapshots.Save(r.Context(), name)
+	if err != nil {
+		writeSnapshotError(w, name, err)
+		return
+	}
+	writeJSONResponse(w, info)
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		writeSnapshotError(w, "", err)
+		return
+	}
+	writeJSONResponse(w, snapshots)
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logf(generateRequestID(), r, log.INFO, "deleting snapshot %q", name)
+	if err := s.snapshots.Delete(name); err != nil {
+		writeSnapshotError(w, name, err)
+		return
+	}
+	writeJSONResponse(w, map[string]string{"status": "ok"})
+}
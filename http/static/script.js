@@ -1222,6 +1222,12 @@ $(function () {
         });
     }
 
+    // The search snippet is HTML-escaped by the server, the matches in <mark> elements.
+    function formatPreview(email) {
+        const preview = $('<span>').css('font-style', 'italic');
+        return email.snippet ? preview.attr('data-testid', 'email-snippet-' + email.id).html(email.snippet) : preview.text(email.preview);
+    }
+
     function generateEmailListItem(email) {
         const rowClass = email.is_read ? 'email-item email-read' : 'email-item email-unread';
         return $(`<tr class="${rowClass}">`)
@@ -1233,7 +1239,7 @@ $(function () {
                     .click(function(e) { e.stopPropagation(); })
             ))
             .append($('<td class="recipient" data-testid="email-to-' + email.id + '">').append(formatRecipientSummary(email.tos)))
-            .append($('<td class="preview" data-testid="email-preview-' + email.id + '">').append($('<strong>').text(email.subject + ' - ')).append($('<span>').css('font-style', 'italic').text(email.preview)))
+            .append($('<td class="preview" data-testid="email-preview-' + email.id + '">').append($('<strong>').text(email.subject + ' - ')).append(formatPreview(email)))
             .append($('<td data-testid="email-attachment-icon-' + email.id + '">').append(email.has_attachments ? $('<i class="bi bi-paperclip icon">') : ''))
             .append($('<td class="date" data-testid="email-date-' + email.id + '">').text(formatDateTime(email.date)))
             .append($('<td data-testid="email-actions-' + email.id + '">')
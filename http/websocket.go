@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"mock-my-mta/log"
@@ -19,12 +20,36 @@ type WSEvent struct {
 
 // wsHub manages connected WebSocket clients and broadcasts events.
 type wsHub struct {
-	mu      sync.RWMutex
-	clients map[*websocket.Conn]bool
+	mu        sync.RWMutex
+	clients   map[*websocket.Conn]bool
+	listeners map[chan WSEvent]struct{} // in-process subscribers (JMAP push)
+	sequence  atomic.Uint64             // number of events broadcast so far
 }
 
 var hub = &wsHub{
-	clients: make(map[*websocket.Conn]bool),
+	clients:   make(map[*websocket.Conn]bool),
+	listeners: make(map[chan WSEvent]struct{}),
+}
+
+// subscribeEvents returns a channel receiving the broadcast events.
+// Events are dropped if the subscriber does not keep up.
+func subscribeEvents() chan WSEvent {
+	listener := make(chan WSEvent, 16)
+	hub.mu.Lock()
+	hub.listeners[listener] = struct{}{}
+	hub.mu.Unlock()
+	return listener
+}
+
+func unsubscribeEvents(listener chan WSEvent) {
+	hub.mu.Lock()
+	delete(hub.listeners, listener)
+	hub.mu.Unlock()
+}
+
+// eventSequence returns the number of events broadcast so far.
+func eventSequence() uint64 {
+	return hub.sequence.Load()
 }
 
 var upgrader = websocket.Upgrader{
@@ -100,9 +125,18 @@ func BroadcastEvent(eventType string, payload interface{}) {
 		return
 	}
 
+	hub.sequence.Add(1)
+
 	hub.mu.RLock()
 	defer hub.mu.RUnlock()
 
+	for listener := range hub.listeners {
+		select {
+		case listener <- event:
+		default:
+			log.Logf(log.DEBUG, "event listener is full, dropping %v event", eventType)
+		}
+	}
 	for conn := range hub.clients {
 		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
 			log.Logf(log.DEBUG, "websocket write error: %v", err)
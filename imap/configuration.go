@@ -0,0 +1,5 @@
+package imap
+
+type Configuration struct {
+	Addr string `json:"addr"` // empty = IMAP server disabled
+}
@@ -0,0 +1,587 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mock-my-mta/storage/multipart"
+)
+
+// fetchItem is a data item of a FETCH command.
+type fetchItem struct {
+	name       string // UID, FLAGS, BODY, BODY.PEEK, RFC822...
+	section    string // section specification of BODY[...], as sent by the client
+	hasSection bool
+	partial    bool
+	start      int
+	length     int
+}
+
+func parseFetchItems(f field) ([]fetchItem, error) {
+	var names []string
+	if f.isList {
+		for _, item := range f.list {
+			if item.isList {
+				return nil, fmt.Errorf("invalid fetch item %v", item)
+			}
+			names = append(names, item.value)
+		}
+	} else {
+		switch strings.ToUpper(f.value) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{f.value}
+		}
+	}
+	items := make([]fetchItem, 0, len(names))
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseFetchItem(value string) (fetchItem, error) {
+	name, rest, hasSection := strings.Cut(value, "[")
+	item := fetchItem{name: strings.ToUpper(name), hasSection: hasSection}
+	if hasSection {
+		end := strings.LastIndex(rest, "]")
+		if end < 0 || (item.name != "BODY" && item.name != "BODY.PEEK") {
+			return fetchItem{}, fmt.Errorf("invalid fetch item %v", value)
+		}
+		item.section = rest[:end]
+		partial := rest[end+1:]
+		if partial != "" {
+			if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") {
+				return fetchItem{}, fmt.Errorf("invalid partial %v", partial)
+			}
+			start, length, _ := strings.Cut(partial[1:len(partial)-1], ".")
+			var err error
+			if item.start, err = strconv.Atoi(start); err != nil {
+				return fetchItem{}, fmt.Errorf("invalid partial %v", partial)
+			}
+			item.length = -1
+			if length != "" {
+				if item.length, err = strconv.Atoi(length); err != nil {
+					return fetchItem{}, fmt.Errorf("invalid partial %v", partial)
+				}
+			}
+			item.partial = true
+		}
+		return item, nil
+	}
+	switch item.name {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return item, nil
+	}
+	return fetchItem{}, fmt.Errorf("unknown fetch item %v", value)
+}
+
+// setsSeen returns true if fetching the item implicitly sets the \Seen flag.
+func (item fetchItem) setsSeen() bool {
+	return (item.name == "BODY" && item.hasSection) || item.name == "RFC822" || item.name == "RFC822.TEXT"
+}
+
+func (c *session) fetch(tag string, fields []field, isUID bool) error {
+	if len(fields) != 2 {
+		return c.writeLine("%s BAD usage: FETCH set items", tag)
+	}
+	set, err := parseSeqSet(fields[0].value)
+	if err != nil {
+		return c.writeLine("%s BAD %v", tag, err)
+	}
+	items, err := parseFetchItems(fields[1])
+	if err != nil {
+		return c.writeLine("%s BAD %v", tag, err)
+	}
+	if isUID {
+		hasUID := false
+		for _, item := range items {
+			hasUID = hasUID || item.name == "UID"
+		}
+		if !hasUID {
+			items = append([]fetchItem{{name: "UID"}}, items...)
+		}
+	}
+	err = c.forEachMessage(set, isUID, func(seq int, message mailboxMessage) error {
+		response, err := c.fetchMessage(seq, message, items)
+		if err != nil {
+			return c.writeLine("* NO cannot fetch message %d: %v", seq, err)
+		}
+		return c.write(response)
+	})
+	if err != nil {
+		return err
+	}
+	return c.writeLine("%s OK FETCH completed", tag)
+}
+
+func (c *session) fetchMessage(seq int, message mailboxMessage, items []fetchItem) ([]byte, error) {
+	info, err := c.server.getMessageInfo(message.id)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	var top *rawPart
+	loadRaw := func() error {
+		if raw != nil {
+			return nil
+		}
+		data, err := c.server.store.GetRawEmail(message.id)
+		if err != nil {
+			return err
+		}
+		raw = toCRLF(data)
+		top = parseRawPart(raw, false)
+		return nil
+	}
+
+	hasFlags := false
+	setsSeen := false
+	for _, item := range items {
+		hasFlags = hasFlags || item.name == "FLAGS"
+		setsSeen = setsSeen || item.setsSeen()
+	}
+	if setsSeen && !c.selected.readOnly && !c.server.flags.IsRead(message.id) {
+		c.server.flags.SetRead(message.id, true)
+		if !hasFlags {
+			items = append(items, fetchItem{name: "FLAGS"})
+		}
+	}
+
+	var values []string
+	for _, item := range items {
+		switch item.name {
+		case "UID":
+			values = append(values, fmt.Sprintf("UID %d", message.uid))
+		case "FLAGS":
+			flags := c.flagList(message.id)
+			c.selected.flags[message.id] = flags
+			values = append(values, "FLAGS "+flags)
+		case "INTERNALDATE":
+			values = append(values, `INTERNALDATE "`+info.date.Format("02-Jan-2006 15:04:05 -0700")+`"`)
+		case "RFC822.SIZE":
+			values = append(values, fmt.Sprintf("RFC822.SIZE %d", info.size))
+		case "ENVELOPE":
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			values = append(values, "ENVELOPE "+envelope(top.mimeHeader))
+		case "BODYSTRUCTURE", "BODY":
+			if item.name == "BODY" && item.hasSection {
+				if err := loadRaw(); err != nil {
+					return nil, err
+				}
+				data, err := top.section(item.section)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, item.responseName()+" "+literal(item.applyPartial(data)))
+				continue
+			}
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			mp, err := multipart.ParseEmailFromBytes(raw)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item.name+" "+bodyStructure(mp.GetMimeTree(), top, item.name == "BODYSTRUCTURE"))
+		case "BODY.PEEK":
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			data, err := top.section(item.section)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item.responseName()+" "+literal(item.applyPartial(data)))
+		case "RFC822":
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			values = append(values, "RFC822 "+literal(raw))
+		case "RFC822.HEADER":
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			values = append(values, "RFC822.HEADER "+literal(top.header))
+		case "RFC822.TEXT":
+			if err := loadRaw(); err != nil {
+				return nil, err
+			}
+			values = append(values, "RFC822.TEXT "+literal(top.body))
+		}
+	}
+	return []byte(fmt.Sprintf("* %d FETCH (%v)\r\n", seq, strings.Join(values, " "))), nil
+}
+
+// responseName returns the name of the item in the FETCH response.
+func (item fetchItem) responseName() string {
+	name := "BODY[" + item.section + "]"
+	if item.partial {
+		name += fmt.Sprintf("<%d>", item.start)
+	}
+	return name
+}
+
+func (item fetchItem) applyPartial(data []byte) []byte {
+	if !item.partial {
+		return data
+	}
+	if item.start >= len(data) {
+		return nil
+	}
+	data = data[item.start:]
+	if item.length >= 0 && item.length < len(data) {
+		data = data[:item.length]
+	}
+	return data
+}
+
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// rawPart is a MIME part of a raw email, kept as bytes for the BODY[section] items.
+type rawPart struct {
+	header     []byte // header fields, including the empty line that ends them
+	body       []byte
+	mimeHeader textproto.MIMEHeader
+	mediaType  string
+	params     map[string]string
+	parts      []*rawPart // parts of a multipart
+	message    *rawPart   // encapsulated message of a message/rfc822 part
+}
+
+// parseRawPart splits a message (or a MIME part if isPart) with CRLF line endings.
+func parseRawPart(data []byte, isPart bool) *rawPart {
+	part := &rawPart{}
+	switch {
+	case bytes.HasPrefix(data, []byte("\r\n")):
+		part.header, part.body = data[:2], data[2:]
+	default:
+		end := bytes.Index(data, []byte("\r\n\r\n"))
+		if end < 0 {
+			part.header = data
+		} else {
+			part.header, part.body = data[:end+4], data[end+4:]
+		}
+	}
+	// a malformed header is kept as far as it could be read
+	part.mimeHeader, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(part.header))).ReadMIMEHeader()
+	part.mediaType, part.params = "text/plain", map[string]string{"charset": "us-ascii"}
+	if contentType := part.mimeHeader.Get("Content-Type"); contentType != "" {
+		if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+			part.mediaType, part.params = mediaType, params
+		}
+	}
+	switch {
+	case strings.HasPrefix(part.mediaType, "multipart/"):
+		for _, data := range splitMultipart(part.body, part.params["boundary"]) {
+			part.parts = append(part.parts, parseRawPart(data, true))
+		}
+	case part.mediaType == "message/rfc822" && isPart:
+		part.message = parseRawPart(part.body, false)
+	}
+	return part
+}
+
+// splitMultipart returns the parts of a multipart body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	dashBoundary := []byte("--" + boundary)
+	delimiter := append([]byte("\r\n"), dashBoundary...)
+	var start int
+	if bytes.HasPrefix(body, dashBoundary) {
+		start = 0
+	} else if i := bytes.Index(body, delimiter); i >= 0 {
+		start = i + 2
+	} else {
+		return nil
+	}
+	var parts [][]byte
+	for {
+		// start is at a delimiter line
+		if bytes.HasPrefix(body[start+len(dashBoundary):], []byte("--")) {
+			break
+		}
+		lineEnd := bytes.Index(body[start:], []byte("\r\n"))
+		if lineEnd < 0 {
+			break
+		}
+		partStart := start + lineEnd + 2
+		next := bytes.Index(body[partStart:], delimiter)
+		if next < 0 {
+			parts = append(parts, body[partStart:])
+			break
+		}
+		parts = append(parts, body[partStart:partStart+next])
+		start = partStart + next + 2
+	}
+	return parts
+}
+
+// subPart returns the nth (1-based) part, following the IMAP section numbering.
+func (p *rawPart) subPart(n int) *rawPart {
+	switch {
+	case strings.HasPrefix(p.mediaType, "multipart/"):
+		if n < 1 || n > len(p.parts) {
+			return nil
+		}
+		return p.parts[n-1]
+	case p.message != nil:
+		return p.message.subPart(n)
+	case n == 1:
+		return p
+	}
+	return nil
+}
+
+// section returns the content of a BODY[section] item.
+func (p *rawPart) section(section string) ([]byte, error) {
+	specification, fieldList, _ := strings.Cut(section, " ")
+	part, message := p, p
+	text := ""
+	path := false
+	if specification != "" {
+		for _, component := range strings.Split(specification, ".") {
+			n, err := strconv.Atoi(component)
+			if err != nil || text != "" {
+				text = strings.TrimPrefix(text+"."+strings.ToUpper(component), ".")
+				continue
+			}
+			if part = part.subPart(n); part == nil {
+				return nil, fmt.Errorf("no such section %v", section)
+			}
+			path = true
+		}
+	}
+	if path {
+		message = part.message
+	}
+	switch text {
+	case "":
+		if !path {
+			return append(append([]byte{}, p.header...), p.body...), nil
+		}
+		return part.body, nil
+	case "MIME":
+		if !path {
+			return nil, fmt.Errorf("MIME requires a part number")
+		}
+		return part.header, nil
+	}
+	if message == nil {
+		return nil, fmt.Errorf("section %v is not a message", section)
+	}
+	switch text {
+	case "HEADER":
+		return message.header, nil
+	case "TEXT":
+		return message.body, nil
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		fields, err := parseFields([]byte(fieldList))
+		if err != nil || len(fields) != 1 || !fields[0].isList {
+			return nil, fmt.Errorf("invalid header field list %v", fieldList)
+		}
+		var names []string
+		for _, f := range fields[0].list {
+			names = append(names, f.value)
+		}
+		return filterHeader(message.header, names, text == "HEADER.FIELDS"), nil
+	}
+	return nil, fmt.Errorf("unknown section %v", section)
+}
+
+// filterHeader keeps (or removes) the named header fields.
+func filterHeader(header []byte, names []string, keep bool) []byte {
+	var result bytes.Buffer
+	include := false
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "\r\n" || line == "" {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(line, ":")
+			matches := false
+			for _, n := range names {
+				matches = matches || strings.EqualFold(strings.TrimSpace(name), n)
+			}
+			include = matches == keep
+		}
+		if include {
+			result.WriteString(line)
+		}
+	}
+	result.WriteString("\r\n")
+	return result.Bytes()
+}
+
+// envelope formats the ENVELOPE of a message.
+func envelope(header textproto.MIMEHeader) string {
+	from := addressList(header.Get("From"))
+	sender, replyTo := from, from
+	if value := header.Get("Sender"); value != "" {
+		sender = addressList(value)
+	}
+	if value := header.Get("Reply-To"); value != "" {
+		replyTo = addressList(value)
+	}
+	return "(" + strings.Join([]string{
+		nstring(header.Get("Date")),
+		nstring(header.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(header.Get("To")),
+		addressList(header.Get("Cc")),
+		addressList(header.Get("Bcc")),
+		nstring(header.Get("In-Reply-To")),
+		nstring(header.Get("Message-Id")),
+	}, " ") + ")"
+}
+
+func addressList(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil || len(addresses) == 0 {
+		return "NIL"
+	}
+	var sb strings.Builder
+	sb.WriteString("(")
+	for _, address := range addresses {
+		mailbox, host := address.Address, ""
+		if at := strings.LastIndex(address.Address, "@"); at >= 0 {
+			mailbox, host = address.Address[:at], address.Address[at+1:]
+		}
+		sb.WriteString("(" + nstring(address.Name) + " NIL " + nstring(mailbox) + " " + nstring(host) + ")")
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// bodyStructure formats the BODYSTRUCTURE (or BODY if not extensible) of a
+// MIME tree, taking the exact sizes and encodings from the raw parts.
+func bodyStructure(tree *multipart.MimeTreeNode, part *rawPart, extensible bool) string {
+	mediaType, params, err := mime.ParseMediaType(tree.ContentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	mainType, subType, _ := strings.Cut(mediaType, "/")
+
+	if mainType == "multipart" {
+		var sb strings.Builder
+		sb.WriteString("(")
+		for i, child := range tree.Children {
+			var childPart *rawPart
+			if part != nil && i < len(part.parts) {
+				childPart = part.parts[i]
+			}
+			sb.WriteString(bodyStructure(child, childPart, extensible))
+		}
+		sb.WriteString(" " + quote(strings.ToUpper(subType)))
+		if extensible {
+			sb.WriteString(" " + parameterList(params) + " " + disposition(tree.Disposition) + " NIL NIL")
+		}
+		sb.WriteString(")")
+		return sb.String()
+	}
+
+	contentID, description, encoding := "", "", tree.Encoding
+	size := tree.Size
+	var body []byte
+	if part != nil {
+		contentID = part.mimeHeader.Get("Content-Id")
+		description = part.mimeHeader.Get("Content-Description")
+		if value := part.mimeHeader.Get("Content-Transfer-Encoding"); value != "" {
+			encoding = value
+		}
+		body = part.body
+		size = len(body)
+	} else if tree.ContentID != "" {
+		contentID = "<" + tree.ContentID + ">"
+	}
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fields := []string{
+		quote(strings.ToUpper(mainType)),
+		quote(strings.ToUpper(subType)),
+		parameterList(params),
+		nstring(contentID),
+		nstring(description),
+		quote(strings.ToUpper(encoding)),
+		strconv.Itoa(size),
+	}
+	switch {
+	case mainType == "text":
+		fields = append(fields, strconv.Itoa(countLines(body)))
+	case mediaType == "message/rfc822" && part != nil && part.message != nil:
+		encapsulated, err := multipart.ParseEmailFromBytes(part.body)
+		if err == nil {
+			fields = append(fields,
+				envelope(part.message.mimeHeader),
+				bodyStructure(encapsulated.GetMimeTree(), part.message, extensible),
+				strconv.Itoa(countLines(body)))
+		}
+	}
+	if extensible {
+		fields = append(fields, "NIL", disposition(tree.Disposition), "NIL", "NIL")
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func parameterList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		values = append(values, quote(strings.ToUpper(key)), quote(params[key]))
+	}
+	return "(" + strings.Join(values, " ") + ")"
+}
+
+func disposition(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	dispositionType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "NIL"
+	}
+	return "(" + quote(strings.ToUpper(dispositionType)) + " " + parameterList(params) + ")"
+}
+
+func countLines(body []byte) int {
+	lines := bytes.Count(body, []byte("\n"))
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
@@ -0,0 +1,337 @@
+package imap
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+	"mock-my-mta/sieve"
+	"mock-my-mta/storage"
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
+)
+
+// Server is an IMAP4rev1 server (RFC 3501) exposing the mailboxes of the storage.
+// Users log in with a recipient address: its INBOX holds the emails sent to
+// that address, and the Sieve folders of the mailbox are the other IMAP mailboxes.
+type Server struct {
+	configuration Configuration
+	store         storage.Storage
+	flags         *storage.FlagStore
+	sieveStore    *sieve.Store
+
+	tlsConfig     *tls.Config                          // enables STARTTLS when set
+	checkPassword func(username, password string) bool // nil = any password accepted
+
+	uidValidity uint32
+
+	mu          sync.Mutex
+	listener    net.Listener
+	connections map[net.Conn]struct{}
+	closed      bool
+	subscribers map[chan struct{}]struct{} // sessions waiting for mailbox changes (IDLE)
+	messages    map[string]*messageInfo    // email ID → cached message information
+	mailboxes   map[string]*mailboxUIDs    // mailbox/folder → UIDs
+}
+
+// messageInfo is the immutable information of an email needed by IMAP.
+type messageInfo struct {
+	size       int
+	date       time.Time
+	placements []multipart.FolderPlacement
+}
+
+// mailboxUIDs assigns strictly ascending UIDs to the emails of a mailbox.
+type mailboxUIDs struct {
+	next uint32
+	uids map[string]uint32
+}
+
+// mailboxMessage is a message of a selected mailbox.
+type mailboxMessage struct {
+	id  string
+	uid uint32
+}
+
+// SetTLSConfig enables the STARTTLS command with the given TLS configuration.
+func (s *Server) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+}
+
+// SetCheckPassword registers a callback validating LOGIN credentials.
+func (s *Server) SetCheckPassword(fn func(username, password string) bool) {
+	s.checkPassword = fn
+}
+
+// SetFlagStore shares the flags (and the \Seen read state) with the HTTP API.
+func (s *Server) SetFlagStore(flags *storage.FlagStore) {
+	s.flags = flags
+}
+
+// SetSieveStore exposes the Sieve folders of each mailbox as IMAP mailboxes.
+func (s *Server) SetSieveStore(store *sieve.Store) {
+	s.sieveStore = store
+}
+
+func NewServer(config Configuration, store storage.Storage) *Server {
+	return &Server{
+		configuration: config,
+		store:         store,
+		flags:         storage.NewFlagStore(),
+		uidValidity:   uint32(time.Now().Unix()),
+		connections:   make(map[net.Conn]struct{}),
+		subscribers:   make(map[chan struct{}]struct{}),
+		messages:      make(map[string]*messageInfo),
+		mailboxes:     make(map[string]*mailboxUIDs),
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	log.Logf(log.INFO, "starting imap server on %v", s.configuration.Addr)
+	listener, err := net.Listen("tcp", s.configuration.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.connections[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			newSession(s, conn).serve()
+			s.mu.Lock()
+			delete(s.connections, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) Shutdown() error {
+	log.Logf(log.INFO, "stopping imap server...")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.connections {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// NotifyNewEmail wakes up the sessions waiting in IDLE so that they report the new email.
+func (s *Server) NotifyNewEmail(emailID string) {
+	s.notifySubscribers()
+}
+
+// NotifyDeleteEmail forgets the email deleted by another client, or every email
+// without ID, and wakes up the sessions waiting in IDLE so that they report it.
+func (s *Server) NotifyDeleteEmail(emailID string) {
+	s.forgetEmail(emailID)
+	s.notifySubscribers()
+}
+
+// forgetEmail drops the cached information and the UIDs of the email, or of
+// every email without ID. The next UIDs of the folders are kept ascending.
+func (s *Server) forgetEmail(emailID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if emailID == "" {
+		s.messages = make(map[string]*messageInfo)
+		for _, uids := range s.mailboxes {
+			uids.uids = make(map[string]uint32)
+		}
+		return
+	}
+	delete(s.messages, emailID)
+	for _, uids := range s.mailboxes {
+		delete(uids.uids, emailID)
+	}
+}
+
+func (s *Server) notifySubscribers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+			// a notification is already pending
+		}
+	}
+}
+
+func (s *Server) subscribe() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscriber := make(chan struct{}, 1)
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (s *Server) unsubscribe(subscriber chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, subscriber)
+}
+
+// findMailbox returns the name of the mailbox matching the username.
+// Unknown mailboxes are accepted and simply empty.
+func (s *Server) findMailbox(username string) (string, error) {
+	mailboxes, err := s.store.GetMailboxes()
+	if err != nil {
+		return "", err
+	}
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(mailbox.Name, username) {
+			return mailbox.Name, nil
+		}
+	}
+	return username, nil
+}
+
+// getFolders returns the folders of the mailbox, the first one being the INBOX.
+func (s *Server) getFolders(mailbox string) []string {
+	if s.sieveStore == nil {
+		return []string{multipart.DefaultFolder}
+	}
+	return s.sieveStore.GetFolders(mailbox)
+}
+
+// getMessageInfo returns the cached information of an email, reading it on first use.
+func (s *Server) getMessageInfo(emailID string) (*messageInfo, error) {
+	s.mu.Lock()
+	info, found := s.messages[emailID]
+	s.mu.Unlock()
+	if found {
+		return info, nil
+	}
+	raw, err := s.store.GetRawEmail(emailID)
+	if err != nil {
+		return nil, err
+	}
+	info = &messageInfo{size: len(toCRLF(raw))}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		log.Logf(log.WARNING, "imap: cannot parse email %v: %v", emailID, err)
+	} else {
+		info.date = mp.GetDate()
+		info.placements = mp.GetFolderPlacements()
+		// flags set by Sieve (imap4flags) become the initial flags of the email
+		for _, placement := range info.placements {
+			s.flags.AddFlags(emailID, placement.Flags...)
+		}
+	}
+	s.mu.Lock()
+	s.messages[emailID] = info
+	s.mu.Unlock()
+	return info, nil
+}
+
+// isInFolder returns true if the email was filed into the folder of the mailbox.
+func (info *messageInfo) isInFolder(mailbox, folder string) bool {
+	for _, placement := range info.placements {
+		if strings.EqualFold(placement.Mailbox, mailbox) && strings.EqualFold(placement.Folder, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMessages returns the messages of a folder of the mailbox, in UID order.
+// New emails are given UIDs greater than all the UIDs already assigned in the folder.
+func (s *Server) getMessages(mailbox, folder string) ([]mailboxMessage, uint32, error) {
+	emailHeaders, _, err := s.store.SearchEmails("mailbox:"+matcher.QuoteValue(mailbox), 1, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+	var emailIDs []string
+	for _, emailHeader := range emailHeaders {
+		info, err := s.getMessageInfo(emailHeader.ID)
+		if err != nil {
+			// deleted in the meantime
+			log.Logf(log.DEBUG, "imap: skipping email %v: %v", emailHeader.ID, err)
+			continue
+		}
+		if info.isInFolder(mailbox, folder) {
+			emailIDs = append(emailIDs, emailHeader.ID)
+		}
+	}
+	// email IDs start with the date: new emails are numbered in date order
+	sort.Strings(emailIDs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(mailbox) + "\x00" + strings.ToLower(folder)
+	uids, found := s.mailboxes[key]
+	if !found {
+		uids = &mailboxUIDs{next: 1, uids: make(map[string]uint32)}
+		s.mailboxes[key] = uids
+	}
+	present := make(map[string]bool, len(emailIDs))
+	messages := make([]mailboxMessage, 0, len(emailIDs))
+	for _, emailID := range emailIDs {
+		present[emailID] = true
+		uid, found := uids.uids[emailID]
+		if !found {
+			uid = uids.next
+			uids.next++
+			uids.uids[emailID] = uid
+		}
+		messages = append(messages, mailboxMessage{id: emailID, uid: uid})
+	}
+	// forget deleted emails
+	for emailID := range uids.uids {
+		if !present[emailID] {
+			delete(uids.uids, emailID)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].uid < messages[j].uid
+	})
+	return messages, uids.next, nil
+}
+
+// deleteEmail removes an expunged email from the storage.
+func (s *Server) deleteEmail(emailID string) error {
+	if err := s.store.DeleteEmailByID(emailID); err != nil {
+		return err
+	}
+	s.flags.Delete(emailID)
+	s.forgetEmail(emailID)
+	return nil
+}
+
+// toCRLF converts the line endings of a raw email to CRLF.
+func toCRLF(raw []byte) []byte {
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	return []byte(strings.ReplaceAll(text, "\n", "\r\n"))
+}
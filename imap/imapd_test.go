@@ -0,0 +1,329 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mock-my-mta/smtp"
+	"mock-my-mta/storage"
+)
+
+const firstEmail = "From: Sender <sender@example.com>\r\nTo: bob@example.com\r\nSubject: first\r\nDate: Mon, 01 Jan 2024 10:00:00 +0000\r\n\r\nline one\r\nline two\r\n"
+const secondEmail = "From: other@example.com\r\nTo: bob@example.com, carol@example.com\r\nSubject: second\r\nDate: Tue, 02 Jan 2024 10:00:00 +0000\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n--b1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nhello world\r\n--b1\r\nContent-Type: application/pdf; name=\"doc.pdf\"\r\nContent-Disposition: attachment; filename=\"doc.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n--b1--\r\n"
+
+func newTestStorage(t *testing.T, emails ...string) *storage.Engine {
+	engine, err := storage.NewEngine([]storage.StorageLayerConfiguration{{Type: "MEMORY"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range emails {
+		addEmail(t, engine, raw)
+	}
+	return engine
+}
+
+func addEmail(t *testing.T, engine *storage.Engine, raw string) string {
+	message, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := engine.Set(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func startTestServer(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String()
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	return c
+}
+
+// readLine reads a response line, literals included.
+func (c *testClient) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var sb strings.Builder
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		sb.WriteString(line)
+		size, _, ok := literalSize(line)
+		if !ok {
+			return sb.String()
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			c.t.Fatal(err)
+		}
+		sb.WriteString("\r\n")
+		sb.Write(data)
+	}
+}
+
+// cmd sends a command and returns the untagged responses and the tagged status.
+func (c *testClient) cmd(format string, args ...interface{}) ([]string, string) {
+	c.t.Helper()
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		c.t.Fatal(err)
+	}
+	var untagged []string
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, tag+" ") {
+			return untagged, strings.TrimPrefix(line, tag+" ")
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (c *testClient) expectOK(format string, args ...interface{}) []string {
+	c.t.Helper()
+	untagged, status := c.cmd(format, args...)
+	if !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("%q: expected OK, got %q", fmt.Sprintf(format, args...), status)
+	}
+	return untagged
+}
+
+func expectResponse(t *testing.T, untagged []string, expected string) {
+	t.Helper()
+	for _, line := range untagged {
+		if line == expected {
+			return
+		}
+	}
+	t.Fatalf("expected %q in %q", expected, untagged)
+}
+
+func TestSession(t *testing.T) {
+	engine := newTestStorage(t, firstEmail, secondEmail)
+	flags := storage.NewFlagStore()
+	server := NewServer(Configuration{}, engine)
+	server.SetFlagStore(flags)
+	c := dial(t, startTestServer(t, server))
+
+	if _, status := c.cmd("SELECT INBOX"); !strings.HasPrefix(status, "BAD") {
+		t.Fatalf("SELECT before LOGIN should fail, got %q", status)
+	}
+	c.expectOK("LOGIN bob@example.com secret")
+
+	untagged := c.expectOK(`LIST "" "*"`)
+	expectResponse(t, untagged, `* LIST (\HasNoChildren) "/" "INBOX"`)
+
+	untagged = c.expectOK("SELECT INBOX")
+	expectResponse(t, untagged, "* 2 EXISTS")
+	expectResponse(t, untagged, "* OK [UIDNEXT 3] predicted next UID")
+
+	untagged = c.expectOK("FETCH 1:* (UID FLAGS RFC822.SIZE ENVELOPE)")
+	expectResponse(t, untagged, fmt.Sprintf(`* 1 FETCH (UID 1 FLAGS () RFC822.SIZE %d ENVELOPE ("Mon, 01 Jan 2024 10:00:00 +0000" "first" (("Sender" NIL "sender" "example.com")) (("Sender" NIL "sender" "example.com")) (("Sender" NIL "sender" "example.com")) ((NIL NIL "bob" "example.com")) NIL NIL NIL NIL))`, len(firstEmail)))
+
+	untagged = c.expectOK("FETCH 2 BODYSTRUCTURE")
+	expectResponse(t, untagged, `* 2 FETCH (BODYSTRUCTURE (("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 11 1 NIL NIL NIL NIL)("APPLICATION" "PDF" ("NAME" "doc.pdf") NIL NIL "BASE64" 8 NIL ("ATTACHMENT" ("FILENAME" "doc.pdf")) NIL NIL) "MIXED" ("BOUNDARY" "b1") NIL NIL NIL))`)
+
+	// BODY.PEEK does not set \Seen, BODY[] does
+	untagged = c.expectOK("FETCH 2 BODY.PEEK[1]")
+	expectResponse(t, untagged, "* 2 FETCH (BODY[1] {11}\r\nhello world)")
+	if flags.IsRead(messageID(t, server, 2)) {
+		t.Fatal("BODY.PEEK should not set \\Seen")
+	}
+	untagged = c.expectOK("UID FETCH 1 BODY[HEADER.FIELDS (SUBJECT)]")
+	expectResponse(t, untagged, "* 1 FETCH (UID 1 BODY[HEADER.FIELDS (SUBJECT)] {18}\r\nSubject: first\r\n\r\n FLAGS (\\Seen))")
+
+	// flags are shared with the web UI
+	untagged = c.expectOK("SEARCH UNSEEN")
+	expectResponse(t, untagged, "* SEARCH 2")
+	flags.ResetRead()
+	untagged = c.expectOK("NOOP")
+	expectResponse(t, untagged, "* 1 FETCH (FLAGS ())")
+
+	untagged = c.expectOK(`SEARCH OR SUBJECT "second" FROM sender SINCE 1-Jan-2024`)
+	expectResponse(t, untagged, "* SEARCH 1 2")
+	untagged = c.expectOK("SEARCH BODY hello NOT BEFORE 2-Jan-2024")
+	expectResponse(t, untagged, "* SEARCH 2")
+	untagged = c.expectOK("UID SEARCH ON 1-Jan-2024")
+	expectResponse(t, untagged, "* SEARCH 1")
+	if _, status := c.cmd("SEARCH CHARSET KOI8-R ALL"); !strings.HasPrefix(status, "NO [BADCHARSET") {
+		t.Fatalf("expected BADCHARSET, got %q", status)
+	}
+
+	untagged = c.expectOK(`STORE 1 +FLAGS (\Deleted $Important)`)
+	expectResponse(t, untagged, `* 1 FETCH (FLAGS ($Important \Deleted))`)
+	untagged = c.expectOK("EXPUNGE")
+	expectResponse(t, untagged, "* 1 EXPUNGE")
+	if _, total, _ := engine.SearchEmails("", 1, -1); total != 1 {
+		t.Fatalf("expected 1 email left, got %d", total)
+	}
+
+	c.expectOK("LOGOUT")
+}
+
+// messageID returns the email ID of a message of the INBOX of bob@example.com.
+func messageID(t *testing.T, server *Server, seq int) string {
+	t.Helper()
+	messages, _, err := server.getMessages("bob@example.com", "Inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages[seq-1].id
+}
+
+func TestIdle(t *testing.T) {
+	engine := newTestStorage(t, firstEmail)
+	server := NewServer(Configuration{}, engine)
+	c := dial(t, startTestServer(t, server))
+	c.expectOK("LOGIN bob@example.com secret")
+	c.expectOK("SELECT INBOX")
+
+	fmt.Fprintf(c.conn, "a100 IDLE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got %q", line)
+	}
+	secondID := addEmail(t, engine, secondEmail)
+	server.NotifyNewEmail(secondID)
+	if line := c.readLine(); line != "* 2 EXISTS" {
+		t.Fatalf("expected EXISTS, got %q", line)
+	}
+	// deleted by another client
+	if err := engine.DeleteEmailByID(secondID); err != nil {
+		t.Fatal(err)
+	}
+	server.NotifyDeleteEmail(secondID)
+	if line := c.readLine(); line != "* 2 EXPUNGE" {
+		t.Fatalf("expected EXPUNGE, got %q", line)
+	}
+	server.mu.Lock()
+	_, cached := server.messages[secondID]
+	server.mu.Unlock()
+	if cached {
+		t.Errorf("expected the deleted email to be forgotten")
+	}
+	fmt.Fprintf(c.conn, "DONE\r\n")
+	if line := c.readLine(); !strings.HasPrefix(line, "a100 OK") {
+		t.Fatalf("expected IDLE completion, got %q", line)
+	}
+}
+
+// queryStorage records the search queries and counts the raw email reads.
+type queryStorage struct {
+	storage.Storage
+	mu      sync.Mutex
+	queries []string
+	reads   int
+}
+
+func (s *queryStorage) SearchEmails(query string, page, pageSize int) ([]storage.EmailHeader, int, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+	return s.Storage.SearchEmails(query, page, pageSize)
+}
+
+func (s *queryStorage) GetRawEmail(emailID string) ([]byte, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	return s.Storage.GetRawEmail(emailID)
+}
+
+func TestSearchPushdown(t *testing.T) {
+	store := &queryStorage{Storage: newTestStorage(t, firstEmail, secondEmail)}
+	server := NewServer(Configuration{}, store)
+	c := dial(t, startTestServer(t, server))
+	c.expectOK("LOGIN bob@example.com secret")
+	c.expectOK("SELECT INBOX")
+
+	store.mu.Lock()
+	store.reads = 0
+	store.mu.Unlock()
+	untagged := c.expectOK(`SEARCH SUBJECT "SECOND" FROM other@example.com`)
+	expectResponse(t, untagged, "* SEARCH 2")
+	store.mu.Lock()
+	query, reads := store.queries[len(store.queries)-1], store.reads
+	store.mu.Unlock()
+	if query != `mailbox:"bob@example.com" subject:"SECOND" from:"other@example.com"` {
+		t.Fatalf("unexpected query %q", query)
+	}
+	if reads != 0 {
+		t.Fatalf("expected the storage to match the headers, got %d raw reads", reads)
+	}
+
+	// To and Cc are told apart on the email, NOT and OR on the messages
+	untagged = c.expectOK("SEARCH TO carol@example.com")
+	expectResponse(t, untagged, "* SEARCH 2")
+	untagged = c.expectOK("SEARCH CC carol@example.com")
+	expectResponse(t, untagged, "* SEARCH")
+	untagged = c.expectOK("SEARCH NOT SUBJECT first")
+	expectResponse(t, untagged, "* SEARCH 2")
+	untagged = c.expectOK("SEARCH OR FROM other@example.com SUBJECT first")
+	expectResponse(t, untagged, "* SEARCH 1 2")
+}
+
+func TestCheckPassword(t *testing.T) {
+	server := NewServer(Configuration{}, newTestStorage(t))
+	server.SetCheckPassword(func(username, password string) bool {
+		return username == "bob@example.com" && password == "secret"
+	})
+	c := dial(t, startTestServer(t, server))
+
+	if _, status := c.cmd("LOGIN bob@example.com wrong"); !strings.HasPrefix(status, "NO") {
+		t.Fatalf("expected NO, got %q", status)
+	}
+	c.expectOK("LOGIN \"bob@example.com\" {6+}\r\nsecret")
+}
+
+func TestSTARTTLS(t *testing.T) {
+	server := NewServer(Configuration{}, newTestStorage(t, firstEmail))
+	server.SetTLSConfig(smtp.GenerateSelfSignedTLS())
+	c := dial(t, startTestServer(t, server))
+
+	untagged := c.expectOK("CAPABILITY")
+	if !strings.Contains(untagged[0], "STARTTLS") {
+		t.Fatalf("STARTTLS not advertised: %q", untagged)
+	}
+	c.expectOK("STARTTLS")
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	c.expectOK("LOGIN bob@example.com secret")
+	untagged = c.expectOK("EXAMINE INBOX")
+	expectResponse(t, untagged, "* 1 EXISTS")
+}
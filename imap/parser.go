@@ -0,0 +1,243 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// field is a parsed command argument: an atom, a string (quoted or literal)
+// or a parenthesized list.
+type field struct {
+	value  string
+	quoted bool // string rather than atom (NIL is an atom)
+	list   []field
+	isList bool
+}
+
+func (f field) String() string {
+	if f.isList {
+		values := make([]string, 0, len(f.list))
+		for _, item := range f.list {
+			values = append(values, item.String())
+		}
+		return "(" + strings.Join(values, " ") + ")"
+	}
+	return f.value
+}
+
+// parseFields parses the arguments of a command. Literals are expected
+// inline as "{n}\r\n" followed by n bytes.
+func parseFields(data []byte) ([]field, error) {
+	p := &fieldParser{data: data}
+	fields, err := p.parseList(0)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+type fieldParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *fieldParser) parseList(closing byte) ([]field, error) {
+	var fields []field
+	for {
+		for p.pos < len(p.data) && (p.data[p.pos] == ' ' || p.data[p.pos] == '\r' || p.data[p.pos] == '\n') {
+			p.pos++
+		}
+		if p.pos >= len(p.data) {
+			if closing != 0 {
+				return nil, fmt.Errorf("missing %q", closing)
+			}
+			return fields, nil
+		}
+		c := p.data[p.pos]
+		switch {
+		case c == closing:
+			p.pos++
+			return fields, nil
+		case c == ')':
+			return nil, fmt.Errorf("unexpected ')'")
+		case c == '(':
+			p.pos++
+			list, err := p.parseList(')')
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{list: list, isList: true})
+		case c == '"':
+			value, err := p.parseQuoted()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{value: value, quoted: true})
+		case c == '{':
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{value: value, quoted: true})
+		default:
+			fields = append(fields, field{value: p.parseAtom()})
+		}
+	}
+}
+
+func (p *fieldParser) parseQuoted() (string, error) {
+	var sb strings.Builder
+	p.pos++ // opening quote
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.pos >= len(p.data) {
+				return "", fmt.Errorf("unterminated quoted string")
+			}
+			sb.WriteByte(p.data[p.pos])
+			p.pos++
+		case '"':
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string")
+}
+
+func (p *fieldParser) parseLiteral() (string, error) {
+	end := bytes.IndexByte(p.data[p.pos:], '}')
+	if end < 0 {
+		return "", fmt.Errorf("invalid literal")
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(string(p.data[p.pos+1:p.pos+end]), "+"))
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("invalid literal size")
+	}
+	p.pos += end + 1
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("\r\n")) {
+		return "", fmt.Errorf("literal must be followed by CRLF")
+	}
+	p.pos += 2
+	if p.pos+size > len(p.data) {
+		return "", fmt.Errorf("truncated literal")
+	}
+	value := string(p.data[p.pos : p.pos+size])
+	p.pos += size
+	return value, nil
+}
+
+// parseAtom reads an atom. Brackets are kept in the atom with their content,
+// so that fetch items such as BODY[HEADER.FIELDS (FROM)]<0.10> are one field.
+func (p *fieldParser) parseAtom() string {
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		} else if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '"' || c == '\r' || c == '\n') {
+			break
+		}
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// literalSize returns the size of the literal announced at the end of a
+// command line, and whether it is a non-synchronizing literal (LITERAL+).
+func literalSize(line string) (int, bool, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	start := strings.LastIndexByte(line, '{')
+	if start < 0 {
+		return 0, false, false
+	}
+	value := line[start+1 : len(line)-1]
+	nonSync := strings.HasSuffix(value, "+")
+	size, err := strconv.Atoi(strings.TrimSuffix(value, "+"))
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+	return size, nonSync, true
+}
+
+// seqRange is a range of a sequence set; 0 stands for "*".
+type seqRange struct {
+	start, stop uint32
+}
+
+type seqSet []seqRange
+
+func parseSeqNumber(value string) (uint32, error) {
+	if value == "*" {
+		return 0, nil
+	}
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", value)
+	}
+	return uint32(number), nil
+}
+
+func parseSeqSet(value string) (seqSet, error) {
+	if value == "" {
+		return nil, fmt.Errorf("empty sequence set")
+	}
+	var set seqSet
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, ":")
+		start, err := parseSeqNumber(first)
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if isRange {
+			if stop, err = parseSeqNumber(last); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start: start, stop: stop})
+	}
+	return set, nil
+}
+
+// contains returns true if the number is in the set, max being the value of "*".
+func (s seqSet) contains(number uint32, max uint32) bool {
+	for _, r := range s {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if number >= start && number <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+// isSeqSet returns true if the atom looks like a sequence set.
+func isSeqSet(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9') && c != '*' && c != ':' && c != ',' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	fields, err := parseFields([]byte(`1:* (UID BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>) "quoted \"string\"" {5}` + "\r\nhello NIL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 5 {
+		t.Fatalf("expected 5 fields, got %v", fields)
+	}
+	if fields[0].value != "1:*" {
+		t.Errorf("unexpected sequence set %q", fields[0].value)
+	}
+	if !fields[1].isList || len(fields[1].list) != 2 || fields[1].list[1].value != "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>" {
+		t.Errorf("unexpected list %v", fields[1])
+	}
+	if !fields[2].quoted || fields[2].value != `quoted "string"` {
+		t.Errorf("unexpected quoted string %q", fields[2].value)
+	}
+	if !fields[3].quoted || fields[3].value != "hello" {
+		t.Errorf("unexpected literal %q", fields[3].value)
+	}
+	if fields[4].quoted || fields[4].value != "NIL" {
+		t.Errorf("unexpected atom %v", fields[4])
+	}
+
+	for _, invalid := range []string{`(UID`, `UID)`, `"unterminated`, "{10}\r\nshort"} {
+		if _, err := parseFields([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1,3:4,10:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for number, expected := range map[uint32]bool{1: true, 2: false, 3: true, 4: true, 9: false, 10: true, 12: true} {
+		if set.contains(number, 12) != expected {
+			t.Errorf("contains(%d) should be %v", number, expected)
+		}
+	}
+	// "*:2" is the same range as "2:*"
+	set, _ = parseSeqSet("*:2")
+	if !set.contains(5, 5) || set.contains(1, 5) {
+		t.Errorf("unexpected reversed range")
+	}
+	for _, invalid := range []string{"", "0", "a", "1:b"} {
+		if _, err := parseSeqSet(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSection(t *testing.T) {
+	part := parseRawPart(toCRLF([]byte(secondEmail)), false)
+	for section, expected := range map[string]string{
+		"1":                          "hello world",
+		"1.MIME":                     "Content-Type: text/plain; charset=utf-8\r\n\r\n",
+		"2":                          "JVBERi0=",
+		"HEADER.FIELDS (SUBJECT TO)": "To: bob@example.com, carol@example.com\r\nSubject: second\r\n\r\n",
+	} {
+		data, err := part.section(section)
+		if err != nil {
+			t.Errorf("section %v: %v", section, err)
+			continue
+		}
+		if string(data) != expected {
+			t.Errorf("section %v: expected %q, got %q", section, expected, data)
+		}
+	}
+	if _, err := part.section("3"); err == nil {
+		t.Errorf("expected an error for a missing part")
+	}
+}
@@ -0,0 +1,402 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"mock-my-mta/storage"
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
+)
+
+// searchMessage is a message being evaluated by SEARCH.
+type searchMessage struct {
+	seq     int
+	message mailboxMessage
+	info    *messageInfo
+	mp      *multipart.Multipart // parsed on first use
+	err     error
+}
+
+// searchKey is a node of the SEARCH criteria.
+type searchKey func(c *session, m *searchMessage) bool
+
+// searchParser turns the SEARCH arguments into a tree of keys.
+// The keys that all the results must match are also translated into terms of
+// a storage query when pushdown is set, so that the layers can use their indexes.
+type searchParser struct {
+	fields   []field
+	pos      int
+	pushdown bool
+	terms    []string
+}
+
+// parseNested parses a key under NOT or OR, which cannot be pushed down.
+func (p *searchParser) parseNested() (searchKey, error) {
+	pushdown := p.pushdown
+	p.pushdown = false
+	defer func() { p.pushdown = pushdown }()
+	return p.parseKey()
+}
+
+// isAddress returns true if the value is a bare email address.
+func isAddress(value string) bool {
+	address, err := mail.ParseAddress(value)
+	return err == nil && address.Name == "" && address.Address == value
+}
+
+func matchAll(c *session, m *searchMessage) bool { return true }
+
+func (p *searchParser) next() (field, error) {
+	if p.pos >= len(p.fields) {
+		return field{}, fmt.Errorf("missing search argument")
+	}
+	f := p.fields[p.pos]
+	p.pos++
+	return f, nil
+}
+
+func (p *searchParser) nextString() (string, error) {
+	f, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if f.isList {
+		return "", fmt.Errorf("expected a string, got %v", f)
+	}
+	return f.value, nil
+}
+
+func (p *searchParser) nextDate() (time.Time, error) {
+	value, err := p.nextString()
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := time.Parse("2-Jan-2006", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return date, nil
+}
+
+func (p *searchParser) nextNumber() (int, error) {
+	value, err := p.nextString()
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return number, nil
+}
+
+// parseAll parses the remaining keys, which must all match.
+func (p *searchParser) parseAll() (searchKey, error) {
+	var keys []searchKey
+	for p.pos < len(p.fields) {
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return allKeys(keys), nil
+}
+
+func allKeys(keys []searchKey) searchKey {
+	return func(c *session, m *searchMessage) bool {
+		for _, key := range keys {
+			if !key(c, m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (p *searchParser) parseKey() (searchKey, error) {
+	f, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if f.isList {
+		sub := &searchParser{fields: f.list, pushdown: p.pushdown}
+		key, err := sub.parseAll()
+		p.terms = append(p.terms, sub.terms...)
+		return key, err
+	}
+	if !f.quoted && isSeqSet(f.value) {
+		set, err := parseSeqSet(f.value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *session, m *searchMessage) bool {
+			return set.contains(uint32(m.seq), uint32(len(c.selected.messages)))
+		}, nil
+	}
+
+	name := strings.ToUpper(f.value)
+	switch name {
+	case "ALL", "OLD":
+		// no message is recent: the server does not keep sessions across connections
+		return matchAll, nil
+	case "NEW", "RECENT":
+		return func(c *session, m *searchMessage) bool { return false }, nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		return flagKey(`\`+name[:1]+strings.ToLower(name[1:]), true), nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return flagKey(`\`+name[2:3]+strings.ToLower(name[3:]), false), nil
+	case "KEYWORD", "UNKEYWORD":
+		keyword, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		return flagKey(keyword, name == "KEYWORD"), nil
+	case "NOT":
+		key, err := p.parseNested()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *session, m *searchMessage) bool { return !key(c, m) }, nil
+	case "OR":
+		left, err := p.parseNested()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.parseNested()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *session, m *searchMessage) bool { return left(c, m) || right(c, m) }, nil
+	case "UID":
+		value, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *session, m *searchMessage) bool {
+			messages := c.selected.messages
+			return set.contains(m.message.uid, messages[len(messages)-1].uid)
+		}, nil
+	case "LARGER", "SMALLER":
+		size, err := p.nextNumber()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *session, m *searchMessage) bool {
+			if name == "LARGER" {
+				return m.info.size > size
+			}
+			return m.info.size < size
+		}, nil
+	case "BEFORE", "SENTBEFORE", "SINCE", "SENTSINCE", "ON", "SENTON":
+		date, err := p.nextDate()
+		if err != nil {
+			return nil, err
+		}
+		return dateKey(strings.TrimPrefix(name, "SENT"), date)
+	case "SUBJECT":
+		value, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		if p.pushdown && value != "" {
+			// subject: is the same case-insensitive substring match
+			p.terms = append(p.terms, "subject:"+matcher.QuoteValue(value))
+			return matchAll, nil
+		}
+		return textKey(func(mp *multipart.Multipart) []string {
+			return []string{mp.GetSubject()}
+		}, value), nil
+	case "BODY", "TEXT":
+		value, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		return textKey(func(mp *multipart.Multipart) []string {
+			var texts []string
+			for _, bodyVersion := range mp.GetBodyVersions() {
+				if body, err := mp.GetBody(bodyVersion); err == nil {
+					texts = append(texts, body)
+				}
+			}
+			if name == "TEXT" {
+				for _, values := range mp.GetAllHeaders() {
+					texts = append(texts, values...)
+				}
+			}
+			return texts
+		}, value), nil
+	case "FROM", "TO", "CC", "BCC":
+		value, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		if p.pushdown && name != "BCC" && isAddress(value) {
+			if name == "FROM" {
+				// a full address is the address of the sender
+				p.terms = append(p.terms, "from:"+matcher.QuoteValue(value))
+				return matchAll, nil
+			}
+			// mailbox: matches To and Cc together: the field is still checked
+			p.terms = append(p.terms, "mailbox:"+matcher.QuoteValue(value))
+		}
+		return headerKey(name, value), nil
+	case "HEADER":
+		header, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.nextString()
+		if err != nil {
+			return nil, err
+		}
+		return headerKey(header, value), nil
+	}
+	return nil, fmt.Errorf("unknown search key %v", f.value)
+}
+
+func flagKey(flag string, set bool) searchKey {
+	return func(c *session, m *searchMessage) bool {
+		return c.server.flags.HasFlag(m.message.id, flag) == set
+	}
+}
+
+// dateKey matches the date of the emails with the date matchers of the web UI search.
+// IMAP dates are days: BEFORE is before the day, SINCE is the day or later;
+// after:D being strictly after D 00:00, the midnight itself is checked apart.
+func dateKey(name string, date time.Time) (searchKey, error) {
+	const layout = "2006-01-02"
+	var query string
+	switch name {
+	case "BEFORE":
+		query = "before:" + date.Format(layout)
+	case "SINCE":
+		query = "after:" + date.Format(layout)
+	case "ON":
+		query = "after:" + date.Format(layout) + " before:" + date.AddDate(0, 0, 1).Format(layout)
+	}
+	matchers, err := matcher.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *session, m *searchMessage) bool {
+		mp := m.parsed(c)
+		return mp != nil && (mp.MatchAll(matchers) || (name != "BEFORE" && mp.GetDate().Equal(date)))
+	}, nil
+}
+
+// textKey matches a case-insensitive substring of the texts of the email.
+func textKey(texts func(mp *multipart.Multipart) []string, value string) searchKey {
+	value = strings.ToLower(value)
+	return func(c *session, m *searchMessage) bool {
+		mp := m.parsed(c)
+		if mp == nil {
+			return false
+		}
+		for _, text := range texts(mp) {
+			if strings.Contains(strings.ToLower(text), value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// headerKey matches a case-insensitive substring of the decoded header field.
+// An empty value matches all the emails having the field.
+func headerKey(name, value string) searchKey {
+	return textKey(func(mp *multipart.Multipart) []string {
+		for key, values := range mp.GetAllHeaders() {
+			if strings.EqualFold(key, name) {
+				return values
+			}
+		}
+		return nil
+	}, value)
+}
+
+// parsed returns the parsed email, nil if it cannot be read.
+func (m *searchMessage) parsed(c *session) *multipart.Multipart {
+	if m.mp != nil || m.err != nil {
+		return m.mp
+	}
+	raw, err := c.server.store.GetRawEmail(m.message.id)
+	if err != nil {
+		m.err = err
+		return nil
+	}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		m.err = err
+		return nil
+	}
+	m.mp = mp
+	return mp
+}
+
+func (c *session) search(tag string, fields []field, isUID bool) error {
+	if len(fields) >= 2 && !fields[0].isList && strings.EqualFold(fields[0].value, "CHARSET") {
+		charset := strings.ToUpper(fields[1].value)
+		if charset != "UTF-8" && charset != "US-ASCII" {
+			return c.writeLine("%s NO [BADCHARSET (UTF-8 US-ASCII)] unsupported charset %v", tag, fields[1].value)
+		}
+		fields = fields[2:]
+	}
+	if len(fields) == 0 {
+		return c.writeLine("%s BAD usage: SEARCH criteria", tag)
+	}
+	parser := &searchParser{fields: fields, pushdown: true}
+	key, err := parser.parseAll()
+	if err != nil {
+		return c.writeLine("%s BAD %v", tag, err)
+	}
+	var candidates map[string]bool
+	if len(parser.terms) > 0 {
+		query := "mailbox:" + matcher.QuoteValue(c.mailbox) + " " + strings.Join(parser.terms, " ")
+		emailHeaders, _, err := storage.SearchEmailsContext(context.Background(), c.server.store, query, 1, -1)
+		if err != nil {
+			return c.writeLine("%s NO %v", tag, err)
+		}
+		candidates = make(map[string]bool, len(emailHeaders))
+		for _, emailHeader := range emailHeaders {
+			candidates[emailHeader.ID] = true
+		}
+	}
+
+	var results []string
+	for i, message := range c.selected.messages {
+		if candidates != nil && !candidates[message.id] {
+			continue
+		}
+		info, err := c.server.getMessageInfo(message.id)
+		if err != nil {
+			// deleted in the meantime, reported by the next rescan
+			continue
+		}
+		if !key(c, &searchMessage{seq: i + 1, message: message, info: info}) {
+			continue
+		}
+		if isUID {
+			results = append(results, strconv.FormatUint(uint64(message.uid), 10))
+		} else {
+			results = append(results, strconv.Itoa(i+1))
+		}
+	}
+	if len(results) == 0 {
+		if err := c.writeLine("* SEARCH"); err != nil {
+			return err
+		}
+	} else if err := c.writeLine("* SEARCH %v", strings.Join(results, " ")); err != nil {
+		return err
+	}
+	return c.writeLine("%s OK SEARCH completed", tag)
+}
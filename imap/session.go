@@ -0,0 +1,723 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"mock-my-mta/log"
+	"mock-my-mta/sieve"
+	"mock-my-mta/storage"
+	"mock-my-mta/storage/multipart"
+)
+
+const (
+	// idleTimeout is the autologout timer of RFC 3501 (at least 30 minutes).
+	idleTimeout = 30 * time.Minute
+	// maxLiteralSize bounds the literals sent by clients (commands only, no APPEND).
+	maxLiteralSize = 1 << 20
+	// hierarchyDelimiter separates the levels of mailbox names.
+	hierarchyDelimiter = "/"
+	inboxName          = "INBOX"
+)
+
+// systemFlags are the flags that can be stored, in addition to keywords.
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, storage.FlagSeen, `\Draft`}
+
+type sessionState int
+
+const (
+	stateNotAuthenticated sessionState = iota
+	stateAuthenticated
+	stateSelected
+)
+
+type selectedMailbox struct {
+	name     string
+	folder   string
+	readOnly bool
+	messages []mailboxMessage
+	uidNext  uint32
+	flags    map[string]string // email ID → flags last reported to the client
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	tls    bool
+
+	state    sessionState
+	mailbox  string
+	selected *selectedMailbox
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	return &session{
+		server: server,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// errLogout ends the session after the reply has been sent.
+var errLogout = errors.New("logout")
+
+func (c *session) serve() {
+	defer c.conn.Close()
+	log.Logf(log.DEBUG, "imap: new connection from %v", c.conn.RemoteAddr())
+	c.writeLine("* OK [CAPABILITY %v] MockMyMTA IMAP4rev1 server ready", c.capabilities())
+	for {
+		command, err := c.readCommand()
+		if err != nil {
+			log.Logf(log.DEBUG, "imap: connection from %v closed: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+		if err := c.handle(command); err != nil {
+			if err != errLogout {
+				log.Logf(log.ERROR, "imap: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *session) readLine() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readCommand reads a command line with its literals.
+func (c *session) readCommand() ([]byte, error) {
+	var command bytes.Buffer
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		command.WriteString(line)
+		size, nonSync, ok := literalSize(line)
+		if !ok {
+			return command.Bytes(), nil
+		}
+		if size > maxLiteralSize {
+			c.writeLine("* BAD literal too big")
+			return nil, fmt.Errorf("literal of %d bytes is too big", size)
+		}
+		if !nonSync {
+			if err := c.writeLine("+ Ready for literal data"); err != nil {
+				return nil, err
+			}
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, literal); err != nil {
+			return nil, err
+		}
+		command.WriteString("\r\n")
+		command.Write(literal)
+	}
+}
+
+func (c *session) write(data []byte) error {
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *session) writeLine(format string, args ...interface{}) error {
+	return c.write([]byte(fmt.Sprintf(format, args...) + "\r\n"))
+}
+
+func (c *session) capabilities() string {
+	capabilities := "IMAP4rev1 LITERAL+ IDLE UNSELECT AUTH=PLAIN"
+	if c.server.tlsConfig != nil && !c.tls && c.state == stateNotAuthenticated {
+		capabilities += " STARTTLS"
+	}
+	return capabilities
+}
+
+func (c *session) handle(command []byte) error {
+	tag, rest, _ := bytes.Cut(command, []byte(" "))
+	name, arguments, _ := bytes.Cut(rest, []byte(" "))
+	commandName := strings.ToUpper(string(name))
+	if len(tag) == 0 || commandName == "" {
+		return c.writeLine("* BAD missing command")
+	}
+	isUID := false
+	if commandName == "UID" {
+		isUID = true
+		name, arguments, _ = bytes.Cut(arguments, []byte(" "))
+		commandName = strings.ToUpper(string(name))
+	}
+	if commandName == "LOGIN" || commandName == "AUTHENTICATE" {
+		log.Logf(log.DEBUG, "imap: received %s %s ****", tag, commandName)
+	} else {
+		log.Logf(log.DEBUG, "imap: received %s", command)
+	}
+	fields, err := parseFields(arguments)
+	if err != nil {
+		return c.writeLine("%s BAD %v", tag, err)
+	}
+	t := string(tag)
+
+	// commands valid in any state
+	switch commandName {
+	case "CAPABILITY":
+		c.writeLine("* CAPABILITY %v", c.capabilities())
+		return c.writeLine("%s OK CAPABILITY completed", t)
+	case "NOOP", "CHECK":
+		if err := c.rescan(); err != nil {
+			return err
+		}
+		return c.writeLine("%s OK %v completed", t, commandName)
+	case "LOGOUT":
+		c.writeLine("* BYE MockMyMTA IMAP4rev1 server logging out")
+		c.writeLine("%s OK LOGOUT completed", t)
+		return errLogout
+	}
+
+	if c.state == stateNotAuthenticated {
+		switch commandName {
+		case "STARTTLS":
+			return c.startTLS(t)
+		case "LOGIN":
+			return c.login(t, fields)
+		case "AUTHENTICATE":
+			return c.authenticate(t, fields)
+		}
+		return c.writeLine("%s BAD command unknown or not allowed before authentication", t)
+	}
+
+	switch commandName {
+	case "SELECT", "EXAMINE":
+		return c.selectMailbox(t, fields, commandName == "EXAMINE")
+	case "LIST", "LSUB":
+		return c.list(t, commandName, fields)
+	case "STATUS":
+		return c.status(t, fields)
+	case "CREATE":
+		return c.create(t, fields)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		return c.writeLine("%s OK %v completed", t, commandName)
+	case "DELETE", "RENAME":
+		return c.writeLine("%s NO [CANNOT] folders cannot be removed or renamed", t)
+	case "APPEND":
+		return c.writeLine("%s NO [CANNOT] emails can only be delivered through SMTP", t)
+	case "IDLE":
+		return c.idle(t)
+	}
+
+	if c.state != stateSelected {
+		return c.writeLine("%s BAD command unknown or not allowed without selected mailbox", t)
+	}
+	switch commandName {
+	case "FETCH":
+		return c.fetch(t, fields, isUID)
+	case "STORE":
+		return c.store(t, fields, isUID)
+	case "SEARCH":
+		return c.search(t, fields, isUID)
+	case "EXPUNGE":
+		if c.selected.readOnly {
+			return c.writeLine("%s NO mailbox is read-only", t)
+		}
+		if err := c.expunge(true); err != nil {
+			return err
+		}
+		return c.writeLine("%s OK EXPUNGE completed", t)
+	case "CLOSE":
+		if !c.selected.readOnly {
+			if err := c.expunge(false); err != nil {
+				return err
+			}
+		}
+		c.unselect()
+		return c.writeLine("%s OK CLOSE completed", t)
+	case "UNSELECT":
+		c.unselect()
+		return c.writeLine("%s OK UNSELECT completed", t)
+	case "COPY", "MOVE":
+		return c.writeLine("%s NO [CANNOT] emails cannot be copied between folders", t)
+	}
+	return c.writeLine("%s BAD unknown command %v", t, commandName)
+}
+
+func (c *session) startTLS(tag string) error {
+	if c.server.tlsConfig == nil || c.tls {
+		return c.writeLine("%s BAD STARTTLS not available", tag)
+	}
+	if err := c.writeLine("%s OK begin TLS negotiation now", tag); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(c.conn, c.server.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.writer = bufio.NewWriter(tlsConn)
+	c.tls = true
+	return nil
+}
+
+func (c *session) login(tag string, fields []field) error {
+	if len(fields) != 2 || fields[0].isList || fields[1].isList {
+		return c.writeLine("%s BAD usage: LOGIN user password", tag)
+	}
+	return c.open(tag, fields[0].value, fields[1].value)
+}
+
+func (c *session) authenticate(tag string, fields []field) error {
+	if len(fields) == 0 || !strings.EqualFold(fields[0].value, "PLAIN") {
+		return c.writeLine("%s NO unsupported authentication mechanism", tag)
+	}
+	var response string
+	if len(fields) > 1 {
+		response = fields[1].value
+	} else {
+		if err := c.writeLine("+ "); err != nil {
+			return err
+		}
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		response = line
+	}
+	if response == "*" {
+		return c.writeLine("%s BAD authentication canceled", tag)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return c.writeLine("%s BAD invalid base64 response", tag)
+	}
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		return c.writeLine("%s BAD invalid PLAIN response", tag)
+	}
+	return c.open(tag, parts[1], parts[2])
+}
+
+// open checks the credentials and opens the mailbox of the user.
+func (c *session) open(tag, username, password string) error {
+	if c.server.checkPassword != nil && !c.server.checkPassword(username, password) {
+		log.Logf(log.INFO, "imap: authentication failed for %v", username)
+		return c.writeLine("%s NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+	}
+	mailbox, err := c.server.findMailbox(username)
+	if err != nil {
+		return c.writeLine("%s NO [UNAVAILABLE] cannot get mailboxes: %v", tag, err)
+	}
+	c.mailbox = mailbox
+	c.state = stateAuthenticated
+	log.Logf(log.INFO, "imap: %v logged in as %v", c.conn.RemoteAddr(), mailbox)
+	return c.writeLine("%s OK [CAPABILITY %v] logged in", tag, c.capabilities())
+}
+
+// mailboxNames returns the IMAP names of the folders of the user.
+func (c *session) mailboxNames() []string {
+	names := []string{inboxName}
+	for _, folder := range c.server.getFolders(c.mailbox) {
+		if !strings.EqualFold(folder, multipart.DefaultFolder) {
+			names = append(names, folder)
+		}
+	}
+	return names
+}
+
+// resolveFolder returns the folder of an IMAP mailbox name.
+func (c *session) resolveFolder(name string) (string, string, bool) {
+	if strings.EqualFold(name, inboxName) {
+		return multipart.DefaultFolder, inboxName, true
+	}
+	for _, folder := range c.server.getFolders(c.mailbox) {
+		if strings.EqualFold(folder, name) && !strings.EqualFold(folder, multipart.DefaultFolder) {
+			return folder, folder, true
+		}
+	}
+	return "", "", false
+}
+
+func (c *session) selectMailbox(tag string, fields []field, readOnly bool) error {
+	c.unselect()
+	if len(fields) != 1 || fields[0].isList {
+		return c.writeLine("%s BAD usage: SELECT mailbox", tag)
+	}
+	folder, name, found := c.resolveFolder(fields[0].value)
+	if !found {
+		return c.writeLine("%s NO [NONEXISTENT] no such mailbox", tag)
+	}
+	messages, uidNext, err := c.server.getMessages(c.mailbox, folder)
+	if err != nil {
+		return c.writeLine("%s NO [UNAVAILABLE] cannot open mailbox: %v", tag, err)
+	}
+	selected := &selectedMailbox{
+		name:     name,
+		folder:   folder,
+		readOnly: readOnly,
+		messages: messages,
+		uidNext:  uidNext,
+		flags:    make(map[string]string),
+	}
+	firstUnseen := 0
+	for i, message := range messages {
+		selected.flags[message.id] = c.flagList(message.id)
+		if firstUnseen == 0 && !c.server.flags.IsRead(message.id) {
+			firstUnseen = i + 1
+		}
+	}
+	c.selected = selected
+	c.state = stateSelected
+
+	c.writeLine(`* FLAGS (%v)`, strings.Join(systemFlags, " "))
+	c.writeLine("* %d EXISTS", len(messages))
+	c.writeLine("* 0 RECENT")
+	if firstUnseen > 0 {
+		c.writeLine("* OK [UNSEEN %d] first unseen message", firstUnseen)
+	}
+	c.writeLine("* OK [UIDVALIDITY %d] UIDs valid", c.server.uidValidity)
+	c.writeLine("* OK [UIDNEXT %d] predicted next UID", uidNext)
+	if readOnly {
+		c.writeLine("* OK [PERMANENTFLAGS ()] no permanent flags permitted")
+		return c.writeLine("%s OK [READ-ONLY] EXAMINE completed", tag)
+	}
+	c.writeLine(`* OK [PERMANENTFLAGS (%v \*)] flags permitted`, strings.Join(systemFlags, " "))
+	return c.writeLine("%s OK [READ-WRITE] SELECT completed", tag)
+}
+
+func (c *session) unselect() {
+	c.selected = nil
+	if c.state == stateSelected {
+		c.state = stateAuthenticated
+	}
+}
+
+// listPattern converts a LIST pattern to a regular expression.
+func listPattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?i)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '%':
+			sb.WriteString("[^" + regexp.QuoteMeta(hierarchyDelimiter) + "]*")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func (c *session) list(tag, command string, fields []field) error {
+	if len(fields) != 2 {
+		return c.writeLine("%s BAD usage: %v reference pattern", tag, command)
+	}
+	reference, pattern := fields[0].value, fields[1].value
+	if pattern == "" {
+		c.writeLine(`* %v (\Noselect) "%v" ""`, command, hierarchyDelimiter)
+		return c.writeLine("%s OK %v completed", tag, command)
+	}
+	matcher := listPattern(reference + pattern)
+	for _, name := range c.mailboxNames() {
+		if !matcher.MatchString(name) {
+			continue
+		}
+		attributes := `\HasNoChildren`
+		if strings.EqualFold(name, sieve.FolderSpam) {
+			attributes += ` \Junk`
+		}
+		c.writeLine(`* %v (%v) "%v" %v`, command, attributes, hierarchyDelimiter, quote(name))
+	}
+	return c.writeLine("%s OK %v completed", tag, command)
+}
+
+func (c *session) status(tag string, fields []field) error {
+	if len(fields) != 2 || !fields[1].isList {
+		return c.writeLine("%s BAD usage: STATUS mailbox (items)", tag)
+	}
+	folder, name, found := c.resolveFolder(fields[0].value)
+	if !found {
+		return c.writeLine("%s NO [NONEXISTENT] no such mailbox", tag)
+	}
+	messages, uidNext, err := c.server.getMessages(c.mailbox, folder)
+	if err != nil {
+		return c.writeLine("%s NO [UNAVAILABLE] cannot open mailbox: %v", tag, err)
+	}
+	var items []string
+	for _, item := range fields[1].list {
+		switch strings.ToUpper(item.value) {
+		case "MESSAGES":
+			items = append(items, fmt.Sprintf("MESSAGES %d", len(messages)))
+		case "RECENT":
+			items = append(items, "RECENT 0")
+		case "UIDNEXT":
+			items = append(items, fmt.Sprintf("UIDNEXT %d", uidNext))
+		case "UIDVALIDITY":
+			items = append(items, fmt.Sprintf("UIDVALIDITY %d", c.server.uidValidity))
+		case "UNSEEN":
+			unseen := 0
+			for _, message := range messages {
+				if !c.server.flags.IsRead(message.id) {
+					unseen++
+				}
+			}
+			items = append(items, fmt.Sprintf("UNSEEN %d", unseen))
+		default:
+			return c.writeLine("%s BAD unknown status item %v", tag, item.value)
+		}
+	}
+	c.writeLine("* STATUS %v (%v)", quote(name), strings.Join(items, " "))
+	return c.writeLine("%s OK STATUS completed", tag)
+}
+
+func (c *session) create(tag string, fields []field) error {
+	if len(fields) != 1 || fields[0].isList {
+		return c.writeLine("%s BAD usage: CREATE mailbox", tag)
+	}
+	name := strings.TrimSuffix(fields[0].value, hierarchyDelimiter)
+	if c.server.sieveStore == nil || strings.EqualFold(name, inboxName) {
+		return c.writeLine("%s NO [CANNOT] cannot create mailbox", tag)
+	}
+	if err := c.server.sieveStore.CreateFolder(c.mailbox, name); err != nil {
+		return c.writeLine("%s NO [CANNOT] %v", tag, err)
+	}
+	return c.writeLine("%s OK CREATE completed", tag)
+}
+
+// flagList returns the flags of an email formatted as an IMAP list.
+func (c *session) flagList(emailID string) string {
+	return "(" + strings.Join(c.server.flags.GetFlags(emailID), " ") + ")"
+}
+
+// rescan reports the changes of the selected mailbox: expunged emails,
+// new emails and flags changed by other clients (or the web UI).
+func (c *session) rescan() error {
+	if c.selected == nil {
+		return nil
+	}
+	messages, uidNext, err := c.server.getMessages(c.mailbox, c.selected.folder)
+	if err != nil {
+		return c.writeLine("* NO [UNAVAILABLE] cannot scan mailbox: %v", err)
+	}
+	present := make(map[string]bool, len(messages))
+	for _, message := range messages {
+		present[message.id] = true
+	}
+	known := make(map[string]bool, len(c.selected.messages))
+	for i := len(c.selected.messages) - 1; i >= 0; i-- {
+		id := c.selected.messages[i].id
+		known[id] = true
+		if present[id] {
+			continue
+		}
+		c.selected.messages = append(c.selected.messages[:i], c.selected.messages[i+1:]...)
+		delete(c.selected.flags, id)
+		if err := c.writeLine("* %d EXPUNGE", i+1); err != nil {
+			return err
+		}
+	}
+	added := false
+	for _, message := range messages {
+		if !known[message.id] {
+			c.selected.messages = append(c.selected.messages, message)
+			c.selected.flags[message.id] = c.flagList(message.id)
+			added = true
+		}
+	}
+	sort.Slice(c.selected.messages, func(i, j int) bool {
+		return c.selected.messages[i].uid < c.selected.messages[j].uid
+	})
+	c.selected.uidNext = uidNext
+	if added {
+		if err := c.writeLine("* %d EXISTS", len(c.selected.messages)); err != nil {
+			return err
+		}
+	}
+	for i, message := range c.selected.messages {
+		flags := c.flagList(message.id)
+		if c.selected.flags[message.id] != flags {
+			c.selected.flags[message.id] = flags
+			if err := c.writeLine("* %d FETCH (FLAGS %v)", i+1, flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expunge removes the emails flagged \Deleted from the storage.
+func (c *session) expunge(report bool) error {
+	for i := len(c.selected.messages) - 1; i >= 0; i-- {
+		message := c.selected.messages[i]
+		if !c.server.flags.HasFlag(message.id, `\Deleted`) {
+			continue
+		}
+		if err := c.server.deleteEmail(message.id); err != nil {
+			log.Logf(log.ERROR, "imap: cannot delete email %v: %v", message.id, err)
+			continue
+		}
+		log.Logf(log.INFO, "imap: expunged email %v from mailbox %v", message.id, c.mailbox)
+		c.selected.messages = append(c.selected.messages[:i], c.selected.messages[i+1:]...)
+		delete(c.selected.flags, message.id)
+		if report {
+			if err := c.writeLine("* %d EXPUNGE", i+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *session) idle(tag string) error {
+	notifications := c.server.subscribe()
+	defer c.server.unsubscribe(notifications)
+	if err := c.writeLine("+ idling"); err != nil {
+		return err
+	}
+	type lineResult struct {
+		line string
+		err  error
+	}
+	lines := make(chan lineResult, 1)
+	go func() {
+		line, err := c.readLine()
+		lines <- lineResult{line, err}
+	}()
+	for {
+		select {
+		case <-notifications:
+			if err := c.rescan(); err != nil {
+				return err
+			}
+		case result := <-lines:
+			if result.err != nil {
+				return result.err
+			}
+			if !strings.EqualFold(result.line, "DONE") {
+				return c.writeLine("%s BAD expected DONE", tag)
+			}
+			return c.writeLine("%s OK IDLE terminated", tag)
+		}
+	}
+}
+
+// forEachMessage calls fn for the messages of the selected mailbox in the sequence (or UID) set.
+func (c *session) forEachMessage(set seqSet, isUID bool, fn func(seq int, message mailboxMessage) error) error {
+	messages := c.selected.messages
+	var maxUID uint32
+	if len(messages) > 0 {
+		maxUID = messages[len(messages)-1].uid
+	}
+	for i, message := range messages {
+		if isUID {
+			if !set.contains(message.uid, maxUID) {
+				continue
+			}
+		} else if !set.contains(uint32(i+1), uint32(len(messages))) {
+			continue
+		}
+		if err := fn(i+1, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *session) store(tag string, fields []field, isUID bool) error {
+	if len(fields) < 3 {
+		return c.writeLine("%s BAD usage: STORE set item flags", tag)
+	}
+	if c.selected.readOnly {
+		return c.writeLine("%s NO mailbox is read-only", tag)
+	}
+	set, err := parseSeqSet(fields[0].value)
+	if err != nil {
+		return c.writeLine("%s BAD %v", tag, err)
+	}
+	item := strings.ToUpper(fields[1].value)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return c.writeLine("%s BAD unknown store item %v", tag, fields[1].value)
+	}
+	var flags []string
+	for _, f := range fields[2:] {
+		if f.isList {
+			for _, flag := range f.list {
+				flags = append(flags, flag.value)
+			}
+		} else {
+			flags = append(flags, f.value)
+		}
+	}
+	// \Recent cannot be stored
+	storable := flags[:0]
+	for _, flag := range flags {
+		if !strings.EqualFold(flag, `\Recent`) {
+			storable = append(storable, flag)
+		}
+	}
+	flags = storable
+
+	err = c.forEachMessage(set, isUID, func(seq int, message mailboxMessage) error {
+		switch item {
+		case "FLAGS":
+			c.server.flags.SetFlags(message.id, flags...)
+		case "+FLAGS":
+			c.server.flags.AddFlags(message.id, flags...)
+		case "-FLAGS":
+			c.server.flags.RemoveFlags(message.id, flags...)
+		}
+		flagList := c.flagList(message.id)
+		c.selected.flags[message.id] = flagList
+		if silent {
+			return nil
+		}
+		if isUID {
+			return c.writeLine("* %d FETCH (UID %d FLAGS %v)", seq, message.uid, flagList)
+		}
+		return c.writeLine("* %d FETCH (FLAGS %v)", seq, flagList)
+	})
+	if err != nil {
+		return err
+	}
+	return c.writeLine("%s OK STORE completed", tag)
+}
+
+// quote formats a string as an IMAP quoted string, or as a literal if needed.
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || s[i] == '\r' || s[i] == '\n' || s[i] == 0 {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// nstring formats a string, NIL if empty.
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
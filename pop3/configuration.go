@@ -0,0 +1,5 @@
+package pop3
+
+type Configuration struct {
+	Addr string `json:"addr"` // empty = POP3 server disabled
+}
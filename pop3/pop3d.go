@@ -0,0 +1,593 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+	"mock-my-mta/storage"
+	"mock-my-mta/storage/matcher"
+)
+
+// idleTimeout is the autologout timer of RFC 1939 (at least 10 minutes).
+const idleTimeout = 10 * time.Minute
+
+// Server is a POP3 server (RFC 1939) exposing the mailboxes of the storage.
+// Each mailbox is the set of emails sent to a recipient address.
+type Server struct {
+	configuration Configuration
+	store         storage.Storage
+
+	tlsConfig *tls.Config // enables STLS when set
+
+	mu          sync.Mutex
+	listener    net.Listener
+	connections map[net.Conn]struct{}
+	closed      bool
+}
+
+// SetTLSConfig enables the STLS command with the given TLS configuration.
+func (s *Server) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+}
+
+func NewServer(config Configuration, store storage.Storage) *Server {
+	return &Server{
+		configuration: config,
+		store:         store,
+		connections:   make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	log.Logf(log.INFO, "starting pop3 server on %v", s.configuration.Addr)
+	listener, err := net.Listen("tcp", s.configuration.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.connections[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			newSession(s, conn).serve()
+			s.mu.Lock()
+			delete(s.connections, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) Shutdown() error {
+	log.Logf(log.INFO, "stopping pop3 server...")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.connections {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+type sessionState int
+
+const (
+	stateAuthorization sessionState = iota
+	stateTransaction
+)
+
+type message struct {
+	id      string
+	size    int // octets on the wire, -1 until measured
+	deleted bool
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	state    sessionState
+	tls      bool
+	username string
+	mailbox  string
+	messages []message
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	return &session{
+		server: server,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// errQuit ends the session after the reply has been sent.
+var errQuit = errors.New("quit")
+
+func (c *session) serve() {
+	defer c.conn.Close()
+	log.Logf(log.DEBUG, "pop3: new connection from %v", c.conn.RemoteAddr())
+	c.reply(true, "MockMyMTA POP3 server ready")
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			log.Logf(log.DEBUG, "pop3: connection from %v closed: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+		command, argument, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		command = strings.ToUpper(command)
+		if command == "PASS" {
+			log.Logf(log.DEBUG, "pop3: received PASS ****")
+		} else {
+			log.Logf(log.DEBUG, "pop3: received %v %v", command, argument)
+		}
+		if err := c.handle(command, argument); err != nil {
+			if err != errQuit {
+				log.Logf(log.ERROR, "pop3: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *session) handle(command, argument string) error {
+	switch command {
+	case "CAPA":
+		return c.capa()
+	case "QUIT":
+		return c.quit()
+	case "NOOP":
+		if c.state != stateTransaction {
+			return c.reply(false, "not authenticated")
+		}
+		return c.reply(true, "")
+	}
+	if c.state == stateAuthorization {
+		switch command {
+		case "STLS":
+			return c.stls()
+		case "USER":
+			return c.user(argument)
+		case "PASS":
+			return c.pass(argument)
+		}
+		return c.reply(false, "unknown command or not authenticated")
+	}
+	switch command {
+	case "STAT":
+		return c.stat()
+	case "LIST":
+		return c.list(argument)
+	case "UIDL":
+		return c.uidl(argument)
+	case "RETR":
+		return c.retr(argument)
+	case "TOP":
+		return c.top(argument)
+	case "DELE":
+		return c.dele(argument)
+	case "RSET":
+		return c.rset()
+	}
+	return c.reply(false, "unknown command")
+}
+
+func (c *session) reply(ok bool, text string) error {
+	status := "+OK"
+	if !ok {
+		status = "-ERR"
+	}
+	if text != "" {
+		status += " " + text
+	}
+	if _, err := c.writer.WriteString(status + "\r\n"); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// writeLines sends a multi-line response body, dot-stuffed and terminated by ".".
+func (c *session) writeLines(lines []string) error {
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		if _, err := c.writer.WriteString(line + "\r\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := c.writer.WriteString(".\r\n"); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *session) capa() error {
+	capabilities := []string{"TOP", "UIDL", "USER", "RESP-CODES", "PIPELINING", "IMPLEMENTATION MockMyMTA"}
+	if c.server.tlsConfig != nil && !c.tls && c.state == stateAuthorization {
+		capabilities = append(capabilities, "STLS")
+	}
+	if err := c.reply(true, "capability list follows"); err != nil {
+		return err
+	}
+	return c.writeLines(capabilities)
+}
+
+func (c *session) stls() error {
+	if c.server.tlsConfig == nil {
+		return c.reply(false, "STLS not available")
+	}
+	if c.tls {
+		return c.reply(false, "TLS already active")
+	}
+	if err := c.reply(true, "begin TLS negotiation"); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(c.conn, c.server.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.writer = bufio.NewWriter(tlsConn)
+	c.tls = true
+	c.username = ""
+	return nil
+}
+
+func (c *session) user(argument string) error {
+	if argument == "" {
+		return c.reply(false, "missing mailbox name")
+	}
+	c.username = argument
+	return c.reply(true, "send password for "+argument)
+}
+
+func (c *session) pass(argument string) error {
+	if c.username == "" {
+		return c.reply(false, "USER first")
+	}
+	// any password is accepted, like SMTP AUTH
+	username := c.username
+	c.username = ""
+	mailbox, err := c.server.findMailbox(username)
+	if err != nil {
+		return c.reply(false, "[SYS/TEMP] cannot get mailboxes: "+err.Error())
+	}
+	messages, err := c.server.loadMessages(mailbox)
+	if err != nil {
+		return c.reply(false, "[SYS/TEMP] cannot open maildrop: "+err.Error())
+	}
+	c.mailbox = mailbox
+	c.messages = messages
+	c.state = stateTransaction
+	log.Logf(log.INFO, "pop3: %v opened mailbox %v (%d messages)", c.conn.RemoteAddr(), mailbox, len(messages))
+	return c.reply(true, fmt.Sprintf("maildrop locked and ready, %d messages", len(messages)))
+}
+
+// findMailbox returns the name of the mailbox matching the username.
+// Unknown mailboxes are accepted and simply empty.
+func (s *Server) findMailbox(username string) (string, error) {
+	mailboxes, err := s.store.GetMailboxes()
+	if err != nil {
+		return "", err
+	}
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(mailbox.Name, username) {
+			return mailbox.Name, nil
+		}
+	}
+	return username, nil
+}
+
+// loadMessages returns the messages of the mailbox, oldest first. Their sizes
+// are measured when first needed.
+func (s *Server) loadMessages(mailbox string) ([]message, error) {
+	emailHeaders, _, err := s.store.SearchEmails("mailbox:"+matcher.QuoteValue(mailbox), 1, -1)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]message, 0, len(emailHeaders))
+	for i := len(emailHeaders) - 1; i >= 0; i-- {
+		messages = append(messages, message{id: emailHeaders[i].ID, size: -1})
+	}
+	return messages, nil
+}
+
+// messageSize returns the size of the message, streaming its raw email the
+// first time.
+func (c *session) messageSize(msg *message) (int, error) {
+	if msg.size >= 0 {
+		return msg.size, nil
+	}
+	raw, err := storage.OpenRawEmail(c.server.store, msg.id)
+	if err != nil {
+		return 0, err
+	}
+	defer raw.Close()
+	size, err := wireSize(raw)
+	if err != nil {
+		return 0, err
+	}
+	msg.size = size
+	return size, nil
+}
+
+// measureMessages measures the message of the argument, or every message
+// without argument. An invalid argument is left to the command to report.
+func (c *session) measureMessages(argument string) error {
+	if argument != "" {
+		msg, err := c.getMessage(argument)
+		if err != nil {
+			return nil
+		}
+		_, err = c.messageSize(msg)
+		return err
+	}
+	for i := range c.messages {
+		if c.messages[i].deleted {
+			continue
+		}
+		if _, err := c.messageSize(&c.messages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getMessage returns the message from its 1-based number, if not deleted.
+func (c *session) getMessage(argument string) (*message, error) {
+	number, err := strconv.Atoi(strings.TrimSpace(argument))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message number %q", argument)
+	}
+	if number < 1 || number > len(c.messages) {
+		return nil, fmt.Errorf("no such message")
+	}
+	msg := &c.messages[number-1]
+	if msg.deleted {
+		return nil, fmt.Errorf("message %d already deleted", number)
+	}
+	return msg, nil
+}
+
+func (c *session) stat() error {
+	if err := c.measureMessages(""); err != nil {
+		return c.reply(false, "cannot read message: "+err.Error())
+	}
+	count, size := 0, 0
+	for _, msg := range c.messages {
+		if msg.deleted {
+			continue
+		}
+		count++
+		size += msg.size
+	}
+	return c.reply(true, fmt.Sprintf("%d %d", count, size))
+}
+
+func (c *session) list(argument string) error {
+	if err := c.measureMessages(argument); err != nil {
+		return c.reply(false, "cannot read message: "+err.Error())
+	}
+	return c.scanListing(argument, func(number int, msg message) string {
+		return fmt.Sprintf("%d %d", number, msg.size)
+	})
+}
+
+func (c *session) uidl(argument string) error {
+	return c.scanListing(argument, func(number int, msg message) string {
+		return fmt.Sprintf("%d %s", number, msg.id)
+	})
+}
+
+// scanListing implements the common part of LIST and UIDL.
+func (c *session) scanListing(argument string, format func(number int, msg message) string) error {
+	if argument != "" {
+		msg, err := c.getMessage(argument)
+		if err != nil {
+			return c.reply(false, err.Error())
+		}
+		number, _ := strconv.Atoi(strings.TrimSpace(argument))
+		return c.reply(true, format(number, *msg))
+	}
+	var lines []string
+	for i, msg := range c.messages {
+		if msg.deleted {
+			continue
+		}
+		lines = append(lines, format(i+1, msg))
+	}
+	if err := c.reply(true, fmt.Sprintf("%d messages", len(lines))); err != nil {
+		return err
+	}
+	return c.writeLines(lines)
+}
+
+func (c *session) retr(argument string) error {
+	msg, err := c.getMessage(argument)
+	if err != nil {
+		return c.reply(false, err.Error())
+	}
+	raw, err := c.server.store.GetRawEmail(msg.id)
+	if err != nil {
+		return c.reply(false, "cannot read message: "+err.Error())
+	}
+	msg.size = rawSize(raw)
+	if err := c.reply(true, fmt.Sprintf("%d octets", msg.size)); err != nil {
+		return err
+	}
+	return c.writeLines(splitLines(raw))
+}
+
+func (c *session) top(argument string) error {
+	fields := strings.Fields(argument)
+	if len(fields) != 2 {
+		return c.reply(false, "usage: TOP msg n")
+	}
+	msg, err := c.getMessage(fields[0])
+	if err != nil {
+		return c.reply(false, err.Error())
+	}
+	bodyLines, err := strconv.Atoi(fields[1])
+	if err != nil || bodyLines < 0 {
+		return c.reply(false, "invalid number of lines")
+	}
+	raw, err := c.server.store.GetRawEmail(msg.id)
+	if err != nil {
+		return c.reply(false, "cannot read message: "+err.Error())
+	}
+	lines := splitLines(raw)
+	// keep the headers, the separating blank line and the first body lines
+	for i, line := range lines {
+		if line == "" {
+			if end := i + 1 + bodyLines; end < len(lines) {
+				lines = lines[:end]
+			}
+			break
+		}
+	}
+	if err := c.reply(true, "top of message follows"); err != nil {
+		return err
+	}
+	return c.writeLines(lines)
+}
+
+func (c *session) dele(argument string) error {
+	msg, err := c.getMessage(argument)
+	if err != nil {
+		return c.reply(false, err.Error())
+	}
+	msg.deleted = true
+	return c.reply(true, "message deleted")
+}
+
+func (c *session) rset() error {
+	for i := range c.messages {
+		c.messages[i].deleted = false
+	}
+	return c.reply(true, fmt.Sprintf("maildrop has %d messages", len(c.messages)))
+}
+
+// quit enters the UPDATE state: messages marked as deleted are removed from the storage.
+func (c *session) quit() error {
+	if c.state != stateTransaction {
+		c.reply(true, "bye")
+		return errQuit
+	}
+	failed := 0
+	for _, msg := range c.messages {
+		if !msg.deleted {
+			continue
+		}
+		if err := c.server.store.DeleteEmailByID(msg.id); err != nil {
+			log.Logf(log.ERROR, "pop3: cannot delete email %v: %v", msg.id, err)
+			failed++
+			continue
+		}
+		log.Logf(log.INFO, "pop3: deleted email %v from mailbox %v", msg.id, c.mailbox)
+	}
+	if failed > 0 {
+		c.reply(false, fmt.Sprintf("%d messages not removed", failed))
+		return errQuit
+	}
+	c.reply(true, "bye")
+	return errQuit
+}
+
+// splitLines splits a raw email into lines without their line terminators.
+func splitLines(raw []byte) []string {
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	return strings.Split(text, "\n")
+}
+
+// rawSize returns the size of the raw email as sent on the wire (CRLF line endings).
+func rawSize(raw []byte) int {
+	size, _ := wireSize(bytes.NewReader(raw))
+	return size
+}
+
+// wireSize returns the size of the raw email read from r as sent on the wire:
+// the lines of splitLines, each terminated by CRLF.
+func wireSize(r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	var length, newlines int // length of the text with LF line endings
+	var last byte
+	pendingCR := false
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		last = b
+		if b == '\n' {
+			// LF or CRLF
+			length++
+			newlines++
+			pendingCR = false
+			continue
+		}
+		if pendingCR {
+			length++ // a bare CR
+		}
+		pendingCR = b == '\r'
+		if !pendingCR {
+			length++
+		}
+	}
+	if pendingCR {
+		length++
+	}
+	if last == '\n' {
+		// the last line terminator does not start another line
+		length--
+		newlines--
+	}
+	// each line is sent with a CRLF: the separators get one more octet, and the
+	// last line two
+	return length + newlines + 2, nil
+}
@@ -0,0 +1,228 @@
+package pop3
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mock-my-mta/smtp"
+	"mock-my-mta/storage"
+)
+
+const firstEmail = "From: sender@example.com\r\nTo: bob@example.com\r\nSubject: first\r\nDate: Mon, 01 Jan 2024 10:00:00 +0000\r\n\r\nline one\r\n.starts with a dot\r\nline three\r\n"
+const secondEmail = "From: sender@example.com\r\nTo: bob@example.com, carol@example.com\r\nSubject: second\r\nDate: Tue, 02 Jan 2024 10:00:00 +0000\r\n\r\nhello\r\n"
+
+func newTestStorage(t *testing.T) *storage.Engine {
+	engine, err := storage.NewEngine([]storage.StorageLayerConfiguration{{Type: "MEMORY"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{firstEmail, secondEmail} {
+		message, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := engine.Set(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return engine
+}
+
+func startTestServer(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String()
+}
+
+type testClient struct {
+	t    *testing.T
+	conn *textproto.Conn
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn}
+	c.expectOK("")
+	return c
+}
+
+// cmd sends a command and returns the status line.
+func (c *testClient) cmd(format string, args ...interface{}) string {
+	c.t.Helper()
+	if err := c.conn.PrintfLine(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := c.conn.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return line
+}
+
+func (c *testClient) expectOK(format string, args ...interface{}) string {
+	c.t.Helper()
+	var line string
+	if format == "" {
+		var err error
+		if line, err = c.conn.ReadLine(); err != nil {
+			c.t.Fatal(err)
+		}
+	} else {
+		line = c.cmd(format, args...)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		c.t.Fatalf("expected +OK, got %q", line)
+	}
+	return line
+}
+
+func (c *testClient) readLines() []string {
+	c.t.Helper()
+	lines, err := c.conn.ReadDotLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return lines
+}
+
+func TestSession(t *testing.T) {
+	engine := newTestStorage(t)
+	addr := startTestServer(t, NewServer(Configuration{}, engine))
+	c := dial(t, addr)
+
+	if line := c.cmd("STAT"); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("expected STAT to fail before authentication, got %q", line)
+	}
+	c.expectOK("CAPA")
+	if capabilities := c.readLines(); !strings.Contains(strings.Join(capabilities, " "), "UIDL") {
+		t.Errorf("expected UIDL capability, got %v", capabilities)
+	}
+	c.expectOK("USER BOB@example.com")
+	c.expectOK("PASS anything")
+
+	expectedSize := len(firstEmail) + len(secondEmail)
+	if line := c.expectOK("STAT"); line != "+OK 2 "+strconv.Itoa(expectedSize) {
+		t.Errorf("unexpected STAT reply %q (expected size %d)", line, expectedSize)
+	}
+
+	c.expectOK("LIST")
+	listing := c.readLines()
+	if len(listing) != 2 || listing[0] != "1 "+strconv.Itoa(len(firstEmail)) {
+		t.Errorf("unexpected LIST %v", listing)
+	}
+
+	c.expectOK("UIDL")
+	uids := c.readLines()
+	emails, _, _ := engine.SearchEmails("subject:first", 1, -1)
+	if len(uids) != 2 || uids[0] != "1 "+emails[0].ID {
+		t.Errorf("unexpected UIDL %v (expected first id %v)", uids, emails[0].ID)
+	}
+
+	c.expectOK("RETR 1")
+	body := c.readLines()
+	if body[len(body)-2] != ".starts with a dot" || body[len(body)-1] != "line three" {
+		t.Errorf("unexpected RETR body %q", body)
+	}
+
+	c.expectOK("TOP 1 1")
+	top := c.readLines()
+	if top[len(top)-1] != "line one" {
+		t.Errorf("unexpected TOP body %q", top)
+	}
+
+	if line := c.cmd("RETR 3"); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("expected error for unknown message, got %q", line)
+	}
+
+	c.expectOK("DELE 1")
+	if line := c.cmd("RETR 1"); !strings.HasPrefix(line, "-ERR") {
+		t.Errorf("expected error for deleted message, got %q", line)
+	}
+	c.expectOK("RSET")
+	c.expectOK("DELE 2")
+	c.expectOK("QUIT")
+
+	remaining, total, err := engine.SearchEmails("", 1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || remaining[0].Subject != "first" {
+		t.Errorf("expected only the first email to remain, got %+v", remaining)
+	}
+}
+
+func TestUnknownMailboxIsEmpty(t *testing.T) {
+	addr := startTestServer(t, NewServer(Configuration{}, newTestStorage(t)))
+	c := dial(t, addr)
+	c.expectOK("USER nobody@example.com")
+	c.expectOK("PASS x")
+	if line := c.expectOK("STAT"); line != "+OK 0 0" {
+		t.Errorf("unexpected STAT reply %q", line)
+	}
+}
+
+func TestMailboxNameIsNotAQuery(t *testing.T) {
+	addr := startTestServer(t, NewServer(Configuration{}, newTestStorage(t)))
+	c := dial(t, addr)
+	c.expectOK(`USER carol@example.com mailbox:"carol@example.com"`)
+	c.expectOK("PASS x")
+	if line := c.expectOK("STAT"); line != "+OK 0 0" {
+		t.Errorf("unexpected STAT reply %q", line)
+	}
+}
+
+func TestSTLS(t *testing.T) {
+	server := NewServer(Configuration{}, newTestStorage(t))
+	server.SetTLSConfig(smtp.GenerateSelfSignedTLS())
+	addr := startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: textproto.NewConn(conn)}
+	c.expectOK("")
+	c.expectOK("STLS")
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c = &testClient{t: t, conn: textproto.NewConn(tlsConn)}
+	c.expectOK("CAPA")
+	if capabilities := c.readLines(); strings.Contains(strings.Join(capabilities, " "), "STLS") {
+		t.Errorf("STLS should not be advertised once TLS is active, got %v", capabilities)
+	}
+	c.expectOK("USER bob@example.com")
+	c.expectOK("PASS x")
+	if line := c.expectOK("STAT"); !strings.HasPrefix(line, "+OK 2 ") {
+		t.Errorf("unexpected STAT reply %q", line)
+	}
+}
+
+func TestWireSize(t *testing.T) {
+	for _, raw := range []string{"", "a", "a\n", "a\r\nb", "a\r\nb\r\n", "a\n\nb\n", "\r\n\n", "bare\rcr\r", "a\r\r\nb"} {
+		expected := 0
+		for _, line := range splitLines([]byte(raw)) {
+			expected += len(line) + 2
+		}
+		size, err := wireSize(strings.NewReader(raw))
+		if err != nil || size != expected {
+			t.Errorf("%q: expected %d, got %d (%v)", raw, expected, size, err)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package sieve
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Message is the view of an incoming email that a script is evaluated against.
+type Message struct {
+	Sender    string      // SMTP envelope sender (MAIL FROM)
+	Recipient string      // SMTP envelope recipient (RCPT TO) owning the script
+	Header    mail.Header // message headers
+	Size      int         // message size in bytes
+}
+
+// Result is the outcome of running a script on a message.
+type Result struct {
+	Keep      bool     // deliver to the Inbox (explicit or implicit keep)
+	FileInto  []string // folders the message is filed into
+	Redirects []string // addresses the message is redirected to
+	Flags     []string // IMAP flags set with addflag/setflag
+	Rejected  bool     // the message must be refused
+	Reason    string   // reject reason
+}
+
+// Discarded returns true when the message is not delivered anywhere.
+func (r Result) Discarded() bool {
+	return !r.Rejected && !r.Keep && len(r.FileInto) == 0 && len(r.Redirects) == 0
+}
+
+// Script is a compiled Sieve script (RFC 5228).
+type Script struct {
+	source   string
+	commands []*command
+}
+
+// supportedExtensions lists the capability strings accepted by "require".
+var supportedExtensions = map[string]bool{
+	"fileinto":                   true,
+	"reject":                     true,
+	"envelope":                   true,
+	"imap4flags":                 true,
+	"copy":                       true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Compile parses and validates a script.
+func Compile(source string) (*Script, error) {
+	commands, err := parse(source)
+	if err != nil {
+		return nil, err
+	}
+	required := make(map[string]bool)
+	if err := validateCommands(commands, required); err != nil {
+		return nil, err
+	}
+	return &Script{source: source, commands: commands}, nil
+}
+
+// Source returns the original text of the script.
+func (s *Script) Source() string {
+	return s.source
+}
+
+// Evaluate runs the script on a message and returns the resulting actions.
+func (s *Script) Evaluate(msg Message) Result {
+	e := &executor{msg: msg, implicitKeep: true}
+	e.run(s.commands)
+	if e.implicitKeep {
+		e.result.Keep = true
+	}
+	e.result.Flags = e.flags
+	return e.result
+}
+
+func validateCommands(commands []*command, required map[string]bool) error {
+	previous := ""
+	for _, cmd := range commands {
+		need := ""
+		switch cmd.name {
+		case "require":
+			if len(cmd.args) != 1 || !cmd.args[0].isStrings() {
+				return ParseError{Line: cmd.line, Msg: "require expects a string list"}
+			}
+			for _, ext := range cmd.args[0].strings {
+				if !supportedExtensions[strings.ToLower(ext)] {
+					return ParseError{Line: cmd.line, Msg: fmt.Sprintf("unsupported extension %q", ext)}
+				}
+				required[strings.ToLower(ext)] = true
+			}
+		case "if", "elsif", "else":
+			if cmd.name != "if" && previous != "if" && previous != "elsif" {
+				return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v without if", cmd.name)}
+			}
+			if cmd.name == "else" && len(cmd.tests) != 0 {
+				return ParseError{Line: cmd.line, Msg: "else does not take a test"}
+			}
+			if cmd.name != "else" && len(cmd.tests) != 1 {
+				return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v expects exactly one test", cmd.name)}
+			}
+			for _, t := range cmd.tests {
+				if err := validateTest(t, required); err != nil {
+					return err
+				}
+			}
+			if err := validateCommands(cmd.block, required); err != nil {
+				return err
+			}
+		case "stop", "keep", "discard":
+			if len(cmd.args) != 0 {
+				return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v does not take arguments", cmd.name)}
+			}
+		case "fileinto", "redirect":
+			if cmd.name == "fileinto" {
+				need = "fileinto"
+			}
+			positional, tags := splitTags(cmd.args)
+			if tags["copy"] && !required["copy"] {
+				return ParseError{Line: cmd.line, Msg: `missing require "copy"`}
+			}
+			if len(positional) != 1 || len(positional[0].strings) != 1 {
+				return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v expects a single string", cmd.name)}
+			}
+		case "reject":
+			need = "reject"
+			if len(cmd.args) != 1 || len(cmd.args[0].strings) != 1 {
+				return ParseError{Line: cmd.line, Msg: "reject expects a single string"}
+			}
+		case "addflag", "setflag", "removeflag":
+			need = "imap4flags"
+			if len(cmd.args) != 1 || !cmd.args[0].isStrings() {
+				return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v expects a string list", cmd.name)}
+			}
+		default:
+			return ParseError{Line: cmd.line, Msg: fmt.Sprintf("unknown command %q", cmd.name)}
+		}
+		if need != "" && !required[need] {
+			return ParseError{Line: cmd.line, Msg: fmt.Sprintf("missing require %q", need)}
+		}
+		if cmd.name != "if" && cmd.name != "elsif" && cmd.name != "else" && (len(cmd.tests) > 0 || cmd.block != nil) {
+			return ParseError{Line: cmd.line, Msg: fmt.Sprintf("%v does not take a test or block", cmd.name)}
+		}
+		previous = cmd.name
+	}
+	return nil
+}
+
+func validateTest(t *test, required map[string]bool) error {
+	switch t.name {
+	case "true", "false":
+		if len(t.args) != 0 || len(t.tests) != 0 {
+			return ParseError{Line: t.line, Msg: fmt.Sprintf("%v does not take arguments", t.name)}
+		}
+		return nil
+	case "not":
+		if len(t.tests) != 1 {
+			return ParseError{Line: t.line, Msg: "not expects exactly one test"}
+		}
+		return validateTest(t.tests[0], required)
+	case "allof", "anyof":
+		if len(t.tests) == 0 {
+			return ParseError{Line: t.line, Msg: fmt.Sprintf("%v expects a test list", t.name)}
+		}
+		for _, sub := range t.tests {
+			if err := validateTest(sub, required); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "exists":
+		if len(t.args) != 1 || !t.args[0].isStrings() {
+			return ParseError{Line: t.line, Msg: "exists expects a string list"}
+		}
+		return nil
+	case "size":
+		opts, err := parseTestOptions(t)
+		if err != nil {
+			return err
+		}
+		if opts.sizeMode == "" || len(opts.positional) != 1 || !opts.positional[0].isNum {
+			return ParseError{Line: t.line, Msg: "size expects :over or :under and a number"}
+		}
+		return nil
+	case "envelope":
+		if !required["envelope"] {
+			return ParseError{Line: t.line, Msg: `missing require "envelope"`}
+		}
+		fallthrough
+	case "address", "header":
+		opts, err := parseTestOptions(t)
+		if err != nil {
+			return err
+		}
+		if len(opts.positional) != 2 || !opts.positional[0].isStrings() || !opts.positional[1].isStrings() {
+			return ParseError{Line: t.line, Msg: fmt.Sprintf("%v expects a header list and a key list", t.name)}
+		}
+		if t.name == "header" && opts.addressPart != "" {
+			return ParseError{Line: t.line, Msg: "header does not accept an address part"}
+		}
+		return nil
+	default:
+		return ParseError{Line: t.line, Msg: fmt.Sprintf("unknown test %q", t.name)}
+	}
+}
+
+// testOptions holds the tagged arguments common to address, envelope, header and size.
+type testOptions struct {
+	matchType   string // "is", "contains" or "matches"
+	comparator  string
+	addressPart string // "all", "localpart" or "domain"
+	sizeMode    string // "over" or "under"
+	positional  []argument
+}
+
+func parseTestOptions(t *test) (testOptions, error) {
+	opts := testOptions{matchType: "is", comparator: "i;ascii-casemap"}
+	for i := 0; i < len(t.args); i++ {
+		arg := t.args[i]
+		if !arg.isTag() {
+			opts.positional = append(opts.positional, arg)
+			continue
+		}
+		switch arg.tag {
+		case "is", "contains", "matches":
+			opts.matchType = arg.tag
+		case "all", "localpart", "domain":
+			opts.addressPart = arg.tag
+		case "over", "under":
+			opts.sizeMode = arg.tag
+		case "comparator":
+			if i+1 >= len(t.args) || len(t.args[i+1].strings) != 1 {
+				return opts, ParseError{Line: t.line, Msg: ":comparator expects a string"}
+			}
+			i++
+			opts.comparator = strings.ToLower(t.args[i].strings[0])
+			if opts.comparator != "i;ascii-casemap" && opts.comparator != "i;octet" {
+				return opts, ParseError{Line: t.line, Msg: fmt.Sprintf("unsupported comparator %q", opts.comparator)}
+			}
+		default:
+			return opts, ParseError{Line: t.line, Msg: fmt.Sprintf("unknown tag :%v", arg.tag)}
+		}
+	}
+	return opts, nil
+}
+
+// splitTags separates the tags of an action command from its positional arguments.
+func splitTags(args []argument) ([]argument, map[string]bool) {
+	var positional []argument
+	tags := make(map[string]bool)
+	for _, arg := range args {
+		if arg.isTag() {
+			tags[arg.tag] = true
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	return positional, tags
+}
+
+type executor struct {
+	msg          Message
+	result       Result
+	flags        []string
+	implicitKeep bool
+	stopped      bool
+}
+
+func (e *executor) run(commands []*command) {
+	// lastCondition tracks whether a previous branch of an if/elsif chain matched
+	lastCondition := false
+	for _, cmd := range commands {
+		if e.stopped {
+			return
+		}
+		switch cmd.name {
+		case "require":
+			// validated at compile time
+		case "if":
+			lastCondition = e.test(cmd.tests[0])
+			if lastCondition {
+				e.run(cmd.block)
+			}
+		case "elsif":
+			if !lastCondition {
+				lastCondition = e.test(cmd.tests[0])
+				if lastCondition {
+					e.run(cmd.block)
+				}
+			}
+		case "else":
+			if !lastCondition {
+				e.run(cmd.block)
+			}
+		case "stop":
+			e.stopped = true
+		case "keep":
+			e.result.Keep = true
+			e.implicitKeep = false
+		case "discard":
+			e.implicitKeep = false
+		case "fileinto":
+			positional, tags := splitTags(cmd.args)
+			e.result.FileInto = appendUnique(e.result.FileInto, positional[0].strings[0])
+			if !tags["copy"] {
+				e.implicitKeep = false
+			}
+		case "redirect":
+			positional, tags := splitTags(cmd.args)
+			e.result.Redirects = appendUnique(e.result.Redirects, positional[0].strings[0])
+			if !tags["copy"] {
+				e.implicitKeep = false
+			}
+		case "reject":
+			e.result.Rejected = true
+			e.result.Reason = cmd.args[0].strings[0]
+			e.implicitKeep = false
+		case "addflag":
+			for _, flag := range splitFlags(cmd.args[0].strings) {
+				e.flags = appendUnique(e.flags, flag)
+			}
+		case "setflag":
+			e.flags = nil
+			for _, flag := range splitFlags(cmd.args[0].strings) {
+				e.flags = appendUnique(e.flags, flag)
+			}
+		case "removeflag":
+			remove := splitFlags(cmd.args[0].strings)
+			var kept []string
+			for _, flag := range e.flags {
+				if !containsFold(remove, flag) {
+					kept = append(kept, flag)
+				}
+			}
+			e.flags = kept
+		}
+	}
+}
+
+func (e *executor) test(t *test) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !e.test(t.tests[0])
+	case "allof":
+		for _, sub := range t.tests {
+			if !e.test(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.tests {
+			if e.test(sub) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range t.args[0].strings {
+			if len(e.msg.Header[canonicalHeader(name)]) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	opts, _ := parseTestOptions(t)
+	switch t.name {
+	case "size":
+		limit := opts.positional[0].number
+		if opts.sizeMode == "over" {
+			return int64(e.msg.Size) > limit
+		}
+		return int64(e.msg.Size) < limit
+	case "header":
+		var values []string
+		for _, name := range opts.positional[0].strings {
+			for _, value := range e.msg.Header[canonicalHeader(name)] {
+				values = append(values, decodeHeader(value))
+			}
+		}
+		return matchAny(values, opts.positional[1].strings, opts)
+	case "address":
+		var values []string
+		for _, name := range opts.positional[0].strings {
+			for _, value := range e.msg.Header[canonicalHeader(name)] {
+				for _, address := range parseAddresses(value) {
+					values = append(values, addressPart(address, opts.addressPart))
+				}
+			}
+		}
+		return matchAny(values, opts.positional[1].strings, opts)
+	case "envelope":
+		var values []string
+		for _, name := range opts.positional[0].strings {
+			switch strings.ToLower(name) {
+			case "from":
+				values = append(values, addressPart(e.msg.Sender, opts.addressPart))
+			case "to":
+				values = append(values, addressPart(e.msg.Recipient, opts.addressPart))
+			}
+		}
+		return matchAny(values, opts.positional[1].strings, opts)
+	}
+	return false
+}
+
+func canonicalHeader(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func parseAddresses(value string) []string {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		// keep the raw value so that malformed headers can still be matched
+		return []string{strings.Trim(strings.TrimSpace(value), "<>")}
+	}
+	addresses := make([]string, 0, len(list))
+	for _, address := range list {
+		addresses = append(addresses, address.Address)
+	}
+	return addresses
+}
+
+func addressPart(address string, part string) string {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+	at := strings.LastIndex(address, "@")
+	switch part {
+	case "localpart":
+		if at < 0 {
+			return address
+		}
+		return address[:at]
+	case "domain":
+		if at < 0 {
+			return ""
+		}
+		return address[at+1:]
+	default:
+		return address
+	}
+}
+
+func matchAny(values []string, keys []string, opts testOptions) bool {
+	for _, value := range values {
+		for _, key := range keys {
+			if matchValue(value, key, opts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchValue(value string, key string, opts testOptions) bool {
+	if opts.comparator == "i;ascii-casemap" {
+		value = strings.ToLower(value)
+		key = strings.ToLower(key)
+	}
+	switch opts.matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return globToRegexp(key).MatchString(value)
+	default:
+		return value == key
+	}
+}
+
+// globToRegexp converts a Sieve wildcard pattern ("*", "?", "\" escapes) to a regexp.
+func globToRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func splitFlags(values []string) []string {
+	var flags []string
+	for _, value := range values {
+		flags = append(flags, strings.Fields(value)...)
+	}
+	return flags
+}
+
+func appendUnique(values []string, value string) []string {
+	if containsFold(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
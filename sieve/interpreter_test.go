@@ -0,0 +1,164 @@
+package sieve
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEmail = `From: "Alice" <alice@example.com>
+To: bob@example.com, carol@example.org
+Subject: =?UTF-8?Q?Cheap_pills_=E2=9C=94?=
+X-Spam-Flag: YES
+List-Id: <news.example.com>
+
+Buy now.
+`
+
+func newTestMessage(t *testing.T) Message {
+	msg, err := mail.ReadMessage(strings.NewReader(testEmail))
+	if err != nil {
+		t.Fatalf("cannot parse test email: %v", err)
+	}
+	return Message{
+		Sender:    "bounce@example.com",
+		Recipient: "bob@example.com",
+		Header:    msg.Header,
+		Size:      len(testEmail),
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"unknown command", `frobnicate;`},
+		{"unknown test", `if frobnicate { keep; }`},
+		{"missing require fileinto", `fileinto "Spam";`},
+		{"missing require imap4flags", `addflag "\\Seen";`},
+		{"missing require envelope", `if envelope :is "from" "x" { keep; }`},
+		{"missing require copy", `require "fileinto"; fileinto :copy "A";`},
+		{"unsupported extension", `require "vacation";`},
+		{"else without if", `else { keep; }`},
+		{"missing semicolon", `keep`},
+		{"unterminated string", `require "fileinto`},
+		{"unterminated block", `if true { keep;`},
+		{"size without number", `if size :over "big" { keep; }`},
+		{"unknown comparator", `if header :comparator "i;unicode" "subject" "x" { keep; }`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Compile(test.script); err == nil {
+				t.Errorf("expected error for script %q", test.script)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected Result
+	}{
+		{
+			name:     "empty script keeps",
+			script:   ``,
+			expected: Result{Keep: true},
+		},
+		{
+			name: "fileinto on header",
+			script: `require "fileinto";
+if header :is "X-Spam-Flag" "yes" { fileinto "Spam"; }`,
+			expected: Result{FileInto: []string{"Spam"}},
+		},
+		{
+			name: "decoded subject contains",
+			script: `require ["fileinto"];
+if header :contains "subject" "PILLS ✔" { fileinto "Spam"; stop; }
+fileinto "Other";`,
+			expected: Result{FileInto: []string{"Spam"}},
+		},
+		{
+			name: "address domain with elsif",
+			script: `require "fileinto";
+if address :domain "from" "example.org" { fileinto "Org"; }
+elsif address :localpart :matches "from" "ali*" { fileinto "Alice"; }
+else { discard; }`,
+			expected: Result{FileInto: []string{"Alice"}},
+		},
+		{
+			name: "envelope test",
+			script: `require ["envelope", "fileinto"];
+if envelope :is "from" "bounce@example.com" { fileinto "Bounces"; }`,
+			expected: Result{FileInto: []string{"Bounces"}},
+		},
+		{
+			name:     "discard",
+			script:   `if exists "list-id" { discard; }`,
+			expected: Result{},
+		},
+		{
+			name:     "not exists",
+			script:   `if not exists "x-mailer" { discard; }`,
+			expected: Result{},
+		},
+		{
+			name: "size and anyof",
+			script: `require "fileinto";
+if anyof (size :over 1M, header :contains "subject" "nothing") { fileinto "Big"; }`,
+			expected: Result{Keep: true},
+		},
+		{
+			name: "allof with redirect copy",
+			script: `require "copy";
+if allof (true, size :under 10K) { redirect :copy "archive@example.com"; }`,
+			expected: Result{Keep: true, Redirects: []string{"archive@example.com"}},
+		},
+		{
+			name:     "reject",
+			script:   `require "reject"; reject "no thanks";`,
+			expected: Result{Rejected: true, Reason: "no thanks"},
+		},
+		{
+			name: "flags",
+			script: `require ["imap4flags", "fileinto"];
+addflag ["\\Flagged", "$Junk \\Seen"];
+removeflag "\\Seen";
+fileinto "Spam";`,
+			expected: Result{FileInto: []string{"Spam"}, Flags: []string{"\\Flagged", "$Junk"}},
+		},
+		{
+			name: "explicit keep and comments",
+			script: `# keep everything
+/* and also
+   file a copy */
+require ["fileinto", "copy"];
+keep;
+fileinto :copy text:
+Archive
+.
+;`,
+			expected: Result{Keep: true, FileInto: []string{"Archive\r\n"}},
+		},
+		{
+			name:     "octet comparator is case sensitive",
+			script:   `if header :comparator "i;octet" :is "x-spam-flag" "yes" { discard; }`,
+			expected: Result{Keep: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, err := Compile(test.script)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			result := script.Evaluate(newTestMessage(t))
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, result)
+			}
+		})
+	}
+}
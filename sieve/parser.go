@@ -0,0 +1,412 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseError is returned when a script cannot be parsed.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("sieve: line %d: %v", e.Line, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenIdentifier tokenKind = iota
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSymbol // one of [ ] ( ) , ; { }
+	tokenEOF
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	num   int64
+	line  int
+}
+
+// argument is a positional or tagged argument of a command or test (RFC 5228 section 2.6).
+type argument struct {
+	tag     string   // set for ":tag" arguments
+	number  int64    // set for numbers
+	strings []string // set for strings and string lists
+	isNum   bool
+}
+
+func (a argument) isTag() bool {
+	return a.tag != ""
+}
+
+func (a argument) isStrings() bool {
+	return a.tag == "" && !a.isNum
+}
+
+// test is a condition used by "if", "elsif", "not", "allof" and "anyof".
+type test struct {
+	name  string
+	args  []argument
+	tests []*test
+	line  int
+}
+
+// command is a control or action command (RFC 5228 section 3 and 4).
+type command struct {
+	name  string
+	args  []argument
+	tests []*test
+	block []*command
+	line  int
+}
+
+// tokenize splits a script into tokens, skipping whitespace and comments.
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	line := 1
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(source) && source[i+1] == '*':
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return nil, ParseError{Line: line, Msg: "unterminated comment"}
+			}
+			line += strings.Count(source[i:i+2+end], "\n")
+			i += end + 4
+		case strings.ContainsRune("[](),;{}", rune(c)):
+			tokens = append(tokens, token{kind: tokenSymbol, value: string(c), line: line})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			start := line
+			i++
+			for {
+				if i >= len(source) {
+					return nil, ParseError{Line: start, Msg: "unterminated string"}
+				}
+				if source[i] == '\\' && i+1 < len(source) {
+					sb.WriteByte(source[i+1])
+					i += 2
+					continue
+				}
+				if source[i] == '"' {
+					i++
+					break
+				}
+				if source[i] == '\n' {
+					line++
+				}
+				sb.WriteByte(source[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, value: sb.String(), line: start})
+		case c == ':':
+			j := i + 1
+			for j < len(source) && isIdentifierChar(source[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, ParseError{Line: line, Msg: "empty tag"}
+			}
+			tokens = append(tokens, token{kind: tokenTag, value: strings.ToLower(source[i+1 : j]), line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(source) && source[j] >= '0' && source[j] <= '9' {
+				j++
+			}
+			n, err := strconv.ParseInt(source[i:j], 10, 64)
+			if err != nil {
+				return nil, ParseError{Line: line, Msg: fmt.Sprintf("invalid number %q", source[i:j])}
+			}
+			if j < len(source) {
+				switch source[j] {
+				case 'K', 'k':
+					n *= 1024
+					j++
+				case 'M', 'm':
+					n *= 1024 * 1024
+					j++
+				case 'G', 'g':
+					n *= 1024 * 1024 * 1024
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, num: n, line: line})
+			i = j
+		case isIdentifierChar(c):
+			j := i
+			for j < len(source) && isIdentifierChar(source[j]) {
+				j++
+			}
+			word := strings.ToLower(source[i:j])
+			if word == "text" && j < len(source) && source[j] == ':' {
+				// multi-line string: "text:" up to a line containing a single "."
+				text, consumed, lines, err := readMultiLine(source[j+1:], line)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{kind: tokenString, value: text, line: line})
+				line += lines
+				i = j + 1 + consumed
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, value: word, line: line})
+			i = j
+		default:
+			return nil, ParseError{Line: line, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, line: line})
+	return tokens, nil
+}
+
+// readMultiLine reads the body of a "text:" string. It returns the decoded
+// text, the number of bytes consumed and the number of newlines consumed.
+func readMultiLine(source string, line int) (string, int, int, error) {
+	// the rest of the "text:" line is ignored (whitespace or a comment)
+	eol := strings.IndexByte(source, '\n')
+	if eol < 0 {
+		return "", 0, 0, ParseError{Line: line, Msg: "unterminated multi-line string"}
+	}
+	pos := eol + 1
+	lines := 1
+	var sb strings.Builder
+	for {
+		next := strings.IndexByte(source[pos:], '\n')
+		if next < 0 {
+			return "", 0, 0, ParseError{Line: line, Msg: "unterminated multi-line string"}
+		}
+		content := strings.TrimRight(source[pos:pos+next], "\r")
+		pos += next + 1
+		lines++
+		if content == "." {
+			return sb.String(), pos, lines, nil
+		}
+		// dot-stuffing: a leading ".." stands for a single "."
+		if strings.HasPrefix(content, "..") {
+			content = content[1:]
+		}
+		sb.WriteString(content)
+		sb.WriteString("\r\n")
+	}
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a complete script into its list of top-level commands.
+func parse(source string) ([]*command, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	commands, err := p.parseCommands()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, ParseError{Line: tok.line, Msg: fmt.Sprintf("unexpected %q", tok.value)}
+	}
+	return commands, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	tok := p.peek()
+	return tok.kind == tokenSymbol && tok.value == symbol
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	tok := p.next()
+	if tok.kind != tokenSymbol || tok.value != symbol {
+		return ParseError{Line: tok.line, Msg: fmt.Sprintf("expected %q", symbol)}
+	}
+	return nil
+}
+
+func (p *parser) parseCommands() ([]*command, error) {
+	var commands []*command
+	for {
+		tok := p.peek()
+		if tok.kind != tokenIdentifier {
+			return commands, nil
+		}
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+}
+
+func (p *parser) parseCommand() (*command, error) {
+	name := p.next()
+	cmd := &command{name: name.value, line: name.line}
+	args, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	cmd.args = args
+	switch {
+	case p.isSymbol("("):
+		cmd.tests, err = p.parseTestList()
+		if err != nil {
+			return nil, err
+		}
+	case p.peek().kind == tokenIdentifier:
+		t, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		cmd.tests = []*test{t}
+	}
+	if p.isSymbol("{") {
+		p.next()
+		cmd.block, err = p.parseCommands()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("}"); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+	if err := p.expectSymbol(";"); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (p *parser) parseArguments() ([]argument, error) {
+	var args []argument
+	for {
+		tok := p.peek()
+		switch {
+		case tok.kind == tokenTag:
+			p.next()
+			args = append(args, argument{tag: tok.value})
+		case tok.kind == tokenNumber:
+			p.next()
+			args = append(args, argument{number: tok.num, isNum: true})
+		case tok.kind == tokenString:
+			p.next()
+			args = append(args, argument{strings: []string{tok.value}})
+		case tok.kind == tokenSymbol && tok.value == "[":
+			list, err := p.parseStringList()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, argument{strings: list})
+		default:
+			return args, nil
+		}
+	}
+}
+
+func (p *parser) parseStringList() ([]string, error) {
+	if err := p.expectSymbol("["); err != nil {
+		return nil, err
+	}
+	var list []string
+	for {
+		tok := p.next()
+		if tok.kind != tokenString {
+			return nil, ParseError{Line: tok.line, Msg: "expected string in string list"}
+		}
+		list = append(list, tok.value)
+		if p.isSymbol(",") {
+			p.next()
+			continue
+		}
+		if err := p.expectSymbol("]"); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+}
+
+func (p *parser) parseTestList() ([]*test, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var tests []*test
+	for {
+		t, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+		if p.isSymbol(",") {
+			p.next()
+			continue
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return tests, nil
+	}
+}
+
+func (p *parser) parseTest() (*test, error) {
+	name := p.next()
+	if name.kind != tokenIdentifier {
+		return nil, ParseError{Line: name.line, Msg: "expected test"}
+	}
+	t := &test{name: name.value, line: name.line}
+	args, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	t.args = args
+	switch {
+	case p.isSymbol("("):
+		t.tests, err = p.parseTestList()
+		if err != nil {
+			return nil, err
+		}
+	case p.peek().kind == tokenIdentifier:
+		sub, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		t.tests = []*test{sub}
+	}
+	return t, nil
+}
@@ -0,0 +1,260 @@
+package sieve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"mock-my-mta/log"
+)
+
+// Default folders that every mailbox has.
+const (
+	FolderInbox = "Inbox"
+	FolderSpam  = "Spam"
+)
+
+// Placement records where a delivered message landed for one mailbox.
+type Placement struct {
+	Mailbox string   `json:"mailbox"`
+	Folder  string   `json:"folder"`
+	Flags   []string `json:"flags,omitempty"`
+}
+
+// Delivery is the outcome of running every recipient's script on a message.
+type Delivery struct {
+	Placements []Placement
+	Rejected   bool
+	Reason     string
+	// Filtered is true when at least one recipient had a script, i.e. when the
+	// placements carry more information than the default "everything in Inbox".
+	Filtered bool
+}
+
+// Store holds the per-mailbox Sieve scripts and folders.
+// Mailbox names are the recipient addresses, compared case-insensitively.
+type Store struct {
+	mu       sync.RWMutex
+	scripts  map[string]*Script
+	folders  map[string]map[string]bool // custom folders per mailbox
+	filename string                     // file keeping the scripts and folders, if any
+}
+
+// storeFile is the content of the file keeping the scripts and folders.
+type storeFile struct {
+	Scripts map[string]string   `json:"scripts"`
+	Folders map[string][]string `json:"folders"`
+}
+
+func NewStore() *Store {
+	return &Store{
+		scripts: make(map[string]*Script),
+		folders: make(map[string]map[string]bool),
+	}
+}
+
+// SetFile loads the scripts and folders kept in the file, which then receives every
+// change. A missing file is created on the first change.
+func (s *Store) SetFile(filename string) error {
+	var content storeFile
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &content); err != nil {
+			return fmt.Errorf("cannot parse %v: %w", filename, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for mailbox, source := range content.Scripts {
+		script, err := Compile(source)
+		if err != nil {
+			log.Logf(log.WARNING, "sieve: ignoring the script of mailbox %v: %v", mailbox, err)
+			continue
+		}
+		s.scripts[mailboxKey(mailbox)] = script
+	}
+	for mailbox, folders := range content.Folders {
+		for _, folder := range folders {
+			s.addFolder(mailboxKey(mailbox), folder)
+		}
+	}
+	s.filename = filename
+	return nil
+}
+
+// saveLocked writes the scripts and folders into the file of the store, if any.
+// Must be called with the lock held.
+func (s *Store) saveLocked() {
+	if s.filename == "" {
+		return
+	}
+	content := storeFile{Scripts: make(map[string]string), Folders: make(map[string][]string)}
+	for mailbox, script := range s.scripts {
+		content.Scripts[mailbox] = script.Source()
+	}
+	for mailbox, folders := range s.folders {
+		for folder := range folders {
+			content.Folders[mailbox] = append(content.Folders[mailbox], folder)
+		}
+		sort.Strings(content.Folders[mailbox])
+	}
+	if err := writeFileAtomic(s.filename, content); err != nil {
+		log.Logf(log.WARNING, "sieve: cannot save the scripts into %v: %v", s.filename, err)
+	}
+}
+
+// writeFileAtomic replaces the file with the JSON content through a temporary file,
+// so that a crash never leaves a truncated file.
+func writeFileAtomic(filename string, content storeFile) error {
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func mailboxKey(mailbox string) string {
+	return strings.ToLower(strings.TrimSpace(mailbox))
+}
+
+// SetScript compiles and installs the script of a mailbox.
+func (s *Store) SetScript(mailbox string, source string) error {
+	script, err := Compile(source)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[mailboxKey(mailbox)] = script
+	s.saveLocked()
+	log.Logf(log.INFO, "sieve: installed script for mailbox %v", mailbox)
+	return nil
+}
+
+// GetScript returns the source of the script of a mailbox.
+func (s *Store) GetScript(mailbox string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	script, found := s.scripts[mailboxKey(mailbox)]
+	if !found {
+		return "", false
+	}
+	return script.Source(), true
+}
+
+// DeleteScript removes the script of a mailbox.
+func (s *Store) DeleteScript(mailbox string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scripts, mailboxKey(mailbox))
+	s.saveLocked()
+}
+
+// CreateFolder adds a custom folder to a mailbox.
+func (s *Store) CreateFolder(mailbox string, folder string) error {
+	folder = strings.TrimSpace(folder)
+	if folder == "" {
+		return fmt.Errorf("empty folder name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.addFolder(mailboxKey(mailbox), folder) {
+		s.saveLocked()
+	}
+	return nil
+}
+
+// addFolder returns true if the folder is new. Must be called with the lock held.
+func (s *Store) addFolder(key string, folder string) bool {
+	if strings.EqualFold(folder, FolderInbox) || strings.EqualFold(folder, FolderSpam) || s.folders[key][folder] {
+		return false
+	}
+	if s.folders[key] == nil {
+		s.folders[key] = make(map[string]bool)
+	}
+	s.folders[key][folder] = true
+	return true
+}
+
+// GetFolders returns the folders of a mailbox: Inbox, Spam, then custom folders sorted by name.
+func (s *Store) GetFolders(mailbox string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var custom []string
+	for folder := range s.folders[mailboxKey(mailbox)] {
+		custom = append(custom, folder)
+	}
+	sort.Strings(custom)
+	return append([]string{FolderInbox, FolderSpam}, custom...)
+}
+
+// Deliver evaluates the script of each envelope recipient and returns where the message goes.
+// A reject from any recipient's script refuses the whole message. Redirects to other
+// addresses are delivered to the Inbox of the target mailbox (every address is local
+// to a mock MTA); the target's own script is not run, to avoid redirect loops.
+func (s *Store) Deliver(sender string, recipients []string, header mail.Header, size int) Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var delivery Delivery
+	seen := make(map[string]bool)
+	add := func(placement Placement) {
+		key := mailboxKey(placement.Mailbox) + "\x00" + strings.ToLower(placement.Folder)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		delivery.Placements = append(delivery.Placements, placement)
+	}
+
+	for _, recipient := range recipients {
+		script, found := s.scripts[mailboxKey(recipient)]
+		if !found {
+			add(Placement{Mailbox: recipient, Folder: FolderInbox})
+			continue
+		}
+		delivery.Filtered = true
+		result := script.Evaluate(Message{Sender: sender, Recipient: recipient, Header: header, Size: size})
+		log.Logf(log.DEBUG, "sieve: result for %v: %+v", recipient, result)
+		if result.Rejected {
+			delivery.Rejected = true
+			delivery.Reason = result.Reason
+			continue
+		}
+		if result.Discarded() {
+			log.Logf(log.INFO, "sieve: message discarded for mailbox %v", recipient)
+		}
+		if result.Keep {
+			add(Placement{Mailbox: recipient, Folder: FolderInbox, Flags: result.Flags})
+		}
+		for _, folder := range result.FileInto {
+			if s.addFolder(mailboxKey(recipient), folder) {
+				s.saveLocked()
+			}
+			add(Placement{Mailbox: recipient, Folder: folder, Flags: result.Flags})
+		}
+		for _, target := range result.Redirects {
+			add(Placement{Mailbox: target, Folder: FolderInbox})
+		}
+	}
+	return delivery
+}
@@ -0,0 +1,138 @@
+package sieve
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreScripts(t *testing.T) {
+	store := NewStore()
+	if err := store.SetScript("Bob@Example.com", `frobnicate;`); err == nil {
+		t.Errorf("expected error for invalid script")
+	}
+	if _, found := store.GetScript("bob@example.com"); found {
+		t.Errorf("invalid script should not be installed")
+	}
+	if err := store.SetScript("Bob@Example.com", `keep;`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	script, found := store.GetScript("bob@example.com")
+	if !found || script != `keep;` {
+		t.Errorf("expected script to be found case-insensitively, got %q (found=%v)", script, found)
+	}
+	store.DeleteScript("bob@example.com")
+	if _, found := store.GetScript("bob@example.com"); found {
+		t.Errorf("expected script to be deleted")
+	}
+}
+
+func TestStoreFolders(t *testing.T) {
+	store := NewStore()
+	if err := store.CreateFolder("bob@example.com", "Receipts"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.CreateFolder("bob@example.com", "spam"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.CreateFolder("bob@example.com", " "); err == nil {
+		t.Errorf("expected error for empty folder name")
+	}
+	expected := []string{FolderInbox, FolderSpam, "Receipts"}
+	if folders := store.GetFolders("BOB@example.com"); !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected %v, got %v", expected, folders)
+	}
+	if folders := store.GetFolders("carol@example.com"); !reflect.DeepEqual(folders, []string{FolderInbox, FolderSpam}) {
+		t.Errorf("expected default folders, got %v", folders)
+	}
+}
+
+func TestStoreDeliver(t *testing.T) {
+	store := NewStore()
+	err := store.SetScript("bob@example.com", `require ["fileinto", "imap4flags"];
+if header :is "x-spam-flag" "yes" { addflag "$Junk"; fileinto "Spam"; }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = store.SetScript("dave@example.com", `redirect "erin@example.com";`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = store.SetScript("frank@example.com", `discard;`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg := newTestMessage(t)
+
+	delivery := store.Deliver(msg.Sender, []string{"bob@example.com", "carol@example.org", "dave@example.com", "frank@example.com"}, msg.Header, msg.Size)
+	if !delivery.Filtered || delivery.Rejected {
+		t.Fatalf("unexpected delivery status: %+v", delivery)
+	}
+	expected := []Placement{
+		{Mailbox: "bob@example.com", Folder: "Spam", Flags: []string{"$Junk"}},
+		{Mailbox: "carol@example.org", Folder: FolderInbox},
+		{Mailbox: "erin@example.com", Folder: FolderInbox},
+	}
+	if !reflect.DeepEqual(delivery.Placements, expected) {
+		t.Errorf("expected %+v, got %+v", expected, delivery.Placements)
+	}
+	// fileinto implicitly creates the folder
+	if folders := store.GetFolders("bob@example.com"); len(folders) != 2 {
+		t.Errorf("expected Spam not to be duplicated, got %v", folders)
+	}
+
+	// no script: not filtered, everything in the Inbox
+	delivery = store.Deliver(msg.Sender, []string{"carol@example.org"}, msg.Header, msg.Size)
+	if delivery.Filtered || len(delivery.Placements) != 1 {
+		t.Errorf("unexpected delivery for unfiltered mailbox: %+v", delivery)
+	}
+
+	// reject refuses the whole message
+	if err := store.SetScript("carol@example.org", `require "reject"; reject "go away";`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delivery = store.Deliver(msg.Sender, []string{"bob@example.com", "carol@example.org"}, msg.Header, msg.Size)
+	if !delivery.Rejected || delivery.Reason != "go away" {
+		t.Errorf("expected rejection, got %+v", delivery)
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sieve", "scripts.json")
+	store := NewStore()
+	if err := store.SetFile(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.SetScript("Bob@Example.com", `require "fileinto"; fileinto "Work";`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.SetScript("carol@example.org", `keep;`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.DeleteScript("carol@example.org")
+	if err := store.CreateFolder("carol@example.org", "Receipts"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reloaded := NewStore()
+	if err := reloaded.SetFile(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if script, found := reloaded.GetScript("bob@example.com"); !found || script != `require "fileinto"; fileinto "Work";` {
+		t.Errorf("expected the script to be reloaded, got %q (found=%v)", script, found)
+	}
+	if _, found := reloaded.GetScript("carol@example.org"); found {
+		t.Errorf("expected the deleted script not to be reloaded")
+	}
+	if folders := reloaded.GetFolders("carol@example.org"); !reflect.DeepEqual(folders, []string{FolderInbox, FolderSpam, "Receipts"}) {
+		t.Errorf("expected the folders to be reloaded, got %v", folders)
+	}
+
+	if err := os.WriteFile(filename, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore().SetFile(filename); err == nil {
+		t.Errorf("expected error for a corrupted file")
+	}
+}
@@ -5,6 +5,7 @@ type Configuration struct {
 	MaxMessageSize int                 `json:"max_message_size"` // bytes; 0 = unlimited
 	RequireAuth    bool                `json:"require_auth"`     // when true, clients must AUTH before sending
 	Relays         RelayConfigurations `json:"relays"`
+	RecordDir      string              `json:"record_dir"` // when set, each session is saved there as a transcript
 }
 
 type RelayConfigurations map[string]RelayConfiguration
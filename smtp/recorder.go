@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// recordingListener records the sessions of the accepted connections as transcripts.
+type recordingListener struct {
+	net.Listener
+	dir string
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, dir: l.dir, start: time.Now()}, nil
+}
+
+// recordingConn records the lines read from the client and the bytes written by the
+// server. Once STARTTLS is accepted the session is encrypted and the recording stops.
+// The credentials of AUTH are recorded as RedactedCredentials, and replayed so.
+type recordingConn struct {
+	net.Conn
+	dir   string
+	start time.Time
+
+	mu         sync.Mutex
+	transcript Transcript
+	pending    []byte // client bytes of an incomplete line
+	lastLine   string // last line sent by the client
+	challenged bool   // the server sent an AUTH challenge (334), answered by credentials
+	encrypted  bool
+	closed     bool
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n > 0 && !c.encrypted {
+		c.pending = append(c.pending, b[:n]...)
+		for {
+			index := bytes.IndexByte(c.pending, '\n')
+			if index < 0 {
+				break
+			}
+			line := c.redact(c.pending[:index+1])
+			c.transcript.Add(TranscriptClient, time.Since(c.start), line)
+			c.lastLine = strings.TrimSpace(string(line))
+			c.pending = c.pending[index+1:]
+		}
+	}
+	return n, err
+}
+
+// RedactedCredentials replaces the credentials sent by the clients in the
+// recorded sessions.
+const RedactedCredentials = "***"
+
+// redact returns the client line with the AUTH initial response, or the answer
+// to an AUTH challenge, replaced by RedactedCredentials.
+func (c *recordingConn) redact(line []byte) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	ending := line[len(content):]
+	if c.challenged {
+		c.challenged = false
+		return append([]byte(RedactedCredentials), ending...)
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		return append([]byte(fields[0]+" "+fields[1]+" "+RedactedCredentials), ending...)
+	}
+	return line
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.encrypted {
+		c.transcript.Add(TranscriptServer, time.Since(c.start), b)
+		c.challenged = bytes.HasPrefix(b, []byte("334 "))
+		if strings.EqualFold(c.lastLine, "STARTTLS") && bytes.HasPrefix(b, []byte("220")) {
+			c.encrypted = true
+			c.transcript.Add(TranscriptComment, 0, []byte("STARTTLS: the rest of the session is encrypted and not recorded"))
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		if err := c.save(); err != nil {
+			log.Logf(log.ERROR, "failed to save smtp session transcript: %v", err)
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// save writes the transcript as <dir>/<start time>-<peer>.smtp.
+func (c *recordingConn) save() error {
+	if len(c.pending) > 0 {
+		c.transcript.Add(TranscriptClient, time.Since(c.start), c.redact(c.pending))
+	}
+	peer := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(c.RemoteAddr().String())
+	name := fmt.Sprintf("%v-%v.smtp", c.start.UTC().Format("20060102T150405.000000000Z"), peer)
+	file, err := os.Create(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "# session from %v at %v\n", c.RemoteAddr(), c.start.UTC().Format(time.RFC3339Nano))
+	if _, err := c.transcript.WriteTo(file); err != nil {
+		return err
+	}
+	log.Logf(log.DEBUG, "saved smtp session transcript %v", name)
+	return nil
+}
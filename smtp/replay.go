@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Reply comparison modes of a replay.
+const (
+	CompareCode = "code" // compare the reply codes only
+	CompareText = "text" // compare the full replies
+	CompareNone = "none" // only check that every reply is received
+)
+
+// ReplayOptions configures the replay of a transcript.
+type ReplayOptions struct {
+	Speed     float64       // timing acceleration (2 = twice as fast); 0 sends without delay
+	Compare   string        // CompareCode (default), CompareText or CompareNone
+	Timeout   time.Duration // maximum wait for each reply (default 30s)
+	TLSConfig *tls.Config   // used after an accepted STARTTLS
+}
+
+// ReplayMismatch is a reply differing from the recorded one.
+type ReplayMismatch struct {
+	Command  string // client line the reply answers, empty for the greeting
+	Expected string
+	Actual   string
+}
+
+func (m ReplayMismatch) String() string {
+	command := m.Command
+	if command == "" {
+		command = "(greeting)"
+	}
+	return fmt.Sprintf("%v: expected %q, got %q", command, m.Expected, m.Actual)
+}
+
+// ReplayResult summarizes the replay of a transcript.
+type ReplayResult struct {
+	Commands   int // client lines sent
+	Replies    int // server replies received
+	Mismatches []ReplayMismatch
+}
+
+// ReplayTranscript connects to the SMTP server at addr and sends the client lines of
+// the transcript with their recorded timing. Before each line, the replies recorded
+// since the previous one are read and compared with the recorded replies.
+func ReplayTranscript(addr string, transcript *Transcript, options ReplayOptions) (ReplayResult, error) {
+	if options.Compare == "" {
+		options.Compare = CompareCode
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 30 * time.Second
+	}
+	switch options.Compare {
+	case CompareCode, CompareText, CompareNone:
+	default:
+		return ReplayResult{}, fmt.Errorf("unknown reply comparison %q", options.Compare)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, options.Timeout)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+
+	var result ReplayResult
+	var expected strings.Builder // server bytes recorded since the last client line
+	var command string           // last client line outside of the DATA content
+	inData := false
+	start := time.Now()
+
+	// checkReplies reads the replies recorded since the last client line.
+	checkReplies := func() error {
+		replies := splitReplies(expected.String())
+		expected.Reset()
+		for _, expectedReply := range replies {
+			conn.SetReadDeadline(time.Now().Add(options.Timeout))
+			actualReply, err := readReply(reader)
+			if err != nil {
+				result.Mismatches = append(result.Mismatches, ReplayMismatch{Command: command, Expected: expectedReply, Actual: err.Error()})
+				return errReplayStopped
+			}
+			result.Replies++
+			if !repliesMatch(expectedReply, actualReply, options.Compare) {
+				result.Mismatches = append(result.Mismatches, ReplayMismatch{Command: command, Expected: expectedReply, Actual: actualReply})
+			}
+			switch {
+			case strings.EqualFold(command, "DATA") && strings.HasPrefix(actualReply, "354"):
+				inData = true
+			case strings.EqualFold(command, "STARTTLS") && strings.HasPrefix(actualReply, "220"):
+				tlsConn := tls.Client(conn, options.TLSConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					return fmt.Errorf("TLS handshake failed: %v", err)
+				}
+				conn = tlsConn
+				reader = bufio.NewReader(conn)
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range transcript.Entries {
+		switch entry.Direction {
+		case TranscriptServer:
+			expected.Write(entry.Data)
+		case TranscriptClient:
+			if err := checkReplies(); err != nil {
+				return result, ignoreReplayStopped(err)
+			}
+			if options.Speed > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(entry.Offset) / options.Speed))))
+			}
+			if _, err := conn.Write(entry.Data); err != nil {
+				return result, err
+			}
+			result.Commands++
+			line := strings.TrimRight(string(entry.Data), "\r\n")
+			switch {
+			case inData && line == ".":
+				inData = false
+				command = "."
+			case !inData:
+				command = line
+			}
+		}
+	}
+	return result, ignoreReplayStopped(checkReplies())
+}
+
+// errReplayStopped stops a replay whose server closed the connection or did not
+// reply in time, which is reported as a mismatch rather than as an error.
+var errReplayStopped = errors.New("replay stopped")
+
+func ignoreReplayStopped(err error) error {
+	if err == errReplayStopped {
+		return nil
+	}
+	return err
+}
+
+// splitReplies splits recorded server bytes into replies, a reply ending with
+// the line having a space (or nothing) after its code.
+func splitReplies(data string) []string {
+	var replies []string
+	var reply strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			continue
+		}
+		reply.WriteString(line)
+		if isLastReplyLine(line) {
+			replies = append(replies, reply.String())
+			reply.Reset()
+		}
+	}
+	if reply.Len() > 0 {
+		replies = append(replies, reply.String())
+	}
+	return replies
+}
+
+func isLastReplyLine(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	return len(line) <= 3 || line[3] != '-'
+}
+
+// readReply reads a complete (possibly multiline) reply.
+func readReply(reader *bufio.Reader) (string, error) {
+	var reply strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		reply.WriteString(line)
+		if err != nil {
+			return reply.String(), fmt.Errorf("no reply (%v)", err)
+		}
+		if isLastReplyLine(line) {
+			return reply.String(), nil
+		}
+	}
+}
+
+func repliesMatch(expected, actual, compare string) bool {
+	switch compare {
+	case CompareNone:
+		return true
+	case CompareText:
+		return expected == actual
+	default:
+		return replyCode(expected) == replyCode(actual)
+	}
+}
+
+func replyCode(reply string) string {
+	if len(reply) < 3 {
+		return reply
+	}
+	return reply[:3]
+}
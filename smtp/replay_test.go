@@ -0,0 +1,204 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayTestEmail = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Replay\r\n\r\nHello\r\n.leading dot\r\n"
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	transcript := &Transcript{}
+	transcript.Add(TranscriptComment, 0, []byte("note"))
+	transcript.Add(TranscriptServer, 0, []byte("220 ready\r\n"))
+	transcript.Add(TranscriptClient, 1500*time.Millisecond, []byte("EHLO \"quoted\"\n"))
+	transcript.Add(TranscriptClient, 2*time.Second, []byte("caf\xe9\r\n"))
+
+	var buffer bytes.Buffer
+	if _, err := transcript.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseTranscript(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Entries) != len(transcript.Entries) {
+		t.Fatalf("expected %d entries, got %d", len(transcript.Entries), len(parsed.Entries))
+	}
+	for i, entry := range transcript.Entries {
+		got := parsed.Entries[i]
+		if got.Direction != entry.Direction || got.Offset != entry.Offset || !bytes.Equal(got.Data, entry.Data) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, entry, got)
+		}
+	}
+
+	if _, err := ParseTranscript(strings.NewReader("X 0 \"data\"\n")); err == nil {
+		t.Errorf("expected an error for an unknown direction")
+	}
+}
+
+func TestNewTranscriptFromEmail(t *testing.T) {
+	transcript, err := NewTranscriptFromEmail([]byte(replayTestEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client []string
+	for _, entry := range transcript.Entries {
+		if entry.Direction == TranscriptClient {
+			client = append(client, string(entry.Data))
+		}
+	}
+	lines := strings.Join(client, "")
+	for _, expected := range []string{"MAIL FROM:<alice@example.com>\r\n", "RCPT TO:<bob@example.com>\r\n", "..leading dot\r\n.\r\nQUIT\r\n"} {
+		if !strings.Contains(lines, expected) {
+			t.Errorf("expected %q in %q", expected, lines)
+		}
+	}
+}
+
+// startRecordingServer serves SMTP on a local port, recording the sessions in dir.
+func startRecordingServer(t *testing.T, dir string, behavior SmtpBehavior) string {
+	t.Helper()
+	s := NewServer(Configuration{RecordDir: dir}, &mockIoStorage{SetUUID: "uuid"})
+	s.SetGetBehavior(func() SmtpBehavior { return behavior })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Shutdown() })
+	return listener.Addr().String()
+}
+
+// sendReplayTestEmail sends the test email without STARTTLS, so that the whole session is recorded.
+func sendReplayTestEmail(t *testing.T, addr string) {
+	t.Helper()
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Mail("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(replayTestEmail))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	addr := startRecordingServer(t, dir, SmtpBehavior{})
+	sendReplayTestEmail(t, addr)
+
+	// the transcript is saved when the server closes the connection
+	var files []string
+	for deadline := time.Now().Add(5 * time.Second); len(files) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.smtp"))
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 transcript, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript, err := ParseTranscript(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"..leading dot\r\n"`) {
+		t.Errorf("DATA bytes should be recorded as sent, got:\n%s", data)
+	}
+
+	result, err := ReplayTranscript(addr, transcript, ReplayOptions{Compare: CompareText})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Mismatches) != 0 || result.Replies == 0 {
+		t.Errorf("expected identical replies, got %+v", result)
+	}
+
+	// replaying against a server rejecting the emails reports the DATA reply
+	rejecting := startRecordingServer(t, t.TempDir(), SmtpBehavior{RejectRate: 100, RejectMessage: "rejected"})
+	result, err = ReplayTranscript(rejecting, transcript, ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Mismatches) != 1 || result.Mismatches[0].Command != "." || !strings.HasPrefix(result.Mismatches[0].Actual, "5") {
+		t.Errorf("expected a mismatch on the end of DATA, got %+v", result.Mismatches)
+	}
+
+	// emails are replayed by their reply codes
+	transcript, err = NewTranscriptFromEmail([]byte(replayTestEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = ReplayTranscript(addr, transcript, ReplayOptions{})
+	if err != nil || len(result.Mismatches) != 0 {
+		t.Errorf("expected no mismatch, got %+v (%v)", result, err)
+	}
+}
+
+func TestRecordingRedactsCredentials(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &recordingConn{Conn: server, start: time.Now()}
+
+	go func() {
+		client.Write([]byte("EHLO client\r\nAUTH PLAIN AGJvYgBzZWNyZXQ=\r\nAUTH LOGIN\r\n"))
+		buffer := make([]byte, 64)
+		client.Read(buffer) // challenge
+		client.Write([]byte("Ym9i\r\n"))
+		client.Read(buffer) // challenge
+		client.Write([]byte("c2VjcmV0\r\nQUIT\r\n"))
+	}()
+	read := func(expected string) {
+		t.Helper()
+		line := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, line); err != nil || string(line) != expected {
+			t.Fatalf("expected %q, got %q (%v)", expected, line, err)
+		}
+	}
+	read("EHLO client\r\nAUTH PLAIN AGJvYgBzZWNyZXQ=\r\nAUTH LOGIN\r\n")
+	conn.Write([]byte("334 VXNlcm5hbWU6\r\n"))
+	read("Ym9i\r\n")
+	conn.Write([]byte("334 UGFzc3dvcmQ6\r\n"))
+	read("c2VjcmV0\r\nQUIT\r\n")
+
+	var buffer bytes.Buffer
+	conn.transcript.WriteTo(&buffer)
+	for _, secret := range []string{"AGJvYgBzZWNyZXQ=", "Ym9i", "c2VjcmV0"} {
+		if strings.Contains(buffer.String(), secret) {
+			t.Errorf("credentials %q should be redacted, got:\n%s", secret, buffer.String())
+		}
+	}
+	var lines []string
+	for _, entry := range conn.transcript.Entries {
+		if entry.Direction == TranscriptClient {
+			lines = append(lines, string(entry.Data))
+		}
+	}
+	expected := []string{"EHLO client\r\n", "AUTH PLAIN ***\r\n", "AUTH LOGIN\r\n", "***\r\n", "***\r\n", "QUIT\r\n"}
+	if strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Errorf("expected client lines %q, got %q", expected, lines)
+	}
+}
@@ -14,12 +14,16 @@ import (
 	"net"
 	"net/mail"
 	"net/smtp"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/chrj/smtpd"
 
 	"mock-my-mta/log"
+	"mock-my-mta/sieve"
 	"mock-my-mta/storage"
+	"mock-my-mta/storage/multipart"
 )
 
 // SmtpBehavior defines runtime-configurable SMTP behavior for chaos testing.
@@ -38,6 +42,7 @@ type Server struct {
 	storageEngine storage.StorageService
 	onNewEmail    func(emailID string)   // callback for WebSocket notifications
 	getBehavior   func() SmtpBehavior    // callback to get current SMTP behavior settings
+	sieveStore    *sieve.Store           // per-mailbox Sieve scripts evaluated at delivery
 }
 
 // SetOnNewEmail registers a callback invoked when a new email is stored.
@@ -50,12 +55,17 @@ func (s *Server) SetGetBehavior(fn func() SmtpBehavior) {
 	s.getBehavior = fn
 }
 
+// SetSieveStore registers the Sieve scripts evaluated for each recipient at delivery time.
+func (s *Server) SetSieveStore(store *sieve.Store) {
+	s.sieveStore = store
+}
+
 func NewServer(config Configuration, storageEngine storage.StorageService) *Server {
 	s := &Server{
 		configuration: config,
 		storageEngine: storageEngine,
 	}
-	tlsConfig := generateSelfSignedTLS()
+	tlsConfig := GenerateSelfSignedTLS()
 
 	s.server = &smtpd.Server{
 		WelcomeMessage:    "MockMyMTA ESMTP ready",
@@ -83,7 +93,24 @@ func NewServer(config Configuration, storageEngine storage.StorageService) *Serv
 
 func (s *Server) ListenAndServe() error {
 	log.Logf(log.INFO, "starting smtp server on %v", s.configuration.Addr)
-	return s.server.ListenAndServe(s.configuration.Addr)
+	listener, err := net.Listen("tcp", s.configuration.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until Shutdown is called. When a
+// record directory is configured, each session is saved there as a transcript.
+func (s *Server) Serve(listener net.Listener) error {
+	if s.configuration.RecordDir != "" {
+		if err := os.MkdirAll(s.configuration.RecordDir, 0755); err != nil {
+			return err
+		}
+		log.Logf(log.INFO, "recording smtp sessions in %v", s.configuration.RecordDir)
+		listener = &recordingListener{Listener: listener, dir: s.configuration.RecordDir}
+	}
+	return s.server.Serve(listener)
 }
 
 func (s *Server) Shutdown() error {
@@ -147,6 +174,25 @@ func (s *Server) handler(peer smtpd.Peer, env smtpd.Envelope) error {
 	if err != nil {
 		return err
 	}
+	// The folders and flags are recorded by the server only, never chosen by the sender
+	delete(message.Header, multipart.FolderHeader)
+	delete(message.Header, multipart.FlagsHeader)
+	// Recipient-side filtering (Sieve)
+	if s.sieveStore != nil {
+		delivery := s.sieveStore.Deliver(env.Sender, env.Recipients, message.Header, len(env.Data))
+		if delivery.Rejected {
+			log.Logf(log.INFO, "rejecting email (sieve: %v)", delivery.Reason)
+			return &smtpd.Error{Code: 550, Message: delivery.Reason}
+		}
+		if len(delivery.Placements) == 0 {
+			log.Logf(log.INFO, "email discarded by sieve for all recipients")
+			return nil
+		}
+		if delivery.Filtered {
+			applyPlacements(message, delivery.Placements)
+		}
+	}
+
 	uuid, err := s.storageEngine.Set(message)
 	if err != nil {
 		return err
@@ -173,6 +219,21 @@ func (s *Server) handler(peer smtpd.Peer, env smtpd.Envelope) error {
 	return nil
 }
 
+// applyPlacements records the Sieve folders and flags as headers of the stored message.
+func applyPlacements(message *mail.Message, placements []sieve.Placement) {
+	var folders, flags []string
+	for _, placement := range placements {
+		folders = append(folders, multipart.FormatMailboxHeader(placement.Mailbox, placement.Folder))
+		if len(placement.Flags) > 0 {
+			flags = append(flags, multipart.FormatMailboxHeader(placement.Mailbox, strings.Join(placement.Flags, " ")))
+		}
+	}
+	message.Header[multipart.FolderHeader] = folders
+	if len(flags) > 0 {
+		message.Header[multipart.FlagsHeader] = flags
+	}
+}
+
 type Envelope struct {
 	Sender     string
 	Recipients []string
@@ -242,9 +303,9 @@ func newLoginAuth(username, password string) smtp.Auth {
 	return &loginAuth{username, password}
 }
 
-// generateSelfSignedTLS creates a self-signed TLS certificate for STARTTLS.
+// GenerateSelfSignedTLS creates a self-signed TLS certificate for STARTTLS.
 // The certificate is generated in memory — no files written to disk.
-func generateSelfSignedTLS() *tls.Config {
+func GenerateSelfSignedTLS() *tls.Config {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		log.Logf(log.ERROR, "failed to generate TLS key: %v", err)
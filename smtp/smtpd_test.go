@@ -9,7 +9,9 @@ import (
 	"testing"
 
 	"github.com/chrj/smtpd"
+	"mock-my-mta/sieve"
 	"mock-my-mta/storage"
+	"mock-my-mta/storage/multipart"
 )
 
 func TestRelayConfigurations_Names(t *testing.T) {
@@ -370,3 +372,84 @@ func TestServer_handler(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_handlerSieve(t *testing.T) {
+	mockPeer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}}
+	data := []byte("From: sender@example.com\nTo: a@example.com, b@example.com\nSubject: Win a prize\n\nThis is a test email.")
+	envelope := smtpd.Envelope{Sender: "sender@example.com", Recipients: []string{"a@example.com", "b@example.com"}, Data: data}
+
+	sieveStore := sieve.NewStore()
+	if err := sieveStore.SetScript("a@example.com", `require ["fileinto", "imap4flags"]; if header :contains "subject" "prize" { addflag "$Junk"; fileinto "Spam"; }`); err != nil {
+		t.Fatal(err)
+	}
+
+	// fileinto: placement headers are recorded in the stored message
+	mockStore := &mockIoStorage{SetUUID: "uuid"}
+	s := NewServer(Configuration{}, mockStore)
+	s.SetSieveStore(sieveStore)
+	if err := s.handler(mockPeer, envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	folders := mockStore.LastMessage.Header[multipart.FolderHeader]
+	expectedFolders := []string{"<a@example.com> Spam", "<b@example.com> Inbox"}
+	if !reflect.DeepEqual(folders, expectedFolders) {
+		t.Errorf("expected folders %v, got %v", expectedFolders, folders)
+	}
+	if flags := mockStore.LastMessage.Header.Get(multipart.FlagsHeader); flags != "<a@example.com> $Junk" {
+		t.Errorf("unexpected flags header %q", flags)
+	}
+
+	// discard for every recipient: the message is accepted but not stored
+	for _, mailbox := range envelope.Recipients {
+		if err := sieveStore.SetScript(mailbox, `discard;`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mockStore = &mockIoStorage{SetUUID: "uuid"}
+	s = NewServer(Configuration{}, mockStore)
+	s.SetSieveStore(sieveStore)
+	if err := s.handler(mockPeer, envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mockStore.SetCalled {
+		t.Errorf("discarded message should not be stored")
+	}
+
+	// reject: the transaction fails with a 550
+	if err := sieveStore.SetScript("b@example.com", `require "reject"; reject "not wanted";`); err != nil {
+		t.Fatal(err)
+	}
+	err := s.handler(mockPeer, envelope)
+	smtpErr, ok := err.(*smtpd.Error)
+	if !ok || smtpErr.Code != 550 || smtpErr.Message != "not wanted" {
+		t.Errorf("expected 550 rejection, got %v", err)
+	}
+}
+
+func TestServer_handlerForgedPlacements(t *testing.T) {
+	mockPeer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}}
+	data := []byte("From: sender@example.com\nTo: a@example.com\nX-Mailbox-Folder: <a@example.com> Archive\nX-Mailbox-Flags: <a@example.com> \\Seen\nSubject: Test\n\nThis is a test email.")
+	envelope := smtpd.Envelope{Sender: "sender@example.com", Recipients: []string{"a@example.com"}, Data: data}
+
+	sieveStore := sieve.NewStore()
+	if err := sieveStore.SetScript("b@example.com", `require "fileinto"; fileinto "Spam";`); err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]*sieve.Store{"no sieve": nil, "no script for the recipient": sieveStore} {
+		mockStore := &mockIoStorage{SetUUID: "uuid"}
+		s := NewServer(Configuration{}, mockStore)
+		if store != nil {
+			s.SetSieveStore(store)
+		}
+		if err := s.handler(mockPeer, envelope); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		header := mockStore.LastMessage.Header
+		if _, ok := header[multipart.FolderHeader]; ok {
+			t.Errorf("%v: the folder header of the sender must be removed, got %v", name, header[multipart.FolderHeader])
+		}
+		if _, ok := header[multipart.FlagsHeader]; ok {
+			t.Errorf("%v: the flags header of the sender must be removed, got %v", name, header[multipart.FlagsHeader])
+		}
+	}
+}
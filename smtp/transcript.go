@@ -0,0 +1,144 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directions of the transcript entries.
+const (
+	TranscriptClient  = 'C' // a line sent by the client
+	TranscriptServer  = 'S' // bytes sent by the server
+	TranscriptComment = '#' // a note, ignored by the replay
+)
+
+// TranscriptEntry is a line sent by the client, bytes sent by the server or a comment.
+type TranscriptEntry struct {
+	Direction byte
+	Offset    time.Duration // since the start of the session
+	Data      []byte
+}
+
+// Transcript is a recorded SMTP session. Its text format has one entry per line:
+//
+//	# comment
+//	C 0.104211 "EHLO client.example.com\r\n"
+//	S 0.104390 "250-localhost\r\n250 8BITMIME\r\n"
+//
+// with the offset in seconds and the exact bytes as a Go quoted string, so that
+// bare LFs, dot-stuffing and 8-bit content of the DATA phase are kept.
+type Transcript struct {
+	Entries []TranscriptEntry
+}
+
+// Add appends an entry to the transcript.
+func (t *Transcript) Add(direction byte, offset time.Duration, data []byte) {
+	t.Entries = append(t.Entries, TranscriptEntry{Direction: direction, Offset: offset, Data: append([]byte(nil), data...)})
+}
+
+// WriteTo writes the transcript in its text format.
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+	for _, entry := range t.Entries {
+		if entry.Direction == TranscriptComment {
+			fmt.Fprintf(&buffer, "# %s\n", entry.Data)
+			continue
+		}
+		fmt.Fprintf(&buffer, "%c %.6f %s\n", entry.Direction, entry.Offset.Seconds(), strconv.Quote(string(entry.Data)))
+	}
+	return buffer.WriteTo(w)
+}
+
+// ParseTranscript reads a transcript in its text format.
+func ParseTranscript(r io.Reader) (*Transcript, error) {
+	transcript := &Transcript{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line[0] == TranscriptComment:
+			transcript.Add(TranscriptComment, 0, []byte(strings.TrimSpace(line[1:])))
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || len(fields[0]) != 1 || (fields[0][0] != TranscriptClient && fields[0][0] != TranscriptServer) {
+			return nil, fmt.Errorf("line %d: expected \"C|S <seconds> <quoted data>\"", lineNumber)
+		}
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("line %d: invalid offset %q", lineNumber, fields[1])
+		}
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted data: %v", lineNumber, err)
+		}
+		transcript.Add(fields[0][0], time.Duration(seconds*float64(time.Second)), []byte(data))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return transcript, nil
+}
+
+// NewTranscriptFromEmail builds the session delivering a captured email. The
+// envelope comes from the From, To, Cc and Bcc headers, and the replies are only
+// known by their codes: replay it comparing codes.
+func NewTranscriptFromEmail(raw []byte) (*Transcript, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid From header: %v", err)
+	}
+	var recipients []string
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		addresses, err := message.Header.AddressList(header)
+		if err != nil && err != mail.ErrHeaderNotPresent {
+			return nil, fmt.Errorf("invalid %v header: %v", header, err)
+		}
+		for _, address := range addresses {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipient in the To, Cc and Bcc headers")
+	}
+
+	transcript := &Transcript{}
+	command := func(line string, code string) {
+		transcript.Add(TranscriptClient, 0, []byte(line+"\r\n"))
+		transcript.Add(TranscriptServer, 0, []byte(code+" \r\n"))
+	}
+	transcript.Add(TranscriptComment, 0, []byte("generated from a captured email"))
+	transcript.Add(TranscriptServer, 0, []byte("220 \r\n"))
+	command("EHLO mock-my-mta", "250")
+	command("MAIL FROM:<"+from.Address+">", "250")
+	for _, recipient := range recipients {
+		command("RCPT TO:<"+recipient+">", "250")
+	}
+	command("DATA", "354")
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		transcript.Add(TranscriptClient, 0, []byte(line+"\r\n"))
+	}
+	transcript.Add(TranscriptClient, 0, []byte(".\r\n"))
+	transcript.Add(TranscriptServer, 0, []byte("250 \r\n"))
+	command("QUIT", "221")
+	return transcript, nil
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+)
+
+// blob is a decoded attachment shared by the emails attaching the same content,
+// with its base64 encodings found in their raw emails, by line ending.
+type blob struct {
+	data      []byte
+	encodings map[string][]byte
+	refs      int
+}
+
+// blobStore holds the decoded attachments of a layer by SHA-256: an attachment
+// sent many times is kept once, and freed when the last email referring to it is
+// removed. It is not safe for concurrent use; the layer holds its own lock.
+type blobStore struct {
+	blobs map[string]*blob
+	size  int64 // bytes of the distinct blobs
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{blobs: make(map[string]*blob)}
+}
+
+// acquire adds a reference to the content of the hash, and returns the shared
+// data and the number of bytes it added to the store.
+func (b *blobStore) acquire(hash string, data []byte) ([]byte, int64) {
+	if existing, ok := b.blobs[hash]; ok {
+		existing.refs++
+		return existing.data, 0
+	}
+	b.blobs[hash] = &blob{data: data, refs: 1}
+	b.size += int64(len(data))
+	return data, int64(len(data))
+}
+
+// release removes a reference to the content of the hash, and returns the number
+// of bytes freed when it was the last one.
+func (b *blobStore) release(hash string) int64 {
+	existing, ok := b.blobs[hash]
+	if !ok {
+		return 0
+	}
+	existing.refs--
+	if existing.refs > 0 {
+		return 0
+	}
+	freed := int64(len(existing.data))
+	for _, encoded := range existing.encodings {
+		freed += int64(len(encoded))
+	}
+	delete(b.blobs, hash)
+	b.size -= freed
+	return freed
+}
+
+// encoding returns the shared base64 encoding of an acquired content with the
+// line ending, adding the encoded bytes when missing, and the number of bytes it
+// added to the store.
+func (b *blobStore) encoding(hash string, lineEnding string, encoded []byte) ([]byte, int64) {
+	existing, ok := b.blobs[hash]
+	if !ok {
+		return encoded, 0
+	}
+	if shared, ok := existing.encodings[lineEnding]; ok {
+		return shared, 0
+	}
+	if existing.encodings == nil {
+		existing.encodings = make(map[string][]byte)
+	}
+	existing.encodings[lineEnding] = encoded
+	b.size += int64(len(encoded))
+	return encoded, int64(len(encoded))
+}
+
+// minSharedEncodingSize is the size under which an encoded attachment is kept in
+// the raw email rather than rebuilt from the blob store.
+const minSharedEncodingSize = 256
+
+// rawSegment is a part of a raw email: literal bytes, or an attachment of the
+// blob store in its base64 encoding.
+type rawSegment struct {
+	literal      []byte
+	attachmentID string // the attachment encoded, for the segments without literal bytes
+	lineEnding   string
+	encoded      []byte // the base64 lines of the attachment, shared by the memory layer
+}
+
+// splitRawEmail returns the raw email as literal segments and references to its
+// attachments, wherever their encoding as 76-character base64 lines is found in
+// the raw bytes. Rebuilding the raw email gives the same bytes: an encoding the
+// attachment was not sent with is just not found.
+func splitRawEmail(rawEmail []byte, attachments map[string]Attachment) []rawSegment {
+	segments := []rawSegment{{literal: rawEmail}}
+	attachmentIDs := make([]string, 0, len(attachments))
+	for attachmentID := range attachments {
+		attachmentIDs = append(attachmentIDs, attachmentID)
+	}
+	sort.Strings(attachmentIDs)
+	for _, attachmentID := range attachmentIDs {
+		for _, lineEnding := range []string{"\r\n", "\n"} {
+			encoded := encodeBase64Lines(attachments[attachmentID].Data, lineEnding)
+			if len(encoded) < minSharedEncodingSize {
+				break
+			}
+			var replaced bool
+			if segments, replaced = replaceSegment(segments, encoded, rawSegment{attachmentID: attachmentID, lineEnding: lineEnding, encoded: encoded}); replaced {
+				break
+			}
+		}
+	}
+	// the literal bytes are copied so that the raw email can be freed
+	for i := range segments {
+		if segments[i].literal != nil {
+			segments[i].literal = bytes.Clone(segments[i].literal)
+		}
+	}
+	return segments
+}
+
+// replaceSegment replaces the first occurrence of the bytes in the literal
+// segments by the reference, returning false when not found.
+func replaceSegment(segments []rawSegment, data []byte, reference rawSegment) ([]rawSegment, bool) {
+	for i, segment := range segments {
+		if segment.literal == nil {
+			continue
+		}
+		index := bytes.Index(segment.literal, data)
+		if index < 0 {
+			continue
+		}
+		replaced := append([]rawSegment{}, segments[:i]...)
+		if index > 0 {
+			replaced = append(replaced, rawSegment{literal: segment.literal[:index]})
+		}
+		replaced = append(replaced, reference)
+		if rest := segment.literal[index+len(data):]; len(rest) > 0 {
+			replaced = append(replaced, rawSegment{literal: rest})
+		}
+		return append(replaced, segments[i+1:]...), true
+	}
+	return segments, false
+}
+
+// joinRawEmail rebuilds the raw email of the segments.
+func joinRawEmail(segments []rawSegment) []byte {
+	if len(segments) == 1 && segments[0].literal != nil {
+		return segments[0].literal
+	}
+	var raw bytes.Buffer
+	for _, segment := range segments {
+		if segment.literal != nil {
+			raw.Write(segment.literal)
+		} else {
+			raw.Write(segment.encoded)
+		}
+	}
+	return raw.Bytes()
+}
+
+// literalSize returns the bytes of the literal segments.
+func literalSize(segments []rawSegment) int64 {
+	var size int64
+	for _, segment := range segments {
+		size += int64(len(segment.literal))
+	}
+	return size
+}
+
+// encodeBase64Lines encodes the data in base64 lines of 76 characters, as sent by
+// the mail clients, without a line ending after the last line.
+func encodeBase64Lines(data []byte, lineEnding string) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines bytes.Buffer
+	for len(encoded) > 76 {
+		lines.WriteString(encoded[:76])
+		lines.WriteString(lineEnding)
+		encoded = encoded[76:]
+	}
+	lines.WriteString(encoded)
+	return lines.Bytes()
+}
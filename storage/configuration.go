@@ -5,6 +5,16 @@ type StorageLayerConfiguration struct {
 	Type       string            `json:"type"`
 	Scope      []string          `json:"scope"`
 	Parameters map[string]string `json:"parameters"`
+	// Backfill stores in this cache-scoped layer the emails it misses and a later layer holds.
+	Backfill bool `json:"backfill,omitempty"`
+	// Async writes into this writable layer through a background queue, after the
+	// synchronous layers. Its writes no longer fail the caller's.
+	Async bool `json:"async,omitempty"`
+	// QueueSize is the number of writes an async layer can lag behind (default 1000).
+	QueueSize int `json:"queue_size,omitempty"`
+	// Reindex compares this layer with the root layer at startup and repairs it,
+	// for instance a SQLITE index missing the emails added to the root meanwhile.
+	Reindex bool `json:"reindex,omitempty"`
 }
 
 // Operation scopes that can be assigned to a storage layer.
@@ -0,0 +1,56 @@
+package storage
+
+import "context"
+
+// ContextStorage is a storage whose listings stop when the context is done: the
+// search of a client gone away, of a timed out request or of a server shutting
+// down. They then return the error of the context.
+type ContextStorage interface {
+	// SearchEmailsContext is SearchEmails, stopping when the context is done.
+	SearchEmailsContext(ctx context.Context, query string, page, pageSize int) ([]EmailHeader, int, error)
+	// GetMailboxesContext is GetMailboxes, stopping when the context is done.
+	GetMailboxesContext(ctx context.Context) ([]Mailbox, error)
+}
+
+// SearchEmailsContext searches the storage with the context if it is a
+// ContextStorage. Else the context is only checked before the search.
+func SearchEmailsContext(ctx context.Context, s Storage, query string, page, pageSize int) ([]EmailHeader, int, error) {
+	if withContext, ok := s.(ContextStorage); ok {
+		return withContext.SearchEmailsContext(ctx, query, page, pageSize)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return s.SearchEmails(query, page, pageSize)
+}
+
+// GetMailboxesContext lists the mailboxes of the storage with the context if it
+// is a ContextStorage. Else the context is only checked before the listing.
+func GetMailboxesContext(ctx context.Context, s Storage) ([]Mailbox, error) {
+	if withContext, ok := s.(ContextStorage); ok {
+		return withContext.GetMailboxesContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetMailboxes()
+}
+
+// RawContextStorage is a storage whose raw email reads stop when the context is
+// done, returning the error of the context.
+type RawContextStorage interface {
+	// GetRawEmailContext is GetRawEmail, stopping when the context is done.
+	GetRawEmailContext(ctx context.Context, emailID string) ([]byte, error)
+}
+
+// GetRawEmailContext reads the raw email of the storage with the context if it
+// is a RawContextStorage. Else the context is only checked before the read.
+func GetRawEmailContext(ctx context.Context, s Storage, emailID string) ([]byte, error) {
+	if withContext, ok := s.(RawContextStorage); ok {
+		return withContext.GetRawEmailContext(ctx, emailID)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetRawEmail(emailID)
+}
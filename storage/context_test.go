@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// testLayers returns the constructors of the layers implementing the whole
+// storage interface, by name.
+func testLayers() map[string]func(t *testing.T) storageLayer {
+	return map[string]func(t *testing.T) storageLayer{
+		"memory": func(t *testing.T) storageLayer {
+			s, _ := newMemoryStorage()
+			return s
+		},
+		"filesystem": func(t *testing.T) storageLayer {
+			s, _ := newFilesystemStorage(t.TempDir(), "eml")
+			return s
+		},
+		"sqlite": func(t *testing.T) storageLayer {
+			s, err := newSqliteStorage(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.db.Close() })
+			return s
+		},
+		"bolt": func(t *testing.T) storageLayer {
+			s, err := newBoltStorage(filepath.Join(t.TempDir(), "test.bolt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.db.Close() })
+			return s
+		},
+		"s3": func(t *testing.T) storageLayer {
+			_, server := newFakeS3(t)
+			s, err := newS3StorageFromParameters(newS3TestParameters(server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+}
+
+func TestContextCanceledListings(t *testing.T) {
+	for name, newLayer := range testLayers() {
+		t.Run(name, func(t *testing.T) {
+			layer := newLayer(t)
+			if err := layer.load(nil); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 3; i++ {
+				if err := layer.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			for _, query := range []string{"", "from:sender@example.com", "Body"} {
+				if _, _, err := layer.SearchEmailsContext(ctx, query, 1, -1); !errors.Is(err, context.Canceled) {
+					t.Errorf("search %q: expected the search to be canceled, got %v", query, err)
+				}
+			}
+			if _, err := layer.GetMailboxesContext(ctx); !errors.Is(err, context.Canceled) {
+				t.Errorf("expected the mailbox listing to be canceled, got %v", err)
+			}
+			if _, err := GetRawEmailContext(ctx, layer, "email-1"); !errors.Is(err, context.Canceled) {
+				t.Errorf("expected the raw email read to be canceled, got %v", err)
+			}
+
+			// a canceled listing leaves the layer as it was
+			if got, _ := searchIDs(t, layer, "Body"); len(got) != 3 {
+				t.Errorf("expected the 3 emails, got %v", got)
+			}
+			mailboxes, err := layer.GetMailboxesContext(context.Background())
+			if err != nil || len(mailboxes) != 3 {
+				t.Errorf("unexpected mailboxes %v: %v", mailboxes, err)
+			}
+			if raw, err := GetRawEmailContext(context.Background(), layer, "email-1"); err != nil || len(raw) == 0 {
+				t.Errorf("unexpected raw email %q: %v", raw, err)
+			}
+		})
+	}
+}
+
+func TestEngineSearchEmailsContext(t *testing.T) {
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "FILESYSTEM", Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := SearchEmailsContext(ctx, engine, "Body", 1, 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the search to be canceled, got %v", err)
+	}
+	if _, err := GetMailboxesContext(ctx, engine); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the mailbox listing to be canceled, got %v", err)
+	}
+	if _, err := engine.GetRawEmailContext(ctx, "email-1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the raw email read to be canceled, got %v", err)
+	}
+	if _, total, err := SearchEmailsContext(context.Background(), engine, "Body", 1, 10); err != nil || total != 1 {
+		t.Errorf("expected one email, got %v, %v", total, err)
+	}
+}
@@ -1,25 +1,52 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/mail"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+
+	"mock-my-mta/log"
 )
 
 // Engine orchestrates multiple storage layers with scope-based routing.
 // Each method is routed to the subset of layers that declared the relevant scope.
 type Engine struct {
-	allLayers    []storageLayer // all layers in config order
-	readLayers   []storageLayer // scope: read — GetEmailByID, GetBodyVersion, GetAttachments, GetAttachment
-	searchLayers []storageLayer // scope: search — SearchEmails, GetMailboxes
-	writeLayers  []storageLayer // scope: write/cache/all — DeleteEmailByID, DeleteAllEmails, Set
-	rawLayers    []storageLayer // scope: raw — GetRawEmail
+	allLayers    []storageLayer        // all layers in config order
+	layerTypes   []string              // type of each layer, in config order
+	readLayers   []storageLayer        // scope: read — GetEmailByID, GetBodyVersion, GetAttachments, GetAttachment
+	searchLayers []storageLayer        // scope: search — SearchEmails, GetMailboxes
+	writeLayers  []storageLayer        // scope: write/cache/all — DeleteEmailByID, DeleteAllEmails, Set
+	rawLayers    []storageLayer        // scope: raw — GetRawEmail
+	backfilled   map[storageLayer]bool // cache layers receiving the emails they miss on reads
+
+	// async writable layers, written in the background after the writeLayers
+	writeQueues []*writeQueue
+	queues      map[storageLayer]*writeQueue
+
+	// watchers of the FILESYSTEM layers, and the callbacks of the changes they
+	// find and of the deletions
+	stopWatching  context.CancelFunc
+	watchers      sync.WaitGroup
+	notifyMu      sync.RWMutex
+	onNewEmail    func(emailID string)
+	onDeleteEmail func(emailID string)
+	onDeleteAll   func()
+
+	// retention janitor, nil without retention limits
+	janitor *janitor
 }
 
-// Engine must implement the Storage interface
-var _ Storage = &Engine{}
+// Engine must implement the Storage, StreamingStorage and ContextStorage interfaces
+var (
+	_ Storage          = &Engine{}
+	_ StreamingStorage = &Engine{}
+	_ ContextStorage   = &Engine{}
+)
 
 // error that says this layer does not implement the method
 type unimplementedMethodInLayerError struct {
@@ -41,7 +68,7 @@ func isUnimplemented(err error) bool {
 }
 
 func NewEngine(storagesConfiguration []StorageLayerConfiguration) (*Engine, error) {
-	engine := &Engine{}
+	engine := &Engine{backfilled: make(map[storageLayer]bool), queues: make(map[storageLayer]*writeQueue)}
 
 	// Backward compatibility: if no scope specified, default to "all"
 	for i := range storagesConfiguration {
@@ -51,38 +78,15 @@ func NewEngine(storagesConfiguration []StorageLayerConfiguration) (*Engine, erro
 	}
 
 	// Construct storage layers
-	for _, cfg := range storagesConfiguration {
-		var layer storageLayer
-		var err error
-
-		switch cfg.Type {
-		case "MEMORY":
-			layer, err = newMemoryStorage()
-		case "SQLITE":
-			dbFile, ok := cfg.Parameters["database"]
-			if !ok {
-				return nil, fmt.Errorf("missing database parameter for SQLITE storage")
-			}
-			layer, err = newSqliteStorage(dbFile)
-		case "FILESYSTEM":
-			folder, ok := cfg.Parameters["folder"]
-			if !ok {
-				return nil, fmt.Errorf("missing folder parameter for FILESYSTEM storage")
-			}
-			fsType, ok := cfg.Parameters["type"]
-			if !ok {
-				return nil, fmt.Errorf("missing type parameter for FILESYSTEM storage")
-			}
-			layer, err = newFilesystemStorage(folder, fsType)
-		default:
-			return nil, fmt.Errorf("unknown storage type: %s", cfg.Type)
-		}
-
+	var asyncLayers, reindexed []int
+	for index, cfg := range storagesConfiguration {
+		layer, err := newStorageLayer(cfg)
 		if err != nil {
 			return nil, err
 		}
 
 		engine.allLayers = append(engine.allLayers, layer)
+		engine.layerTypes = append(engine.layerTypes, cfg.Type)
 
 		// Build per-scope routing tables
 		if cfg.hasScope(ScopeRead) {
@@ -91,12 +95,29 @@ func NewEngine(storagesConfiguration []StorageLayerConfiguration) (*Engine, erro
 		if cfg.hasScope(ScopeSearch) {
 			engine.searchLayers = append(engine.searchLayers, layer)
 		}
-		if cfg.isWritable() {
+		if cfg.Async {
+			if !cfg.isWritable() {
+				return nil, fmt.Errorf("async requires a writable scope (%s storage)", cfg.Type)
+			}
+			asyncLayers = append(asyncLayers, index)
+		} else if cfg.isWritable() {
 			engine.writeLayers = append(engine.writeLayers, layer)
 		}
 		if cfg.hasScope(ScopeRaw) {
 			engine.rawLayers = append(engine.rawLayers, layer)
 		}
+		if cfg.Backfill {
+			if !cfg.hasScope(ScopeCache) {
+				return nil, fmt.Errorf("backfill requires the cache scope (%s storage)", cfg.Type)
+			}
+			engine.backfilled[layer] = true
+		}
+		if cfg.Reindex {
+			if index == len(storagesConfiguration)-1 {
+				return nil, fmt.Errorf("reindex cannot apply to the root layer (%s storage)", cfg.Type)
+			}
+			reindexed = append(reindexed, index)
+		}
 	}
 
 	// Load layers: root (last) first, then others hydrate from root
@@ -106,10 +127,64 @@ func NewEngine(storagesConfiguration []StorageLayerConfiguration) (*Engine, erro
 			return nil, err
 		}
 	}
+	if len(reindexed) > 0 {
+		if err := engine.reindex(reindexed); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start the queues of the async layers once loaded
+	for _, index := range asyncLayers {
+		cfg := storagesConfiguration[index]
+		queue := newWriteQueue(engine.allLayers[index], cfg.Type, index, cfg.QueueSize)
+		engine.writeQueues = append(engine.writeQueues, queue)
+		engine.queues[engine.allLayers[index]] = queue
+	}
+
+	// Watch the folders of the FILESYSTEM layers configured to
+	ctx, cancel := context.WithCancel(context.Background())
+	engine.stopWatching = cancel
+	for _, layer := range engine.allLayers {
+		if fs, ok := layer.(*filesystemStorage); ok && fs.watchInterval > 0 {
+			engine.watchers.Add(1)
+			go func() {
+				defer engine.watchers.Done()
+				fs.watch(ctx, func(changes []fileChange) {
+					engine.applyExternalChanges(fs, changes)
+				})
+			}()
+		}
+	}
 
 	return engine, nil
 }
 
+// newStorageLayer constructs the layer of the configuration, not loaded yet.
+func newStorageLayer(cfg StorageLayerConfiguration) (storageLayer, error) {
+	switch cfg.Type {
+	case "MEMORY":
+		return newMemoryStorageFromParameters(cfg.Parameters)
+	case "SQLITE":
+		dbFile, ok := cfg.Parameters["database"]
+		if !ok {
+			return nil, fmt.Errorf("missing database parameter for SQLITE storage")
+		}
+		return newSqliteStorage(dbFile)
+	case "BOLT":
+		dbFile, ok := cfg.Parameters["database"]
+		if !ok {
+			return nil, fmt.Errorf("missing database parameter for BOLT storage")
+		}
+		return newBoltStorage(dbFile)
+	case "FILESYSTEM":
+		return newFilesystemStorageFromParameters(cfg.Parameters)
+	case "S3":
+		return newS3StorageFromParameters(cfg.Parameters)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", cfg.Type)
+	}
+}
+
 // load initializes all layers. The root layer (last) loads with nil;
 // all other layers receive the root so they can hydrate from it.
 func (e *Engine) load(rootStorage Storage) error {
@@ -128,69 +203,301 @@ func (e *Engine) load(rootStorage Storage) error {
 	return nil
 }
 
-// --- Read scope (first-match-wins) ---
+// layerType returns the configured type of the layer at index.
+func (e *Engine) layerType(index int) string {
+	if index < len(e.layerTypes) {
+		return e.layerTypes[index]
+	}
+	return fmt.Sprintf("layer %d", index)
+}
 
-func (e *Engine) GetEmailByID(emailID string) (EmailHeader, error) {
-	for _, s := range e.readLayers {
-		result, err := s.GetEmailByID(emailID)
-		if err != nil {
-			if isUnimplemented(err) {
-				continue
-			}
-			return EmailHeader{}, err
+// CacheStats returns the usage of the memory layers, in configuration order.
+func (e *Engine) CacheStats() []CacheStats {
+	var stats []CacheStats
+	for _, layer := range e.allLayers {
+		if memory, ok := layer.(*memoryStorage); ok {
+			stats = append(stats, memory.stats())
 		}
-		return result, nil
 	}
-	return EmailHeader{}, fmt.Errorf("no storage layer implements GetEmailByID")
+	return stats
 }
 
-func (e *Engine) GetBodyVersion(emailID string, version EmailVersionType) (string, error) {
-	for _, s := range e.readLayers {
-		body, err := s.GetBodyVersion(emailID, version)
+// WriteQueueStats returns the lag of the async layers, in configuration order.
+func (e *Engine) WriteQueueStats() []WriteQueueStats {
+	var stats []WriteQueueStats
+	for _, queue := range e.writeQueues {
+		stats = append(stats, queue.stats())
+	}
+	return stats
+}
+
+// Close stops the retention janitor and the watchers, applies the writes queued
+// for the async layers and stops their queues. Writes made after Close are
+// applied to the async layers synchronously.
+func (e *Engine) Close() {
+	if e.janitor != nil {
+		e.janitor.close()
+	}
+	if e.stopWatching != nil {
+		e.stopWatching()
+		e.watchers.Wait()
+	}
+	for _, queue := range e.writeQueues {
+		queue.close()
+	}
+}
+
+// flush waits until the async layers applied the writes made so far.
+func (e *Engine) flush() {
+	for _, queue := range e.writeQueues {
+		queue.flush()
+	}
+}
+
+// SetOnNewEmail sets the callback of the emails a watcher found in a folder.
+func (e *Engine) SetOnNewEmail(callback func(emailID string)) {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+	e.onNewEmail = callback
+}
+
+// SetOnDeleteEmail sets the callback of the deleted emails: deleted through the
+// engine by any client or the retention janitor, or found removed from a folder
+// by a watcher.
+func (e *Engine) SetOnDeleteEmail(callback func(emailID string)) {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+	e.onDeleteEmail = callback
+}
+
+// SetOnDeleteAllEmails sets the callback of DeleteAllEmails.
+func (e *Engine) SetOnDeleteAllEmails(callback func()) {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+	e.onDeleteAll = callback
+}
+
+// applyExternalChanges propagates the changes another tool made to the folder of
+// a watched layer into the other writable layers, then notifies them.
+func (e *Engine) applyExternalChanges(source storageLayer, changes []fileChange) {
+	for _, change := range changes {
+		emailID := change.emailID
+		if change.kind == fileDeleted {
+			log.Logf(log.INFO, "email %v removed from a watched folder", emailID)
+			e.propagateDelete(source, emailID)
+			e.notifyDelete(emailID)
+			continue
+		}
+		rawEmail, err := source.GetRawEmail(emailID)
 		if err != nil {
-			if isUnimplemented(err) {
+			log.Logf(log.WARNING, "cannot read email %v of a watched folder: %v", emailID, err)
+			continue
+		}
+		log.Logf(log.INFO, "email %v added to a watched folder", emailID)
+		if change.kind == fileModified {
+			e.propagateDelete(source, emailID)
+		}
+		for _, s := range e.writeLayers {
+			if s == source {
 				continue
 			}
-			return "", err
+			if err := s.setWithID(emailID, rawEmail); err != nil && !isUnimplemented(err) {
+				log.Logf(log.WARNING, "cannot propagate email %v of a watched folder: %v", emailID, err)
+			}
+		}
+		for _, queue := range e.writeQueues {
+			if queue.layer != source {
+				queue.enqueue(writeOperation{kind: writeSet, emailID: emailID, rawEmail: rawEmail})
+			}
+		}
+		if change.kind == fileCreated {
+			e.notifyMu.RLock()
+			if e.onNewEmail != nil {
+				e.onNewEmail(emailID)
+			}
+			e.notifyMu.RUnlock()
 		}
-		return body, nil
 	}
-	return "", fmt.Errorf("no storage layer implements GetBodyVersion")
 }
 
-func (e *Engine) GetAttachments(emailID string) ([]AttachmentHeader, error) {
-	for _, s := range e.readLayers {
-		atts, err := s.GetAttachments(emailID)
+// notifyDelete calls the callback of the deleted emails.
+func (e *Engine) notifyDelete(emailID string) {
+	e.notifyMu.RLock()
+	defer e.notifyMu.RUnlock()
+	if e.onDeleteEmail != nil {
+		e.onDeleteEmail(emailID)
+	}
+}
+
+// propagateDelete deletes the email from the writable layers but the source.
+func (e *Engine) propagateDelete(source storageLayer, emailID string) {
+	for _, s := range e.writeLayers {
+		if s == source {
+			continue
+		}
+		if err := s.DeleteEmailByID(emailID); err != nil && !isUnimplemented(err) && !IsNotFound(err) {
+			log.Logf(log.WARNING, "cannot propagate the removal of email %v: %v", emailID, err)
+		}
+	}
+	for _, queue := range e.writeQueues {
+		if queue.layer != source {
+			queue.enqueue(writeOperation{kind: writeDelete, emailID: emailID})
+		}
+	}
+}
+
+// flagLayer is a layer keeping the email flags, like the Maildir filenames do.
+type flagLayer interface {
+	loadFlags() (map[string][]string, error)
+	saveFlags(emailID string, flags []string) error
+}
+
+// LoadFlags returns the flags kept by the layers, merged in configuration order.
+// The Engine is the FlagPersister of the FlagStore.
+func (e *Engine) LoadFlags() (map[string][]string, error) {
+	flags := make(map[string][]string)
+	for _, layer := range e.allLayers {
+		s, ok := layer.(flagLayer)
+		if !ok {
+			continue
+		}
+		layerFlags, err := s.loadFlags()
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
 			}
 			return nil, err
 		}
-		return atts, nil
+		for emailID, emailFlags := range layerFlags {
+			if _, exists := flags[emailID]; !exists {
+				flags[emailID] = emailFlags
+			}
+		}
 	}
-	return nil, fmt.Errorf("no storage layer implements GetAttachments")
+	return flags, nil
 }
 
-func (e *Engine) GetAttachment(emailID string, attachmentID string) (Attachment, error) {
-	for _, s := range e.readLayers {
-		att, err := s.GetAttachment(emailID, attachmentID)
+// SaveFlags saves the flags of the email into every writable layer keeping flags.
+// The async layers save them after the writes queued before.
+func (e *Engine) SaveFlags(emailID string, flags []string) error {
+	for layer, queue := range e.queues {
+		if _, ok := layer.(flagLayer); ok {
+			queue.enqueue(writeOperation{kind: writeFlags, emailID: emailID, flags: flags})
+		}
+	}
+	for _, layer := range e.writeLayers {
+		s, ok := layer.(flagLayer)
+		if !ok {
+			continue
+		}
+		if err := s.saveFlags(emailID, flags); err != nil && !isUnimplemented(err) && !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- Read scope (first-match-wins, falling through on not found) ---
+
+// readThrough returns the result of the first layer holding the email. Layers not
+// implementing the method or not holding the email are skipped, and the backfilled
+// layers among them receive the email once found. When no layer holds it, the
+// not-found error of the last layer is returned.
+func readThrough[T any](e *Engine, layers []storageLayer, methodName string, emailID string, read func(storageLayer) (T, error)) (T, error) {
+	var zero T
+	var notFound error
+	var missed []storageLayer
+	for _, s := range layers {
+		result, err := read(s)
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
 			}
-			return Attachment{}, err
+			if IsNotFound(err) {
+				notFound = err
+				missed = append(missed, s)
+				continue
+			}
+			return zero, err
 		}
-		return att, nil
+		e.backfill(emailID, s, missed)
+		return result, nil
+	}
+	if notFound != nil {
+		return zero, notFound
 	}
-	return Attachment{}, fmt.Errorf("no storage layer implements GetAttachment")
+	return zero, fmt.Errorf("no storage layer implements %s", methodName)
+}
+
+// backfill stores the email found in a layer into the backfilled layers that missed it.
+func (e *Engine) backfill(emailID string, found storageLayer, missed []storageLayer) {
+	var targets []storageLayer
+	for _, s := range missed {
+		if e.backfilled[s] {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	raw, err := found.GetRawEmail(emailID)
+	if err != nil {
+		for _, s := range e.rawLayers {
+			if raw, err = s.GetRawEmail(emailID); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Logf(log.WARNING, "cannot backfill email %v: %v", emailID, err)
+		return
+	}
+	for _, s := range targets {
+		if queue, ok := e.queues[s]; ok {
+			queue.enqueue(writeOperation{kind: writeSet, emailID: emailID, rawEmail: raw})
+			continue
+		}
+		if err := s.setWithID(emailID, raw); err != nil && !isUnimplemented(err) {
+			log.Logf(log.WARNING, "cannot backfill email %v: %v", emailID, err)
+		}
+	}
+}
+
+func (e *Engine) GetEmailByID(emailID string) (EmailHeader, error) {
+	return readThrough(e, e.readLayers, "GetEmailByID", emailID, func(s storageLayer) (EmailHeader, error) {
+		return s.GetEmailByID(emailID)
+	})
+}
+
+func (e *Engine) GetBodyVersion(emailID string, version EmailVersionType) (string, error) {
+	return readThrough(e, e.readLayers, "GetBodyVersion", emailID, func(s storageLayer) (string, error) {
+		return s.GetBodyVersion(emailID, version)
+	})
+}
+
+func (e *Engine) GetAttachments(emailID string) ([]AttachmentHeader, error) {
+	return readThrough(e, e.readLayers, "GetAttachments", emailID, func(s storageLayer) ([]AttachmentHeader, error) {
+		return s.GetAttachments(emailID)
+	})
+}
+
+func (e *Engine) GetAttachment(emailID string, attachmentID string) (Attachment, error) {
+	return readThrough(e, e.readLayers, "GetAttachment", emailID, func(s storageLayer) (Attachment, error) {
+		return s.GetAttachment(emailID, attachmentID)
+	})
 }
 
 // --- Search scope (first-match-wins) ---
 
 func (e *Engine) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return e.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage. A search stopped by the context
+// does not fall through to the next layers.
+func (e *Engine) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
 	for _, s := range e.searchLayers {
-		headers, total, err := s.SearchEmails(query, page, pageSize)
+		headers, total, err := s.SearchEmailsContext(ctx, query, page, pageSize)
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
@@ -203,8 +510,13 @@ func (e *Engine) SearchEmails(query string, page int, pageSize int) ([]EmailHead
 }
 
 func (e *Engine) GetMailboxes() ([]Mailbox, error) {
+	return e.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage.
+func (e *Engine) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
 	for _, s := range e.searchLayers {
-		mailboxes, err := s.GetMailboxes()
+		mailboxes, err := s.GetMailboxesContext(ctx)
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
@@ -219,21 +531,45 @@ func (e *Engine) GetMailboxes() ([]Mailbox, error) {
 // --- Raw scope (first-match-wins) ---
 
 func (e *Engine) GetRawEmail(emailID string) ([]byte, error) {
-	for _, s := range e.rawLayers {
-		raw, err := s.GetRawEmail(emailID)
-		if err != nil {
-			if isUnimplemented(err) {
-				continue
-			}
-			return nil, err
-		}
-		return raw, nil
-	}
-	return nil, fmt.Errorf("no storage layer implements GetRawEmail")
+	return readThrough(e, e.rawLayers, "GetRawEmail", emailID, func(s storageLayer) ([]byte, error) {
+		return s.GetRawEmail(emailID)
+	})
 }
 
-// --- Write scope (propagate to all writable layers) ---
+// GetRawEmailContext implements RawContextStorage, with the raw layers.
+func (e *Engine) GetRawEmailContext(ctx context.Context, emailID string) ([]byte, error) {
+	return readThrough(e, e.rawLayers, "GetRawEmail", emailID, func(s storageLayer) ([]byte, error) {
+		return GetRawEmailContext(ctx, s, emailID)
+	})
+}
+
+// OpenRawEmail implements StreamingStorage, with the raw layers. Layers without
+// streaming serve the bytes of GetRawEmail.
+func (e *Engine) OpenRawEmail(emailID string) (io.ReadSeekCloser, error) {
+	return readThrough(e, e.rawLayers, "OpenRawEmail", emailID, func(s storageLayer) (io.ReadSeekCloser, error) {
+		return OpenRawEmail(s, emailID)
+	})
+}
+
+// openedAttachment is an attachment opened by a layer.
+type openedAttachment struct {
+	header  AttachmentHeader
+	content io.ReadSeekCloser
+}
 
+// OpenAttachment implements StreamingStorage, with the read layers.
+func (e *Engine) OpenAttachment(emailID string, attachmentID string) (AttachmentHeader, io.ReadSeekCloser, error) {
+	opened, err := readThrough(e, e.readLayers, "OpenAttachment", emailID, func(s storageLayer) (openedAttachment, error) {
+		header, content, err := OpenAttachment(s, emailID, attachmentID)
+		return openedAttachment{header, content}, err
+	})
+	return opened.header, opened.content, err
+}
+
+// --- Write scope (all-or-nothing across the synchronous writable layers) ---
+
+// DeleteAllEmails deletes the emails of every writable layer. The async layers
+// delete them after the writes queued before.
 func (e *Engine) DeleteAllEmails() error {
 	var errors []error
 	for _, s := range e.writeLayers {
@@ -245,25 +581,78 @@ func (e *Engine) DeleteAllEmails() error {
 			errors = append(errors, err)
 		}
 	}
+	for _, queue := range e.writeQueues {
+		queue.enqueue(writeOperation{kind: writeDeleteAll})
+	}
 	if len(errors) > 0 {
 		return fmt.Errorf("errors: %v", errors)
 	}
+	e.notifyMu.RLock()
+	defer e.notifyMu.RUnlock()
+	if e.onDeleteAll != nil {
+		e.onDeleteAll()
+	}
 	return nil
 }
 
+// DeleteEmailByID deletes the email from every writable layer. A layer not
+// holding it is not an error, unless no layer held it. When a layer fails, the
+// email is restored into the layers it was already deleted from.
 func (e *Engine) DeleteEmailByID(emailID string) error {
+	var rawEmail []byte
+	if len(e.writeLayers) > 1 {
+		// kept to restore the email if a layer fails; read without backfilling
+		for _, s := range e.rawLayers {
+			if raw, err := s.GetRawEmail(emailID); err == nil {
+				rawEmail = raw
+				break
+			}
+		}
+	}
+
+	var notFound error
+	var deleted []storageLayer
 	for _, s := range e.writeLayers {
 		err := s.DeleteEmailByID(emailID)
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
 			}
+			if IsNotFound(err) {
+				notFound = err
+				continue
+			}
+			e.restore(emailID, rawEmail, deleted)
 			return err
 		}
+		deleted = append(deleted, s)
+	}
+	for _, queue := range e.writeQueues {
+		queue.enqueue(writeOperation{kind: writeDelete, emailID: emailID})
+	}
+	if len(deleted) == 0 && notFound != nil {
+		return notFound
 	}
+	e.notifyDelete(emailID)
 	return nil
 }
 
+// restore writes back the email into the layers it was deleted from.
+func (e *Engine) restore(emailID string, rawEmail []byte, layers []storageLayer) {
+	if len(layers) == 0 {
+		return
+	}
+	if rawEmail == nil {
+		log.Logf(log.ERROR, "cannot restore email %v: no raw layer holds it", emailID)
+		return
+	}
+	for _, s := range layers {
+		if err := s.setWithID(emailID, rawEmail); err != nil {
+			log.Logf(log.ERROR, "cannot restore email %v: %v", emailID, err)
+		}
+	}
+}
+
 // Set inserts a new email into the storage. Writes to ALL writable layers.
 // The message body is serialized to bytes once; layers receive the immutable
 // []byte and parse only what they need (zero-copy for filesystem writes).
@@ -288,15 +677,33 @@ func (e *Engine) Set(message *mail.Message) (string, error) {
 	return emailID, e.setWithID(emailID, rawBytes)
 }
 
+// setWithID writes the email into the synchronous writable layers, in order.
+// When a layer fails, the email is deleted from the layers already written and
+// the error is returned. Once all of them hold it, the async layers are queued.
 func (e *Engine) setWithID(emailID string, rawEmail []byte) error {
+	var written []storageLayer
 	for _, s := range e.writeLayers {
 		err := s.setWithID(emailID, rawEmail)
 		if err != nil {
 			if isUnimplemented(err) {
 				continue
 			}
+			e.rollback(emailID, written)
 			return err
 		}
+		written = append(written, s)
+	}
+	for _, queue := range e.writeQueues {
+		queue.enqueue(writeOperation{kind: writeSet, emailID: emailID, rawEmail: rawEmail})
 	}
 	return nil
 }
+
+// rollback deletes the email from the layers it was written to, last first.
+func (e *Engine) rollback(emailID string, layers []storageLayer) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := layers[i].DeleteEmailByID(emailID); err != nil && !IsNotFound(err) {
+			log.Logf(log.ERROR, "cannot roll back email %v: %v", emailID, err)
+		}
+	}
+}
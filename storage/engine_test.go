@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"net/mail"
 	"strings"
 	"testing"
@@ -258,6 +260,14 @@ func TestNewEngineMissingParameter(t *testing.T) {
 				},
 			},
 		},
+		{
+			{
+				Type: "BOLT",
+				Parameters: map[string]string{
+					"missing-parameter": "test.db",
+				},
+			},
+		},
 		{
 			{
 				Type: "FILESYSTEM",
@@ -516,6 +526,60 @@ func TestMultiLayerSetReceivesSameBytes(t *testing.T) {
 	}
 }
 
+func TestEngineReadThrough(t *testing.T) {
+	folder := t.TempDir()
+	root, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	cold, _ := newMemoryStorage()
+	backfilled, _ := newMemoryStorage()
+	engine := newTestEngine(cold, backfilled, root)
+	engine.backfilled = map[storageLayer]bool{backfilled: true}
+
+	// the memory layers miss the email written behind their back
+	header, err := engine.GetEmailByID("email-1")
+	if err != nil || header.Subject != "email 1" {
+		t.Fatalf("expected the email from the filesystem, got %+v, %v", header, err)
+	}
+	if _, err := cold.GetEmailByID("email-1"); !IsNotFound(err) {
+		t.Errorf("expected the layer without backfill to stay cold, got %v", err)
+	}
+	if _, err := backfilled.GetEmailByID("email-1"); err != nil {
+		t.Errorf("expected the email to be backfilled, got %v", err)
+	}
+
+	_, err = engine.GetRawEmail("unknown")
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.EmailID != "unknown" || notFound.Layer != "filesystem" {
+		t.Errorf("expected the not found error of the root, got %v", err)
+	}
+	if _, err := engine.GetAttachment("email-1", "unknown"); !IsNotFound(err) {
+		t.Errorf("expected an attachment not found error, got %v", err)
+	}
+
+	// deleting from the layers not holding the email is not an error
+	if err := engine.DeleteEmailByID("email-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := engine.DeleteEmailByID("email-1"); !IsNotFound(err) {
+		t.Errorf("expected a not found error once deleted, got %v", err)
+	}
+}
+
+func TestNewEngineBackfillRequiresCacheScope(t *testing.T) {
+	_, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead}, Backfill: true},
+		{Type: "FILESYSTEM", Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}},
+	})
+	if err == nil {
+		t.Errorf("expected an error for a backfilled layer without the cache scope")
+	}
+}
+
 type mockStorageLayer struct {
 	// list of method names that have been called with their arguments
 	calls              map[string][]interface{}
@@ -572,6 +636,14 @@ func (m *mockStorageLayer) SearchEmails(query string, page int, pageSize int) ([
 	return nil, 0, m.addCall("SearchEmails", query, page, pageSize)
 }
 
+func (m *mockStorageLayer) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	return m.GetMailboxes()
+}
+
+func (m *mockStorageLayer) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return m.SearchEmails(query, page, pageSize)
+}
+
 func (m *mockStorageLayer) GetRawEmail(emailID string) ([]byte, error) {
 	return nil, m.addCall("GetRawEmail", emailID)
 }
@@ -583,3 +655,29 @@ func (m *mockStorageLayer) load(rootStorage Storage) error {
 func (m *mockStorageLayer) setWithID(emailID string, rawEmail []byte) error {
 	return m.addCall("setWithID", emailID, rawEmail)
 }
+
+func TestEngineNotifiesDeletions(t *testing.T) {
+	engine := newTestEngine(newFailingLayer(t))
+	for _, emailID := range []string{"email-1", "email-2"} {
+		if err := engine.setWithID(emailID, memoryTestEmail(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var deleted []string
+	deletedAll := false
+	engine.SetOnDeleteEmail(func(emailID string) { deleted = append(deleted, emailID) })
+	engine.SetOnDeleteAllEmails(func() { deletedAll = true })
+
+	if err := engine.DeleteEmailByID("email-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.DeleteEmailByID("unknown"); err == nil {
+		t.Error("expected an error for an unknown email")
+	}
+	if err := engine.DeleteAllEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "email-1" || !deletedAll {
+		t.Errorf("unexpected notifications %v, %v", deleted, deletedAll)
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"mock-my-mta/log"
+)
+
+// FlagSeen is the IMAP flag of read emails.
+const FlagSeen = `\Seen`
+
+// FlagStore keeps the volatile per-email flags (IMAP system flags and keywords).
+// The read state shown in the web UI is the FlagSeen flag, so it is shared by
+// the HTTP API and the mailbox access protocols.
+type FlagStore struct {
+	mu        sync.RWMutex
+	flags     map[string]map[string]bool // email ID → canonical flag name → set
+	persister FlagPersister
+}
+
+// FlagPersister keeps the flags of the emails across restarts, like the Maildir
+// filenames do.
+type FlagPersister interface {
+	// LoadFlags returns the flags of the emails having some.
+	LoadFlags() (map[string][]string, error)
+	// SaveFlags replaces the flags of an email.
+	SaveFlags(emailID string, flags []string) error
+}
+
+func NewFlagStore() *FlagStore {
+	return &FlagStore{
+		flags: make(map[string]map[string]bool),
+	}
+}
+
+// SetPersister loads the flags kept by the persister, which then receives every change.
+func (f *FlagStore) SetPersister(persister FlagPersister) error {
+	flags, err := persister.LoadFlags()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for emailID, emailFlags := range flags {
+		f.addFlagsLocked(emailID, emailFlags)
+	}
+	f.persister = persister
+	return nil
+}
+
+// saveLocked hands the flags of the email to the persister. Must be called with the lock held.
+func (f *FlagStore) saveLocked(emailID string) {
+	if f.persister == nil {
+		return
+	}
+	flags := make([]string, 0, len(f.flags[emailID]))
+	for flag := range f.flags[emailID] {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	if err := f.persister.SaveFlags(emailID, flags); err != nil {
+		log.Logf(log.WARNING, "cannot save the flags of email %v: %v", emailID, err)
+	}
+}
+
+// canonicalFlag returns the flag with the case of the IMAP system flags,
+// which are case-insensitive.
+func canonicalFlag(flag string) string {
+	for _, systemFlag := range []string{FlagSeen, `\Answered`, `\Flagged`, `\Deleted`, `\Draft`} {
+		if strings.EqualFold(flag, systemFlag) {
+			return systemFlag
+		}
+	}
+	return flag
+}
+
+// IsRead returns true if the email has the FlagSeen flag.
+func (f *FlagStore) IsRead(emailID string) bool {
+	return f.HasFlag(emailID, FlagSeen)
+}
+
+// SetRead sets or clears the FlagSeen flag of the email.
+func (f *FlagStore) SetRead(emailID string, read bool) {
+	if read {
+		f.AddFlags(emailID, FlagSeen)
+	} else {
+		f.RemoveFlags(emailID, FlagSeen)
+	}
+}
+
+// HasFlag returns true if the email has the flag.
+func (f *FlagStore) HasFlag(emailID string, flag string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.flags[emailID][canonicalFlag(flag)]
+}
+
+// GetFlags returns the sorted flags of the email.
+func (f *FlagStore) GetFlags(emailID string) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flags := make([]string, 0, len(f.flags[emailID]))
+	for flag := range f.flags[emailID] {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// SetFlags replaces the flags of the email.
+func (f *FlagStore) SetFlags(emailID string, flags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.flags, emailID)
+	f.addFlagsLocked(emailID, flags)
+	f.saveLocked(emailID)
+}
+
+// AddFlags adds flags to the email.
+func (f *FlagStore) AddFlags(emailID string, flags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addFlagsLocked(emailID, flags)
+	f.saveLocked(emailID)
+}
+
+func (f *FlagStore) addFlagsLocked(emailID string, flags []string) {
+	if len(flags) == 0 {
+		return
+	}
+	if f.flags[emailID] == nil {
+		f.flags[emailID] = make(map[string]bool)
+	}
+	for _, flag := range flags {
+		f.flags[emailID][canonicalFlag(flag)] = true
+	}
+}
+
+// RemoveFlags removes flags from the email.
+func (f *FlagStore) RemoveFlags(emailID string, flags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, flag := range flags {
+		delete(f.flags[emailID], canonicalFlag(flag))
+	}
+	if len(f.flags[emailID]) == 0 {
+		delete(f.flags, emailID)
+	}
+	f.saveLocked(emailID)
+}
+
+// Delete forgets the flags of a deleted email.
+func (f *FlagStore) Delete(emailID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.flags, emailID)
+}
+
+// ResetRead marks all emails as unread, keeping the other flags.
+func (f *FlagStore) ResetRead() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for emailID, flags := range f.flags {
+		if !flags[FlagSeen] {
+			continue
+		}
+		delete(flags, FlagSeen)
+		if len(flags) == 0 {
+			delete(f.flags, emailID)
+		}
+		f.saveLocked(emailID)
+	}
+}
+
+// Clear forgets the flags of all emails, once deleted.
+func (f *FlagStore) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flags = make(map[string]map[string]bool)
+}
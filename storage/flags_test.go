@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlagStore(t *testing.T) {
+	flags := NewFlagStore()
+	flags.AddFlags("1", `\seen`, "$Important")
+	if !flags.IsRead("1") {
+		t.Fatal("system flags should be case-insensitive")
+	}
+	if got := flags.GetFlags("1"); !reflect.DeepEqual(got, []string{"$Important", FlagSeen}) {
+		t.Fatalf("unexpected flags %v", got)
+	}
+
+	flags.SetFlags("2", `\Flagged`, FlagSeen)
+	flags.ResetRead()
+	if flags.IsRead("1") || flags.IsRead("2") {
+		t.Fatal("ResetRead should mark all emails as unread")
+	}
+	if !flags.HasFlag("2", `\Flagged`) {
+		t.Fatal("ResetRead should keep the other flags")
+	}
+
+	flags.RemoveFlags("2", `\FLAGGED`)
+	flags.Delete("1")
+	if len(flags.GetFlags("1")) != 0 || len(flags.GetFlags("2")) != 0 {
+		t.Fatal("flags should be removed")
+	}
+}
+
+type testFlagPersister struct {
+	saved map[string][]string
+}
+
+func (p *testFlagPersister) LoadFlags() (map[string][]string, error) {
+	return map[string][]string{"1": {`\Seen`, `\Answered`}}, nil
+}
+
+func (p *testFlagPersister) SaveFlags(emailID string, flags []string) error {
+	p.saved[emailID] = flags
+	return nil
+}
+
+func TestFlagStorePersister(t *testing.T) {
+	flags := NewFlagStore()
+	persister := &testFlagPersister{saved: make(map[string][]string)}
+	if err := flags.SetPersister(persister); err != nil {
+		t.Fatal(err)
+	}
+	if !flags.IsRead("1") || !flags.HasFlag("1", `\Answered`) {
+		t.Fatalf("expected the persisted flags to be loaded, got %v", flags.GetFlags("1"))
+	}
+
+	flags.AddFlags("2", `\flagged`)
+	flags.ResetRead()
+	expected := map[string][]string{"1": {`\Answered`}, "2": {`\Flagged`}}
+	if !reflect.DeepEqual(persister.saved, expected) {
+		t.Errorf("expected saved flags %v, got %v", expected, persister.saved)
+	}
+}
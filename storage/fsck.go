@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"mock-my-mta/log"
+)
+
+// FsckReport compares the layers with the root layer, the last one.
+type FsckReport struct {
+	Root   string        `json:"root"`   // type of the root layer
+	Emails int           `json:"emails"` // emails held by the root layer
+	Layers []LayerReport `json:"layers"`
+}
+
+// LayerReport lists the differences of a layer with the root layer, and the
+// repairs made.
+type LayerReport struct {
+	Layer      string   `json:"layer"` // layer type
+	Index      int      `json:"index"` // position of the layer in the configuration
+	Skipped    string   `json:"skipped,omitempty"`
+	Emails     int      `json:"emails"`
+	Missing    []string `json:"missing"`    // held by the root only
+	Extra      []string `json:"extra"`      // held by the layer only
+	Mismatched []string `json:"mismatched"` // held by both, with different headers
+	Repaired   int      `json:"repaired"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// Consistent tells whether every checked layer matches the root layer, or was
+// repaired to.
+func (r FsckReport) Consistent() bool {
+	for _, layer := range r.Layers {
+		if !layer.consistent() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r LayerReport) consistent() bool {
+	differences := len(r.Missing) + len(r.Extra) + len(r.Mismatched)
+	return len(r.Errors) == 0 && (differences == 0 || r.Repaired == differences)
+}
+
+// Fsck compares every layer with the root layer: emails missing from the layer,
+// emails the root no longer holds and emails whose headers differ. With repair,
+// the missing and mismatched emails are written again from the root and the
+// extra ones are deleted. Layers unable to list their emails, like the bounded
+// memory caches, are skipped. Emails written during the check may be reported.
+func (e *Engine) Fsck(ctx context.Context, repair bool) (FsckReport, error) {
+	if len(e.allLayers) == 0 {
+		return FsckReport{}, nil
+	}
+	e.flush()
+	rootIndex := len(e.allLayers) - 1
+	rootHeaders, err := e.listRoot(ctx)
+	if err != nil {
+		return FsckReport{}, err
+	}
+	report := FsckReport{Root: e.layerType(rootIndex), Emails: len(rootHeaders)}
+	for index := range e.allLayers[:rootIndex] {
+		layerReport, err := e.fsckLayer(ctx, index, rootHeaders, repair)
+		if err != nil {
+			return report, err
+		}
+		report.Layers = append(report.Layers, layerReport)
+	}
+	return report, nil
+}
+
+// listRoot returns the headers of the emails of the root layer, by ID.
+func (e *Engine) listRoot(ctx context.Context) (map[string]EmailHeader, error) {
+	root := e.allLayers[len(e.allLayers)-1]
+	headers, _, err := root.SearchEmailsContext(ctx, "", 1, -1)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the emails of the root layer: %w", err)
+	}
+	byID := make(map[string]EmailHeader, len(headers))
+	for _, header := range headers {
+		byID[header.ID] = header
+	}
+	return byID, nil
+}
+
+// fsckLayer compares the layer at index with the root headers, and repairs it.
+func (e *Engine) fsckLayer(ctx context.Context, index int, rootHeaders map[string]EmailHeader, repair bool) (LayerReport, error) {
+	layer := e.allLayers[index]
+	report := LayerReport{Layer: e.layerType(index), Index: index, Missing: []string{}, Extra: []string{}, Mismatched: []string{}}
+	headers, _, err := layer.SearchEmailsContext(ctx, "", 1, -1)
+	if err != nil {
+		if isUnimplemented(err) {
+			report.Skipped = "the layer cannot list its emails"
+			return report, nil
+		}
+		if ctx.Err() != nil {
+			return report, err
+		}
+		report.Errors = append(report.Errors, err.Error())
+		return report, nil
+	}
+	report.Emails = len(headers)
+
+	held := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		held[header.ID] = true
+		rootHeader, ok := rootHeaders[header.ID]
+		if !ok {
+			report.Extra = append(report.Extra, header.ID)
+		} else if !sameHeaders(header, rootHeader) {
+			report.Mismatched = append(report.Mismatched, header.ID)
+		}
+	}
+	for emailID := range rootHeaders {
+		if !held[emailID] {
+			report.Missing = append(report.Missing, emailID)
+		}
+	}
+	slices.Sort(report.Missing)
+	slices.Sort(report.Extra)
+	slices.Sort(report.Mismatched)
+	if !repair {
+		return report, nil
+	}
+
+	root := e.allLayers[len(e.allLayers)-1]
+	rewrite := func(emailID string, replace bool) error {
+		raw, err := root.GetRawEmail(emailID)
+		if err != nil {
+			return err
+		}
+		if replace {
+			if err := layer.DeleteEmailByID(emailID); err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+		return layer.setWithID(emailID, raw)
+	}
+	repaired := func(emailID string, err error) {
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", emailID, err))
+			return
+		}
+		report.Repaired++
+	}
+	for _, emailID := range report.Missing {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		repaired(emailID, rewrite(emailID, false))
+	}
+	for _, emailID := range report.Mismatched {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		repaired(emailID, rewrite(emailID, true))
+	}
+	for _, emailID := range report.Extra {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		err := layer.DeleteEmailByID(emailID)
+		if IsNotFound(err) {
+			err = nil
+		}
+		repaired(emailID, err)
+	}
+	return report, nil
+}
+
+// sameHeaders compares the headers every layer derives from the raw email.
+func sameHeaders(a, b EmailHeader) bool {
+	if a.From.Address != b.From.Address || a.Subject != b.Subject || !a.Date.Equal(b.Date) || len(a.Tos) != len(b.Tos) {
+		return false
+	}
+	for i := range a.Tos {
+		if a.Tos[i].Address != b.Tos[i].Address {
+			return false
+		}
+	}
+	return slices.Equal(a.DeliveredTo, b.DeliveredTo)
+}
+
+// reindex repairs the layers configured to be checked at startup.
+func (e *Engine) reindex(indexes []int) error {
+	ctx := context.Background()
+	rootHeaders, err := e.listRoot(ctx)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		report, err := e.fsckLayer(ctx, index, rootHeaders, true)
+		if err != nil {
+			return err
+		}
+		if report.Skipped != "" {
+			log.Logf(log.WARNING, "reindex of %v storage (layer %d) skipped: %v", report.Layer, index, report.Skipped)
+			continue
+		}
+		log.Logf(log.INFO, "reindex of %v storage (layer %d): %d missing, %d extra, %d mismatched, %d repaired",
+			report.Layer, index, len(report.Missing), len(report.Extra), len(report.Mismatched), report.Repaired)
+		for _, message := range report.Errors {
+			log.Logf(log.WARNING, "reindex of %v storage (layer %d): %v", report.Layer, index, message)
+		}
+	}
+	return nil
+}
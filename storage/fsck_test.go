@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newFsckTestEngine(t *testing.T, folder string, database string, reindex bool) *Engine {
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead, ScopeCache}},
+		{Type: "BOLT", Scope: []string{ScopeCache}, Parameters: map[string]string{"database": filepath.Join(t.TempDir(), "test.bolt")}},
+		{Type: "SQLITE", Scope: []string{ScopeSearch, ScopeCache}, Reindex: reindex, Parameters: map[string]string{"database": database}},
+		{Type: "FILESYSTEM", Scope: []string{ScopeAll}, Parameters: map[string]string{"folder": folder, "type": "eml"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		engine.allLayers[1].(*boltStorage).db.Close()
+		engine.allLayers[2].(*sqliteStorage).db.Close()
+	})
+	return engine
+}
+
+func TestEngineFsck(t *testing.T) {
+	engine := newFsckTestEngine(t, t.TempDir(), filepath.Join(t.TempDir(), "test.db"), false)
+	for i := 1; i <= 3; i++ {
+		if err := engine.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := engine.Fsck(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || report.Root != "FILESYSTEM" || report.Emails != 3 || len(report.Layers) != 3 {
+		t.Fatalf("expected consistent layers, got %+v", report)
+	}
+
+	sqlite, root := engine.allLayers[2], engine.allLayers[3]
+	if err := root.setWithID("email-4", memoryTestEmail(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.setWithID("email-5", memoryTestEmail(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.DeleteEmailByID("email-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.setWithID("email-2", memoryTestEmail(6)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = engine.Fsck(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Consistent() {
+		t.Fatal("expected differences")
+	}
+	got := report.Layers[2]
+	if got.Layer != "SQLITE" || !slices.Equal(got.Missing, []string{"email-4"}) || !slices.Equal(got.Extra, []string{"email-5"}) ||
+		!slices.Equal(got.Mismatched, []string{"email-2"}) || got.Repaired != 0 {
+		t.Errorf("unexpected report %+v", got)
+	}
+	if got := report.Layers[0]; !slices.Equal(got.Missing, []string{"email-4"}) || len(got.Extra) != 0 {
+		t.Errorf("unexpected report %+v", got)
+	}
+
+	report, err = engine.Fsck(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || report.Layers[2].Repaired != 3 {
+		t.Errorf("expected the layers repaired, got %+v", report)
+	}
+	report, err = engine.Fsck(context.Background(), false)
+	if err != nil || !report.Consistent() {
+		t.Errorf("expected consistent layers, got %+v, %v", report, err)
+	}
+	if header, err := sqlite.GetEmailByID("email-2"); err != nil || header.Subject != "email 2" {
+		t.Errorf("expected the email rewritten from the root, got %+v, %v", header, err)
+	}
+}
+
+func TestNewEngineReindex(t *testing.T) {
+	folder, database := t.TempDir(), filepath.Join(t.TempDir(), "test.db")
+	engine := newFsckTestEngine(t, folder, database, false)
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	engine.allLayers[2].(*sqliteStorage).db.Close()
+
+	// added to the root while the server is down
+	root, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.setWithID("email-2", memoryTestEmail(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	engine = newFsckTestEngine(t, folder, database, true)
+	if got, _ := searchIDs(t, engine.allLayers[2], "Body"); len(got) != 2 {
+		t.Errorf("expected the 2 emails in the reindexed layer, got %v", got)
+	}
+}
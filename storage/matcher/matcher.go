@@ -23,6 +23,18 @@ func newAttachmentMatch() AttachmentMatch {
 	return AttachmentMatch{}
 }
 
+type AttachmentHashMatch struct {
+	hash string
+}
+
+func newAttachmentHashMatch(hash string) AttachmentHashMatch {
+	return AttachmentHashMatch{hash: hash}
+}
+
+func (a AttachmentHashMatch) GetHash() string {
+	return a.hash
+}
+
 type PlainTextMatch struct {
 	text string
 }
@@ -106,3 +118,22 @@ func newSubjectMatch(subject string) SubjectMatch {
 func (s SubjectMatch) GetSubject() string {
 	return s.subject
 }
+
+// FolderMatch matches the emails filed into the folder, for the mailboxes of
+// the query when it has mailbox: terms, for any recipient otherwise.
+type FolderMatch struct {
+	folder    string
+	mailboxes []string
+}
+
+func newFolderMatch(folder string) FolderMatch {
+	return FolderMatch{folder: folder}
+}
+
+func (f FolderMatch) GetFolder() string {
+	return f.folder
+}
+
+func (f FolderMatch) GetMailboxes() []string {
+	return f.mailboxes
+}
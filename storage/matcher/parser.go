@@ -1,6 +1,8 @@
 package matcher
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"mock-my-mta/log"
 	"regexp"
@@ -36,6 +38,10 @@ func ParseQuery(query string) ([]interface{}, error) {
 				// Search for emails in the specified mailbox
 				log.Logf(log.DEBUG, "searching for mailbox %v", value)
 				matchers = append(matchers, newMailboxMatch(value))
+			case "in":
+				// Search for emails filed into the specified folder
+				log.Logf(log.DEBUG, "searching for folder %v", value)
+				matchers = append(matchers, newFolderMatch(value))
 			case "has":
 				switch value {
 				case "attachment":
@@ -45,6 +51,14 @@ func ParseQuery(query string) ([]interface{}, error) {
 				default:
 					return nil, newInvalidQueryError(query, fmt.Sprintf("unknown search attribute for 'has': %v", value))
 				}
+			case "attachment_hash":
+				// Search for emails with an attachment of the specified SHA-256
+				hash := strings.ToLower(value)
+				if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+					return nil, newInvalidQueryError(query, fmt.Sprintf("invalid SHA-256 hash: %v", value))
+				}
+				log.Logf(log.DEBUG, "searching for emails with attachment %v", hash)
+				matchers = append(matchers, newAttachmentHashMatch(hash))
 			case "before":
 				// search for emails with date before
 				valueDate, err := time.Parse(LAYOUT_DATE, value)
@@ -91,6 +105,21 @@ func ParseQuery(query string) ([]interface{}, error) {
 		}
 	}
 
+	// a folder is the folder of the mailboxes searched: mailbox:bob in:spam
+	// matches the emails filed into spam for bob, not for another recipient
+	var mailboxes []string
+	for _, m := range matchers {
+		if mailbox, ok := m.(MailboxMatch); ok {
+			mailboxes = append(mailboxes, mailbox.GetMailbox())
+		}
+	}
+	for i, m := range matchers {
+		if folder, ok := m.(FolderMatch); ok {
+			folder.mailboxes = mailboxes
+			matchers[i] = folder
+		}
+	}
+
 	for _, plainText := range plainTexts {
 		if plainText == "" {
 			continue
@@ -124,32 +153,58 @@ func parseCustomDuration(value string) (time.Duration, error) {
 	return time.ParseDuration(value)
 }
 
+// QuoteValue quotes a value of a search key, or a plain text, so that it is
+// searched as a whole: its quotes and backslashes are escaped with a backslash.
+func QuoteValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// unquote returns the value of a quoted string, without its escaping.
+func unquote(quoted string) string {
+	quoted = quoted[1 : len(quoted)-1]
+	if !strings.Contains(quoted, `\`) {
+		return quoted
+	}
+	var value strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] == '\\' && i+1 < len(quoted) {
+			i++
+		}
+		value.WriteByte(quoted[i])
+	}
+	return value.String()
+}
+
 // tokenizeQuery parses the input string into a slice of key-value pairs and plain text elements.
 func tokenizeQuery(query string) ([]map[string]string, []string) {
 	var keyValuePairs []map[string]string
 	var plainTexts []string
 
-	// Regex pattern to extract key:value pairs and quoted/non-quoted text
-	pattern := `(\w+:\s*"[^"]+"|\w+:\s*\S+|"[^"]+"|\S+)`
+	// Regex pattern to extract key:value pairs and quoted/non-quoted text; a
+	// quoted string may hold escaped quotes
+	pattern := `(\w+:\s*"(?:[^"\\]|\\.)+"|\w+:\s*\S+|"(?:[^"\\]|\\.)+"|\S+)`
 
 	re := regexp.MustCompile(pattern)
 	matches := re.FindAllString(query, -1)
 	for _, match := range matches {
-		// Split only at the first occurrence of ':'
+		// Split only at the first occurrence of ':', out of a quoted string
 		splitIndex := strings.Index(match, ":")
+		if strings.HasPrefix(match, "\"") {
+			splitIndex = -1
+		}
 		if splitIndex != -1 {
 			key := match[:splitIndex]
 			value := strings.TrimSpace(match[splitIndex+1:])
 			// Remove quotes if they exist
-			if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-				value = strings.Trim(value, "\"")
+			if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+				value = unquote(value)
 			}
 			keyValuePair := make(map[string]string)
 			keyValuePair[key] = value
 			keyValuePairs = append(keyValuePairs, keyValuePair)
-		} else if strings.HasPrefix(match, "\"") && strings.HasSuffix(match, "\"") {
+		} else if len(match) >= 2 && strings.HasPrefix(match, "\"") && strings.HasSuffix(match, "\"") {
 			// Handle standalone quoted strings
-			plainTexts = append(plainTexts, strings.Trim(match, "\""))
+			plainTexts = append(plainTexts, unquote(match))
 		} else {
 			// Generic word handling
 			plainTexts = append(plainTexts, match)
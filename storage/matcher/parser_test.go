@@ -28,6 +28,8 @@ func TestParse(t *testing.T) {
 		{"older_than_days", "older_than:2d", "OlderThanMatch", 2 * 24 * time.Hour, nil},
 		{"newer_than_days", "newer_than:2d", "NewerThanMatch", 2 * 24 * time.Hour, nil},
 		{"subject", "subject:important", "SubjectMatch", "important", nil},
+		{"in", "in:spam", "FolderMatch", "spam", nil},
+		{"attachment_hash", "attachment_hash:E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855", "AttachmentHashMatch", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", nil},
 		{"plain_text", "important", "PlainTextMatch", "important", nil},
 		{"plain_text_quote", "\"important thing\"", "PlainTextMatch", "important thing", nil},
 		{"empty query", "", "", nil, nil},
@@ -39,6 +41,7 @@ func TestParse(t *testing.T) {
 		{"older_than invalid duration", "older_than:2f30m", "", nil, InvalidQueryError{}},
 		{"newer_than invalid duration", "newer_than:2f30m", "", nil, InvalidQueryError{}},
 		{"unknown key", "unknown:some-value", "", nil, InvalidQueryError{}},
+		{"attachment_hash too short", "attachment_hash:e3b0c442", "", nil, InvalidQueryError{}},
 	}
 
 	for _, data := range testData {
@@ -128,6 +131,20 @@ func TestParse(t *testing.T) {
 				if m.GetText() != data.expectedValue {
 					t.Errorf("Expected %v, got %v", data.expectedValue, m.GetText())
 				}
+			case FolderMatch:
+				if data.expectedType != "FolderMatch" {
+					t.Errorf("Expected FolderMatch, got %T", m)
+				}
+				if m.GetFolder() != data.expectedValue {
+					t.Errorf("Expected %v, got %v", data.expectedValue, m.GetFolder())
+				}
+			case AttachmentHashMatch:
+				if data.expectedType != "AttachmentHashMatch" {
+					t.Errorf("Expected AttachmentHashMatch, got %T", m)
+				}
+				if m.GetHash() != data.expectedValue {
+					t.Errorf("Expected %v, got %v", data.expectedValue, m.GetHash())
+				}
 			default:
 			}
 
@@ -199,6 +216,25 @@ func TestParseQuotedSubject(t *testing.T) {
 	}
 }
 
+func TestQuoteValue(t *testing.T) {
+	// a value with spaces, quotes and backslashes is searched as a whole
+	for _, value := range []string{"a from:x", `say "hi"`, `back\slash`, `"`} {
+		matchers, err := ParseQuery("mailbox:" + QuoteValue(value) + " " + QuoteValue(value))
+		if err != nil {
+			t.Fatalf("Error parsing query: %v", err)
+		}
+		if len(matchers) != 2 {
+			t.Fatalf("Expected 2 matchers for %q, got %v", value, matchers)
+		}
+		if mailbox, ok := matchers[0].(MailboxMatch); !ok || mailbox.GetMailbox() != value {
+			t.Errorf("Expected mailbox %q, got %v", value, matchers[0])
+		}
+		if text, ok := matchers[1].(PlainTextMatch); !ok || text.GetText() != value {
+			t.Errorf("Expected plain text %q, got %v", value, matchers[1])
+		}
+	}
+}
+
 func TestInvalidQueryError(t *testing.T) {
 	query := "mailbox:recipient@example.com has:attachment sometext \"important and quoted\" before:2020-02-01 after:2020-03-01 from:sender@example.com older_than:2h subject:important"
 	errorString := "some error message"
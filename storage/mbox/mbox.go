@@ -0,0 +1,169 @@
+// Package mbox reads and writes mbox files in the mboxrd format: each message
+// starts with a "From " separator line and ends with a blank line, and the lines
+// of a message starting with "From " after any number of '>' are quoted with
+// one more '>', so that the quoting can be reversed.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"time"
+)
+
+// Message is a message of an mbox file.
+type Message struct {
+	Start  int64  // offset of the "From " separator line
+	Offset int64  // offset of the quoted content, after the separator line
+	Size   int64  // size of the quoted content, without the separating blank line
+	End    int64  // offset of the next message, or the size of the file
+	From   string // separator line, without its line ending
+	Raw    []byte // unquoted content
+}
+
+// Reader reads the messages of an mbox file.
+type Reader struct {
+	reader *bufio.Reader
+	offset int64  // offset of the next line
+	next   []byte // separator line of the next message, already read
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next message, or io.EOF after the last one. Anything before
+// the first separator line is ignored.
+func (r *Reader) Next() (*Message, error) {
+	for r.next == nil {
+		line, err := r.readLine()
+		if len(line) == 0 && err != nil {
+			return nil, err
+		}
+		if isSeparator(line) {
+			r.next = line
+		}
+	}
+	message := &Message{
+		Start:  r.offset - int64(len(r.next)),
+		Offset: r.offset,
+		From:   string(bytes.TrimRight(r.next, "\r\n")),
+	}
+	r.next = nil
+	var content bytes.Buffer
+	for {
+		line, err := r.readLine()
+		if isSeparator(line) {
+			r.next = line
+			break
+		}
+		content.Write(line)
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+	}
+	quoted := trimSeparatingLine(content.Bytes())
+	message.Size = int64(len(quoted))
+	message.End = message.Offset + int64(content.Len())
+	message.Raw = Unquote(quoted)
+	return message, nil
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.reader.ReadBytes('\n')
+	r.offset += int64(len(line))
+	return line, err
+}
+
+// isSeparator returns true for the "From " line starting a message.
+func isSeparator(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// trimSeparatingLine removes the blank line ending a message.
+func trimSeparatingLine(content []byte) []byte {
+	switch {
+	case bytes.HasSuffix(content, []byte("\n\n")):
+		return content[:len(content)-1]
+	case bytes.HasSuffix(content, []byte("\r\n\r\n")):
+		return content[:len(content)-2]
+	}
+	return content
+}
+
+// isQuotedFrom returns true for the lines starting with "From " after any
+// number of '>'.
+func isQuotedFrom(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// Quote quotes the "From " lines of a message, ending it with a line ending.
+func Quote(raw []byte) []byte {
+	var quoted bytes.Buffer
+	quoted.Grow(len(raw) + 1)
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		if isQuotedFrom(line) {
+			quoted.WriteByte('>')
+		}
+		quoted.Write(line)
+	}
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		quoted.WriteByte('\n')
+	}
+	return quoted.Bytes()
+}
+
+// Unquote reverses Quote.
+func Unquote(quoted []byte) []byte {
+	var raw bytes.Buffer
+	raw.Grow(len(quoted))
+	for _, line := range bytes.SplitAfter(quoted, []byte("\n")) {
+		if len(line) > 0 && line[0] == '>' && isQuotedFrom(line) {
+			line = line[1:]
+		}
+		raw.Write(line)
+	}
+	return raw.Bytes()
+}
+
+// FromLine returns the separator line of a message, with the sender (the
+// Return-Path or From address) and the date of its headers.
+func FromLine(raw []byte) string {
+	sender, date := "MAILER-DAEMON", time.Unix(0, 0)
+	if message, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if address, err := mail.ParseAddress(message.Header.Get("Return-Path")); err == nil && address.Address != "" {
+			sender = address.Address
+		} else if address, err := mail.ParseAddress(message.Header.Get("From")); err == nil && address.Address != "" {
+			sender = address.Address
+		}
+		if headerDate, err := message.Header.Date(); err == nil {
+			date = headerDate
+		}
+	}
+	return fmt.Sprintf("From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+}
+
+// Writer writes messages to an mbox file.
+type Writer struct {
+	writer io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{writer: w}
+}
+
+// WriteMessage writes the separator line, the quoted message and the blank line
+// ending it.
+func (w *Writer) WriteMessage(raw []byte) error {
+	var buffer bytes.Buffer
+	buffer.WriteString(FromLine(raw))
+	buffer.Write(Quote(raw))
+	buffer.WriteByte('\n')
+	_, err := buffer.WriteTo(w.writer)
+	return err
+}
@@ -0,0 +1,79 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	testCases := []struct {
+		raw    string
+		quoted string
+	}{
+		{"Subject: a\n\nbody\n", "Subject: a\n\nbody\n"},
+		{"Subject: a\n\nFrom here\n", "Subject: a\n\n>From here\n"},
+		{"Subject: a\n\n>From here\n>>From there\n", "Subject: a\n\n>>From here\n>>>From there\n"},
+		{"Subject: a\r\n\r\nFrom here\r\n", "Subject: a\r\n\r\n>From here\r\n"},
+		{"Subject: a\n\nFromage\n> From\nno newline", "Subject: a\n\nFromage\n> From\nno newline\n"},
+	}
+	for _, data := range testCases {
+		quoted := Quote([]byte(data.raw))
+		if string(quoted) != data.quoted {
+			t.Errorf("Quote(%q): expected %q, got %q", data.raw, data.quoted, quoted)
+		}
+		expected := data.raw
+		if !strings.HasSuffix(expected, "\n") {
+			expected += "\n"
+		}
+		if raw := Unquote(quoted); string(raw) != expected {
+			t.Errorf("Unquote(%q): expected %q, got %q", quoted, expected, raw)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	messages := []string{
+		"From: alice@example.com\r\nDate: Mon, 01 Jan 2024 10:00:00 +0000\r\nSubject: one\r\n\r\nFrom the start\r\n>From quoted\r\n",
+		"Return-Path: <bounce@example.com>\nFrom: bob@example.com\nSubject: two\n\nlast line\n\n",
+		"Subject: three\n\nno final newline\n",
+	}
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+	for _, message := range messages {
+		if err := writer.WriteMessage([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buffer.Bytes()
+	if !strings.HasPrefix(string(data), "From alice@example.com Mon Jan  1 10:00:00 2024\n") {
+		t.Errorf("unexpected separator line in %q", data)
+	}
+
+	reader := NewReader(bytes.NewReader(append([]byte("garbage\n"), data...)))
+	senders := []string{"alice@example.com", "bounce@example.com", "MAILER-DAEMON"}
+	for i, expected := range messages {
+		message, err := reader.Next()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if string(message.Raw) != expected {
+			t.Errorf("message %d: expected %q, got %q", i, expected, message.Raw)
+		}
+		if !strings.HasPrefix(message.From, "From "+senders[i]+" ") {
+			t.Errorf("message %d: unexpected separator %q", i, message.From)
+		}
+		// the offsets are those of the file read, after the 8 bytes of garbage
+		quoted := data[message.Offset-8 : message.Offset-8+message.Size]
+		if string(Unquote(quoted)) != expected {
+			t.Errorf("message %d: unexpected content at offset %d: %q", i, message.Offset, quoted)
+		}
+		if i < len(messages)-1 && !strings.HasPrefix(string(data[message.End-8:]), "From ") {
+			t.Errorf("message %d: expected the next message at %d", i, message.End)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last message, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"mock-my-mta/log"
+)
+
+// MigrateOptions tunes a migration.
+type MigrateOptions struct {
+	// Overwrite writes again the emails the destination already holds. Else they
+	// are skipped, so an interrupted migration resumes where it stopped.
+	Overwrite bool
+	// Progress, if not nil, is called after each email.
+	Progress func(done int, total int)
+}
+
+// MigrateResult counts the emails of a migration.
+type MigrateResult struct {
+	Total   int      // emails of the source
+	Copied  int      // written into the destination
+	Skipped int      // already held by the destination
+	Flags   int      // emails whose flags (read state) were written
+	Errors  []string // emails that could not be copied
+}
+
+// Migrate copies the emails of the source layer into the destination layer,
+// with their IDs, in date order. The raw emails are read and written through the
+// layers, which handle their format: the envelope of the mailhog files, the
+// encoding of the eml files, the ID header of the mbox files. The flags (read
+// state) kept by a Maildir source are written to a Maildir destination. A failed
+// email is reported and the migration goes on; an error is returned when a layer
+// cannot be opened or listed, or when the context is done.
+func Migrate(ctx context.Context, source StorageLayerConfiguration, destination StorageLayerConfiguration, options MigrateOptions) (MigrateResult, error) {
+	var result MigrateResult
+	from, err := openMigrationLayer(source)
+	if err != nil {
+		return result, fmt.Errorf("source: %v", err)
+	}
+	defer closeLayer(from)
+	to, err := openMigrationLayer(destination)
+	if err != nil {
+		return result, fmt.Errorf("destination: %v", err)
+	}
+	defer closeLayer(to)
+
+	headers, _, err := from.SearchEmailsContext(ctx, "", 1, -1)
+	if err != nil {
+		return result, fmt.Errorf("cannot list the emails of the source: %v", err)
+	}
+	emailIDs := make([]string, 0, len(headers))
+	for _, header := range headers {
+		emailIDs = append(emailIDs, header.ID)
+	}
+	slices.Sort(emailIDs) // the IDs start with the date
+	result.Total = len(emailIDs)
+
+	held := make(map[string]bool)
+	if !options.Overwrite {
+		existing, _, err := to.SearchEmailsContext(ctx, "", 1, -1)
+		if err != nil && !isUnimplemented(err) {
+			return result, fmt.Errorf("cannot list the emails of the destination: %v", err)
+		}
+		for _, header := range existing {
+			held[header.ID] = true
+		}
+	}
+
+	var flags map[string][]string
+	sourceFlags, fromFlags := from.(flagLayer)
+	destinationFlags, toFlags := to.(flagLayer)
+	if fromFlags && toFlags {
+		if flags, err = sourceFlags.loadFlags(); err != nil && !isUnimplemented(err) {
+			return result, fmt.Errorf("cannot load the flags of the source: %v", err)
+		}
+	}
+
+	for i, emailID := range emailIDs {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if held[emailID] {
+			result.Skipped++
+		} else if err := copyEmail(from, to, emailID, options.Overwrite); err != nil {
+			log.Logf(log.WARNING, "cannot migrate email %v: %v", emailID, err)
+			result.Errors = append(result.Errors, fmt.Sprintf("%v: %v", emailID, err))
+		} else {
+			result.Copied++
+		}
+		if emailFlags := flags[emailID]; len(emailFlags) > 0 {
+			if err := destinationFlags.saveFlags(emailID, emailFlags); err != nil && !isUnimplemented(err) && !IsNotFound(err) {
+				result.Errors = append(result.Errors, fmt.Sprintf("%v: flags: %v", emailID, err))
+			} else if err == nil {
+				result.Flags++
+			}
+		}
+		if options.Progress != nil {
+			options.Progress(i+1, len(emailIDs))
+		}
+	}
+	return result, nil
+}
+
+// openMigrationLayer constructs and loads the layer as a root layer.
+func openMigrationLayer(cfg StorageLayerConfiguration) (storageLayer, error) {
+	layer, err := newStorageLayer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := layer.load(nil); err != nil {
+		closeLayer(layer)
+		return nil, err
+	}
+	return layer, nil
+}
+
+// closeLayer releases the database of the layer, if any.
+func closeLayer(layer storageLayer) {
+	switch s := layer.(type) {
+	case *sqliteStorage:
+		s.db.Close()
+	case *boltStorage:
+		s.db.Close()
+	}
+}
+
+// copyEmail writes the raw email of the source into the destination, replacing
+// the email the destination may hold.
+func copyEmail(from storageLayer, to storageLayer, emailID string, replace bool) error {
+	rawEmail, err := from.GetRawEmail(emailID)
+	if err != nil {
+		return err
+	}
+	if replace {
+		if err := to.DeleteEmailByID(emailID); err != nil && !IsNotFound(err) && !isUnimplemented(err) {
+			return err
+		}
+	}
+	return to.setWithID(emailID, rawEmail)
+}
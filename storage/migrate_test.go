@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMigrateMailhogToSqlite(t *testing.T) {
+	folder := t.TempDir()
+	// a file written by MailHog, and an email saved as is into the folder
+	envelope := "HELO:<mx.example.com>\r\nFROM:<sender@example.com>\r\nTO:<rcpt1@example.com>\r\n\r\n"
+	if err := os.WriteFile(filepath.Join(folder, "2024-01-01T10:00:01Z-1@mailhog.example"), append([]byte(envelope), memoryTestEmail(1)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "2024-01-01T10:00:02Z-2@mailhog.example"), memoryTestEmail(2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := StorageLayerConfiguration{Type: "FILESYSTEM", Parameters: map[string]string{"folder": folder, "type": "mailhog"}}
+	destination := StorageLayerConfiguration{Type: "SQLITE", Parameters: map[string]string{"database": filepath.Join(t.TempDir(), "test.db")}}
+
+	var progress []int
+	result, err := Migrate(context.Background(), source, destination, MigrateOptions{Progress: func(done, total int) {
+		progress = append(progress, done)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 2 || result.Copied != 2 || result.Skipped != 0 || len(result.Errors) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if !slices.Equal(progress, []int{1, 2}) {
+		t.Errorf("unexpected progress %v", progress)
+	}
+
+	sqlite, err := newSqliteStorage(destination.Parameters["database"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, emailID := range []string{"2024-01-01T10:00:01Z-1", "2024-01-01T10:00:02Z-2"} {
+		raw, err := sqlite.GetRawEmail(emailID)
+		if err != nil || string(raw) != string(memoryTestEmail(i+1)) {
+			t.Errorf("unexpected raw email %v: %q, %v", emailID, raw, err)
+		}
+	}
+	sqlite.db.Close()
+
+	// resumed: the emails already migrated are skipped
+	result, err = Migrate(context.Background(), source, destination, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 0 || result.Skipped != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestMigrateMaildirFlags(t *testing.T) {
+	sourceFolder, destinationFolder := t.TempDir(), t.TempDir()
+	maildir, err := newFilesystemStorage(sourceFolder, "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := maildir.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, emailID := range []string{"2024-01-01T10:00:01Z-1", "2024-01-01T10:00:02Z-2"} {
+		if err := maildir.setWithID(emailID, memoryTestEmail(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := maildir.saveFlags("2024-01-01T10:00:01Z-1", []string{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+
+	source := StorageLayerConfiguration{Type: "FILESYSTEM", Parameters: map[string]string{"folder": sourceFolder, "type": "maildir"}}
+	destination := StorageLayerConfiguration{Type: "FILESYSTEM", Parameters: map[string]string{"folder": destinationFolder, "type": "maildir"}}
+	result, err := Migrate(context.Background(), source, destination, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 2 || result.Flags != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	migrated, err := newFilesystemStorage(destinationFolder, "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := migrated.loadFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(flags["2024-01-01T10:00:01Z-1"], []string{FlagSeen}) || len(flags["2024-01-01T10:00:02Z-2"]) != 0 {
+		t.Errorf("unexpected flags %v", flags)
+	}
+}
+
+func TestMigrateUnknownType(t *testing.T) {
+	source := StorageLayerConfiguration{Type: "FILESYSTEM", Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}}
+	if _, err := Migrate(context.Background(), source, StorageLayerConfiguration{Type: "TAPE"}, MigrateOptions{}); err == nil {
+		t.Error("expected an error for an unknown destination type")
+	}
+}
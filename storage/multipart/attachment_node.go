@@ -1,6 +1,8 @@
 package multipart
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"mime"
 	"strings"
 )
@@ -47,3 +49,9 @@ func parseFilenameManual(contentDisposition string) string {
 func (l AttachmentNode) GetSize() int {
 	return len(l.body)
 }
+
+// GetHash returns the hexadecimal SHA-256 of the decoded attachment.
+func (l AttachmentNode) GetHash() string {
+	sum := sha256.Sum256([]byte(l.GetDecodedBody()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package multipart
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// FindAttachment reads the message until its attachment with the ID of
+// GetAttachments, without parsing the other parts. It returns the attachment
+// without body, and the reader of its encoded body, valid until the message is
+// read further.
+func FindAttachment(message *mail.Message, attachmentID string) (AttachmentNode, io.Reader, bool, error) {
+	next := 0
+	return findAttachment(message.Header, message.Body, attachmentID, &next)
+}
+
+func findAttachment(headersMap map[string][]string, bodyReader io.Reader, attachmentID string, next *int) (AttachmentNode, io.Reader, bool, error) {
+	headers := newHeaders(headersMap)
+	// same structure as parseMail
+	contentType := getContentType(headers)
+	mediaType := "text/plain"
+	params := map[string]string{}
+	if contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return AttachmentNode{}, nil, false, err
+		}
+	} else {
+		headers.values["content-type"] = []string{"text/plain; charset=us-ascii"}
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		leaf := leafNode{headers: headers}
+		if !leaf.isAttachment() {
+			return AttachmentNode{}, nil, false, nil
+		}
+		id := fmt.Sprintf("%v", *next)
+		*next++
+		if id != attachmentID {
+			return AttachmentNode{}, nil, false, nil
+		}
+		return AttachmentNode{leafNode: leaf}, bodyReader, true, nil
+	}
+	mr := multipart.NewReader(bodyReader, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return AttachmentNode{}, nil, false, nil
+		}
+		if err != nil {
+			return AttachmentNode{}, nil, false, err
+		}
+		attachment, body, found, err := findAttachment(p.Header, p, attachmentID, next)
+		if found || err != nil {
+			return attachment, body, found, err
+		}
+	}
+}
+
+// GetDecoders returns the decoders of the encoded body, in the order
+// GetDecodedBody applies them: the Content-Transfer-Encoding, then the charset.
+// GetDecodedBody keeps the body as it was before a decoder failing.
+func (l AttachmentNode) GetDecoders() []func(io.Reader) io.Reader {
+	var decoders []func(io.Reader) io.Reader
+	switch strings.ToLower(l.getContentTransferEncoding()) {
+	case "base64":
+		decoders = append(decoders, func(r io.Reader) io.Reader {
+			return base64.NewDecoder(base64.StdEncoding, r)
+		})
+	case "quoted-printable":
+		decoders = append(decoders, func(r io.Reader) io.Reader {
+			return quotedprintable.NewReader(r)
+		})
+	}
+	if charset := l.getCharset(); charset != "" && !isUTF8Charset(charset) {
+		if enc, err := ianaindex.IANA.Encoding(charset); err == nil && enc != nil {
+			decoders = append(decoders, func(r io.Reader) io.Reader {
+				return enc.NewDecoder().Reader(r)
+			})
+		}
+	}
+	return decoders
+}
@@ -0,0 +1,100 @@
+package multipart
+
+import (
+	"slices"
+	"strings"
+)
+
+// Headers recording the outcome of Sieve filtering in the stored message.
+// Each value is "<mailbox> value", one header per mailbox.
+const (
+	FolderHeader = "X-Mailbox-Folder"
+	FlagsHeader  = "X-Mailbox-Flags"
+)
+
+// DefaultFolder is the folder of messages that were not filed anywhere else.
+const DefaultFolder = "Inbox"
+
+// FolderPlacement is the folder (and flags) a message was filed into for one mailbox.
+type FolderPlacement struct {
+	Mailbox string
+	Folder  string
+	Flags   []string
+}
+
+// FormatMailboxHeader formats the value of a FolderHeader or FlagsHeader.
+func FormatMailboxHeader(mailbox string, value string) string {
+	return "<" + mailbox + "> " + value
+}
+
+func parseMailboxHeader(value string) (string, string, bool) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "<") {
+		return "", "", false
+	}
+	end := strings.Index(value, ">")
+	if end < 0 {
+		return "", "", false
+	}
+	return value[1:end], strings.TrimSpace(value[end+1:]), true
+}
+
+// GetFolderPlacements returns the folders the message was filed into.
+// Messages without placement headers are in the Inbox of every recipient.
+func (mp Multipart) GetFolderPlacements() []FolderPlacement {
+	var placements []FolderPlacement
+	for _, value := range getHeaderValues(mp, FolderHeader) {
+		mailbox, folder, ok := parseMailboxHeader(value)
+		if !ok || folder == "" {
+			continue
+		}
+		placements = append(placements, FolderPlacement{Mailbox: mailbox, Folder: folder})
+	}
+	if len(placements) == 0 {
+		for _, recipient := range mp.GetRecipients() {
+			placements = append(placements, FolderPlacement{Mailbox: recipient.Address, Folder: DefaultFolder})
+		}
+	}
+	for _, value := range getHeaderValues(mp, FlagsHeader) {
+		mailbox, flags, ok := parseMailboxHeader(value)
+		if !ok {
+			continue
+		}
+		for i := range placements {
+			if strings.EqualFold(placements[i].Mailbox, mailbox) {
+				placements[i].Flags = strings.Fields(flags)
+			}
+		}
+	}
+	return placements
+}
+
+// GetPlacementMailboxes returns the mailboxes the message was filed for by Sieve,
+// redirect targets included, which may not be recipients of the message.
+func (mp Multipart) GetPlacementMailboxes() []string {
+	var mailboxes []string
+	for _, value := range getHeaderValues(mp, FolderHeader) {
+		mailbox, _, ok := parseMailboxHeader(value)
+		if !ok || mailbox == "" || slices.ContainsFunc(mailboxes, func(m string) bool { return strings.EqualFold(m, mailbox) }) {
+			continue
+		}
+		mailboxes = append(mailboxes, mailbox)
+	}
+	return mailboxes
+}
+
+// IsInFolder returns true if the message was filed into the folder for one of
+// the mailboxes, or for any mailbox without mailboxes.
+func (mp Multipart) IsInFolder(folder string, mailboxes ...string) bool {
+	for _, placement := range mp.GetFolderPlacements() {
+		if !strings.EqualFold(placement.Folder, folder) {
+			continue
+		}
+		if len(mailboxes) == 0 || slices.ContainsFunc(mailboxes, func(mailbox string) bool {
+			return strings.EqualFold(mailbox, placement.Mailbox)
+		}) {
+			return true
+		}
+	}
+	return false
+}
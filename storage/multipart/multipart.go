@@ -8,6 +8,7 @@ import (
 	"mime/multipart"
 	"net/mail"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -418,6 +419,65 @@ func (mp Multipart) GetBody(bodyVersion string) (string, error) {
 	return bodyContent, nil
 }
 
+// GetHTMLText returns the text of the HTML body, without tags, scripts and styles.
+func (mp Multipart) GetHTMLText() string {
+	body, err := mp.GetBody("html")
+	if err != nil {
+		return ""
+	}
+	return stripHTMLTags(body)
+}
+
+// SearchText is the decoded text of a message matched by free text searches.
+type SearchText struct {
+	Subject     string
+	Addresses   string // sender and recipients, with their display names, one per line
+	Body        string // plain text body
+	HTMLText    string
+	HTML        string // HTML and watch HTML bodies as written, markup included
+	Attachments string // attachment filenames, one per line
+}
+
+// GetSearchText returns the text matched by free text searches, the same for
+// every storage layer.
+func (mp Multipart) GetSearchText() SearchText {
+	var addresses []string
+	for _, address := range append([]mail.Address{mp.GetFrom()}, mp.GetRecipients()...) {
+		addresses = append(addresses, strings.TrimSpace(address.Name+" "+address.Address))
+	}
+	var filenames []string
+	for _, attachment := range mp.GetAttachments() {
+		filenames = append(filenames, attachment.GetFilename())
+	}
+	sort.Strings(filenames)
+	var htmlBodies []string
+	for _, version := range []string{"html", "watch-html"} {
+		if body, err := mp.GetBody(version); err == nil {
+			htmlBodies = append(htmlBodies, body)
+		}
+	}
+	body, _ := mp.GetBody("plain-text")
+	return SearchText{
+		Subject:     mp.GetSubject(),
+		Addresses:   strings.Join(addresses, "\n"),
+		Body:        body,
+		HTMLText:    mp.GetHTMLText(),
+		HTML:        strings.Join(htmlBodies, "\n"),
+		Attachments: strings.Join(filenames, "\n"),
+	}
+}
+
+// Contains returns true if one of the texts contains the text, ignoring the case.
+func (t SearchText) Contains(text string) bool {
+	text = strings.ToLower(text)
+	for _, field := range []string{t.Subject, t.Addresses, t.Body, t.HTMLText, t.HTML, t.Attachments} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
+		}
+	}
+	return false
+}
+
 func (mp Multipart) GetBodyVersions() []string {
 	var versions []string
 	versionsMap := make(map[string]bool)
@@ -15,37 +15,27 @@ func (multipart Multipart) match(m interface{}) bool {
 				return true
 			}
 		}
-		return false
-	case matcher.AttachmentMatch:
-		return multipart.HasAttachments()
-	case matcher.PlainTextMatch:
-		searchText := strings.ToLower(mt.GetText())
-		// check if the body contains the string (case insensitive)
-		bodyVersions := multipart.GetBodyVersions()
-		for _, bodyVersion := range bodyVersions {
-			body, err := multipart.GetBody(bodyVersion)
-			if err != nil {
-				continue
-			}
-			if strings.Contains(strings.ToLower(body), searchText) {
+		// the mailboxes Sieve delivered the message to, redirect targets included
+		for _, mailbox := range multipart.GetPlacementMailboxes() {
+			if strings.EqualFold(mailbox, mt.GetMailbox()) {
 				return true
 			}
 		}
-		// check if the subject contains the string
-		if strings.Contains(strings.ToLower(multipart.GetSubject()), searchText) {
-			return true
-		}
-		// check if the from contains the string
-		if strings.Contains(strings.ToLower(multipart.GetFrom().Address), searchText) {
-			return true
-		}
-		// check if the recipients contain the string
-		for _, recipient := range multipart.GetRecipients() {
-			if strings.Contains(strings.ToLower(recipient.Address), searchText) {
+		return false
+	case matcher.FolderMatch:
+		return multipart.IsInFolder(mt.GetFolder(), mt.GetMailboxes()...)
+	case matcher.AttachmentMatch:
+		return multipart.HasAttachments()
+	case matcher.AttachmentHashMatch:
+		for _, attachment := range multipart.GetAttachments() {
+			if attachment.GetHash() == mt.GetHash() {
 				return true
 			}
 		}
 		return false
+	case matcher.PlainTextMatch:
+		// the text indexed by the full-text search of the SQLite layer
+		return multipart.GetSearchText().Contains(mt.GetText())
 	case matcher.BeforeMatch:
 		if multipart.GetDate().Before(mt.GetDate()) {
 			return true
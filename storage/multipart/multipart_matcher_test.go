@@ -73,6 +73,9 @@ func TestMatch(t *testing.T) {
 		{"match-subject-quote-case", mustParseQuery(t, "subject:\"OF THE EMAIL\""), true},
 		{"not-match-subject", mustParseQuery(t, "subject:unknown"), false},
 		{"not-match-subject-quote", mustParseQuery(t, "subject:\"oof the email\""), false},
+		// Folder matchers (no placement header: Inbox)
+		{"match-in-inbox", mustParseQuery(t, "in:inbox"), true},
+		{"not-match-in-spam", mustParseQuery(t, "in:spam"), false},
 	}
 
 	for _, test := range tests {
@@ -86,6 +89,28 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestMatchHTML(t *testing.T) {
+	email, err := mail.ReadMessage(strings.NewReader("From: sender@example.com\r\nTo: to1@example.com\r\nSubject: Lunch\r\nContent-Type: text/html\r\n\r\n<p>See you at <a href=\"https://example.com/menu\">noon</a> &amp; bring it</p>\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multipart, err := New(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for query, expected := range map[string]bool{
+		"noon":                 true, // HTML text
+		"\"you at noon\"":      true, // HTML text, across the tags
+		"example.com/menu":     true, // markup, as written
+		"&amp;":                true, // entity, as written
+		"zzz_nonexistent_text": false,
+	} {
+		if actual := multipart.match(mustParseQuery(t, query)); actual != expected {
+			t.Errorf("search %q: expected %v, got %v", query, expected, actual)
+		}
+	}
+}
+
 func TestMatchAll(t *testing.T) {
 	// read the email
 	email, err := mail.ReadMessage(strings.NewReader(simpleEmailMatcher))
@@ -143,3 +168,60 @@ func mustParseQuery(t *testing.T, query string) interface{} {
 	}
 	return matchers[0]
 }
+
+func TestMatchFolder(t *testing.T) {
+	raw := "X-Mailbox-Folder: <to1@example.com> Spam\n" +
+		"X-Mailbox-Folder: <to2@example.com> Inbox\n" +
+		"X-Mailbox-Flags: <to1@example.com> $Junk \\Flagged\n" +
+		simpleEmailMatcher
+	email, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multipart, err := New(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placements := multipart.GetFolderPlacements()
+	if len(placements) != 2 {
+		t.Fatalf("expected 2 placements, got %+v", placements)
+	}
+	if placements[0].Folder != "Spam" || len(placements[0].Flags) != 2 || placements[0].Flags[0] != "$Junk" {
+		t.Errorf("unexpected placement %+v", placements[0])
+	}
+	if !multipart.match(mustParseQuery(t, "in:SPAM")) {
+		t.Errorf("expected message to be in Spam")
+	}
+	if multipart.match(mustParseQuery(t, "in:receipts")) {
+		t.Errorf("expected message not to be in receipts")
+	}
+}
+
+func TestMatchFolderOfMailbox(t *testing.T) {
+	raw := "X-Mailbox-Folder: <to1@example.com> Spam\n" +
+		"X-Mailbox-Folder: <to2@example.com> Inbox\n" +
+		simpleEmailMatcher
+	email, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multipart, err := New(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for query, expected := range map[string]bool{
+		"mailbox:to1@example.com in:spam":  true,
+		"mailbox:TO2@example.com in:inbox": true,
+		"mailbox:to2@example.com in:spam":  false,
+		"in:inbox mailbox:to1@example.com": false,
+	} {
+		matchers, err := matcher.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if multipart.MatchAll(matchers) != expected {
+			t.Errorf("%q: expected %v", query, expected)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// defaultRetentionInterval is the time between two runs of the janitor.
+const defaultRetentionInterval = time.Minute
+
+// RetentionConfiguration limits the emails kept by the storage. The oldest
+// emails beyond a limit are deleted by a background janitor; a zero or empty
+// limit does not apply.
+type RetentionConfiguration struct {
+	// MaxAge deletes the emails received before this Go duration ("168h"), dated
+	// by their Date header when the storage does not know their receive time.
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxCount is the number of emails kept.
+	MaxCount int `json:"max_count,omitempty"`
+	// MaxCountPerMailbox is the number of emails kept for each recipient.
+	MaxCountPerMailbox int `json:"max_count_per_mailbox,omitempty"`
+	// MaxSize is the total size of the raw emails kept, in bytes with an optional
+	// KB, MB or GB suffix.
+	MaxSize string `json:"max_size,omitempty"`
+	// Interval is the time between two runs of the janitor (default 1m).
+	Interval string `json:"interval,omitempty"`
+}
+
+// retentionPolicy is the parsed RetentionConfiguration.
+type retentionPolicy struct {
+	maxAge             time.Duration
+	maxCount           int
+	maxCountPerMailbox int
+	maxSize            int64
+	interval           time.Duration
+}
+
+func parseRetentionConfiguration(config RetentionConfiguration) (retentionPolicy, error) {
+	policy := retentionPolicy{
+		maxCount:           config.MaxCount,
+		maxCountPerMailbox: config.MaxCountPerMailbox,
+		interval:           defaultRetentionInterval,
+	}
+	var err error
+	if config.MaxAge != "" {
+		if policy.maxAge, err = time.ParseDuration(config.MaxAge); err != nil || policy.maxAge < 0 {
+			return policy, fmt.Errorf("invalid retention max_age: %q", config.MaxAge)
+		}
+	}
+	if policy.maxCount < 0 || policy.maxCountPerMailbox < 0 {
+		return policy, fmt.Errorf("invalid retention count: %d, %d per mailbox", policy.maxCount, policy.maxCountPerMailbox)
+	}
+	if config.MaxSize != "" {
+		if policy.maxSize, err = parseByteSize(config.MaxSize); err != nil {
+			return policy, fmt.Errorf("invalid retention max_size: %v", err)
+		}
+	}
+	if config.Interval != "" {
+		if policy.interval, err = time.ParseDuration(config.Interval); err != nil || policy.interval <= 0 {
+			return policy, fmt.Errorf("invalid retention interval: %q", config.Interval)
+		}
+	}
+	return policy, nil
+}
+
+// enabled returns true if the policy limits the emails.
+func (p retentionPolicy) enabled() bool {
+	return p.maxAge > 0 || p.maxCount > 0 || p.maxCountPerMailbox > 0 || p.maxSize > 0
+}
+
+// RetentionStats is the activity of the retention janitor.
+type RetentionStats struct {
+	Runs      int       `json:"runs"`
+	LastRun   time.Time `json:"last_run,omitzero"`
+	NextRun   time.Time `json:"next_run,omitzero"`
+	Emails    int       `json:"emails"` // emails kept by the last run
+	Size      int64     `json:"size"`   // size of the emails kept by the last run, when limited
+	Deleted   int       `json:"deleted"`
+	ByAge     int       `json:"deleted_by_age"`
+	ByCount   int       `json:"deleted_by_count"`
+	ByMailbox int       `json:"deleted_by_mailbox"`
+	BySize    int       `json:"deleted_by_size"`
+	Failed    int       `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// reasons of the deletion of an email by the janitor
+const (
+	expiredByAge = iota + 1
+	expiredByMailbox
+	expiredByCount
+	expiredBySize
+)
+
+// janitor deletes periodically the emails beyond the limits of the policy.
+type janitor struct {
+	engine *Engine
+	policy retentionPolicy
+	sizes  map[string]int64 // raw email sizes, kept between the runs
+	stop   context.CancelFunc
+	done   chan struct{}
+
+	mu    sync.Mutex
+	stats RetentionStats
+}
+
+// StartRetention starts the janitor deleting the oldest emails beyond the limits
+// of the configuration from all the layers, notified to the SetOnDeleteEmail
+// callback. It does nothing without limits, and is stopped by Close.
+func (e *Engine) StartRetention(config RetentionConfiguration) error {
+	policy, err := parseRetentionConfiguration(config)
+	if err != nil {
+		return err
+	}
+	if !policy.enabled() {
+		return nil
+	}
+	if e.janitor != nil {
+		return fmt.Errorf("retention already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.janitor = &janitor{engine: e, policy: policy, sizes: make(map[string]int64), stop: cancel, done: make(chan struct{})}
+	log.Logf(log.INFO, "retention: checking the emails every %v", policy.interval)
+	go e.janitor.loop(ctx)
+	return nil
+}
+
+// RetentionStats returns the activity of the retention janitor, nil when not started.
+func (e *Engine) RetentionStats() *RetentionStats {
+	if e.janitor == nil {
+		return nil
+	}
+	return e.janitor.statistics()
+}
+
+func (j *janitor) loop(ctx context.Context) {
+	defer close(j.done)
+	for {
+		j.run(ctx, time.Now())
+		j.mu.Lock()
+		j.stats.NextRun = time.Now().Add(j.policy.interval).UTC()
+		j.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(j.policy.interval):
+		}
+	}
+}
+
+// close stops the janitor, waiting for its current run.
+func (j *janitor) close() {
+	j.stop()
+	<-j.done
+}
+
+func (j *janitor) statistics() *RetentionStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := j.stats
+	return &stats
+}
+
+// run deletes the emails beyond the limits of the policy at now, oldest first.
+func (j *janitor) run(ctx context.Context, now time.Time) {
+	headers, _, err := j.engine.SearchEmailsContext(ctx, "", 1, -1)
+	if err != nil {
+		if ctx.Err() == nil {
+			j.failed(fmt.Errorf("cannot list the emails: %w", err))
+		}
+		return
+	}
+	// oldest first, by reception: the date of an email is set by its sender
+	slices.SortStableFunc(headers, func(a, b EmailHeader) int {
+		if c := a.receivedOrDate().Compare(b.receivedOrDate()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	reasons := j.expired(ctx, headers, now)
+
+	deleted := make(map[int]int)
+	kept, size := 0, int64(0)
+	for _, header := range headers {
+		reason, ok := reasons[header.ID]
+		if !ok {
+			kept++
+			size += j.sizes[header.ID]
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := j.engine.DeleteEmailByID(header.ID); err != nil && !IsNotFound(err) {
+			j.failed(fmt.Errorf("cannot delete email %v: %w", header.ID, err))
+			kept++
+			continue
+		}
+		delete(j.sizes, header.ID)
+		deleted[reason]++
+	}
+	if total := len(headers) - kept; total > 0 {
+		log.Logf(log.INFO, "retention: deleted %d emails (%d by age, %d by count, %d by mailbox count, %d by size)",
+			total, deleted[expiredByAge], deleted[expiredByCount], deleted[expiredByMailbox], deleted[expiredBySize])
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Runs++
+	j.stats.LastRun = now.UTC()
+	j.stats.Emails = kept
+	j.stats.Size = size
+	j.stats.ByAge += deleted[expiredByAge]
+	j.stats.ByCount += deleted[expiredByCount]
+	j.stats.ByMailbox += deleted[expiredByMailbox]
+	j.stats.BySize += deleted[expiredBySize]
+	j.stats.Deleted = j.stats.ByAge + j.stats.ByCount + j.stats.ByMailbox + j.stats.BySize
+}
+
+// expired returns the emails to delete, out of the emails sorted oldest first,
+// with the reason of their deletion.
+func (j *janitor) expired(ctx context.Context, headers []EmailHeader, now time.Time) map[string]int {
+	reasons := make(map[string]int)
+	remaining := func() []EmailHeader {
+		var emails []EmailHeader
+		for _, header := range headers {
+			if _, ok := reasons[header.ID]; !ok {
+				emails = append(emails, header)
+			}
+		}
+		return emails
+	}
+
+	if j.policy.maxAge > 0 {
+		limit := now.Add(-j.policy.maxAge)
+		for _, header := range headers {
+			if received := header.receivedOrDate(); !received.IsZero() && received.Before(limit) {
+				reasons[header.ID] = expiredByAge
+			}
+		}
+	}
+	if j.policy.maxCountPerMailbox > 0 {
+		// the newest emails of each mailbox are kept: an email to several
+		// mailboxes is deleted only once all of them are full
+		counts := make(map[string]int)
+		emails := remaining()
+		for i := len(emails) - 1; i >= 0; i-- {
+			mailboxes := emailMailboxes(emails[i])
+			full := len(mailboxes) > 0
+			for _, mailbox := range mailboxes {
+				full = full && counts[mailbox] >= j.policy.maxCountPerMailbox
+			}
+			if full {
+				reasons[emails[i].ID] = expiredByMailbox
+				continue
+			}
+			for _, mailbox := range mailboxes {
+				counts[mailbox]++
+			}
+		}
+	}
+	if j.policy.maxCount > 0 {
+		emails := remaining()
+		for i := 0; i < len(emails)-j.policy.maxCount; i++ {
+			reasons[emails[i].ID] = expiredByCount
+		}
+	}
+	if j.policy.maxSize > 0 {
+		emails := remaining()
+		var total int64
+		for _, header := range emails {
+			total += j.size(header.ID)
+		}
+		for _, header := range emails {
+			if total <= j.policy.maxSize || ctx.Err() != nil {
+				break
+			}
+			reasons[header.ID] = expiredBySize
+			total -= j.sizes[header.ID]
+		}
+		// forget the emails deleted meanwhile
+		listed := make(map[string]bool, len(headers))
+		for _, header := range headers {
+			listed[header.ID] = true
+		}
+		for emailID := range j.sizes {
+			if !listed[emailID] {
+				delete(j.sizes, emailID)
+			}
+		}
+	}
+	return reasons
+}
+
+// size returns the size of the raw email, measured once.
+func (j *janitor) size(emailID string) int64 {
+	if size, ok := j.sizes[emailID]; ok {
+		return size
+	}
+	raw, err := j.engine.OpenRawEmail(emailID)
+	if err != nil {
+		return 0
+	}
+	defer raw.Close()
+	size, err := raw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	j.sizes[emailID] = size
+	return size
+}
+
+func (j *janitor) failed(err error) {
+	log.Logf(log.WARNING, "retention: %v", err)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Failed++
+	j.stats.LastError = err.Error()
+}
+
+// emailMailboxes returns the recipients of the email and the mailboxes Sieve
+// delivered it to, lower-cased and unique.
+func emailMailboxes(header EmailHeader) []string {
+	var addresses []string
+	for _, recipient := range append(append([]EmailAddress{}, header.Tos...), header.CCs...) {
+		addresses = append(addresses, recipient.Address)
+	}
+	addresses = append(addresses, header.DeliveredTo...)
+	var mailboxes []string
+	for _, address := range addresses {
+		mailbox := strings.ToLower(address)
+		if mailbox != "" && !slices.Contains(mailboxes, mailbox) {
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	return mailboxes
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// retentionTestDate returns the date of an email received days after 2024-01-01.
+func retentionTestDate(days int) time.Time {
+	return testEmailDate(0).AddDate(0, 0, days)
+}
+
+func newRetentionTestEngine(t *testing.T, config RetentionConfiguration) (*Engine, *janitor) {
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := newFilesystemStorage(t.TempDir(), "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(memory, root)
+	policy, err := parseRetentionConfiguration(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the runs are made by the test
+	engine.janitor = &janitor{engine: engine, policy: policy, sizes: make(map[string]int64)}
+	// emails 1 to 6, received one day apart, alternately to alice and bob
+	for i := 1; i <= 6; i++ {
+		mailbox := []string{"alice@example.com", "bob@example.com"}[i%2]
+		if err := engine.setWithID(fmt.Sprintf("email-%d", i), testEmail(i, retentionTestDate(i), mailbox)); err != nil {
+			t.Fatal(err)
+		}
+		setReceivedAt(engine, fmt.Sprintf("email-%d", i), retentionTestDate(i))
+	}
+	return engine, engine.janitor
+}
+
+// setReceivedAt changes the time the memory layer of the engine received an email.
+func setReceivedAt(engine *Engine, emailID string, receivedAt time.Time) {
+	memory := engine.allLayers[0].(*memoryStorage)
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	memory.entries[emailID].Value.(*memoryEntry).header.ReceivedAt = receivedAt
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	for name, test := range map[string]struct {
+		config   RetentionConfiguration
+		expected []string
+	}{
+		"age":     {RetentionConfiguration{MaxAge: "72h"}, []string{"email-4", "email-5", "email-6"}},
+		"count":   {RetentionConfiguration{MaxCount: 4}, []string{"email-3", "email-4", "email-5", "email-6"}},
+		"mailbox": {RetentionConfiguration{MaxCountPerMailbox: 1}, []string{"email-5", "email-6"}},
+		"size":    {RetentionConfiguration{MaxSize: fmt.Sprint(3 * len(testEmail(1, retentionTestDate(1), "alice@example.com")))}, []string{"email-4", "email-5", "email-6"}},
+		"both":    {RetentionConfiguration{MaxAge: "120h", MaxCount: 3}, []string{"email-4", "email-5", "email-6"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			engine, janitor := newRetentionTestEngine(t, test.config)
+			var notified []string
+			engine.SetOnDeleteEmail(func(emailID string) { notified = append(notified, emailID) })
+
+			janitor.run(context.Background(), now)
+			got, _ := searchIDs(t, engine, "")
+			slices.Sort(got)
+			if !slices.Equal(got, test.expected) {
+				t.Errorf("expected %v kept, got %v", test.expected, got)
+			}
+			if len(notified) != 6-len(test.expected) {
+				t.Errorf("unexpected deletions notified %v", notified)
+			}
+			for _, emailID := range notified {
+				if holds(engine.allLayers[1], emailID) {
+					t.Errorf("email %v still in the root layer", emailID)
+				}
+			}
+			stats := engine.RetentionStats()
+			if stats.Runs != 1 || stats.Emails != len(test.expected) || stats.Deleted != len(notified) || stats.Failed != 0 {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRetentionSeveralMailboxes(t *testing.T) {
+	engine, janitor := newRetentionTestEngine(t, RetentionConfiguration{MaxCountPerMailbox: 2})
+	// the newest email of carol, older than the two kept for alice and bob
+	if err := engine.setWithID("email-0", testEmail(0, retentionTestDate(0), "alice@example.com", "carol@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	setReceivedAt(engine, "email-0", retentionTestDate(0))
+	// an email to alice and bob, both full
+	if err := engine.setWithID("email-00", testEmail(0, retentionTestDate(0), "alice@example.com", "bob@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	setReceivedAt(engine, "email-00", retentionTestDate(0))
+
+	janitor.run(context.Background(), retentionTestDate(7))
+	got, _ := searchIDs(t, engine, "")
+	slices.Sort(got)
+	expected := []string{"email-0", "email-3", "email-4", "email-5", "email-6"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v kept, got %v", expected, got)
+	}
+}
+
+func TestRetentionReceiveTime(t *testing.T) {
+	engine, janitor := newRetentionTestEngine(t, RetentionConfiguration{MaxAge: "72h"})
+	// an email dated years ago, received now, and one of unknown receive time
+	for _, emailID := range []string{"old-date", "unknown"} {
+		if err := engine.setWithID(emailID, testEmail(0, retentionTestDate(-365), "alice@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setReceivedAt(engine, "unknown", time.Time{})
+
+	janitor.run(context.Background(), time.Now())
+	got, _ := searchIDs(t, engine, "")
+	if !slices.Equal(got, []string{"old-date"}) {
+		t.Errorf("expected the email received now kept, got %v", got)
+	}
+}
+
+func TestLayersRecordReceiveTime(t *testing.T) {
+	layers := testLayers()
+	layers["mbox"] = func(t *testing.T) storageLayer {
+		s, _ := newFilesystemStorage(t.TempDir(), "mbox")
+		return s
+	}
+	for name, newLayer := range layers {
+		t.Run(name, func(t *testing.T) {
+			layer := newLayer(t)
+			if err := layer.load(nil); err != nil {
+				t.Fatal(err)
+			}
+			before := time.Now().Add(-time.Second)
+			if err := layer.setWithID("email-1", testEmail(1, retentionTestDate(-365), "alice@example.com")); err != nil {
+				t.Fatal(err)
+			}
+			header, err := layer.GetEmailByID("email-1")
+			if err != nil || header.ReceivedAt.Before(before) {
+				t.Errorf("expected the email received now, got %v (%v)", header.ReceivedAt, err)
+			}
+			headers, _, err := layer.SearchEmailsContext(context.Background(), "", 1, -1)
+			if err != nil || len(headers) != 1 || headers[0].ReceivedAt.Before(before) {
+				t.Errorf("expected the email received now, got %+v (%v)", headers, err)
+			}
+		})
+	}
+}
+
+func TestRetentionConfiguration(t *testing.T) {
+	engine := newTestEngine(newFailingLayer(t))
+	if err := engine.StartRetention(RetentionConfiguration{}); err != nil || engine.RetentionStats() != nil {
+		t.Errorf("expected no janitor without limits, got %v", err)
+	}
+	for _, config := range []RetentionConfiguration{{MaxAge: "a week"}, {MaxCount: -1}, {MaxSize: "lots"}, {MaxCount: 1, Interval: "0s"}} {
+		if err := engine.StartRetention(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	if err := engine.StartRetention(RetentionConfiguration{MaxCount: 10, Interval: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	engine.Close()
+	if stats := engine.RetentionStats(); stats == nil || stats.Runs != 1 {
+		t.Errorf("expected a run at start, got %+v", stats)
+	}
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// snapshotFormat is the version of the snapshot archives.
+const snapshotFormat = 1
+
+// snapshotManifest is the manifest.json entry of a snapshot archive.
+type snapshotManifest struct {
+	Format  int             `json:"format"`
+	Created time.Time       `json:"created"`
+	Emails  []snapshotEmail `json:"emails"`
+}
+
+// snapshotEmail describes an email of a snapshot: its raw email is the File
+// entry of the archive, written before the manifest.
+type snapshotEmail struct {
+	ID     string      `json:"id"`
+	File   string      `json:"file"`
+	Flags  []string    `json:"flags,omitempty"` // read state and other IMAP flags
+	Header EmailHeader `json:"header"`          // for the readers of the archive, derived again on restore
+}
+
+// maxSnapshotManifestSize is the size of the largest manifest.json read by
+// RestoreSnapshot, the only entry held in memory.
+const maxSnapshotManifestSize = 256 << 20
+
+// WriteSnapshot writes every email of the storage, raw, with its header and its
+// flags, as a gzip-compressed tar archive: one emails/<n>.eml entry per email,
+// copied from the storage as it is read, then a manifest.json entry. It returns
+// the number of emails written.
+func (e *Engine) WriteSnapshot(ctx context.Context, w io.Writer, flags *FlagStore) (int, error) {
+	headers, _, err := e.SearchEmailsContext(ctx, "", 1, -1)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list the emails: %w", err)
+	}
+	slices.SortFunc(headers, func(a, b EmailHeader) int { return strings.Compare(a.ID, b.ID) })
+
+	manifest := snapshotManifest{Format: snapshotFormat, Created: time.Now().UTC()}
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+	for i, header := range headers {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		email := snapshotEmail{ID: header.ID, File: fmt.Sprintf("emails/%06d.eml", i+1), Header: header}
+		if err := e.writeSnapshotEmail(archive, email.File, header.ID, manifest.Created); err != nil {
+			if IsNotFound(err) {
+				continue // deleted meanwhile
+			}
+			return 0, err
+		}
+		if flags != nil {
+			email.Flags = flags.GetFlags(header.ID)
+		}
+		manifest.Emails = append(manifest.Emails, email)
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := writeTarEntry(archive, "manifest.json", int64(len(manifestData)), bytes.NewReader(manifestData), manifest.Created); err != nil {
+		return 0, err
+	}
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+	return len(manifest.Emails), compressor.Close()
+}
+
+// writeSnapshotEmail copies the raw email to the archive entry.
+func (e *Engine) writeSnapshotEmail(archive *tar.Writer, name string, emailID string, modTime time.Time) error {
+	raw, err := e.OpenRawEmail(emailID)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	size, err := raw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := raw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeTarEntry(archive, name, size, raw, modTime)
+}
+
+func writeTarEntry(archive *tar.Writer, name string, size int64, data io.Reader, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(archive, data, size)
+	return err
+}
+
+// RestoreSnapshot replaces the emails of the storage and their flags with those
+// of a snapshot archive written by WriteSnapshot, keeping their IDs. The archive
+// is read to a temporary folder and checked before anything is deleted. It
+// returns the number of emails restored.
+func (e *Engine) RestoreSnapshot(ctx context.Context, r io.Reader, flags *FlagStore) (int, error) {
+	snapshot, err := readSnapshot(ctx, r, e.encryptsEmails())
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.close()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := e.DeleteAllEmails(); err != nil {
+		return 0, fmt.Errorf("cannot delete the emails: %w", err)
+	}
+	if flags != nil {
+		flags.Clear()
+	}
+	for _, email := range snapshot.manifest.Emails {
+		raw, err := snapshot.files[email.File].read()
+		if err != nil {
+			return 0, fmt.Errorf("cannot restore email %v: %w", email.ID, err)
+		}
+		if err := e.setWithID(email.ID, raw); err != nil {
+			return 0, fmt.Errorf("cannot restore email %v: %w", email.ID, err)
+		}
+		if flags != nil && len(email.Flags) > 0 {
+			flags.SetFlags(email.ID, email.Flags...)
+		}
+	}
+	log.Logf(log.INFO, "restored %d emails from a snapshot of %v", len(snapshot.manifest.Emails), snapshot.manifest.Created.Format(time.RFC3339))
+	return len(snapshot.manifest.Emails), nil
+}
+
+// encryptsEmails returns true if a layer of the engine may hold encrypted emails.
+func (e *Engine) encryptsEmails() bool {
+	for _, layer := range e.allLayers {
+		if filesystem, ok := layer.(*filesystemStorage); ok && filesystem.codec.hasKey() {
+			return true
+		}
+	}
+	return false
+}
+
+// stagedSnapshot is a snapshot archive read to a temporary folder.
+type stagedSnapshot struct {
+	manifest snapshotManifest
+	folder   string
+	seal     bool
+	files    map[string]stagedFile // archive entry → file of the temporary folder
+}
+
+// stagedFile is a raw email of a staged snapshot, sealed for the storages
+// encrypting the emails.
+type stagedFile struct {
+	filename string
+	cipher   *tempCipher // nil when not sealed
+}
+
+func (f stagedFile) read() ([]byte, error) {
+	raw, err := os.ReadFile(f.filename)
+	if err == nil && f.cipher != nil {
+		f.cipher.stream(0).XORKeyStream(raw, raw)
+	}
+	return raw, err
+}
+
+func (s *stagedSnapshot) close() {
+	os.RemoveAll(s.folder)
+}
+
+// readSnapshot reads the manifest of a snapshot archive, and writes its raw
+// emails to a temporary folder, removed by close. The emails are sealed when
+// seal is set.
+func readSnapshot(ctx context.Context, r io.Reader, seal bool) (*stagedSnapshot, error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	defer decompressor.Close()
+	folder, err := os.MkdirTemp("", "mock-my-mta-snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &stagedSnapshot{folder: folder, seal: seal, files: make(map[string]stagedFile)}
+	if err := snapshot.read(ctx, tar.NewReader(decompressor)); err != nil {
+		snapshot.close()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *stagedSnapshot) read(ctx context.Context, archive *tar.Reader) error {
+	hasManifest := false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Name == "manifest.json" {
+			data, err := io.ReadAll(io.LimitReader(archive, maxSnapshotManifestSize+1))
+			if err != nil {
+				return fmt.Errorf("invalid snapshot: %w", err)
+			}
+			if len(data) > maxSnapshotManifestSize {
+				return fmt.Errorf("invalid snapshot: manifest.json larger than %d bytes", maxSnapshotManifestSize)
+			}
+			if err := json.Unmarshal(data, &s.manifest); err != nil {
+				return fmt.Errorf("invalid snapshot manifest: %w", err)
+			}
+			hasManifest = true
+			continue
+		}
+		file := stagedFile{filename: filepath.Join(s.folder, fmt.Sprintf("%06d.eml", len(s.files)+1))}
+		if s.seal {
+			// a key for each file: the key stream is never reused
+			if file.cipher, err = newTempCipher(); err != nil {
+				return err
+			}
+		}
+		if err := file.write(archive); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		s.files[path.Clean(header.Name)] = file
+	}
+	if !hasManifest {
+		return fmt.Errorf("invalid snapshot: no manifest.json")
+	}
+	if s.manifest.Format != snapshotFormat {
+		return fmt.Errorf("unsupported snapshot format %d", s.manifest.Format)
+	}
+	for _, email := range s.manifest.Emails {
+		if email.ID == "" {
+			return fmt.Errorf("invalid snapshot: email without ID")
+		}
+		if _, ok := s.files[email.File]; !ok {
+			return fmt.Errorf("invalid snapshot: missing %v of email %v", email.File, email.ID)
+		}
+	}
+	return nil
+}
+
+func (f stagedFile) write(r io.Reader) error {
+	file, err := os.Create(f.filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f.cipher.writer(file), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// snapshotSuffix is the extension of the snapshot archives.
+const snapshotSuffix = ".tar.gz"
+
+// ErrInvalidSnapshotName is returned for a snapshot name that is not made of
+// letters, digits, dots, dashes and underscores.
+var ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+
+var snapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// SnapshotInfo describes a named snapshot.
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// SnapshotStore keeps named snapshots of the storage in a folder, one
+// <name>.tar.gz archive each, to switch quickly between known states.
+type SnapshotStore struct {
+	folder string
+	engine *Engine
+	flags  *FlagStore
+}
+
+// NewSnapshotStore returns the snapshots of the engine kept in the folder,
+// created on the first snapshot. flags, if not nil, is saved and restored with
+// the emails.
+func NewSnapshotStore(folder string, engine *Engine, flags *FlagStore) *SnapshotStore {
+	return &SnapshotStore{folder: folder, engine: engine, flags: flags}
+}
+
+func (s *SnapshotStore) filename(name string) (string, error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidSnapshotName, name)
+	}
+	return filepath.Join(s.folder, name+snapshotSuffix), nil
+}
+
+// Write writes a snapshot of the current emails, without keeping it.
+func (s *SnapshotStore) Write(ctx context.Context, w io.Writer) (int, error) {
+	return s.engine.WriteSnapshot(ctx, w, s.flags)
+}
+
+// Restore replaces the current emails with those of a snapshot archive.
+func (s *SnapshotStore) Restore(ctx context.Context, r io.Reader) (int, error) {
+	return s.engine.RestoreSnapshot(ctx, r, s.flags)
+}
+
+// Save keeps a snapshot of the current emails under the name, replacing the
+// snapshot of the same name.
+func (s *SnapshotStore) Save(ctx context.Context, name string) (SnapshotInfo, error) {
+	filename, err := s.filename(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.MkdirAll(s.folder, 0755); err != nil {
+		return SnapshotInfo{}, err
+	}
+	file, err := os.CreateTemp(s.folder, "."+name+".*.tmp")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	tmpFilename := file.Name()
+	_, err = s.Write(ctx, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return SnapshotInfo{}, err
+	}
+	log.Logf(log.INFO, "saved snapshot %v", name)
+	return s.info(name, filename)
+}
+
+// RestoreNamed replaces the current emails with those of the named snapshot.
+func (s *SnapshotStore) RestoreNamed(ctx context.Context, name string) (int, error) {
+	file, err := s.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return s.Restore(ctx, file)
+}
+
+// Open opens the archive of the named snapshot.
+func (s *SnapshotStore) Open(name string) (*os.File, error) {
+	filename, err := s.filename(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+// Delete removes the named snapshot.
+func (s *SnapshotStore) Delete(name string) error {
+	filename, err := s.filename(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// List returns the named snapshots, by name.
+func (s *SnapshotStore) List() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []SnapshotInfo{}, nil
+		}
+		return nil, err
+	}
+	snapshots := []SnapshotInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), snapshotSuffix)
+		if !ok || !entry.Type().IsRegular() || !snapshotNameRegexp.MatchString(name) {
+			continue
+		}
+		info, err := s.info(name, filepath.Join(s.folder, entry.Name()))
+		if err != nil {
+			continue // removed meanwhile
+		}
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, nil
+}
+
+func (s *SnapshotStore) info(name string, filename string) (SnapshotInfo, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{Name: name, Size: stat.Size(), Created: stat.ModTime().UTC()}, nil
+}
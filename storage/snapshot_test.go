@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead, ScopeCache}},
+		{Type: "FILESYSTEM", Scope: []string{ScopeAll}, Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := NewFlagStore()
+	snapshots := NewSnapshotStore(t.TempDir(), engine, flags)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if err := engine.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags.SetRead("email-1", true)
+
+	info, err := snapshots.Save(ctx, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "base" || info.Size == 0 {
+		t.Errorf("unexpected snapshot %+v", info)
+	}
+
+	// the test case changes the state
+	if err := engine.setWithID("email-4", memoryTestEmail(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.DeleteEmailByID("email-1"); err != nil {
+		t.Fatal(err)
+	}
+	flags.SetRead("email-2", true)
+
+	restored, err := snapshots.RestoreNamed(ctx, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 3 {
+		t.Errorf("expected 3 emails restored, got %d", restored)
+	}
+	got, _ := searchIDs(t, engine, "")
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"email-1", "email-2", "email-3"}) {
+		t.Errorf("unexpected emails %v", got)
+	}
+	if raw, err := engine.GetRawEmail("email-1"); err != nil || !bytes.Equal(raw, memoryTestEmail(1)) {
+		t.Errorf("unexpected raw email %q, %v", raw, err)
+	}
+	if !flags.IsRead("email-1") || flags.IsRead("email-2") {
+		t.Error("expected the read state of the snapshot")
+	}
+
+	list, err := snapshots.List()
+	if err != nil || len(list) != 1 || list[0].Name != "base" {
+		t.Errorf("unexpected snapshots %v, %v", list, err)
+	}
+	if _, err := snapshots.Save(ctx, "../outside"); !errors.Is(err, ErrInvalidSnapshotName) {
+		t.Errorf("expected an invalid name, got %v", err)
+	}
+	if _, err := snapshots.RestoreNamed(ctx, "unknown"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing snapshot, got %v", err)
+	}
+	if err := snapshots.Delete("base"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := snapshots.List(); len(list) != 0 {
+		t.Errorf("expected no snapshots, got %v", list)
+	}
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	engine := newTestEngine(newFailingLayer(t))
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if _, err := engine.WriteSnapshot(context.Background(), &archive, nil); err != nil {
+		t.Fatal(err)
+	}
+	truncated := archive.Bytes()[:archive.Len()/2]
+	for name, data := range map[string][]byte{"garbage": []byte("not an archive"), "truncated": truncated} {
+		if _, err := engine.RestoreSnapshot(context.Background(), bytes.NewReader(data), nil); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+	if !holds(engine.allLayers[0], "email-1") {
+		t.Error("an invalid snapshot must leave the emails")
+	}
+}
+
+func TestSnapshotArchive(t *testing.T) {
+	engine := newTestEngine(newFailingLayer(t))
+	for i := 1; i <= 2; i++ {
+		if err := engine.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if _, err := engine.WriteSnapshot(context.Background(), &archive, nil); err != nil {
+		t.Fatal(err)
+	}
+	decompressor, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	reader := tar.NewReader(decompressor)
+	for header, err := reader.Next(); err == nil; header, err = reader.Next() {
+		names = append(names, header.Name)
+	}
+	// the emails are streamed, the manifest listing them comes last
+	if !slices.Equal(names, []string{"emails/000001.eml", "emails/000002.eml", "manifest.json"}) {
+		t.Errorf("unexpected entries %v", names)
+	}
+
+	// the entries are staged on disk, sealed for the storages encrypting the
+	// emails, and removed once restored
+	for _, seal := range []bool{false, true} {
+		snapshot, err := readSnapshot(context.Background(), bytes.NewReader(archive.Bytes()), seal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := snapshot.files["emails/000002.eml"]
+		onDisk, _ := os.ReadFile(file.filename)
+		if bytes.Equal(onDisk, memoryTestEmail(2)) == seal {
+			t.Errorf("sealed %v: unexpected staged file %q", seal, onDisk)
+		}
+		staged, err := file.read()
+		if err != nil || !bytes.Equal(staged, memoryTestEmail(2)) {
+			t.Errorf("unexpected staged email %q, %v", staged, err)
+		}
+		snapshot.close()
+		if _, err := os.Stat(snapshot.folder); !os.IsNotExist(err) {
+			t.Errorf("expected the staged emails to be removed, got %v", err)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
 )
 
 // Storage is an interface that defines the methods that a storage engine must implement.
+// Methods given an unknown email or attachment ID return a *NotFoundError.
 type Storage interface {
 	// GetMailboxes returns a list of mailboxes.
 	GetMailboxes() ([]Mailbox, error)
@@ -30,8 +36,37 @@ type Storage interface {
 	GetRawEmail(emailID string) ([]byte, error)
 }
 
+// NotFoundError is returned for an email or an attachment a storage does not hold.
+type NotFoundError struct {
+	EmailID      string
+	AttachmentID string // empty when the email is not found
+	Layer        string // storage that reported it
+}
+
+func (e *NotFoundError) Error() string {
+	if e.AttachmentID != "" {
+		return fmt.Sprintf("attachment not found in %s: %s/%s", e.Layer, e.EmailID, e.AttachmentID)
+	}
+	return fmt.Sprintf("email not found in %s: %s", e.Layer, e.EmailID)
+}
+
+func newEmailNotFoundError(layer string, emailID string) error {
+	return &NotFoundError{EmailID: emailID, Layer: layer}
+}
+
+func newAttachmentNotFoundError(layer string, emailID string, attachmentID string) error {
+	return &NotFoundError{EmailID: emailID, AttachmentID: attachmentID, Layer: layer}
+}
+
+// IsNotFound returns true if the error (or an error it wraps) is a *NotFoundError.
+func IsNotFound(err error) bool {
+	var notFound *NotFoundError
+	return errors.As(err, &notFound)
+}
+
 type storageLayer interface {
 	Storage
+	ContextStorage
 
 	// load loads the storage based on the root storage
 	load(rootStorage Storage) error
@@ -54,12 +89,57 @@ type EmailHeader struct {
 	From           EmailAddress   `json:"from"`
 	Tos            []EmailAddress `json:"tos"`
 	CCs            []EmailAddress `json:"ccs"`
+	DeliveredTo    []string       `json:"delivered_to,omitempty"` // mailboxes filed into by Sieve, redirect targets included
 	Subject        string         `json:"subject"`
 	Date           time.Time      `json:"date"`
+	ReceivedAt     time.Time      `json:"received_at,omitzero"` // when the layer stored the email, zero when unknown
 	HasAttachments bool           `json:"has_attachments"`
 	Preview        string         `json:"preview"`
 	BodyVersions   []string       `json:"body_versions"`
 	IsRead         bool           `json:"is_read"`
+	Snippet        string         `json:"snippet,omitempty"` // HTML-escaped search excerpt, matches in <mark>
+}
+
+// receivedOrDate returns the time the email was received, its date when unknown.
+func (h EmailHeader) receivedOrDate() time.Time {
+	if h.ReceivedAt.IsZero() {
+		return h.Date
+	}
+	return h.ReceivedAt
+}
+
+// matchHeader checks a matcher of the query on an email header, like the parsed
+// email would: ok is false for the matchers needing the body.
+func matchHeader(header EmailHeader, m interface{}, now time.Time) (matched bool, ok bool) {
+	switch mt := m.(type) {
+	case matcher.MailboxMatch:
+		for _, recipient := range append(append([]EmailAddress{}, header.Tos...), header.CCs...) {
+			if strings.EqualFold(recipient.Address, mt.GetMailbox()) {
+				return true, true
+			}
+		}
+		for _, mailbox := range header.DeliveredTo {
+			if strings.EqualFold(mailbox, mt.GetMailbox()) {
+				return true, true
+			}
+		}
+		return false, true
+	case matcher.FromMatch:
+		return strings.EqualFold(header.From.Address, mt.GetFrom()), true
+	case matcher.AttachmentMatch:
+		return header.HasAttachments, true
+	case matcher.SubjectMatch:
+		return strings.Contains(strings.ToLower(header.Subject), strings.ToLower(mt.GetSubject())), true
+	case matcher.BeforeMatch:
+		return header.Date.Before(mt.GetDate()), true
+	case matcher.AfterMatch:
+		return header.Date.After(mt.GetDate()), true
+	case matcher.NewerThanMatch:
+		return now.Sub(header.Date) < mt.GetDuration(), true
+	case matcher.OlderThanMatch:
+		return now.Sub(header.Date) > mt.GetDuration(), true
+	}
+	return false, false
 }
 
 type AttachmentHeader struct {
@@ -67,6 +147,28 @@ type AttachmentHeader struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
 	Size        int    `json:"size"`
+	Hash        string `json:"hash"` // hexadecimal SHA-256 of the decoded content
+}
+
+// newAttachmentHeader returns the header of an attachment of a parsed email.
+func newAttachmentHeader(attachmentID string, node multipart.AttachmentNode) AttachmentHeader {
+	return AttachmentHeader{
+		ID:          attachmentID,
+		ContentType: node.GetContentType(),
+		Filename:    node.GetFilename(),
+		Size:        node.GetSize(),
+		Hash:        node.GetHash(),
+	}
+}
+
+// matchAttachmentHash returns true if one of the attachments has the hash of the matcher.
+func matchAttachmentHash(attachments []AttachmentHeader, m matcher.AttachmentHashMatch) bool {
+	for _, attachment := range attachments {
+		if attachment.Hash == m.GetHash() {
+			return true
+		}
+	}
+	return false
 }
 
 type Attachment struct {
@@ -0,0 +1,696 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"mock-my-mta/log"
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
+)
+
+// Buckets of the bolt storage.
+var (
+	boltRawBucket         = []byte("raw")          // email ID → raw email, or its segments referring to the blobs
+	boltHeadersBucket     = []byte("headers")      // email ID → JSON EmailHeader
+	boltAttachmentsBucket = []byte("attachments")  // email ID, 0, attachment ID → JSON AttachmentHeader
+	boltBlobsBucket       = []byte("blobs")        // SHA-256 → decoded attachment
+	boltBlobRefsBucket    = []byte("blob_refs")    // SHA-256 → number of attachments referring to the blob
+	boltDateBucket        = []byte("by_date")      // date key, email ID → nothing
+	boltSenderBucket      = []byte("by_sender")    // lowercase address, 0, date key, email ID → nothing
+	boltRecipientBucket   = []byte("by_recipient") // lowercase address, 0, date key, email ID → address
+)
+
+var boltBuckets = [][]byte{boltRawBucket, boltHeadersBucket, boltAttachmentsBucket, boltBlobsBucket, boltBlobRefsBucket, boltDateBucket, boltSenderBucket, boltRecipientBucket}
+
+// boltStorage keeps the emails in a single bbolt file: the raw emails, their
+// parsed headers and decoded attachments, and secondary indexes sorted by date.
+// The decoded attachments are stored once by SHA-256, with a reference count, and
+// the raw emails refer to them where they hold their base64 encoding.
+type boltStorage struct {
+	db               *bolt.DB
+	databaseFilename string
+}
+
+// boltStorage implements the storageLayer interface
+var _ storageLayer = &boltStorage{}
+
+func newBoltStorage(databaseFilename string) (*boltStorage, error) {
+	log.Logf(log.INFO, "using bolt storage with database %v", databaseFilename)
+	// the file is locked by the process having it open
+	db, err := bolt.Open(databaseFilename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open bolt database %s: %v", databaseFilename, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create bolt buckets in %s: %v", databaseFilename, err)
+	}
+	return &boltStorage{db: db, databaseFilename: databaseFilename}, nil
+}
+
+// boltDateKey encodes a date as 8 bytes sorting in time order.
+func boltDateKey(date time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(date.UnixMicro())^(1<<63))
+	return key
+}
+
+// boltDateFromKey decodes a date key.
+func boltDateFromKey(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+}
+
+// boltAddressPrefix returns the prefix of the keys of an address in the sender
+// and recipient indexes.
+func boltAddressPrefix(address string) []byte {
+	return append([]byte(strings.ToLower(address)), 0)
+}
+
+// boltIndexKeys returns the keys of an email in the secondary indexes, by bucket.
+func boltIndexKeys(header EmailHeader) map[string][][]byte {
+	dateKey := append(boltDateKey(header.Date), header.ID...)
+	keys := map[string][][]byte{
+		string(boltDateBucket): {dateKey},
+	}
+	if header.From.Address != "" {
+		keys[string(boltSenderBucket)] = [][]byte{append(boltAddressPrefix(header.From.Address), dateKey...)}
+	}
+	// the mailboxes Sieve delivered the email to are matched by mailbox: too
+	for _, address := range emailMailboxes(header) {
+		keys[string(boltRecipientBucket)] = append(keys[string(boltRecipientBucket)], append(boltAddressPrefix(address), dateKey...))
+	}
+	return keys
+}
+
+// attachmentKey returns the key of an attachment; the attachments of an email share
+// the email ID prefix.
+func boltAttachmentKey(emailID string, attachmentID string) []byte {
+	return append(append([]byte(emailID), 0), attachmentID...)
+}
+
+// acquireBlob stores the decoded attachment of the hash, or adds a reference to it.
+func acquireBlob(tx *bolt.Tx, hash string, data []byte) error {
+	refs := tx.Bucket(boltBlobRefsBucket)
+	count := uint64(0)
+	if value := refs.Get([]byte(hash)); value != nil {
+		count = binary.BigEndian.Uint64(value)
+	} else if err := tx.Bucket(boltBlobsBucket).Put([]byte(hash), data); err != nil {
+		return err
+	}
+	return refs.Put([]byte(hash), binary.BigEndian.AppendUint64(nil, count+1))
+}
+
+// boltSegmentsMarker starts the values of the raw bucket made of segments: a raw
+// email never starts with a NUL byte.
+const boltSegmentsMarker = 0
+
+// Kinds of the segments of a raw value, each followed by the length of its data
+// as a uvarint and the data: literal bytes, or the SHA-256 of an attachment
+// followed by the line ending of its base64 lines.
+const (
+	boltLiteralSegment    = 'L'
+	boltAttachmentSegment = 'A'
+)
+
+// boltRawValue returns the value of the raw bucket of an email: the raw email,
+// or its segments when the base64 encoding of attachments was found in it.
+func boltRawValue(rawEmail []byte, attachments map[string]Attachment) []byte {
+	segments := splitRawEmail(rawEmail, attachments)
+	if len(segments) == 1 && segments[0].literal != nil {
+		return rawEmail
+	}
+	value := []byte{boltSegmentsMarker}
+	for _, segment := range segments {
+		kind, data := byte(boltLiteralSegment), segment.literal
+		if segment.literal == nil {
+			kind, data = boltAttachmentSegment, []byte(attachments[segment.attachmentID].Hash+segment.lineEnding)
+		}
+		value = append(value, kind)
+		value = binary.AppendUvarint(value, uint64(len(data)))
+		value = append(value, data...)
+	}
+	return value
+}
+
+// boltRawEmail returns the raw email of a value of the raw bucket, encoding the
+// attachments it refers to. The returned bytes remain valid after the transaction.
+func boltRawEmail(tx *bolt.Tx, emailID []byte, value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != boltSegmentsMarker {
+		return bytes.Clone(value), nil
+	}
+	var raw bytes.Buffer
+	for rest := value[1:]; len(rest) > 0; {
+		kind := rest[0]
+		length, n := binary.Uvarint(rest[1:])
+		if n <= 0 || length > uint64(len(rest)-1-n) {
+			return nil, fmt.Errorf("bolt storage: invalid raw email %s", emailID)
+		}
+		data := rest[1+n : 1+n+int(length)]
+		rest = rest[1+n+int(length):]
+		switch {
+		case kind == boltLiteralSegment:
+			raw.Write(data)
+		case kind == boltAttachmentSegment && len(data) >= sha256.Size*2:
+			blob := tx.Bucket(boltBlobsBucket).Get(data[:sha256.Size*2])
+			if blob == nil {
+				return nil, fmt.Errorf("bolt storage: missing attachment %s of email %s", data[:sha256.Size*2], emailID)
+			}
+			raw.Write(encodeBase64Lines(blob, string(data[sha256.Size*2:])))
+		default:
+			return nil, fmt.Errorf("bolt storage: invalid raw email %s", emailID)
+		}
+	}
+	return raw.Bytes(), nil
+}
+
+// releaseBlob removes a reference to the decoded attachment of the hash, and the
+// attachment with the last one.
+func releaseBlob(tx *bolt.Tx, hash string) error {
+	refs := tx.Bucket(boltBlobRefsBucket)
+	value := refs.Get([]byte(hash))
+	if value == nil {
+		return nil
+	}
+	if count := binary.BigEndian.Uint64(value); count > 1 {
+		return refs.Put([]byte(hash), binary.BigEndian.AppendUint64(nil, count-1))
+	}
+	if err := refs.Delete([]byte(hash)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBlobsBucket).Delete([]byte(hash))
+}
+
+// attachmentHeaders returns the attachment headers of an email.
+func (s *boltStorage) attachmentHeaders(tx *bolt.Tx, emailID string) ([]AttachmentHeader, error) {
+	var headers []AttachmentHeader
+	cursor := tx.Bucket(boltAttachmentsBucket).Cursor()
+	prefix := boltAttachmentKey(emailID, "")
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		var header AttachmentHeader
+		if err := json.Unmarshal(value, &header); err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+// load hydrates from root storage (if this is not the root).
+func (s *boltStorage) load(rootStorage Storage) error {
+	if rootStorage == nil {
+		return nil // we are root
+	}
+
+	var count int
+	s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(boltHeadersBucket).Stats().KeyN
+		return nil
+	})
+	if count > 0 {
+		log.Logf(log.INFO, "bolt storage: already has %d emails, skipping reload from root", count)
+		return nil
+	}
+
+	log.Logf(log.INFO, "bolt storage: loading from root storage")
+	emails, _, err := rootStorage.SearchEmails("", 1, -1)
+	if err != nil {
+		log.Logf(log.WARNING, "bolt storage: could not load from root: %v", err)
+		return nil
+	}
+	loaded := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, header := range emails {
+			raw, err := rootStorage.GetRawEmail(header.ID)
+			if err != nil {
+				log.Logf(log.WARNING, "bolt storage: cannot load email %v from root: %v", header.ID, err)
+				continue
+			}
+			if err := s.putEmail(tx, header.ID, raw, header.ReceivedAt); err != nil {
+				log.Logf(log.WARNING, "bolt storage: cannot load email %v from root: %v", header.ID, err)
+				continue
+			}
+			loaded++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Logf(log.INFO, "bolt storage: loaded %d emails from root", loaded)
+	return nil
+}
+
+// setWithID stores the raw email, its header, attachments and index keys.
+func (s *boltStorage) setWithID(emailID string, rawEmail []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putEmail(tx, emailID, rawEmail, time.Now().UTC())
+	})
+}
+
+// putEmail stores an email received at the given time in the transaction,
+// replacing the email with the same ID.
+func (s *boltStorage) putEmail(tx *bolt.Tx, emailID string, rawEmail []byte, receivedAt time.Time) error {
+	mp, err := multipart.ParseEmailFromBytes(rawEmail)
+	if err != nil {
+		return fmt.Errorf("bolt storage: cannot parse email %s: %v", emailID, err)
+	}
+	if err := s.removeEmail(tx, emailID); err != nil && !IsNotFound(err) {
+		return err
+	}
+	header := newEmailHeaderFromMultipart(emailID, mp)
+	header.ReceivedAt = receivedAt
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltHeadersBucket).Put([]byte(emailID), headerJSON); err != nil {
+		return err
+	}
+	attachments := make(map[string]Attachment)
+	for attachmentID, node := range mp.GetAttachments() {
+		attachment := Attachment{AttachmentHeader: newAttachmentHeader(attachmentID, node), Data: []byte(node.GetDecodedBody())}
+		value, err := json.Marshal(attachment.AttachmentHeader)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltAttachmentsBucket).Put(boltAttachmentKey(emailID, attachmentID), value); err != nil {
+			return err
+		}
+		if err := acquireBlob(tx, attachment.Hash, attachment.Data); err != nil {
+			return err
+		}
+		attachments[attachmentID] = attachment
+	}
+	if err := tx.Bucket(boltRawBucket).Put([]byte(emailID), boltRawValue(rawEmail, attachments)); err != nil {
+		return err
+	}
+	for bucket, keys := range boltIndexKeys(header) {
+		for _, key := range keys {
+			var value []byte
+			if bucket == string(boltRecipientBucket) {
+				value = []byte(recipientAddress(header, key))
+			}
+			if err := tx.Bucket([]byte(bucket)).Put(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recipientAddress returns the recipient address, with its case, of a key of the
+// recipient index.
+func recipientAddress(header EmailHeader, key []byte) string {
+	lowercase, _, _ := bytes.Cut(key, []byte{0})
+	for _, recipient := range append(append([]EmailAddress{}, header.Tos...), header.CCs...) {
+		if strings.EqualFold(recipient.Address, string(lowercase)) {
+			return recipient.Address
+		}
+	}
+	for _, mailbox := range header.DeliveredTo {
+		if strings.EqualFold(mailbox, string(lowercase)) {
+			return mailbox
+		}
+	}
+	return string(lowercase)
+}
+
+// removeEmail removes an email and its keys in the transaction.
+func (s *boltStorage) removeEmail(tx *bolt.Tx, emailID string) error {
+	headerJSON := tx.Bucket(boltHeadersBucket).Get([]byte(emailID))
+	if headerJSON == nil {
+		return newEmailNotFoundError("bolt", emailID)
+	}
+	var header EmailHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return err
+	}
+	for bucket, keys := range boltIndexKeys(header) {
+		for _, key := range keys {
+			if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	attachments, err := s.attachmentHeaders(tx, emailID)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		if err := releaseBlob(tx, attachment.Hash); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltAttachmentsBucket).Delete(boltAttachmentKey(emailID, attachment.ID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltRawBucket).Delete([]byte(emailID)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltHeadersBucket).Delete([]byte(emailID))
+}
+
+// --- Search methods ---
+
+// boltSearch is a search query answered by a secondary index: the emails of a
+// recipient or a sender, or all of them, iterated from the newest within the date
+// bounds. The other matchers are checked on the stored headers and attachment
+// headers, and the ones needing the body on the parsed raw emails.
+type boltSearch struct {
+	bucket         []byte
+	prefix         []byte
+	after, before  int64                         // exclusive bounds, Unix microseconds
+	headerMatchers []interface{}                 // checked on the headers
+	hashMatchers   []matcher.AttachmentHashMatch // checked on the attachment headers
+	goMatchers     []interface{}                 // checked on the parsed raw emails
+}
+
+func newBoltSearch(matchers []interface{}, now time.Time) boltSearch {
+	search := boltSearch{bucket: boltDateBucket, after: -1 << 63, before: 1<<63 - 1}
+	bound := func(after, before time.Time) {
+		if !after.IsZero() && after.UnixMicro() > search.after {
+			search.after = after.UnixMicro()
+		}
+		if !before.IsZero() && before.UnixMicro() < search.before {
+			search.before = before.UnixMicro()
+		}
+	}
+	// the index of the first mailbox, else of the first sender, drives the search
+	driver := -1
+	for i, m := range matchers {
+		if _, ok := m.(matcher.MailboxMatch); ok {
+			driver = i
+			break
+		}
+		if _, ok := m.(matcher.FromMatch); ok && driver < 0 {
+			driver = i
+		}
+	}
+	for i, m := range matchers {
+		switch mt := m.(type) {
+		case matcher.MailboxMatch:
+			if i == driver {
+				search.bucket, search.prefix = boltRecipientBucket, boltAddressPrefix(mt.GetMailbox())
+				continue
+			}
+			search.headerMatchers = append(search.headerMatchers, m)
+		case matcher.FromMatch:
+			if i == driver {
+				search.bucket, search.prefix = boltSenderBucket, boltAddressPrefix(mt.GetFrom())
+				continue
+			}
+			search.headerMatchers = append(search.headerMatchers, m)
+		case matcher.BeforeMatch:
+			bound(time.Time{}, mt.GetDate())
+		case matcher.AfterMatch:
+			bound(mt.GetDate(), time.Time{})
+		case matcher.NewerThanMatch:
+			bound(now.Add(-mt.GetDuration()), time.Time{})
+		case matcher.OlderThanMatch:
+			bound(time.Time{}, now.Add(-mt.GetDuration()))
+		case matcher.AttachmentMatch, matcher.SubjectMatch:
+			search.headerMatchers = append(search.headerMatchers, m)
+		case matcher.AttachmentHashMatch:
+			search.hashMatchers = append(search.hashMatchers, mt)
+		default:
+			search.goMatchers = append(search.goMatchers, m)
+		}
+	}
+	return search
+}
+
+// matchHeader checks the header matchers on a header.
+func (search boltSearch) matchHeader(header EmailHeader) bool {
+	for _, m := range search.headerMatchers {
+		if matched, _ := matchHeader(header, m, time.Time{}); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAttachments checks the attachment hash matchers on the attachment headers.
+func (search boltSearch) matchAttachments(attachments []AttachmentHeader) bool {
+	for _, m := range search.hashMatchers {
+		if !matchAttachmentHash(attachments, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchEmails iterates the index from the newest email. Without header or body
+// matchers, only the headers of the requested page are read.
+func (s *boltStorage) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return s.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage, checking the context between
+// the index keys.
+func (s *boltStorage) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	if page < 1 {
+		return nil, 0, fmt.Errorf("invalid page number: %v", page)
+	}
+	matchers, err := matcher.ParseQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	search := newBoltSearch(matchers, time.Now())
+	start, end := (page-1)*pageSize, page*pageSize
+	if pageSize < 0 {
+		start, end = 0, -1
+	}
+
+	var headers []EmailHeader
+	total := 0
+	err = s.db.View(func(tx *bolt.Tx) error {
+		headersBucket := tx.Bucket(boltHeadersBucket)
+		readHeader := func(emailID []byte) (EmailHeader, bool) {
+			var header EmailHeader
+			headerJSON := headersBucket.Get(emailID)
+			return header, headerJSON != nil && json.Unmarshal(headerJSON, &header) == nil
+		}
+		cursor := tx.Bucket(search.bucket).Cursor()
+		for key, _ := s.seekLast(cursor, search); key != nil && bytes.HasPrefix(key, search.prefix); key, _ = cursor.Prev() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			date := boltDateFromKey(key[len(search.prefix):])
+			if date <= search.after {
+				break
+			}
+			if date >= search.before {
+				continue
+			}
+			emailID := key[len(search.prefix)+8:]
+			inPage := total >= start && (end < 0 || total < end)
+			if len(search.headerMatchers) == 0 && len(search.hashMatchers) == 0 && len(search.goMatchers) == 0 {
+				if inPage {
+					if header, ok := readHeader(emailID); ok {
+						headers = append(headers, header)
+					}
+				}
+				total++
+				continue
+			}
+			header, ok := readHeader(emailID)
+			if !ok || !search.matchHeader(header) {
+				continue
+			}
+			if len(search.hashMatchers) > 0 {
+				attachments, err := s.attachmentHeaders(tx, string(emailID))
+				if err != nil || !search.matchAttachments(attachments) {
+					continue
+				}
+			}
+			if len(search.goMatchers) > 0 {
+				raw, err := boltRawEmail(tx, emailID, tx.Bucket(boltRawBucket).Get(emailID))
+				if err != nil {
+					continue
+				}
+				mp, err := multipart.ParseEmailFromBytes(raw)
+				if err != nil || !mp.MatchAll(search.goMatchers) {
+					continue
+				}
+			}
+			if inPage {
+				headers = append(headers, header)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return headers, total, nil
+}
+
+// seekLast positions the cursor on the last key of the search prefix before the
+// upper date bound.
+func (s *boltStorage) seekLast(cursor *bolt.Cursor, search boltSearch) ([]byte, []byte) {
+	var upper []byte
+	if search.before < 1<<63-1 {
+		upper = append(append([]byte{}, search.prefix...), boltDateKey(time.UnixMicro(search.before))...)
+	} else if len(search.prefix) > 0 {
+		// the first key after the prefix: the separator incremented
+		upper = append(append([]byte{}, search.prefix[:len(search.prefix)-1]...), 1)
+	}
+	if upper == nil {
+		return cursor.Last()
+	}
+	if key, _ := cursor.Seek(upper); key == nil {
+		return cursor.Last()
+	}
+	return cursor.Prev()
+}
+
+func (s *boltStorage) GetMailboxes() ([]Mailbox, error) {
+	return s.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage, checking the context between
+// the recipients.
+func (s *boltStorage) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltRecipientBucket).Cursor()
+		for key, address := cursor.First(); key != nil; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			mailboxes = append(mailboxes, Mailbox{Name: string(address)})
+			// skip the other emails of the recipient
+			lowercase, _, _ := bytes.Cut(key, []byte{0})
+			key, address = cursor.Seek(append(append([]byte{}, lowercase...), 1))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(mailboxes, func(i, j int) bool {
+		return mailboxes[i].Name < mailboxes[j].Name
+	})
+	return mailboxes, nil
+}
+
+// --- Read methods ---
+
+func (s *boltStorage) GetEmailByID(emailID string) (EmailHeader, error) {
+	var header EmailHeader
+	err := s.db.View(func(tx *bolt.Tx) error {
+		headerJSON := tx.Bucket(boltHeadersBucket).Get([]byte(emailID))
+		if headerJSON == nil {
+			return newEmailNotFoundError("bolt", emailID)
+		}
+		return json.Unmarshal(headerJSON, &header)
+	})
+	return header, err
+}
+
+func (s *boltStorage) GetRawEmail(emailID string) ([]byte, error) {
+	var raw []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltRawBucket).Get([]byte(emailID))
+		if value == nil {
+			return newEmailNotFoundError("bolt", emailID)
+		}
+		var err error
+		raw, err = boltRawEmail(tx, []byte(emailID), value)
+		return err
+	})
+	return raw, err
+}
+
+func (s *boltStorage) GetBodyVersion(emailID string, version EmailVersionType) (string, error) {
+	raw, err := s.GetRawEmail(emailID)
+	if err != nil {
+		return "", err
+	}
+	if version == EmailVersionRaw {
+		return string(raw), nil
+	}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		return "", err
+	}
+	versionStr, err := emailVersionToString(version)
+	if err != nil {
+		return "", err
+	}
+	return mp.GetBody(versionStr)
+}
+
+func (s *boltStorage) GetAttachments(emailID string) ([]AttachmentHeader, error) {
+	var headers []AttachmentHeader
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltHeadersBucket).Get([]byte(emailID)) == nil {
+			return newEmailNotFoundError("bolt", emailID)
+		}
+		var err error
+		headers, err = s.attachmentHeaders(tx, emailID)
+		return err
+	})
+	return headers, err
+}
+
+func (s *boltStorage) GetAttachment(emailID string, attachmentID string) (Attachment, error) {
+	var attachment Attachment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltAttachmentsBucket).Get(boltAttachmentKey(emailID, attachmentID))
+		if value == nil {
+			if tx.Bucket(boltHeadersBucket).Get([]byte(emailID)) == nil {
+				return newEmailNotFoundError("bolt", emailID)
+			}
+			return newAttachmentNotFoundError("bolt", emailID, attachmentID)
+		}
+		if err := json.Unmarshal(value, &attachment.AttachmentHeader); err != nil {
+			return err
+		}
+		// the value is only valid during the transaction
+		attachment.Data = append([]byte{}, tx.Bucket(boltBlobsBucket).Get([]byte(attachment.Hash))...)
+		return nil
+	})
+	return attachment, err
+}
+
+// --- Write methods ---
+
+func (s *boltStorage) DeleteAllEmails() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) DeleteEmailByID(emailID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.removeEmail(tx, emailID)
+	})
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newBoltTestStorage(t *testing.T) *boltStorage {
+	t.Helper()
+	storage, err := newBoltStorage(filepath.Join(t.TempDir(), "test.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.db.Close() })
+	return storage
+}
+
+func TestBoltStorage(t *testing.T) {
+	storage := newBoltTestStorage(t)
+	ids := []string{"2024-01-01-a", "2024-01-02-c", "2024-01-03-d"}
+	for i, raw := range fullTextEmails {
+		if err := storage.setWithID(ids[i], []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header, err := storage.GetEmailByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Subject != "Quarterly report" || header.From.Address != "alice@example.com" {
+		t.Errorf("unexpected header %+v", header)
+	}
+	raw, err := storage.GetRawEmail(ids[1])
+	if err != nil || string(raw) != fullTextEmails[1] {
+		t.Errorf("unexpected raw email %q: %v", raw, err)
+	}
+	body, err := storage.GetBodyVersion(ids[0], EmailVersionPlainText)
+	if err != nil || !strings.Contains(body, "spreadsheet") {
+		t.Errorf("unexpected plain text body %q: %v", body, err)
+	}
+
+	attachments, err := storage.GetAttachments(ids[2])
+	if err != nil || len(attachments) != 1 || attachments[0].Filename != "invoice-42.pdf" {
+		t.Fatalf("unexpected attachments %+v: %v", attachments, err)
+	}
+	attachment, err := storage.GetAttachment(ids[2], attachments[0].ID)
+	if err != nil || string(attachment.Data) != "PDF" {
+		t.Errorf("unexpected attachment %q: %v", attachment.Data, err)
+	}
+	if _, err := storage.GetAttachment(ids[2], "42"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	mailboxes, err := storage.GetMailboxes()
+	if err != nil || fmt.Sprint(mailboxes) != "[{bob@example.com} {erin@example.com}]" {
+		t.Errorf("unexpected mailboxes %v: %v", mailboxes, err)
+	}
+
+	// replacing an email replaces its index keys
+	if err := storage.setWithID(ids[1], []byte(strings.Replace(fullTextEmails[1], "To: bob@", "To: frank@", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := searchIDs(t, storage, "mailbox:bob@example.com"); strings.Join(got, ",") != ids[0] {
+		t.Errorf("expected only %v for bob, got %v", ids[0], got)
+	}
+
+	if err := storage.DeleteEmailByID(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetEmailByID(ids[0]); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err := storage.DeleteEmailByID(ids[0]); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	mailboxes, _ = storage.GetMailboxes()
+	if fmt.Sprint(mailboxes) != "[{erin@example.com} {frank@example.com}]" {
+		t.Errorf("unexpected mailboxes %v", mailboxes)
+	}
+
+	if err := storage.DeleteAllEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := searchIDs(t, storage, ""); len(got) != 0 {
+		t.Errorf("expected no emails, got %v", got)
+	}
+}
+
+func TestBoltSearch(t *testing.T) {
+	storage := newBoltTestStorage(t)
+	// written out of date order
+	for _, day := range []int{3, 1, 5, 2, 4} {
+		from := "alice@example.com"
+		if day%2 == 0 {
+			from = "Bob@Example.com"
+		}
+		raw := fmt.Sprintf("From: %s\r\nTo: team@example.com\r\nSubject: day %d\r\nDate: Mon, 0%d Jan 2024 10:00:00 +0000\r\n\r\nbody of day %d\r\n", from, day, day, day)
+		if err := storage.setWithID(fmt.Sprintf("day-%d", day), []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", "day-5,day-4,day-3,day-2,day-1"},
+		{"from:bob@example.com", "day-4,day-2"},
+		{"mailbox:TEAM@example.com from:alice@example.com", "day-5,day-3,day-1"},
+		{"after:2024-01-02 before:2024-01-05", "day-4,day-3,day-2"},
+		{"from:alice@example.com before:2024-01-04", "day-3,day-1"},
+		{"subject:\"day 2\"", "day-2"},
+		{"\"body of day 4\"", "day-4"},
+		{"mailbox:nobody@example.com", ""},
+	}
+	for _, test := range tests {
+		got, _ := searchIDs(t, storage, test.query)
+		if strings.Join(got, ",") != test.expected {
+			t.Errorf("search %q: expected %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	// pages in date order, with the total of all the pages
+	var pages []string
+	for page := 1; page <= 3; page++ {
+		headers, total, err := storage.SearchEmails("", page, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 {
+			t.Errorf("page %d: expected a total of 5, got %d", page, total)
+		}
+		var ids []string
+		for _, header := range headers {
+			ids = append(ids, header.ID)
+		}
+		pages = append(pages, strings.Join(ids, ","))
+	}
+	if strings.Join(pages, "|") != "day-5,day-4|day-3,day-2|day-1" {
+		t.Errorf("unexpected pages %v", pages)
+	}
+	headers, total, err := storage.SearchEmails("from:alice@example.com", 2, 2)
+	if err != nil || total != 3 || len(headers) != 1 || headers[0].ID != "day-1" {
+		t.Errorf("unexpected second page %+v of %d: %v", headers, total, err)
+	}
+	if _, _, err := storage.SearchEmails("", 0, 2); err == nil {
+		t.Errorf("expected an error for page 0")
+	}
+}
+
+func TestBoltStorageLoadFromRoot(t *testing.T) {
+	root, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, raw := range fullTextEmails {
+		if err := root.setWithID(fmt.Sprintf("email-%d", i), []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage := newBoltTestStorage(t)
+	if err := storage.load(root); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := searchIDs(t, storage, ""); strings.Join(got, ",") != "email-2,email-1,email-0" {
+		t.Errorf("unexpected emails loaded from root: %v", got)
+	}
+}
+
+func TestBoltStorageSharedAttachments(t *testing.T) {
+	storage := newBoltTestStorage(t)
+	for i := 0; i < 3; i++ {
+		if err := storage.setWithID(fmt.Sprintf("invoice-%d", i), invoiceEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs := func() int {
+		count := 0
+		storage.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket(boltBlobsBucket).Stats().KeyN
+			return nil
+		})
+		return count
+	}
+	if count := blobs(); count != 1 {
+		t.Errorf("expected one shared attachment, got %d", count)
+	}
+	attachments, err := storage.GetAttachments("invoice-1")
+	if err != nil || len(attachments) != 1 || attachments[0].Hash != invoiceHash {
+		t.Fatalf("unexpected attachments %+v: %v", attachments, err)
+	}
+	attachment, err := storage.GetAttachment("invoice-1", attachments[0].ID)
+	if err != nil || attachment.Hash != invoiceHash || string(attachment.Data[:4]) != "%PDF" {
+		t.Errorf("unexpected attachment %+v: %v", attachment.AttachmentHeader, err)
+	}
+	if got, _ := searchIDs(t, storage, "attachment_hash:"+invoiceHash+" mailbox:customer1@example.com"); strings.Join(got, ",") != "invoice-1" {
+		t.Errorf("unexpected emails attaching the invoice: %v", got)
+	}
+
+	// replacing or deleting an email releases its attachments
+	if err := storage.setWithID("invoice-0", invoiceEmail(0)); err != nil {
+		t.Fatal(err)
+	}
+	storage.DeleteEmailByID("invoice-0")
+	storage.DeleteEmailByID("invoice-1")
+	if count := blobs(); count != 1 {
+		t.Errorf("expected the attachment to remain, got %d", count)
+	}
+	storage.DeleteEmailByID("invoice-2")
+	if count := blobs(); count != 0 {
+		t.Errorf("expected no attachment left, got %d", count)
+	}
+}
+
+func TestBoltStorageRawSharesAttachments(t *testing.T) {
+	storage := newBoltTestStorage(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	emails := [][]byte{
+		attachmentEmail(0, data, 76, "\r\n"),
+		attachmentEmail(1, data, 76, "\n"),
+		attachmentEmail(2, data, 64, "\r\n"), // not the encoding rebuilt: kept as sent
+		attachmentEmail(3, data, 76, "\r\n"),
+	}
+	for i, raw := range emails {
+		if err := storage.setWithID(fmt.Sprintf("report-%d", i), raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, raw := range emails {
+		got, err := storage.GetRawEmail(fmt.Sprintf("report-%d", i))
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("email %d: expected the raw email as sent, got %d bytes (%v)", i, len(got), err)
+		}
+	}
+	if got, _ := searchIDs(t, storage, "report.bin"); len(got) != len(emails) {
+		t.Errorf("expected the %d emails to be found, got %v", len(emails), got)
+	}
+	// the raw emails refer to the attachment, but the one sent with other lines
+	var size int
+	storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRawBucket).ForEach(func(key, value []byte) error {
+			size += len(value)
+			return nil
+		})
+	})
+	if size > len(emails[2])+4096 {
+		t.Errorf("expected the raw emails to share the attachment, got %d bytes", size)
+	}
+}
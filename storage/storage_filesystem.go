@@ -2,13 +2,20 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"mock-my-mta/log"
 	"mock-my-mta/storage/matcher"
@@ -20,6 +27,8 @@ type filesystemType string
 const (
 	FileStorageTypeEML     filesystemType = "eml"
 	FileStorageTypeMailhog filesystemType = "mailhog"
+	FileStorageTypeMaildir filesystemType = "maildir"
+	FileStorageTypeMbox    filesystemType = "mbox"
 )
 
 func parseFilesystemType(filesystemType string) (filesystemType, error) {
@@ -28,6 +37,10 @@ func parseFilesystemType(filesystemType string) (filesystemType, error) {
 		return FileStorageTypeEML, nil
 	case "mailhog":
 		return FileStorageTypeMailhog, nil
+	case "maildir":
+		return FileStorageTypeMaildir, nil
+	case "mbox":
+		return FileStorageTypeMbox, nil
 	default:
 		return "", fmt.Errorf("unknown filesystem type: %v", filesystemType)
 	}
@@ -39,44 +52,174 @@ func (t filesystemType) GetFileSuffix() string {
 		return ".eml"
 	case FileStorageTypeMailhog:
 		return "@mailhog.example"
+	case FileStorageTypeMaildir:
+		return "" // the Maildir filenames have no suffix
+	case FileStorageTypeMbox:
+		return ".mbox"
 	}
 	panic("unknown filesystem type")
 }
 
+type filesystemLayout string
+
+const (
+	FileStorageLayoutFlat filesystemLayout = "flat" // all emails in the folder
+	FileStorageLayoutDate filesystemLayout = "date" // emails in YYYY/MM/DD sub-folders, by Date header
+)
+
+func parseFilesystemLayout(layout string) (filesystemLayout, error) {
+	switch layout {
+	case "", "flat":
+		return FileStorageLayoutFlat, nil
+	case "date":
+		return FileStorageLayoutDate, nil
+	default:
+		return "", fmt.Errorf("unknown filesystem layout: %v", layout)
+	}
+}
+
+// lockFilename is the file locked by the writers sharing the folder (other instances
+// or tools). Emails are written to a temporary file and renamed into place, so the
+// readers never see half-written files and do not need to lock.
+const lockFilename = ".mock-my-mta.lock"
+
+// fileSettleDelay is the time an external tool is given to finish writing an email
+// dropped in the folder: unparseable files younger than this are silently skipped.
+const fileSettleDelay = 5 * time.Second
+
 // FilesystemStorage is a storage engine that stores emails on the filesystem.
 type filesystemStorage struct {
 	mu             sync.RWMutex
 	folder         string
 	filesystemType filesystemType
+	layout         filesystemLayout
+	maildirFolders string     // maildir type: maildirFoldersNone or maildirFoldersRecipient
+	mboxFiles      string     // mbox type: mboxFilesSingle or mboxFilesMailbox
+	codec          *fileCodec // eml type: compression and encryption of the files
+	index          *filesystemIndex
+
+	watchInterval time.Duration // polling interval of the watcher, 0 = not watched
+	watchMu       sync.Mutex
+	watching      bool
+	changes       []fileChange // external changes found since the last poll
+}
+
+// emailFile is an email file found in the folder.
+type emailFile struct {
+	id      string
+	path    string // slash-separated, relative to the folder
+	offset  int64  // mbox type: offset of the message in the file
+	size    int64
+	modTime int64 // Unix nanoseconds
 }
 
 // FilesystemStorage implements the Storage interface
 var _ Storage = &filesystemStorage{}
 
 func newFilesystemStorage(folder string, filesystemTypeStr string) (*filesystemStorage, error) {
-	log.Logf(log.INFO, "using storage in folder %v (type=%v)", folder, filesystemTypeStr)
+	return newFilesystemStorageWithLayout(folder, filesystemTypeStr, "flat")
+}
+
+// newFilesystemStorageFromParameters returns the filesystem storage of the layer
+// parameters.
+func newFilesystemStorageFromParameters(parameters map[string]string) (*filesystemStorage, error) {
+	folder, ok := parameters["folder"]
+	if !ok {
+		return nil, fmt.Errorf("missing folder parameter for FILESYSTEM storage")
+	}
+	fsType, ok := parameters["type"]
+	if !ok {
+		return nil, fmt.Errorf("missing type parameter for FILESYSTEM storage")
+	}
+	s, err := newFilesystemStorageWithLayout(folder, fsType, parameters["layout"])
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setMaildirFolders(parameters["maildir_folders"]); err != nil {
+		return nil, err
+	}
+	if err := s.setMboxFiles(parameters["mbox_files"]); err != nil {
+		return nil, err
+	}
+	codec, err := newFileCodec(parameters["compression"], parameters["encryption"], parameters["encryption_key_file"], parameters["encryption_key_env"])
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setCodec(codec); err != nil {
+		return nil, err
+	}
+	if err := s.setWatchInterval(parameters["watch"]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setCodec sets the compression and encryption of the email files.
+func (s *filesystemStorage) setCodec(codec *fileCodec) error {
+	if codec.encodes() && s.filesystemType != FileStorageTypeEML {
+		return fmt.Errorf("compression and encryption require the eml type")
+	}
+	s.codec = codec
+	s.index.codec = codec
+	return nil
+}
+
+func newFilesystemStorageWithLayout(folder string, filesystemTypeStr string, layoutStr string) (*filesystemStorage, error) {
+	log.Logf(log.INFO, "using storage in folder %v (type=%v, layout=%v)", folder, filesystemTypeStr, layoutStr)
 	filesystemType, err := parseFilesystemType(filesystemTypeStr)
 	if err != nil {
 		return nil, err
 	}
-	return &filesystemStorage{folder: folder, filesystemType: filesystemType}, nil
+	layout, err := parseFilesystemLayout(layoutStr)
+	if err != nil {
+		return nil, err
+	}
+	if (filesystemType == FileStorageTypeMaildir || filesystemType == FileStorageTypeMbox) && layout != FileStorageLayoutFlat {
+		return nil, fmt.Errorf("the %v layout does not apply to the %v type", layout, filesystemType)
+	}
+	return &filesystemStorage{
+		folder:         folder,
+		filesystemType: filesystemType,
+		layout:         layout,
+		maildirFolders: maildirFoldersNone,
+		mboxFiles:      mboxFilesSingle,
+		index:          newFilesystemIndex(folder),
+	}, nil
 }
 
 // DeleteAllEmails implements Storage.
 func (s *filesystemStorage) DeleteAllEmails() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	emailIDs, err := s.getAllEmailIDs()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var files []emailFile
+	switch s.filesystemType {
+	case FileStorageTypeMaildir:
+		// including the copies in the recipient folders
+		files, err = s.scanMaildirFiles(false)
+	case FileStorageTypeMbox:
+		// including the files of every mailbox
+		files, err = s.scanMboxFiles(false)
+	default:
+		files, err = s.scanEmailFiles()
+	}
 	if err != nil {
 		return err
 	}
 	var errors []error
-	for _, emailID := range emailIDs {
-		// Use internal delete (no lock) since we already hold the lock
-		err := s.deleteEmailFile(emailID)
-		if err != nil {
+	for _, file := range files {
+		filePath := filepath.Join(s.folder, filepath.FromSlash(file.path))
+		log.Logf(log.DEBUG, "deleting file %v", filePath)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 			errors = append(errors, err)
+			continue
 		}
+		s.removeEmptyFolders(filePath)
+	}
+	if err := s.index.reset(); err != nil {
+		errors = append(errors, err)
 	}
 	if len(errors) > 0 {
 		return fmt.Errorf("errors: %v", errors)
@@ -86,20 +229,118 @@ func (s *filesystemStorage) DeleteAllEmails() error {
 
 // DeleteEmailByID implements Storage.
 func (s *filesystemStorage) DeleteEmailByID(emailID string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return s.deleteEmailFile(emailID)
 }
 
+// lock takes the in-process lock and the advisory lock on the folder, shared with
+// the other processes writing to it.
+func (s *filesystemStorage) lock() (func(), error) {
+	s.mu.Lock()
+	file, err := os.OpenFile(filepath.Join(s.folder, lockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("cannot lock folder %v: %v", s.folder, err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+		s.mu.Unlock()
+	}, nil
+}
+
+// deleteEmailFile removes the email file. Must be called with the folder lock held.
 func (s *filesystemStorage) deleteEmailFile(emailID string) error {
-	filePath := s.getEmailFilename(emailID)
+	if s.filesystemType == FileStorageTypeMaildir {
+		copies := s.maildirCopies(emailID)
+		if len(copies) == 0 {
+			return newEmailNotFoundError("filesystem", emailID)
+		}
+		for _, filePath := range copies {
+			log.Logf(log.DEBUG, "deleting file %v", filePath)
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return s.index.update(indexEntry{ID: emailID, Deleted: true})
+	}
+	if s.filesystemType == FileStorageTypeMbox {
+		removed, err := s.removeMboxEmail(emailID)
+		if err == nil && !removed {
+			return newEmailNotFoundError("filesystem", emailID)
+		}
+		return err
+	}
+	filePath := s.emailFilename(emailID, true)
 	log.Logf(log.DEBUG, "deleting file %v", filePath)
-	return os.Remove(filePath)
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return newEmailNotFoundError("filesystem", emailID)
+		}
+		return err
+	}
+	s.removeEmptyFolders(filePath)
+	return s.index.update(indexEntry{ID: emailID, Deleted: true})
+}
+
+// removeEmptyFolders removes the date sub-folders left empty by a deletion.
+func (s *filesystemStorage) removeEmptyFolders(filePath string) {
+	if s.layout != FileStorageLayoutDate {
+		return
+	}
+	for dir := filepath.Dir(filePath); ; dir = filepath.Dir(dir) {
+		relativeDir, err := filepath.Rel(s.folder, dir)
+		if err != nil || relativeDir == "." || strings.HasPrefix(relativeDir, "..") {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return // not empty
+		}
+	}
 }
 
 // getEmailFilename returns the filename of the email.
 func (s *filesystemStorage) getEmailFilename(emailID string) string {
-	return filepath.Join(s.folder, emailID+s.filesystemType.GetFileSuffix())
+	return s.emailFilename(emailID, false)
+}
+
+// emailFilename returns the filename of the email: the indexed one, or where the
+// layout would put it. locked tells if the caller holds the folder lock.
+func (s *filesystemStorage) emailFilename(emailID string, locked bool) string {
+	if entry, ok := s.index.get(emailID); ok {
+		return filepath.Join(s.folder, filepath.FromSlash(entry.Path))
+	}
+	if s.layout != FileStorageLayoutFlat || s.filesystemType == FileStorageTypeMaildir {
+		// written by another process, or before the index
+		if err := s.refreshIndex(context.Background(), locked); err != nil {
+			log.Logf(log.WARNING, "cannot refresh index: %v", err)
+		}
+		if entry, ok := s.index.get(emailID); ok {
+			return filepath.Join(s.folder, filepath.FromSlash(entry.Path))
+		}
+	}
+	return filepath.Join(s.folder, filepath.FromSlash(s.relativeEmailPath(emailID, time.Time{})))
+}
+
+// relativeEmailPath returns where the layout puts an email, slash-separated.
+func (s *filesystemStorage) relativeEmailPath(emailID string, date time.Time) string {
+	filename := emailID + s.filesystemType.GetFileSuffix()
+	if s.filesystemType == FileStorageTypeMaildir {
+		return maildirNew + "/" + maildirUnique(emailID)
+	}
+	if s.layout == FileStorageLayoutDate {
+		return date.UTC().Format("2006/01/02") + "/" + filename
+	}
+	return filename
 }
 
 // GetAttachment implements Storage.
@@ -111,16 +352,11 @@ func (s *filesystemStorage) GetAttachment(emailID string, attachmentID string) (
 	log.Logf(log.DEBUG, "searching for attachment %v", attachmentID)
 	attachmentNode, found := mp.GetAttachment(attachmentID)
 	if !found {
-		return Attachment{}, fmt.Errorf("attachment not found: %v", attachmentID)
+		return Attachment{}, newAttachmentNotFoundError("filesystem", emailID, attachmentID)
 	}
 	attachment := Attachment{
-		AttachmentHeader: AttachmentHeader{
-			ID:          attachmentID,
-			ContentType: attachmentNode.GetContentType(),
-			Filename:    attachmentNode.GetFilename(),
-			Size:        attachmentNode.GetSize(),
-		},
-		Data: []byte(attachmentNode.GetDecodedBody()),
+		AttachmentHeader: newAttachmentHeader(attachmentID, attachmentNode),
+		Data:             []byte(attachmentNode.GetDecodedBody()),
 	}
 	log.Logf(log.DEBUG, "found attachment %v", attachment)
 	return attachment, nil
@@ -134,12 +370,7 @@ func (s *filesystemStorage) GetAttachments(emailID string) ([]AttachmentHeader,
 	}
 	var attachmentHeaders []AttachmentHeader
 	for attachmentID, leaf := range mp.GetAttachments() {
-		attachmentHeaders = append(attachmentHeaders, AttachmentHeader{
-			ID:          attachmentID,
-			ContentType: leaf.GetContentType(),
-			Filename:    leaf.GetFilename(),
-			Size:        leaf.GetSize(),
-		})
+		attachmentHeaders = append(attachmentHeaders, newAttachmentHeader(attachmentID, leaf))
 	}
 	return attachmentHeaders, nil
 }
@@ -177,26 +408,34 @@ func (s *filesystemStorage) GetEmailByID(emailID string) (EmailHeader, error) {
 		return EmailHeader{}, err
 	}
 	// create the email header
-	return newEmailHeaderFromMultiPart(emailID, multipart), nil
+	header := newEmailHeaderFromMultiPart(emailID, multipart)
+	if entry, ok := s.index.get(emailID); ok && entry.Header != nil {
+		header.ReceivedAt = entry.header().ReceivedAt
+	}
+	return header, nil
 }
 
 // GetMailboxes implements Storage.
 func (s *filesystemStorage) GetMailboxes() ([]Mailbox, error) {
-	// list all files in the folder
-	emailIDs, err := s.getAllEmailIDs()
+	return s.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage.
+func (s *filesystemStorage) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	// list all emails from the index
+	entries, err := s.indexedEmails(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// extract the recipients from the emails
 	recipients := make(map[string]bool)
-	for _, emailID := range emailIDs {
-		multipart, err := s.loadEmailFromID(emailID)
-		if err != nil {
-			return nil, err
-		}
-		for _, address := range multipart.GetRecipients() {
+	for _, entry := range entries {
+		for _, address := range append(entry.Header.Tos, entry.Header.CCs...) {
 			recipients[address.Address] = true
 		}
+		for _, mailbox := range entry.Header.DeliveredTo {
+			recipients[mailbox] = true
+		}
 	}
 	// create the mailboxes
 	mailboxes := make([]Mailbox, 0, len(recipients))
@@ -211,25 +450,59 @@ func (s *filesystemStorage) GetMailboxes() ([]Mailbox, error) {
 
 // SearchEmails implements Storage.
 func (s *filesystemStorage) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return s.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage, checking the context between
+// the parsed files.
+func (s *filesystemStorage) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
 	// Parse the query string
 	matchers, err := matcher.ParseQuery(query)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	// list all files in the folder
-	emailIDs, err := s.getAllEmailIDs()
+	// list all emails from the index
+	entries, err := s.indexedEmails(ctx)
 	if err != nil {
 		return nil, 0, err
 	}
+	now := time.Now()
 	var emailHeaders []EmailHeader
-	for _, emailID := range emailIDs {
-		multipart, err := s.loadEmailFromID(emailID)
-		if err != nil {
+	for _, entry := range entries {
+		// the header matchers are checked on the indexed header, the email file is
+		// only parsed for the other ones
+		header := entry.header()
+		matched := true
+		var bodyMatchers []interface{}
+		for _, m := range matchers {
+			headerMatched, ok := matchHeader(header, m, now)
+			if !ok {
+				bodyMatchers = append(bodyMatchers, m)
+			} else if !headerMatched {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if len(bodyMatchers) == 0 {
+			emailHeaders = append(emailHeaders, header)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
 			return nil, 0, err
 		}
-		if multipart.MatchAll(matchers) {
-			emailHeaders = append(emailHeaders, newEmailHeaderFromMultiPart(emailID, multipart))
+		multipart, err := s.loadEmailFromID(entry.ID)
+		if err != nil {
+			if !IsNotFound(err) {
+				log.Logf(log.WARNING, "skipping unreadable email %v: %v", entry.ID, err)
+			}
+			continue
+		}
+		if multipart.MatchAll(bodyMatchers) {
+			emailHeaders = append(emailHeaders, header)
 		}
 	}
 
@@ -266,6 +539,74 @@ func (s *filesystemStorage) GetRawEmail(emailID string) ([]byte, error) {
 	return s.getRawBody(emailID)
 }
 
+// OpenRawEmail implements StreamingStorage: plain files are read in place, from
+// after the mailhog header. Encoded files and mbox emails are decoded in memory.
+func (s *filesystemStorage) OpenRawEmail(emailID string) (io.ReadSeekCloser, error) {
+	if s.filesystemType == FileStorageTypeMbox {
+		raw, err := s.readMboxEmail(emailID)
+		if err != nil {
+			return nil, err
+		}
+		return newBytesContent(raw), nil
+	}
+	file, err := os.Open(s.getEmailFilename(emailID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newEmailNotFoundError("filesystem", emailID)
+		}
+		return nil, err
+	}
+	content, err := s.openEmailFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+func (s *filesystemStorage) openEmailFile(file *os.File) (io.ReadSeekCloser, error) {
+	if s.filesystemType == FileStorageTypeMailhog {
+		if err := skipMailhogHeader(file); err != nil {
+			return nil, err
+		}
+	}
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(encryptedMagic))
+	n, err := file.ReadAt(magic, start)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isEncoded(magic[:n]) {
+		data, err := io.ReadAll(io.NewSectionReader(file, start, info.Size()-start))
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		if data, err = s.codec.decode(data); err != nil {
+			return nil, err
+		}
+		return newBytesContent(data), nil
+	}
+	return sectionContent{io.NewSectionReader(file, start, info.Size()-start), file}, nil
+}
+
+// OpenAttachment implements StreamingStorage.
+func (s *filesystemStorage) OpenAttachment(emailID string, attachmentID string) (AttachmentHeader, io.ReadSeekCloser, error) {
+	raw, err := s.OpenRawEmail(emailID)
+	if err != nil {
+		return AttachmentHeader{}, nil, err
+	}
+	defer raw.Close()
+	return openAttachmentFrom(raw, "filesystem", emailID, attachmentID, s.codec.hasKey())
+}
+
 // Load loads the storage based on the root storage
 func (s *filesystemStorage) load(rootStorage Storage) error {
 	// check that the folder exists
@@ -276,24 +617,111 @@ func (s *filesystemStorage) load(rootStorage Storage) error {
 			return err
 		}
 	}
-	// we don't load anything, all calls are direct to the filesystem
-	return nil
+	if s.filesystemType == FileStorageTypeMaildir {
+		if err := createMaildir(s.folder, false); err != nil {
+			return err
+		}
+	}
+	// check the index against the files, rebuilding it if missing
+	return s.refreshIndex(context.Background(), false)
 }
 
-// setWithID writes the raw email bytes directly to a file (zero parsing).
+// setWithID writes the raw email bytes to a temporary file, synced to disk, and
+// renames it into place: a crash never leaves a half-written email.
 func (s *filesystemStorage) setWithID(emailID string, rawEmail []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// Verify the email is parseable
+	message, err := mail.ReadMessage(bytes.NewReader(rawEmail))
+	var mp *multipart.Multipart
+	if err == nil {
+		mp, err = multipart.New(message)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse email %v: %v", emailID, err)
+	}
+	header := newEmailHeaderFromMultiPart(emailID, mp)
+	header.ReceivedAt = time.Now().UTC()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	log.Logf(log.INFO, "saving email %v", emailID)
-	emailFilename := s.getEmailFilename(emailID)
-	file, err := os.Create(emailFilename)
+	if s.filesystemType == FileStorageTypeMbox {
+		return s.appendMboxEmail(emailID, rawEmail, header)
+	}
+	relativePath := s.relativeEmailPath(emailID, header.Date)
+	emailFilename := filepath.Join(s.folder, filepath.FromSlash(relativePath))
+	folder := filepath.Dir(emailFilename)
+	tmpFolder := folder
+	if s.filesystemType == FileStorageTypeMaildir {
+		// delivered to tmp, then moved to new, replacing the previous copies
+		if err := createMaildir(s.folder, false); err != nil {
+			return err
+		}
+		for _, filename := range s.maildirCopies(emailID) {
+			os.Remove(filename)
+		}
+		tmpFolder = filepath.Join(s.folder, maildirTmp)
+	} else if err := os.MkdirAll(folder, 0755); err != nil {
+		return err
+	}
+	// the temporary file does not match the email suffix until renamed
+	file, err := os.CreateTemp(tmpFolder, "."+maildirUnique(emailID)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmpFilename := file.Name()
+	if err := s.writeEmailFile(file, rawEmail); err != nil {
+		file.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, emailFilename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := syncDir(folder); err != nil {
+		return err
+	}
+	if err := s.deliverToRecipientFolders(emailID, emailFilename, header); err != nil {
+		return err
+	}
+
+	// an email written again with another date moves to another folder
+	if previous, ok := s.index.get(emailID); ok && previous.Path != relativePath && s.filesystemType != FileStorageTypeMaildir {
+		previousFilename := filepath.Join(s.folder, filepath.FromSlash(previous.Path))
+		os.Remove(previousFilename)
+		s.removeEmptyFolders(previousFilename)
+	}
+	info, err := os.Stat(emailFilename)
+	if err != nil {
+		return err
+	}
+	return s.index.update(indexEntry{
+		ID:      emailID,
+		Path:    relativePath,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Header:  &header,
+		Version: indexVersion,
+	})
+}
 
+// writeEmailFile writes the email in the format of the storage and syncs it to disk.
+func (s *filesystemStorage) writeEmailFile(file *os.File, rawEmail []byte) error {
 	switch s.filesystemType {
 	case FileStorageTypeEML:
+		// Write raw bytes directly — no parsing needed — unless encoded
+		var err error
+		if rawEmail, err = s.codec.encode(rawEmail); err != nil {
+			return err
+		}
+	case FileStorageTypeMaildir:
 		// Write raw bytes directly — no parsing needed
 	case FileStorageTypeMailhog:
 		// Prepend fake mailhog envelope header
@@ -310,24 +738,23 @@ func (s *filesystemStorage) setWithID(emailID string, rawEmail []byte) error {
 	if _, err := file.Write(rawEmail); err != nil {
 		return err
 	}
-
-	// Verify the file is parseable
-	_, err = s.loadEmailFromID(emailID)
-	if err != nil {
-		os.Remove(emailFilename)
-		return fmt.Errorf("cannot parse email %v: %v", emailID, err)
-	}
-	return nil
+	return file.Sync()
 }
 
 func (s *filesystemStorage) getRawBody(emailID string) ([]byte, error) {
+	if s.filesystemType == FileStorageTypeMbox {
+		return s.readMboxEmail(emailID)
+	}
 	file, err := os.Open(s.getEmailFilename(emailID))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newEmailNotFoundError("filesystem", emailID)
+		}
 		return nil, err
 	}
 	defer file.Close()
 	switch s.filesystemType {
-	case FileStorageTypeEML:
+	case FileStorageTypeEML, FileStorageTypeMaildir:
 		// nothing to do
 	case FileStorageTypeMailhog:
 		err = skipMailhogHeader(file)
@@ -336,17 +763,39 @@ func (s *filesystemStorage) getRawBody(emailID string) ([]byte, error) {
 		}
 	}
 	// read the complete file
-	return io.ReadAll(file)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return s.codec.decode(data)
 }
 
 func (s *filesystemStorage) loadEmailFromID(emailID string) (*multipart.Multipart, error) {
-	file, err := os.Open(s.getEmailFilename(emailID))
+	if s.filesystemType == FileStorageTypeMbox {
+		raw, err := s.readMboxEmail(emailID)
+		if err != nil {
+			return nil, err
+		}
+		mp, err := multipart.ParseEmailFromBytes(raw)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse email %v: %v", emailID, err)
+		}
+		return mp, nil
+	}
+	return s.loadEmailFile(s.getEmailFilename(emailID), emailID)
+}
+
+func (s *filesystemStorage) loadEmailFile(filename string, emailID string) (*multipart.Multipart, error) {
+	file, err := os.Open(filename)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newEmailNotFoundError("filesystem", emailID)
+		}
 		return nil, err
 	}
 	defer file.Close()
 	switch s.filesystemType {
-	case FileStorageTypeEML:
+	case FileStorageTypeEML, FileStorageTypeMaildir:
 		// nothing to do
 	case FileStorageTypeMailhog:
 		err = skipMailhogHeader(file)
@@ -354,7 +803,19 @@ func (s *filesystemStorage) loadEmailFromID(emailID string) (*multipart.Multipar
 			return nil, err
 		}
 	}
-	message, err := mail.ReadMessage(file)
+	var reader io.Reader = file
+	if s.filesystemType == FileStorageTypeEML {
+		// compressed or encrypted files are decoded in memory
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = s.codec.decode(data); err != nil {
+			return nil, fmt.Errorf("cannot decode email %v: %v", emailID, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	message, err := mail.ReadMessage(reader)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse email %v: %v", emailID, err)
 	}
@@ -367,7 +828,8 @@ func (s *filesystemStorage) loadEmailFromID(emailID string) (*multipart.Multipar
 }
 
 // readMailhogHeader reads the mailhog header from the file
-// it reads until the first empty line
+// it reads until the first empty line. A file without the envelope (an email
+// saved as is into a mailhog folder) is left at its start.
 func skipMailhogHeader(file *os.File) error {
 	reader := bufio.NewReader(file)
 	var totalBytesRead int64
@@ -376,6 +838,10 @@ func skipMailhogHeader(file *os.File) error {
 		if err != nil {
 			return err
 		}
+		if totalBytesRead == 0 && !strings.HasPrefix(line, "HELO:") {
+			_, err = file.Seek(0, io.SeekStart)
+			return err
+		}
 		totalBytesRead += int64(len(line))
 		if line == "\n" || line == "\r\n" {
 			// set the file pointer to the start of the body
@@ -395,6 +861,7 @@ func newEmailHeaderFromMultiPart(ID string, multipart *multipart.Multipart) Emai
 		From:           newEmailAddressFromAddress(multipart.GetFrom()),
 		Tos:            newEmailAddressesFromAddresses(multipart.GetTos()),
 		CCs:            newEmailAddressesFromAddresses(multipart.GetCCs()),
+		DeliveredTo:    multipart.GetPlacementMailboxes(),
 		Subject:        multipart.GetSubject(),
 		Date:           multipart.GetDate(),
 		HasAttachments: multipart.HasAttachments(),
@@ -420,20 +887,223 @@ func newEmailAddressFromAddress(address mail.Address) EmailAddress {
 	}
 }
 
+// getAllEmailIDs lists the emails of the folder, from the index.
 func (s *filesystemStorage) getAllEmailIDs() ([]string, error) {
-	// list all files in the folder
-	fileSuffix := s.filesystemType.GetFileSuffix()
-	filenames, err := filepath.Glob(filepath.Join(s.folder, "*"+fileSuffix))
+	entries, err := s.indexedEmails(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	// extract the email IDs
-	emailIDs := make([]string, 0, len(filenames))
-	for _, filename := range filenames {
-		// remove the folder and the extension
-		emailID := filepath.Base(filename)
-		emailID = emailID[:len(emailID)-len(fileSuffix)]
-		emailIDs = append(emailIDs, emailID)
+	emailIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		emailIDs = append(emailIDs, entry.ID)
 	}
 	return emailIDs, nil
 }
+
+// indexedEmails refreshes the index and returns its entries.
+func (s *filesystemStorage) indexedEmails(ctx context.Context) ([]indexEntry, error) {
+	if err := s.refreshIndex(ctx, false); err != nil {
+		return nil, err
+	}
+	snapshot := s.index.snapshot()
+	entries := make([]indexEntry, 0, len(snapshot))
+	for _, entry := range snapshot {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// refreshIndex checks the index against the email files: new or modified files
+// (written by another process or tool, or before the index existed) are parsed
+// and indexed, removed ones are unindexed. locked tells if the caller holds the
+// folder lock. When the context is done, the files parsed so far are indexed and
+// the error of the context is returned.
+func (s *filesystemStorage) refreshIndex(ctx context.Context, locked bool) error {
+	// the snapshot is taken first: an email written during the scan is then
+	// either found by the scan or dropped by rewrittenSince
+	before := s.index.snapshot()
+	files, err := s.scanEmailFiles()
+	if err != nil {
+		return err
+	}
+	indexed := maps.Clone(before)
+	var changes []indexEntry
+	var external []fileChange // made by other tools
+	var canceled error
+	for _, file := range files {
+		if canceled = ctx.Err(); canceled != nil {
+			// the removed files are only known once all the files are listed
+			indexed = nil
+			break
+		}
+		entry, wasIndexed := indexed[file.id]
+		delete(indexed, file.id)
+		// an entry of an older version is parsed again, without being a change
+		upgraded := wasIndexed && entry.Version < indexVersion && entry.matches(file)
+		if wasIndexed && entry.Version == indexVersion && entry.matches(file) {
+			continue
+		}
+		if wasIndexed && entry.Version == indexVersion && entry.movedTo(file) {
+			// an mbox message moved by the removal of a previous one
+			entry.Offset = file.offset
+			changes = append(changes, entry)
+			continue
+		}
+		var mp *multipart.Multipart
+		if s.filesystemType == FileStorageTypeMbox {
+			mp, err = s.parseMboxMessage(file)
+		} else {
+			mp, err = s.loadEmailFile(filepath.Join(s.folder, filepath.FromSlash(file.path)), file.id)
+		}
+		if err != nil {
+			s.skipUnreadableEmail(file, err)
+			if wasIndexed {
+				changes = append(changes, indexEntry{ID: file.id, Deleted: true})
+				external = append(external, fileChange{emailID: file.id, kind: fileDeleted})
+			}
+			continue
+		}
+		header := newEmailHeaderFromMultiPart(file.id, mp)
+		entry = indexEntry{ID: file.id, Path: file.path, Offset: file.offset, Size: file.size, ModTime: file.modTime, Header: &header, Version: indexVersion}
+		changes = append(changes, entry)
+		if upgraded {
+			continue
+		}
+		if wasIndexed {
+			external = append(external, fileChange{emailID: file.id, kind: fileModified, entry: entry})
+		} else {
+			external = append(external, fileChange{emailID: file.id, kind: fileCreated, entry: entry})
+		}
+	}
+	for emailID := range indexed {
+		changes = append(changes, indexEntry{ID: emailID, Deleted: true})
+		external = append(external, fileChange{emailID: emailID, kind: fileDeleted})
+	}
+	if len(changes) == 0 {
+		return canceled
+	}
+	log.Logf(log.DEBUG, "indexing %d changes in folder %v", len(changes), s.folder)
+	if !locked {
+		unlock, err := s.lock()
+		if err != nil {
+			// a read-only folder: keep the index in memory
+			log.Logf(log.WARNING, "cannot save index of folder %v: %v", s.folder, err)
+			changes, external = s.rewrittenSince(before, changes, external)
+			external = s.external(external)
+			s.index.remember(changes...)
+			s.recordChanges(external)
+			return canceled
+		}
+		defer unlock()
+	}
+	changes, external = s.rewrittenSince(before, changes, external)
+	if len(changes) == 0 {
+		return canceled
+	}
+	external = s.external(external)
+	if err := s.index.update(changes...); err != nil {
+		return err
+	}
+	s.recordChanges(external)
+	return canceled
+}
+
+// rewrittenSince drops the changes of the emails written or deleted by this
+// storage since the index snapshot: the scan may have listed the folder before
+// or after them. Must be called with the folder lock held, when writable.
+func (s *filesystemStorage) rewrittenSince(before map[string]indexEntry, changes []indexEntry, external []fileChange) ([]indexEntry, []fileChange) {
+	rewritten := make(map[string]bool)
+	for _, change := range changes {
+		previous, wasIndexed := before[change.ID]
+		current, indexed := s.index.get(change.ID)
+		if wasIndexed != indexed || (indexed && (previous.Path != current.Path || previous.Offset != current.Offset ||
+			previous.Size != current.Size || previous.ModTime != current.ModTime)) {
+			rewritten[change.ID] = true
+		}
+	}
+	if len(rewritten) == 0 {
+		return changes, external
+	}
+	changes = slices.DeleteFunc(changes, func(change indexEntry) bool { return rewritten[change.ID] })
+	external = slices.DeleteFunc(external, func(change fileChange) bool { return rewritten[change.emailID] })
+	return changes, external
+}
+
+// scanEmailFiles lists the email files of the folder, and of its sub-folders with
+// the date layout. Hidden (temporary) files, files that are not regular (after
+// following symbolic links) and empty files (being created by another tool) are
+// skipped.
+func (s *filesystemStorage) scanEmailFiles() ([]emailFile, error) {
+	switch s.filesystemType {
+	case FileStorageTypeMaildir:
+		return s.scanMaildirFiles(true)
+	case FileStorageTypeMbox:
+		return s.scanMboxFiles(true)
+	}
+	fileSuffix := s.filesystemType.GetFileSuffix()
+	var files []emailFile
+	err := filepath.WalkDir(s.folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.folder && os.IsNotExist(err) {
+				return nil // not created yet
+			}
+			if os.IsNotExist(err) {
+				return nil // removed meanwhile
+			}
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			if path != s.folder && (s.layout == FileStorageLayoutFlat || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, fileSuffix) || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		info, ok := regularFileInfo(path, entry)
+		if !ok || info.Size() == 0 {
+			return nil // not a file, removed or still empty
+		}
+		relativePath, err := filepath.Rel(s.folder, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, emailFile{
+			id:      name[:len(name)-len(fileSuffix)],
+			path:    filepath.ToSlash(relativePath),
+			size:    info.Size(),
+			modTime: info.ModTime().UnixNano(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// regularFileInfo returns the information of the entry if it is a regular file,
+// or a symbolic link to one.
+func regularFileInfo(path string, entry fs.DirEntry) (fs.FileInfo, bool) {
+	if entry.Type()&fs.ModeSymlink != 0 {
+		info, err := os.Stat(path)
+		return info, err == nil && info.Mode().IsRegular()
+	}
+	if !entry.Type().IsRegular() {
+		return nil, false
+	}
+	info, err := entry.Info()
+	return info, err == nil
+}
+
+// skipUnreadableEmail logs an email file left out of the index: still being
+// written by another tool, or invalid.
+func (s *filesystemStorage) skipUnreadableEmail(file emailFile, err error) {
+	if IsNotFound(err) {
+		return
+	}
+	if time.Since(time.Unix(0, file.modTime)) < fileSettleDelay {
+		log.Logf(log.DEBUG, "skipping email %v, still being written: %v", file.path, err)
+		return
+	}
+	log.Logf(log.WARNING, "skipping unreadable email %v: %v", file.path, err)
+}
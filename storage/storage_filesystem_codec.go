@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of the email files of a filesystem storage.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Encryptions of the email files of a filesystem storage.
+const (
+	encryptionNone      = "none"
+	encryptionAES256GCM = "aes-256-gcm"
+)
+
+// Magic numbers starting the encoded email files. Files starting with none of
+// them are plain emails, so that a folder can hold both.
+var (
+	gzipMagic      = []byte{0x1f, 0x8b}
+	zstdMagic      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	encryptedMagic = []byte("MMTAGCM1")
+)
+
+// The zstd encoder and decoder are safe for concurrent use, and costly to create.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+// fileCodec compresses and encrypts the email files at rest, and decodes them
+// whatever the encoding they were written with.
+type fileCodec struct {
+	compression string
+	encrypt     bool
+	aead        cipher.AEAD // nil without a key
+}
+
+// newFileCodec returns the codec of the compression and encryption parameters.
+// The AES-256 key, hexadecimal or base64 encoded, is read from the key file or
+// else from the environment variable named by keyEnv. A key without encryption
+// only decrypts the files.
+func newFileCodec(compression string, encryption string, keyFile string, keyEnv string) (*fileCodec, error) {
+	codec := &fileCodec{compression: compressionNone}
+	switch compression {
+	case "", compressionNone:
+	case compressionGzip, compressionZstd:
+		codec.compression = compression
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", compression)
+	}
+
+	var encodedKey string
+	switch {
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read encryption key: %v", err)
+		}
+		encodedKey = string(data)
+	case keyEnv != "":
+		encodedKey = os.Getenv(keyEnv)
+		if encodedKey == "" {
+			return nil, fmt.Errorf("no encryption key in environment variable %v", keyEnv)
+		}
+	}
+	if encodedKey != "" {
+		key, err := decodeKey(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if codec.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	switch encryption {
+	case "":
+		codec.encrypt = codec.aead != nil
+	case encryptionNone:
+	case encryptionAES256GCM:
+		if codec.aead == nil {
+			return nil, fmt.Errorf("the %v encryption requires a key", encryption)
+		}
+		codec.encrypt = true
+	default:
+		return nil, fmt.Errorf("unknown encryption: %v", encryption)
+	}
+	return codec, nil
+}
+
+// decodeKey decodes a hexadecimal or base64 AES-256 key.
+func decodeKey(encodedKey string) ([]byte, error) {
+	if key, err := hex.DecodeString(encodedKey); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encodedKey); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the encryption key must be 32 bytes, hexadecimal or base64 encoded")
+}
+
+// encodes returns true if the codec changes the emails it writes.
+func (c *fileCodec) encodes() bool {
+	return c != nil && (c.compression != compressionNone || c.encrypt)
+}
+
+// encode compresses, then encrypts the email.
+func (c *fileCodec) encode(raw []byte) ([]byte, error) {
+	if !c.encodes() {
+		return raw, nil
+	}
+	data := raw
+	switch c.compression {
+	case compressionGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		data = buffer.Bytes()
+	case compressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		data = encoder.EncodeAll(raw, nil)
+	}
+	if c.encrypt {
+		return c.seal(data)
+	}
+	return data, nil
+}
+
+// isEncoded returns true if the file data starts with the magic number of an
+// encoding, and must be decoded whole.
+func isEncoded(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic) || bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)
+}
+
+// hasKey returns true if the codec has an encryption key: the files of the
+// storage may be encrypted, and their decoded contents must not be spooled
+// in plaintext.
+func (c *fileCodec) hasKey() bool {
+	return c != nil && c.aead != nil
+}
+
+// decode decrypts, then decompresses the file data.
+func (c *fileCodec) decode(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, encryptedMagic) {
+		if c == nil || c.aead == nil {
+			return nil, fmt.Errorf("encrypted email file, and no encryption key")
+		}
+		var err error
+		if data, err = c.open(data); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case bytes.HasPrefix(data, zstdMagic):
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// encodedAs returns true if the file data has the encoding of the codec.
+func (c *fileCodec) encodedAs(data []byte) (bool, error) {
+	encrypted := bytes.HasPrefix(data, encryptedMagic)
+	if encrypted != c.encrypt {
+		return false, nil
+	}
+	if encrypted {
+		var err error
+		if data, err = c.open(data); err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return c.compression == compressionGzip, nil
+	case bytes.HasPrefix(data, zstdMagic):
+		return c.compression == compressionZstd, nil
+	}
+	return c.compression == compressionNone, nil
+}
+
+// sealLine encrypts a line of the sidecar index, base64 encoded.
+func (c *fileCodec) sealLine(line []byte) ([]byte, error) {
+	if c == nil || !c.encrypt {
+		return line, nil
+	}
+	sealed, err := c.seal(line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openLine decrypts a line of the sidecar index written by sealLine. Plain JSON
+// lines are returned as is.
+func (c *fileCodec) openLine(line []byte) ([]byte, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(sealed, encryptedMagic) || c == nil || c.aead == nil {
+		return nil, fmt.Errorf("encrypted index line, and no encryption key")
+	}
+	return c.open(sealed)
+}
+
+// seal encrypts the data: the magic number, a random nonce and the ciphertext.
+func (c *fileCodec) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, encryptedMagic...), nonce...)
+	return c.aead.Seal(sealed, nonce, data, encryptedMagic), nil
+}
+
+// open decrypts and authenticates data sealed with seal.
+func (c *fileCodec) open(sealed []byte) ([]byte, error) {
+	sealed = sealed[len(encryptedMagic):]
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("truncated encrypted email file")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	data, err := c.aead.Open(nil, nonce, ciphertext, encryptedMagic)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt email file: %v", err)
+	}
+	return data, nil
+}
+
+// RecodeFilesystemFolder rewrites in place the email files of the FILESYSTEM
+// layer parameters with their compression and encryption, and returns the number
+// of rewritten files. The files are read whatever their encoding: a plain folder
+// can be compressed or encrypted, and an encrypted one decrypted with the "none"
+// encryption and its key. progress, if not nil, is called after each file.
+func RecodeFilesystemFolder(parameters map[string]string, progress func(done int, total int)) (int, error) {
+	s, err := newFilesystemStorageFromParameters(parameters)
+	if err != nil {
+		return 0, err
+	}
+	if s.filesystemType != FileStorageTypeEML {
+		return 0, fmt.Errorf("only the eml type can be compressed or encrypted")
+	}
+	if err := s.load(nil); err != nil {
+		return 0, err
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	files, err := s.scanEmailFiles()
+	if err != nil {
+		return 0, err
+	}
+	recoded := 0
+	var changes []indexEntry
+	for i, file := range files {
+		filename := filepath.Join(s.folder, filepath.FromSlash(file.path))
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return recoded, err
+		}
+		encoded, err := s.codec.encodedAs(data)
+		if err != nil {
+			return recoded, fmt.Errorf("%v: %v", file.path, err)
+		}
+		if !encoded {
+			raw, err := s.codec.decode(data)
+			if err == nil {
+				data, err = s.codec.encode(raw)
+			}
+			if err == nil {
+				err = writeFileAtomically(filename, data)
+			}
+			if err != nil {
+				return recoded, fmt.Errorf("%v: %v", file.path, err)
+			}
+			recoded++
+			if entry, ok := s.index.get(file.id); ok {
+				if info, err := os.Stat(filename); err == nil {
+					entry.Size, entry.ModTime = info.Size(), info.ModTime().UnixNano()
+					changes = append(changes, entry)
+				}
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(files))
+		}
+	}
+	if err := s.index.update(changes...); err != nil {
+		return recoded, err
+	}
+	// the index lines follow the encryption of the files
+	return recoded, s.index.save()
+}
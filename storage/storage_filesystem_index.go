@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// indexFilename is the sidecar index of a filesystem storage folder.
+const indexFilename = ".mock-my-mta.index"
+
+// indexEntry is a line of the sidecar index: the header metadata of an email file,
+// or the deletion of an email.
+type indexEntry struct {
+	ID      string       `json:"id"`
+	Path    string       `json:"path,omitempty"`   // slash-separated, relative to the folder
+	Offset  int64        `json:"offset,omitempty"` // mbox type: offset of the message in the file
+	Size    int64        `json:"size,omitempty"`
+	ModTime int64        `json:"mtime,omitempty"` // Unix nanoseconds
+	Header  *EmailHeader `json:"header,omitempty"`
+	Version int          `json:"v,omitempty"` // indexVersion of the header
+	Deleted bool         `json:"deleted,omitempty"`
+}
+
+// indexVersion is the version of the indexed headers: the entries of an older
+// version are parsed again by the next index refresh.
+//
+//	1: the mailboxes Sieve delivered the email to (DeliveredTo)
+const indexVersion = 1
+
+// header returns the header of the email. The emails written by other tools, or
+// before the receive times were indexed, were received when their file was written.
+func (e indexEntry) header() EmailHeader {
+	header := *e.Header
+	if header.ReceivedAt.IsZero() && e.ModTime != 0 {
+		header.ReceivedAt = time.Unix(0, e.ModTime).UTC()
+	}
+	return header
+}
+
+// matches returns true if the entry describes the file as it is on disk.
+func (e indexEntry) matches(file emailFile) bool {
+	return e.Path == file.path && e.Offset == file.offset && e.Size == file.size && e.ModTime == file.modTime
+}
+
+// movedTo returns true if the entry describes the same message of an mbox file,
+// at another offset.
+func (e indexEntry) movedTo(file emailFile) bool {
+	return e.Path == file.path && e.Offset != file.offset && e.Size == file.size && e.ModTime == file.modTime
+}
+
+// filesystemIndex is the sidecar index of a filesystem storage: one JSON line per
+// written or deleted email, appended by the writers holding the folder lock and
+// compacted when mostly made of stale lines.
+//
+// The email files remain the source of truth: the index is checked against the
+// folder on each listing, and rebuilt from the files when missing or corrupted.
+type filesystemIndex struct {
+	mu       sync.Mutex
+	filename string
+	loaded   bool
+	entries  map[string]indexEntry
+	lines    int        // lines in the file, live or stale
+	codec    *fileCodec // encrypts the lines when the email files are
+}
+
+func newFilesystemIndex(folder string) *filesystemIndex {
+	return &filesystemIndex{filename: filepath.Join(folder, indexFilename)}
+}
+
+// ensureLoaded reads the index file the first time. Must be called with the lock held.
+func (idx *filesystemIndex) ensureLoaded() {
+	if idx.loaded {
+		return
+	}
+	idx.loaded = true
+	idx.entries = make(map[string]indexEntry)
+	idx.lines = 0
+	data, err := os.ReadFile(idx.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Logf(log.WARNING, "cannot read index %v, rebuilding it: %v", idx.filename, err)
+		} else {
+			log.Logf(log.INFO, "no index %v, building it", idx.filename)
+		}
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		idx.lines++
+		var entry indexEntry
+		line, err := idx.codec.openLine(scanner.Bytes())
+		if err == nil {
+			err = json.Unmarshal(line, &entry)
+		}
+		if err != nil || entry.ID == "" {
+			// a torn write: the files will tell what the line was about
+			log.Logf(log.WARNING, "skipping invalid line %d of index %v", idx.lines, idx.filename)
+			continue
+		}
+		idx.applyEntry(entry)
+	}
+}
+
+// applyEntry updates the entries. Must be called with the lock held.
+func (idx *filesystemIndex) applyEntry(entry indexEntry) {
+	if entry.Deleted {
+		delete(idx.entries, entry.ID)
+	} else {
+		idx.entries[entry.ID] = entry
+	}
+}
+
+// get returns the entry of an email.
+func (idx *filesystemIndex) get(emailID string) (indexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	entry, ok := idx.entries[emailID]
+	return entry, ok
+}
+
+// snapshot returns a copy of the entries.
+func (idx *filesystemIndex) snapshot() map[string]indexEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	entries := make(map[string]indexEntry, len(idx.entries))
+	for id, entry := range idx.entries {
+		entries[id] = entry
+	}
+	return entries
+}
+
+// update applies the entries and saves them, appending them to the index file or
+// rewriting it when it is mostly made of stale lines. Must be called with the
+// folder lock held.
+func (idx *filesystemIndex) update(entries ...indexEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	for _, entry := range entries {
+		idx.applyEntry(entry)
+	}
+	if idx.lines+len(entries) > 2*len(idx.entries)+64 {
+		return idx.rewrite()
+	}
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		if err := idx.writeLine(&buffer, entry); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(idx.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := buffer.WriteTo(file); err != nil {
+		return err
+	}
+	idx.lines += len(entries)
+	return nil
+}
+
+// remember applies the entries without saving them.
+func (idx *filesystemIndex) remember(entries ...indexEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	for _, entry := range entries {
+		idx.applyEntry(entry)
+	}
+}
+
+// reset empties the index. Must be called with the folder lock held.
+func (idx *filesystemIndex) reset() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.loaded = true
+	idx.entries = make(map[string]indexEntry)
+	return idx.rewrite()
+}
+
+// rewrite saves the live entries to a new index file. Must be called with the lock held.
+func (idx *filesystemIndex) rewrite() error {
+	var buffer bytes.Buffer
+	for _, entry := range idx.entries {
+		if err := idx.writeLine(&buffer, entry); err != nil {
+			return err
+		}
+	}
+	tmpFilename := idx.filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, idx.filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	idx.lines = len(idx.entries)
+	return nil
+}
+
+// save rewrites the index file, with the current encryption. Must be called with
+// the folder lock held.
+func (idx *filesystemIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ensureLoaded()
+	return idx.rewrite()
+}
+
+// writeLine writes the JSON line of an entry, encrypted when the email files are.
+func (idx *filesystemIndex) writeLine(buffer *bytes.Buffer, entry indexEntry) error {
+	line, err := json.Marshal(entry)
+	if err == nil {
+		line, err = idx.codec.sealLine(line)
+	}
+	if err != nil {
+		return err
+	}
+	buffer.Write(line)
+	buffer.WriteByte('\n')
+	return nil
+}
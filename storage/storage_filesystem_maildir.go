@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Maildir folders of a filesystem storage of the maildir type.
+const (
+	maildirTmp = "tmp" // emails being delivered
+	maildirNew = "new" // emails not seen by a mail client yet
+	maildirCur = "cur" // emails with flags, in the info part of their name
+)
+
+// maildirInfoPrefix separates the unique name of a Maildir email from its flags.
+const maildirInfoPrefix = ":2,"
+
+// maildirFlagLetters maps the IMAP system flags onto the Maildir info letters.
+var maildirFlagLetters = map[string]byte{
+	`\Draft`:    'D',
+	`\Flagged`:  'F',
+	`\Answered`: 'R',
+	FlagSeen:    'S',
+	`\Deleted`:  'T',
+}
+
+// maildirFoldersNone and maildirFoldersRecipient are the values of the
+// maildir_folders parameter.
+const (
+	maildirFoldersNone      = "none"      // emails only in the Maildir
+	maildirFoldersRecipient = "recipient" // emails also in a Maildir++ subfolder per recipient
+)
+
+// setMaildirFolders sets the maildir_folders parameter of a maildir storage.
+func (s *filesystemStorage) setMaildirFolders(folders string) error {
+	switch folders {
+	case "", maildirFoldersNone:
+		s.maildirFolders = maildirFoldersNone
+	case maildirFoldersRecipient:
+		if s.filesystemType != FileStorageTypeMaildir {
+			return fmt.Errorf("the maildir_folders parameter requires the maildir type")
+		}
+		s.maildirFolders = maildirFoldersRecipient
+	default:
+		return fmt.Errorf("unknown maildir folders: %v", folders)
+	}
+	return nil
+}
+
+// maildirUnique returns the unique part of the Maildir filename of an email: the
+// email ID, escaping the characters a Maildir filename cannot hold.
+func maildirUnique(emailID string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F", ":", "%3A").Replace(emailID)
+}
+
+// parseMaildirFilename returns the email ID and the flags of a Maildir filename.
+func parseMaildirFilename(name string) (string, []string) {
+	unique, info, _ := strings.Cut(name, maildirInfoPrefix)
+	emailID := unique
+	if strings.Contains(unique, "%") {
+		if unescaped, err := url.PathUnescape(unique); err == nil {
+			emailID = unescaped
+		}
+	}
+	var flags []string
+	for flag, letter := range maildirFlagLetters {
+		if strings.IndexByte(info, letter) >= 0 {
+			flags = append(flags, flag)
+		}
+	}
+	sort.Strings(flags)
+	return emailID, flags
+}
+
+// maildirInfo returns the info part of the Maildir filename for the flags, the
+// letters in ASCII order. Keywords have no letter and are not kept.
+func maildirInfo(flags []string) string {
+	var letters []byte
+	for _, flag := range flags {
+		if letter, ok := maildirFlagLetters[canonicalFlag(flag)]; ok {
+			letters = append(letters, letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return maildirInfoPrefix + string(letters)
+}
+
+// maildirFolderName returns the Maildir++ subfolder of a recipient mailbox. Dots
+// separate the Maildir++ hierarchy levels, so they are replaced in the name.
+func maildirFolderName(mailbox string) string {
+	return "." + strings.NewReplacer(".", "_", "/", "_").Replace(strings.ToLower(mailbox))
+}
+
+// maildirs returns the Maildir of the storage and its Maildir++ subfolders,
+// relative to the folder.
+func (s *filesystemStorage) maildirs() []string {
+	maildirs := []string{"."}
+	entries, err := os.ReadDir(s.folder)
+	if err != nil {
+		return maildirs
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") && entry.Name() != "." && entry.Name() != ".." {
+			maildirs = append(maildirs, entry.Name())
+		}
+	}
+	return maildirs
+}
+
+// scanMaildirFiles lists the emails of the new and cur folders of the Maildir and
+// of its Maildir++ subfolders. With unique, an email in several folders is only
+// listed once, preferably from the Maildir itself.
+func (s *filesystemStorage) scanMaildirFiles(unique bool) ([]emailFile, error) {
+	seen := make(map[string]bool)
+	var files []emailFile
+	for _, maildir := range s.maildirs() {
+		for _, subfolder := range []string{maildirNew, maildirCur} {
+			entries, err := os.ReadDir(filepath.Join(s.folder, maildir, subfolder))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, entry := range entries {
+				name := entry.Name()
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+				info, ok := regularFileInfo(filepath.Join(s.folder, maildir, subfolder, name), entry)
+				if !ok || info.Size() == 0 {
+					continue // not a file, removed or still empty
+				}
+				emailID, _ := parseMaildirFilename(name)
+				if unique && seen[emailID] {
+					continue
+				}
+				seen[emailID] = true
+				files = append(files, emailFile{
+					id:      emailID,
+					path:    filepath.ToSlash(filepath.Join(maildir, subfolder, name)),
+					size:    info.Size(),
+					modTime: info.ModTime().UnixNano(),
+				})
+			}
+		}
+	}
+	return files, nil
+}
+
+// maildirCopies returns the files of an email, in the Maildir and its subfolders.
+func (s *filesystemStorage) maildirCopies(emailID string) []string {
+	unique := maildirUnique(emailID)
+	var copies []string
+	for _, maildir := range s.maildirs() {
+		if filename := filepath.Join(s.folder, maildir, maildirNew, unique); fileExists(filename) {
+			copies = append(copies, filename)
+		}
+		entries, err := os.ReadDir(filepath.Join(s.folder, maildir, maildirCur))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); name == unique || strings.HasPrefix(name, unique+maildirInfoPrefix) {
+				copies = append(copies, filepath.Join(s.folder, maildir, maildirCur, name))
+			}
+		}
+	}
+	return copies
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// deliverToRecipientFolders links the email delivered to the Maildir into the
+// Maildir++ subfolders of its recipients. Must be called with the folder lock held.
+func (s *filesystemStorage) deliverToRecipientFolders(emailID string, emailFilename string, header EmailHeader) error {
+	if s.maildirFolders != maildirFoldersRecipient {
+		return nil
+	}
+	folders := make(map[string]bool)
+	for _, address := range append(header.Tos, header.CCs...) {
+		if address.Address != "" {
+			folders[maildirFolderName(address.Address)] = true
+		}
+	}
+	for folder := range folders {
+		if err := createMaildir(filepath.Join(s.folder, folder), true); err != nil {
+			return err
+		}
+		target := filepath.Join(s.folder, folder, maildirNew, maildirUnique(emailID))
+		os.Remove(target)
+		if err := os.Link(emailFilename, target); err != nil {
+			// no hard links on this filesystem
+			if err := copyFile(emailFilename, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createMaildir creates the tmp, new and cur folders, and the marker file of a
+// Maildir++ subfolder.
+func createMaildir(maildir string, subfolder bool) error {
+	for _, folder := range []string{maildirTmp, maildirNew, maildirCur} {
+		if err := os.MkdirAll(filepath.Join(maildir, folder), 0755); err != nil {
+			return err
+		}
+	}
+	if subfolder {
+		marker, err := os.OpenFile(filepath.Join(maildir, "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		return marker.Close()
+	}
+	return nil
+}
+
+func copyFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// loadFlags returns the flags in the Maildir filenames of the emails.
+func (s *filesystemStorage) loadFlags() (map[string][]string, error) {
+	if s.filesystemType != FileStorageTypeMaildir {
+		return nil, newUnimplementedMethodInLayerError("loadFlags", "filesystemStorage")
+	}
+	entries, err := s.indexedEmails(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string][]string)
+	for _, entry := range entries {
+		if _, emailFlags := parseMaildirFilename(filepath.Base(entry.Path)); len(emailFlags) > 0 {
+			flags[entry.ID] = emailFlags
+		}
+	}
+	return flags, nil
+}
+
+// saveFlags renames the files of the email into the cur folders, with the flags
+// in the info part of their name.
+func (s *filesystemStorage) saveFlags(emailID string, flags []string) error {
+	if s.filesystemType != FileStorageTypeMaildir {
+		return newUnimplementedMethodInLayerError("saveFlags", "filesystemStorage")
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	copies := s.maildirCopies(emailID)
+	if len(copies) == 0 {
+		return newEmailNotFoundError("filesystem", emailID)
+	}
+	indexed, isIndexed := s.index.get(emailID)
+	name := maildirUnique(emailID) + maildirInfo(flags)
+	for _, filename := range copies {
+		maildir := filepath.Dir(filepath.Dir(filename))
+		target := filepath.Join(maildir, maildirCur, name)
+		if target == filename {
+			continue
+		}
+		if err := os.Rename(filename, target); err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(s.folder, filename)
+		if err != nil || !isIndexed || filepath.ToSlash(relativePath) != indexed.Path {
+			continue
+		}
+		relativeTarget, err := filepath.Rel(s.folder, target)
+		if err != nil {
+			continue
+		}
+		// a rename keeps the size and modification time
+		indexed.Path = filepath.ToSlash(relativeTarget)
+		if err := s.index.update(indexed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
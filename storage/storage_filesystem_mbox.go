@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mock-my-mta/log"
+	"mock-my-mta/storage/mbox"
+	"mock-my-mta/storage/multipart"
+)
+
+// mboxIDHeader is the header holding the email ID of the emails written to an
+// mbox file, removed when reading them.
+const mboxIDHeader = "X-Mock-My-MTA-ID"
+
+// mboxSingleFile is the mbox file of the single mode, and of the emails without
+// recipients in the mailbox mode.
+const mboxSingleFile = "mock-my-mta.mbox"
+
+// mboxFilesSingle and mboxFilesMailbox are the values of the mbox_files parameter.
+const (
+	mboxFilesSingle  = "single"  // all the emails in one mbox file
+	mboxFilesMailbox = "mailbox" // one mbox file per recipient mailbox
+)
+
+// setMboxFiles sets the mbox_files parameter of an mbox storage.
+func (s *filesystemStorage) setMboxFiles(files string) error {
+	switch files {
+	case "", mboxFilesSingle:
+		s.mboxFiles = mboxFilesSingle
+	case mboxFilesMailbox:
+		if s.filesystemType != FileStorageTypeMbox {
+			return fmt.Errorf("the mbox_files parameter requires the mbox type")
+		}
+		s.mboxFiles = mboxFilesMailbox
+	default:
+		return fmt.Errorf("unknown mbox files: %v", files)
+	}
+	return nil
+}
+
+// mboxTargets returns the mbox files an email is written to, relative to the folder.
+func (s *filesystemStorage) mboxTargets(header EmailHeader) []string {
+	if s.mboxFiles != mboxFilesMailbox {
+		return []string{mboxSingleFile}
+	}
+	seen := make(map[string]bool)
+	var targets []string
+	for _, address := range append(header.Tos, header.CCs...) {
+		if address.Address == "" {
+			continue
+		}
+		name := strings.ReplaceAll(strings.ToLower(address.Address), "/", "_") + ".mbox"
+		if !seen[name] {
+			seen[name] = true
+			targets = append(targets, name)
+		}
+	}
+	if len(targets) == 0 {
+		return []string{mboxSingleFile}
+	}
+	return targets
+}
+
+// mboxMessageID returns the email ID of an mbox message: the one written with it,
+// or one derived from its date and content for the messages of other tools.
+func mboxMessageID(raw []byte) string {
+	if value, ok := strings.CutPrefix(firstLine(raw), mboxIDHeader+": "); ok {
+		return value
+	}
+	date := time.Unix(0, 0)
+	if message, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if headerDate, err := message.Header.Date(); err == nil {
+			date = headerDate
+		}
+	}
+	sum := sha256.Sum256(raw)
+	return date.Format(time.RFC3339) + "-" + hex.EncodeToString(sum[:8])
+}
+
+func firstLine(raw []byte) string {
+	line, _, _ := bytes.Cut(raw, []byte("\n"))
+	return strings.TrimRight(string(line), "\r")
+}
+
+// withMboxIDHeader returns the email with the header holding its ID.
+func withMboxIDHeader(emailID string, raw []byte) []byte {
+	lineEnding := "\n"
+	if line, _, _ := bytes.Cut(raw, []byte("\n")); bytes.HasSuffix(line, []byte("\r")) {
+		lineEnding = "\r\n"
+	}
+	return append([]byte(mboxIDHeader+": "+emailID+lineEnding), raw...)
+}
+
+// withoutMboxIDHeader returns the email without the header holding its ID.
+func withoutMboxIDHeader(raw []byte) []byte {
+	if strings.HasPrefix(firstLine(raw), mboxIDHeader+": ") {
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			return raw[i+1:]
+		}
+	}
+	return raw
+}
+
+// mboxFilenames returns the mbox files of the folder.
+func (s *filesystemStorage) mboxFilenames() ([]string, error) {
+	entries, err := os.ReadDir(s.folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // not created yet
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, FileStorageTypeMbox.GetFileSuffix()) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, ok := regularFileInfo(filepath.Join(s.folder, name), entry); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// scanMboxFiles lists the messages of the mbox files of the folder. With unique,
+// an email in several files is only listed once. The messages have no
+// modification time: appending to a file does not change the others.
+func (s *filesystemStorage) scanMboxFiles(unique bool) ([]emailFile, error) {
+	names, err := s.mboxFilenames()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var files []emailFile
+	for _, name := range names {
+		err := readMboxFile(filepath.Join(s.folder, name), func(message *mbox.Message) {
+			emailID := mboxMessageID(message.Raw)
+			if unique && seen[emailID] {
+				return
+			}
+			seen[emailID] = true
+			files = append(files, emailFile{id: emailID, path: name, offset: message.Offset, size: message.Size})
+		})
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed meanwhile
+			}
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// readMboxFile calls fn with each message of the mbox file.
+func readMboxFile(filename string, fn func(message *mbox.Message)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := mbox.NewReader(file)
+	for {
+		message, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(message)
+	}
+}
+
+// readMboxEmail returns the email at the indexed position of its mbox file,
+// rescanning the files when it moved.
+func (s *filesystemStorage) readMboxEmail(emailID string) ([]byte, error) {
+	entry, ok := s.index.get(emailID)
+	if ok {
+		if raw, err := s.readMboxMessage(emailFile{id: emailID, path: entry.Path, offset: entry.Offset, size: entry.Size}); err == nil {
+			return raw, nil
+		}
+	}
+	// written by another process, or moved by the removal of another email
+	if err := s.refreshIndex(context.Background(), false); err != nil {
+		return nil, err
+	}
+	if entry, ok = s.index.get(emailID); !ok {
+		return nil, newEmailNotFoundError("filesystem", emailID)
+	}
+	return s.readMboxMessage(emailFile{id: emailID, path: entry.Path, offset: entry.Offset, size: entry.Size})
+}
+
+// readMboxMessage reads a message of an mbox file, checking that it is the email.
+func (s *filesystemStorage) readMboxMessage(message emailFile) ([]byte, error) {
+	file, err := os.Open(filepath.Join(s.folder, message.path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newEmailNotFoundError("filesystem", message.id)
+		}
+		return nil, err
+	}
+	defer file.Close()
+	quoted := make([]byte, message.size)
+	if _, err := file.ReadAt(quoted, message.offset); err != nil {
+		return nil, err
+	}
+	raw := mbox.Unquote(quoted)
+	if emailID := mboxMessageID(raw); emailID != message.id {
+		return nil, fmt.Errorf("found email %v instead of %v in %v", emailID, message.id, message.path)
+	}
+	return withoutMboxIDHeader(raw), nil
+}
+
+// parseMboxMessage parses a message of an mbox file.
+func (s *filesystemStorage) parseMboxMessage(message emailFile) (*multipart.Multipart, error) {
+	raw, err := s.readMboxMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse email %v: %v", message.id, err)
+	}
+	return mp, nil
+}
+
+// appendMboxEmail appends the email to its mbox files, replacing a previous email
+// with the same ID. Must be called with the folder lock held.
+func (s *filesystemStorage) appendMboxEmail(emailID string, rawEmail []byte, header EmailHeader) error {
+	if _, err := s.removeMboxEmail(emailID); err != nil {
+		return err
+	}
+	fromLine := mbox.FromLine(rawEmail)
+	content := mbox.Quote(withMboxIDHeader(emailID, rawEmail))
+	var entry indexEntry
+	for i, name := range s.mboxTargets(header) {
+		offset, err := appendMboxMessage(filepath.Join(s.folder, name), fromLine, content)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			entry = indexEntry{ID: emailID, Path: name, Offset: offset, Size: int64(len(content)), Header: &header, Version: indexVersion}
+		}
+	}
+	return s.index.update(entry)
+}
+
+// appendMboxMessage appends a message to an mbox file, synced to disk, and
+// returns the offset of its content.
+func appendMboxMessage(filename string, fromLine string, content []byte) (int64, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var buffer bytes.Buffer
+	if size := info.Size(); size > 0 {
+		// a message is separated from the previous one by a blank line
+		end := make([]byte, min(size, 2))
+		if _, err := file.ReadAt(end, size-int64(len(end))); err != nil {
+			return 0, err
+		}
+		if !bytes.HasSuffix(end, []byte("\n")) {
+			buffer.WriteString("\n\n")
+		} else if !bytes.Equal(end, []byte("\n\n")) {
+			buffer.WriteString("\n")
+		}
+	}
+	buffer.WriteString(fromLine)
+	offset := info.Size() + int64(buffer.Len())
+	buffer.Write(content)
+	buffer.WriteByte('\n')
+	if _, err := buffer.WriteTo(file); err != nil {
+		return 0, err
+	}
+	return offset, file.Sync()
+}
+
+// removeMboxEmail rewrites the mbox files holding the email without it, and
+// returns true if there was one. Must be called with the folder lock held.
+func (s *filesystemStorage) removeMboxEmail(emailID string) (bool, error) {
+	names, err := s.mboxFilenames()
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, name := range names {
+		filename := filepath.Join(s.folder, name)
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return removed, err
+		}
+		var kept bytes.Buffer
+		last := int64(0) // end of the data already kept
+		found := false
+		reader := mbox.NewReader(bytes.NewReader(data))
+		for {
+			message, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return removed, err
+			}
+			if mboxMessageID(message.Raw) == emailID {
+				kept.Write(data[last:message.Start])
+				last = message.End
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		kept.Write(data[last:])
+		log.Logf(log.DEBUG, "removing email %v from %v", emailID, filename)
+		if err := writeFileAtomically(filename, kept.Bytes()); err != nil {
+			return removed, err
+		}
+		removed = true
+	}
+	if removed {
+		// the following emails moved
+		if err := s.index.update(indexEntry{ID: emailID, Deleted: true}); err != nil {
+			return removed, err
+		}
+		return removed, s.refreshIndex(context.Background(), true)
+	}
+	return removed, nil
+}
+
+// writeFileAtomically replaces the file by a temporary file, synced to disk.
+func writeFileAtomically(filename string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpFilename := file.Name()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
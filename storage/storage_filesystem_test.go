@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 // test that we can create a new storage layer
@@ -166,3 +171,594 @@ func TestMailhogStorage(t *testing.T) {
 		}
 	}
 }
+
+func TestFilesystemAtomicWrite(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.setWithID("simple-email", []byte(simpleEmail)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := storage.setWithID("invalid-email", []byte("not an email")); err == nil {
+		t.Errorf("expected an error for an invalid email")
+	}
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	// no temporary file left behind, no file for the invalid email
+	if len(names) != 3 || names[0] != indexFilename || names[1] != lockFilename || names[2] != "simple-email.eml" {
+		t.Errorf("unexpected files %v", names)
+	}
+}
+
+func TestFilesystemSkipsHalfWrittenFiles(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.setWithID("simple-email", []byte(simpleEmail)); err != nil {
+		t.Fatal(err)
+	}
+	// files dropped by another process: being created, being written, temporary
+	files := map[string]string{
+		"empty.eml":            "",
+		"truncated.eml":        "From: from@example.com\nSubj",
+		".other-email.123.tmp": simpleEmail,
+		"directory.eml" + string(os.PathSeparator) + "x": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(folder, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := storage.getAllEmailIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "simple-email" {
+		t.Errorf("unexpected email IDs %v", ids)
+	}
+	emails, total, err := storage.SearchEmails("", 1, -1)
+	if err != nil {
+		t.Fatalf("expected the unreadable emails to be skipped, got %v", err)
+	}
+	if total != 1 || emails[0].ID != "simple-email" {
+		t.Errorf("unexpected search result %v", emails)
+	}
+	if _, err := storage.GetMailboxes(); err != nil {
+		t.Errorf("expected the unreadable emails to be skipped, got %v", err)
+	}
+}
+
+func TestFilesystemFollowsSymlinks(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// emails linked from another folder, and a dangling link
+	target := filepath.Join(t.TempDir(), "linked-email.eml")
+	if err := os.WriteFile(target, []byte(simpleEmail), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(folder, "linked-email.eml")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(folder, "missing.eml"), filepath.Join(folder, "dangling.eml")); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := storage.getAllEmailIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "linked-email" {
+		t.Errorf("expected the linked email only, got %v", ids)
+	}
+	if _, err := storage.GetEmailByID("linked-email"); err != nil {
+		t.Errorf("expected the linked email to be read, got %v", err)
+	}
+}
+
+func TestFilesystemFolderLock(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another process holding the folder lock
+	lock, err := os.OpenFile(filepath.Join(folder, lockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- storage.setWithID("simple-email", []byte(simpleEmail))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the write to wait for the lock, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := unlockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the write to complete once the lock is released")
+	}
+}
+
+func TestFilesystemDateLayout(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorageWithLayout(folder, "eml", "date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := storage.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(folder, "2024", "01", "01", "email-1.eml")); err != nil {
+		t.Errorf("expected the email in its date folder, got %v", err)
+	}
+	header, err := storage.GetEmailByID("email-2")
+	if err != nil || header.Subject != "email 2" {
+		t.Errorf("unexpected header %+v, %v", header, err)
+	}
+	emails, total, err := storage.SearchEmails("", 1, 2)
+	if err != nil || total != 3 || len(emails) != 2 || emails[0].ID != "email-3" {
+		t.Errorf("unexpected listing %v (total %v), %v", emails, total, err)
+	}
+	mailboxes, err := storage.GetMailboxes()
+	if err != nil || len(mailboxes) != 3 {
+		t.Errorf("unexpected mailboxes %v, %v", mailboxes, err)
+	}
+
+	// the date folders are removed with their last email
+	if err := storage.DeleteAllEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "2024")); !os.IsNotExist(err) {
+		t.Errorf("expected the empty date folders to be removed, got %v", err)
+	}
+
+	if _, err := newFilesystemStorageWithLayout(folder, "eml", "weekly"); err == nil {
+		t.Errorf("expected an error for an unknown layout")
+	}
+}
+
+func TestFilesystemIndex(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := storage.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.DeleteEmailByID("email-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an indexed email is listed without being parsed: replace it with garbage of
+	// the same size and modification time
+	emailFile := filepath.Join(folder, "email-1.eml")
+	info, err := os.Stat(emailFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(emailFile, bytes.Repeat([]byte("x"), int(info.Size())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(emailFile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails, total, err := reopened.SearchEmails("", 1, -1)
+	if err != nil || total != 2 || emails[1].Subject != "email 1" {
+		t.Fatalf("expected the emails from the index, got %v (total %v), %v", emails, total, err)
+	}
+	// and so are the header-only queries
+	emails, total, err = reopened.SearchEmails("subject:\"email 1\" mailbox:rcpt1@example.com", 1, -1)
+	if err != nil || total != 1 || emails[0].ID != "email-1" {
+		t.Fatalf("expected the email matched on the index, got %v (total %v), %v", emails, total, err)
+	}
+
+	// files dropped or removed behind the back of the storage
+	if err := os.WriteFile(filepath.Join(folder, "dropped.eml"), memoryTestEmail(4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(folder, "email-2.eml")); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := reopened.getAllEmailIDs()
+	sort.Strings(ids)
+	if err != nil || len(ids) != 2 || ids[0] != "dropped" || ids[1] != "email-1" {
+		t.Errorf("unexpected email IDs %v, %v", ids, err)
+	}
+
+	// a missing index is rebuilt from the files, a torn line is skipped
+	if err := os.WriteFile(filepath.Join(folder, indexFilename), []byte("{\"id\":\"dropped\",\"pa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailboxes, err := rebuilt.GetMailboxes()
+	if err != nil || len(mailboxes) != 1 || mailboxes[0].Name != "rcpt4@example.com" {
+		t.Errorf("expected the mailbox of the dropped email only, got %v, %v", mailboxes, err)
+	}
+}
+
+func TestFilesystemIndexUpgrade(t *testing.T) {
+	for _, filesystemType := range []string{"eml", "mbox"} {
+		t.Run(filesystemType, func(t *testing.T) {
+			folder := t.TempDir()
+			storage, err := newFilesystemStorage(folder, filesystemType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.setWithID("redirected", sieveTestEmail); err != nil {
+				t.Fatal(err)
+			}
+
+			// an index written before the delivery mailboxes were indexed
+			index, err := os.ReadFile(filepath.Join(folder, indexFilename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var older bytes.Buffer
+			for _, line := range bytes.Split(bytes.TrimSpace(index), []byte("\n")) {
+				var entry indexEntry
+				if err := json.Unmarshal(line, &entry); err != nil {
+					t.Fatal(err)
+				}
+				entry.Version = 0
+				entry.Header.DeliveredTo = nil
+				data, _ := json.Marshal(entry)
+				older.Write(append(data, '\n'))
+			}
+			if err := os.WriteFile(filepath.Join(folder, indexFilename), older.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := newFilesystemStorage(folder, filesystemType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened.watching = true
+			emails, total, err := reopened.SearchEmails("mailbox:carol@example.com", 1, -1)
+			if err != nil || total != 1 || emails[0].ID != "redirected" {
+				t.Errorf("expected the older entry to be parsed again, got %v, %v, %v", emails, total, err)
+			}
+			if len(reopened.changes) != 0 {
+				t.Errorf("expected no external change, got %v", reopened.changes)
+			}
+			entry, ok := reopened.index.get("redirected")
+			if !ok || entry.Version != indexVersion {
+				t.Errorf("expected the entry to be upgraded, got %+v", entry)
+			}
+			if raw, err := reopened.GetRawEmail("redirected"); err != nil || !bytes.Equal(raw, sieveTestEmail) {
+				t.Errorf("unexpected raw email %q, %v", raw, err)
+			}
+		})
+	}
+}
+
+func TestMaildirStorage(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.setMaildirFolders("recipient"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, subfolder := range []string{"tmp", "new", "cur"} {
+		if info, err := os.Stat(filepath.Join(folder, subfolder)); err != nil || !info.IsDir() {
+			t.Errorf("expected the %v folder to be created, got %v", subfolder, err)
+		}
+	}
+	if err := storage.setWithID("2024-01-01T10:00:01Z-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	unique := "2024-01-01T10%3A00%3A01Z-1"
+	if _, err := os.Stat(filepath.Join(folder, "new", unique)); err != nil {
+		t.Errorf("expected the email in the new folder, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, ".rcpt1@example_com", "new", unique)); err != nil {
+		t.Errorf("expected the email in the recipient folder, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(folder, "tmp")); len(entries) != 0 {
+		t.Errorf("expected no leftover in the tmp folder, got %v", entries)
+	}
+	header, err := storage.GetEmailByID("2024-01-01T10:00:01Z-1")
+	if err != nil || header.Subject != "email 1" {
+		t.Errorf("unexpected header %+v, %v", header, err)
+	}
+	_, total, err := storage.SearchEmails("", 1, 10)
+	if err != nil || total != 1 {
+		t.Errorf("expected the email to be listed once, got %v, %v", total, err)
+	}
+
+	// the flags are kept in the info part of the filenames
+	if err := storage.saveFlags("2024-01-01T10:00:01Z-1", []string{FlagSeen, `\Flagged`, "$Important"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, maildir := range []string{".", ".rcpt1@example_com"} {
+		if _, err := os.Stat(filepath.Join(folder, maildir, "cur", unique+":2,FS")); err != nil {
+			t.Errorf("expected the email to move to %v/cur, got %v", maildir, err)
+		}
+	}
+	if _, err := storage.GetRawEmail("2024-01-01T10:00:01Z-1"); err != nil {
+		t.Errorf("expected the moved email to be readable, got %v", err)
+	}
+
+	// emails dropped by a mail client are imported with their flags
+	raw := memoryTestEmail(2)
+	if err := os.WriteFile(filepath.Join(folder, "cur", "external:2,RS"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := newFilesystemStorage(folder, "maildir")
+	if err := reloaded.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := reloaded.loadFlags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"2024-01-01T10:00:01Z-1": {`\Flagged`, FlagSeen},
+		"external":               {`\Answered`, FlagSeen},
+	}
+	if fmt.Sprint(flags) != fmt.Sprint(expected) {
+		t.Errorf("expected flags %v, got %v", expected, flags)
+	}
+
+	if err := reloaded.DeleteEmailByID("2024-01-01T10:00:01Z-1"); err != nil {
+		t.Fatal(err)
+	}
+	if copies := reloaded.maildirCopies("2024-01-01T10:00:01Z-1"); len(copies) != 0 {
+		t.Errorf("expected every copy to be deleted, got %v", copies)
+	}
+	if err := reloaded.DeleteAllEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "cur")); err != nil {
+		t.Errorf("expected the Maildir folders to be kept, got %v", err)
+	}
+
+	if _, err := newFilesystemStorageWithLayout(folder, "maildir", "date"); err == nil {
+		t.Errorf("expected an error for the date layout of a Maildir")
+	}
+	eml, _ := newFilesystemStorage(folder, "eml")
+	if err := eml.setMaildirFolders("recipient"); err == nil {
+		t.Errorf("expected an error for recipient folders outside of a Maildir")
+	}
+}
+
+func TestMboxStorage(t *testing.T) {
+	folder := t.TempDir()
+	storage, err := newFilesystemStorage(folder, "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.setMboxFiles("mailbox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	quoting := []byte("From: sender@example.com\r\nTo: rcpt1@example.com\r\nSubject: quoting\r\nDate: Mon, 01 Jan 2024 11:00:00 +0000\r\n\r\nFrom the start\r\n>From quoted\r\n")
+	emails := map[string][]byte{
+		"email-1": memoryTestEmail(1),
+		"email-2": memoryTestEmail(2),
+		"email-3": quoting,
+	}
+	for _, id := range []string{"email-1", "email-2", "email-3"} {
+		if err := storage.setWithID(id, emails[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(folder, "rcpt1@example.com.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "From sender@example.com Mon Jan  1 10:00:01 2024\n") || !strings.Contains(string(data), "\r\n>From the start\r\n>>From quoted\r\n") {
+		t.Errorf("unexpected mbox file %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "rcpt2@example.com.mbox")); err != nil {
+		t.Errorf("expected an mbox file per mailbox, got %v", err)
+	}
+	for id, expected := range emails {
+		raw, err := storage.GetRawEmail(id)
+		if err != nil || !bytes.Equal(raw, expected) {
+			t.Errorf("%v: expected %q, got %q, %v", id, expected, raw, err)
+		}
+	}
+
+	// the emails following a deleted one move in the file
+	if err := storage.DeleteEmailByID("email-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteEmailByID("email-1"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	header, err := storage.GetEmailByID("email-3")
+	if err != nil || header.Subject != "quoting" {
+		t.Errorf("unexpected header %+v, %v", header, err)
+	}
+
+	// the mbox files of other tools are read, with IDs derived from the emails
+	external := "From someone@example.com Tue Jan  2 10:00:00 2024\nFrom: someone@example.com\nSubject: external\nDate: Tue, 02 Jan 2024 10:00:00 +0000\n\nHello\n\n"
+	if err := os.WriteFile(filepath.Join(folder, "archive.mbox"), []byte(external), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := newFilesystemStorage(folder, "mbox")
+	if err := reloaded.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	headers, total, err := reloaded.SearchEmails("", 1, 10)
+	if err != nil || total != 3 || headers[0].Subject != "external" || !strings.HasPrefix(headers[0].ID, "2024-01-02T10:00:00Z-") {
+		t.Errorf("unexpected listing %+v (total %v), %v", headers, total, err)
+	}
+
+	if err := reloaded.DeleteAllEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := reloaded.scanMboxFiles(false); len(files) != 0 {
+		t.Errorf("expected no email left, got %v", files)
+	}
+	if _, err := newFilesystemStorageWithLayout(folder, "mbox", "date"); err == nil {
+		t.Errorf("expected an error for the date layout of an mbox")
+	}
+}
+
+func TestFilesystemCodec(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		codec, err := newFileCodec(compression, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := codec.encode(memoryTestEmail(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := codec.decode(encoded); err != nil || !bytes.Equal(decoded, memoryTestEmail(1)) {
+			t.Errorf("%v: unexpected decoded email %q, %v", compression, decoded, err)
+		}
+	}
+	if _, err := newFileCodec("lz4", "", "", ""); err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+	if _, err := newFileCodec("", "aes-256-gcm", "", ""); err == nil {
+		t.Errorf("expected an error for an encryption without key")
+	}
+	t.Setenv("TEST_STORAGE_KEY", "short")
+	if _, err := newFileCodec("", "", "", "TEST_STORAGE_KEY"); err == nil {
+		t.Errorf("expected an error for an invalid key")
+	}
+}
+
+func TestFilesystemEncryptedFolder(t *testing.T) {
+	folder := t.TempDir()
+	plain, err := newFilesystemStorage(folder, "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := plain.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the existing files are encrypted in place
+	t.Setenv("TEST_STORAGE_KEY", strings.Repeat("0123456789abcdef", 4))
+	parameters := map[string]string{"folder": folder, "type": "eml", "compression": "zstd", "encryption_key_env": "TEST_STORAGE_KEY"}
+	recoded, err := RecodeFilesystemFolder(parameters, nil)
+	if err != nil || recoded != 3 {
+		t.Fatalf("expected 3 files to be rewritten, got %v, %v", recoded, err)
+	}
+	if recoded, err := RecodeFilesystemFolder(parameters, nil); err != nil || recoded != 0 {
+		t.Errorf("expected the encoded files to be kept, got %v, %v", recoded, err)
+	}
+	data, err := os.ReadFile(filepath.Join(folder, "email-1.eml"))
+	if err != nil || !bytes.HasPrefix(data, encryptedMagic) {
+		t.Errorf("expected an encrypted file, got %q, %v", data, err)
+	}
+	index, err := os.ReadFile(filepath.Join(folder, indexFilename))
+	if err != nil || bytes.Contains(index, []byte("rcpt1@example.com")) {
+		t.Errorf("expected an encrypted index, got %q, %v", index, err)
+	}
+
+	encrypted, err := newFilesystemStorageFromParameters(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.setWithID("email-4", memoryTestEmail(4)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		raw, err := encrypted.GetRawEmail(fmt.Sprintf("email-%d", i))
+		if err != nil || !bytes.Equal(raw, memoryTestEmail(i)) {
+			t.Errorf("email-%d: unexpected raw email %q, %v", i, raw, err)
+		}
+	}
+	emails, total, err := encrypted.SearchEmails("subject:\"email 4\"", 1, 10)
+	if err != nil || total != 1 || emails[0].ID != "email-4" {
+		t.Errorf("unexpected search result %v (total %v), %v", emails, total, err)
+	}
+	if _, err := plain.GetRawEmail("email-4"); err == nil {
+		t.Errorf("expected an error reading an encrypted email without key")
+	}
+	// the attachments are decoded to sealed temporary files
+	if err := encrypted.setWithID("invoice", invoiceEmail(0)); err != nil {
+		t.Fatal(err)
+	}
+	header, content, err := encrypted.OpenAttachment("invoice", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spooled, ok := content.(*tempContent); !ok || spooled.cipher == nil {
+		t.Errorf("expected a sealed attachment, got %T", content)
+	}
+	if data, _ := readContent(t, content, 0); header.Hash != invoiceHash || fmt.Sprintf("%x", sha256.Sum256(data)) != invoiceHash {
+		t.Errorf("unexpected attachment %+v", header)
+	}
+	if err := encrypted.DeleteEmailByID("invoice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// and decrypted back with the key
+	parameters["compression"], parameters["encryption"] = "none", "none"
+	if recoded, err := RecodeFilesystemFolder(parameters, nil); err != nil || recoded != 4 {
+		t.Errorf("expected 4 files to be decrypted, got %v, %v", recoded, err)
+	}
+	if raw, err := os.ReadFile(filepath.Join(folder, "email-4.eml")); err != nil || !bytes.Equal(raw, memoryTestEmail(4)) {
+		t.Errorf("expected a plain file, got %q, %v", raw, err)
+	}
+
+	if _, err := newFilesystemStorageFromParameters(map[string]string{"folder": folder, "type": "maildir", "compression": "gzip"}); err == nil {
+		t.Errorf("expected an error for a compressed Maildir")
+	}
+}
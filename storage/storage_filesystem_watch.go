@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// fileChangeKind is the kind of change made to the folder by another tool.
+type fileChangeKind int
+
+const (
+	fileCreated fileChangeKind = iota
+	fileModified
+	fileDeleted
+)
+
+// fileChange is an email file created, modified or removed by another tool
+// than this storage, as found by the index refreshes.
+type fileChange struct {
+	emailID string
+	kind    fileChangeKind
+	entry   indexEntry // the new index entry of a created or modified file
+}
+
+// setWatchInterval sets the polling interval of the watcher from the "watch"
+// parameter: a duration, or empty for no watcher.
+func (s *filesystemStorage) setWatchInterval(value string) error {
+	if value == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid watch interval %q for FILESYSTEM storage", value)
+	}
+	s.watchInterval = interval
+	return nil
+}
+
+// external keeps the changes found by an index refresh that the storage did not
+// make itself meanwhile. Must be called with the folder lock held, before the
+// index is updated.
+func (s *filesystemStorage) external(changes []fileChange) []fileChange {
+	var external []fileChange
+	for _, change := range changes {
+		current, indexed := s.index.get(change.emailID)
+		if change.kind == fileDeleted {
+			if indexed {
+				external = append(external, change)
+			}
+			continue
+		}
+		if indexed && current.Path == change.entry.Path && current.Size == change.entry.Size && current.ModTime == change.entry.ModTime {
+			continue // written by this storage since the folder was scanned
+		}
+		external = append(external, change)
+	}
+	return external
+}
+
+// recordChanges keeps the external changes for the watcher, if any.
+func (s *filesystemStorage) recordChanges(changes []fileChange) {
+	if len(changes) == 0 {
+		return
+	}
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if s.watching {
+		s.changes = append(s.changes, changes...)
+	}
+}
+
+// watch polls the folder until the context is done, notifying the changes made
+// by other tools: dropped or removed email files. The changes found by the other
+// listings of the folder are notified at the next poll.
+func (s *filesystemStorage) watch(ctx context.Context, notify func([]fileChange)) {
+	s.watchMu.Lock()
+	s.watching = true
+	s.watchMu.Unlock()
+	log.Logf(log.INFO, "watching folder %v every %v", s.folder, s.watchInterval)
+
+	ticker := time.NewTicker(s.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.refreshIndex(ctx, false); err != nil && ctx.Err() == nil {
+			log.Logf(log.WARNING, "cannot watch folder %v: %v", s.folder, err)
+		}
+		s.watchMu.Lock()
+		changes := s.changes
+		s.changes = nil
+		s.watchMu.Unlock()
+		if len(changes) > 0 {
+			notify(changes)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEngineWatchFilesystem(t *testing.T) {
+	folder := t.TempDir()
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead, ScopeSearch, ScopeCache}},
+		{Type: "FILESYSTEM", Scope: []string{ScopeAll}, Parameters: map[string]string{"folder": folder, "type": "eml", "watch": "10ms"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	memory := engine.allLayers[0]
+	created, deleted := make(chan string, 10), make(chan string, 10)
+	engine.SetOnNewEmail(func(emailID string) { created <- emailID })
+	engine.SetOnDeleteEmail(func(emailID string) { deleted <- emailID })
+	wait := func(events chan string, expected string) {
+		t.Helper()
+		select {
+		case emailID := <-events:
+			if emailID != expected {
+				t.Fatalf("expected an event for %v, got %v", expected, emailID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event for %v", expected)
+		}
+	}
+
+	// dropped into the folder by another tool
+	if err := os.WriteFile(filepath.Join(folder, "dropped.eml"), memoryTestEmail(1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wait(created, "dropped")
+	if !holds(memory, "dropped") {
+		t.Error("expected the dropped email in the memory layer")
+	}
+
+	// modified by another tool: propagated, without event
+	modified := filepath.Join(folder, "dropped.eml")
+	if err := os.WriteFile(modified, memoryTestEmail(2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(modified, later, later)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if header, err := memory.GetEmailByID("dropped"); err == nil && header.Subject == "email 2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the modified email in the memory layer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// written through the engine: no event
+	if err := engine.setWithID("email-3", memoryTestEmail(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(folder, "dropped.eml")); err != nil {
+		t.Fatal(err)
+	}
+	wait(deleted, "dropped")
+	if holds(memory, "dropped") {
+		t.Error("expected the removed email deleted from the memory layer")
+	}
+	select {
+	case emailID := <-created:
+		t.Errorf("unexpected event for %v", emailID)
+	default:
+	}
+}
+
+func TestFilesystemWatchParameter(t *testing.T) {
+	for _, value := range []string{"often", "0s", "-1s"} {
+		_, err := newFilesystemStorageFromParameters(map[string]string{"folder": t.TempDir(), "type": "eml", "watch": value})
+		if err == nil {
+			t.Errorf("expected an error for the watch interval %q", value)
+		}
+	}
+}
+
+func TestFilesystemRefreshDuringWrites(t *testing.T) {
+	storage, err := newFilesystemStorage(t.TempDir(), "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	storage.watching = true
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if err := storage.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+		if err := storage.refreshIndex(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the emails written meanwhile are neither unindexed nor notified
+	if ids, err := storage.getAllEmailIDs(); err != nil || len(ids) != 50 {
+		t.Errorf("expected the 50 emails indexed, got %d, %v", len(ids), err)
+	}
+	for _, change := range storage.changes {
+		t.Errorf("unexpected external change %+v", change)
+	}
+}
@@ -2,12 +2,16 @@ package storage
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"net/mail"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"mock-my-mta/log"
 	"mock-my-mta/storage/matcher"
@@ -19,13 +23,59 @@ import (
 // so that reads don't require re-parsing .eml files from disk.
 //
 // Volatile: all data is lost on restart and rebuilt via load(rootStorage).
+//
+// By default every email of the root storage is loaded at startup. A bounded
+// memory storage (max_emails, max_size or headers_only parameters) instead fills
+// itself on read misses from the root storage and evicts the least recently used
+// emails; it leaves searches to the next layers since it only holds a subset.
+//
+// The entries are guarded by mu, held for writing only by the changes: reads hold
+// it for reading, with lruMu to move the entries they use to the front.
 type memoryStorage struct {
-	mu          sync.RWMutex
-	headers     map[string]EmailHeader
-	bodies      map[string]map[EmailVersionType]string
-	attachments map[string][]AttachmentHeader
-	attachment  map[string]Attachment // keyed by "emailID/attachmentID"
-	rawEmails   map[string][]byte     // raw .eml bytes (for root mode or raw scope)
+	mu        sync.RWMutex
+	entries   map[string]*list.Element // values are *memoryEntry
+	lru       *list.List               // most recently used first
+	lruMu     sync.Mutex               // guards lru, hits and misses under a read lock
+	size      int64                    // approximate bytes held by the entries and blobs
+	blobs     *blobStore               // decoded attachments, shared across the entries
+	deletions uint64                   // incremented by each deletion, see lookup
+
+	maxEmails   int     // 0 = unbounded
+	maxSize     int64   // bytes, 0 = unbounded
+	headersOnly bool    // bodies, attachments and raw emails are left to the next layers
+	root        Storage // fills the read misses of a bounded storage
+
+	hits, misses, evictions uint64
+}
+
+// memoryEntry holds the cached data of one email.
+type memoryEntry struct {
+	id          string
+	header      EmailHeader
+	bodies      map[EmailVersionType]string
+	attachments []AttachmentHeader
+	attachment  map[string]Attachment // keyed by attachment ID, data shared in the blob store
+	raw         []rawSegment          // raw .eml bytes, the attachment encodings shared in the blob store
+	size        int64
+}
+
+// rawEmail returns the raw bytes of the email, with the attachment encodings of
+// the blob store.
+func (e *memoryEntry) rawEmail() []byte {
+	return joinRawEmail(e.raw)
+}
+
+// CacheStats reports the usage of a memory storage layer.
+type CacheStats struct {
+	Emails      int    `json:"emails"`
+	Size        int64  `json:"size"`
+	MaxEmails   int    `json:"max_emails,omitempty"`
+	MaxSize     int64  `json:"max_size,omitempty"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
+	Attachments int    `json:"attachments"` // distinct decoded attachments held
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
 }
 
 // memoryStorage implements the storageLayer interface
@@ -34,19 +84,91 @@ var _ storageLayer = &memoryStorage{}
 func newMemoryStorage() (*memoryStorage, error) {
 	log.Logf(log.INFO, "using memory storage")
 	return &memoryStorage{
-		headers:     make(map[string]EmailHeader),
-		bodies:      make(map[string]map[EmailVersionType]string),
-		attachments: make(map[string][]AttachmentHeader),
-		attachment:  make(map[string]Attachment),
-		rawEmails:   make(map[string][]byte),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		blobs:   newBlobStore(),
 	}, nil
 }
 
+// newBoundedMemoryStorage returns a memory storage filled on demand, holding at
+// most maxEmails emails and maxSize bytes (0 for no limit).
+func newBoundedMemoryStorage(maxEmails int, maxSize int64, headersOnly bool) (*memoryStorage, error) {
+	log.Logf(log.INFO, "using bounded memory storage (max_emails=%v, max_size=%v, headers_only=%v)", maxEmails, maxSize, headersOnly)
+	return &memoryStorage{
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		blobs:       newBlobStore(),
+		maxEmails:   maxEmails,
+		maxSize:     maxSize,
+		headersOnly: headersOnly,
+	}, nil
+}
+
+// newMemoryStorageFromParameters creates a memory storage from the layer parameters.
+func newMemoryStorageFromParameters(parameters map[string]string) (*memoryStorage, error) {
+	var maxEmails int
+	var maxSize int64
+	var headersOnly bool
+	var err error
+	if value, ok := parameters["max_emails"]; ok {
+		if maxEmails, err = strconv.Atoi(value); err != nil || maxEmails < 0 {
+			return nil, fmt.Errorf("invalid max_emails parameter for MEMORY storage: %q", value)
+		}
+	}
+	if value, ok := parameters["max_size"]; ok {
+		if maxSize, err = parseByteSize(value); err != nil {
+			return nil, fmt.Errorf("invalid max_size parameter for MEMORY storage: %v", err)
+		}
+	}
+	if value, ok := parameters["headers_only"]; ok {
+		if headersOnly, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid headers_only parameter for MEMORY storage: %q", value)
+		}
+	}
+	if maxEmails == 0 && maxSize == 0 && !headersOnly {
+		return newMemoryStorage()
+	}
+	return newBoundedMemoryStorage(maxEmails, maxSize, headersOnly)
+}
+
+// parseByteSize parses a size in bytes, with an optional KB, MB or GB suffix (powers of 1024).
+func parseByteSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("cannot parse size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+func (m *memoryStorage) isBounded() bool {
+	return m.maxEmails > 0 || m.maxSize > 0 || m.headersOnly
+}
+
 // load hydrates the memory cache from the root storage layer.
 func (m *memoryStorage) load(rootStorage Storage) error {
 	if rootStorage == nil {
+		if m.isBounded() {
+			return fmt.Errorf("a bounded memory storage cannot be the root storage layer")
+		}
 		return nil // we are the root — nothing to load from
 	}
+	if m.isBounded() {
+		// filled on demand
+		m.root = rootStorage
+		return nil
+	}
 
 	log.Logf(log.INFO, "memory storage: loading from root storage")
 
@@ -57,68 +179,48 @@ func (m *memoryStorage) load(rootStorage Storage) error {
 		return nil // non-fatal — we'll populate on writes
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	for _, header := range emails {
-		m.headers[header.ID] = header
-
-		// Load body versions
-		m.bodies[header.ID] = make(map[EmailVersionType]string)
-		for _, versionName := range header.BodyVersions {
-			version, err := ParseEmailVersionType(versionName)
-			if err != nil {
-				continue
-			}
-			body, err := rootStorage.GetBodyVersion(header.ID, version)
-			if err != nil {
-				continue
-			}
-			m.bodies[header.ID][version] = body
-		}
-
-		// Load attachments
-		atts, err := rootStorage.GetAttachments(header.ID)
-		if err == nil {
-			m.attachments[header.ID] = atts
-			for _, att := range atts {
-				fullAtt, err := rootStorage.GetAttachment(header.ID, att.ID)
-				if err == nil {
-					m.attachment[header.ID+"/"+att.ID] = fullAtt
-				}
-			}
+		raw, err := rootStorage.GetRawEmail(header.ID)
+		if err != nil {
+			continue
 		}
-	}
-
-	// Load raw emails
-	for id := range m.headers {
-		raw, err := rootStorage.GetRawEmail(id)
-		if err == nil {
-			m.rawEmails[id] = raw
+		entry, err := newMemoryEntry(header.ID, raw, false)
+		if err != nil {
+			log.Logf(log.WARNING, "%v", err)
+			continue
 		}
+		entry.header.ReceivedAt = header.ReceivedAt
+		m.mu.Lock()
+		m.insert(entry)
+		m.mu.Unlock()
 	}
 
-	log.Logf(log.INFO, "memory storage: loaded %d emails from root", len(m.headers))
+	log.Logf(log.INFO, "memory storage: loaded %d emails from root", len(m.entries))
 	return nil
 }
 
-// setWithID parses the email and caches all derived data.
-func (m *memoryStorage) setWithID(emailID string, rawEmail []byte) error {
+// newMemoryEntry parses the email and derives the cached data.
+func newMemoryEntry(emailID string, rawEmail []byte, headersOnly bool) (*memoryEntry, error) {
 	// Parse from the immutable raw bytes — no double-read issue
 	msg, err := mail.ReadMessage(bytes.NewReader(rawEmail))
 	if err != nil {
-		return fmt.Errorf("memory storage: cannot parse email %s: %v", emailID, err)
+		return nil, fmt.Errorf("memory storage: cannot parse email %s: %v", emailID, err)
 	}
 
 	mp, err := multipart.New(msg)
 	if err != nil {
-		return fmt.Errorf("memory storage: cannot parse email %s: %v", emailID, err)
+		return nil, fmt.Errorf("memory storage: cannot parse email %s: %v", emailID, err)
 	}
 
 	header := newEmailHeaderFromMultipart(emailID, mp)
+	entry := &memoryEntry{id: emailID, header: header}
+	entry.size = int64(len(header.Subject) + len(header.Preview) + 64*(len(header.Tos)+len(header.CCs)) + 256)
+	if headersOnly {
+		return entry, nil
+	}
 
 	// Cache body versions
-	bodies := make(map[EmailVersionType]string)
+	entry.bodies = make(map[EmailVersionType]string)
 	for _, versionName := range header.BodyVersions {
 		if versionName == "raw" {
 			continue // raw is served from filesystem
@@ -129,52 +231,151 @@ func (m *memoryStorage) setWithID(emailID string, rawEmail []byte) error {
 		}
 		body, err := mp.GetBody(versionName)
 		if err == nil {
-			bodies[version] = body
+			entry.bodies[version] = body
+			entry.size += int64(len(body))
 		}
 	}
 
-	// Cache attachments
-	var attHeaders []AttachmentHeader
+	// Cache attachments; their size is counted when inserted in the blob store
+	entry.attachment = make(map[string]Attachment)
 	for attID, node := range mp.GetAttachments() {
-		attHeaders = append(attHeaders, AttachmentHeader{
-			ID:          attID,
-			ContentType: node.GetContentType(),
-			Filename:    node.GetFilename(),
-			Size:        node.GetSize(),
-		})
-		m.mu.Lock()
-		m.attachment[emailID+"/"+attID] = Attachment{
-			AttachmentHeader: AttachmentHeader{
-				ID:          attID,
-				ContentType: node.GetContentType(),
-				Filename:    node.GetFilename(),
-				Size:        node.GetSize(),
-			},
-			Data: []byte(node.GetDecodedBody()),
+		attHeader := newAttachmentHeader(attID, node)
+		entry.attachments = append(entry.attachments, attHeader)
+		entry.attachment[attID] = Attachment{
+			AttachmentHeader: attHeader,
+			Data:             []byte(node.GetDecodedBody()),
 		}
-		m.mu.Unlock()
 	}
 
+	entry.raw = splitRawEmail(rawEmail, entry.attachment)
+	entry.size += literalSize(entry.raw)
+	return entry, nil
+}
+
+// insert adds or replaces an entry, sharing its attachments with the other
+// entries, then evicts the least recently used entries beyond the limits. Must be
+// called with the lock held.
+func (m *memoryStorage) insert(entry *memoryEntry) {
+	m.remove(entry.id)
+	for attachmentID, attachment := range entry.attachment {
+		data, added := m.blobs.acquire(attachment.Hash, attachment.Data)
+		attachment.Data = data
+		entry.attachment[attachmentID] = attachment
+		m.size += added
+	}
+	for i, segment := range entry.raw {
+		if segment.literal == nil {
+			encoded, added := m.blobs.encoding(entry.attachment[segment.attachmentID].Hash, segment.lineEnding, segment.encoded)
+			entry.raw[i].encoded = encoded
+			m.size += added
+		}
+	}
+	m.entries[entry.id] = m.lru.PushFront(entry)
+	m.size += entry.size
+	for m.lru.Len() > 1 && ((m.maxEmails > 0 && m.lru.Len() > m.maxEmails) || (m.maxSize > 0 && m.size > m.maxSize)) {
+		oldest := m.lru.Back().Value.(*memoryEntry)
+		m.remove(oldest.id)
+		m.evictions++
+	}
+}
+
+// remove drops an entry, and the attachments no other entry shares. Must be
+// called with the lock held.
+func (m *memoryStorage) remove(emailID string) {
+	if element, ok := m.entries[emailID]; ok {
+		entry := element.Value.(*memoryEntry)
+		for _, attachment := range entry.attachment {
+			m.size -= m.blobs.release(attachment.Hash)
+		}
+		m.size -= entry.size
+		m.lru.Remove(element)
+		delete(m.entries, emailID)
+	}
+}
+
+// lookup returns the cached data of an email. A bounded storage fills its misses
+// from the root storage, unless an email was deleted meanwhile: the email read
+// from the root storage may be the deleted one.
+func (m *memoryStorage) lookup(emailID string) (*memoryEntry, error) {
+	m.mu.RLock()
+	element, ok := m.entries[emailID]
+	deletions := m.deletions
+	m.lruMu.Lock()
+	if ok {
+		m.lru.MoveToFront(element)
+		m.hits++
+	} else {
+		m.misses++
+	}
+	m.lruMu.Unlock()
+	m.mu.RUnlock()
+	if ok {
+		return element.Value.(*memoryEntry), nil
+	}
+
+	if m.root == nil {
+		return nil, newEmailNotFoundError("memory cache", emailID)
+	}
+	raw, err := m.root.GetRawEmail(emailID)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := newMemoryEntry(emailID, raw, m.headersOnly)
+	if err != nil {
+		return nil, err
+	}
 	m.mu.Lock()
-	m.headers[emailID] = header
-	m.bodies[emailID] = bodies
-	m.attachments[emailID] = attHeaders
-	m.rawEmails[emailID] = rawEmail
-	m.mu.Unlock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[emailID]; ok {
+		// written meanwhile
+		return element.Value.(*memoryEntry), nil
+	}
+	if m.deletions == deletions {
+		m.insert(entry)
+	}
+	return entry, nil
+}
 
+// stats returns the usage of the storage.
+func (m *memoryStorage) stats() CacheStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
+	return CacheStats{
+		Emails:      len(m.entries),
+		Size:        m.size,
+		MaxEmails:   m.maxEmails,
+		MaxSize:     m.maxSize,
+		HeadersOnly: m.headersOnly,
+		Attachments: len(m.blobs.blobs),
+		Hits:        m.hits,
+		Misses:      m.misses,
+		Evictions:   m.evictions,
+	}
+}
+
+// setWithID parses the email and caches all derived data.
+func (m *memoryStorage) setWithID(emailID string, rawEmail []byte) error {
+	entry, err := newMemoryEntry(emailID, rawEmail, m.headersOnly)
+	if err != nil {
+		return err
+	}
+	entry.header.ReceivedAt = time.Now().UTC()
+	m.mu.Lock()
+	m.insert(entry)
+	m.mu.Unlock()
 	return nil
 }
 
 // --- Read methods ---
 
 func (m *memoryStorage) GetEmailByID(emailID string) (EmailHeader, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	header, ok := m.headers[emailID]
-	if !ok {
-		return EmailHeader{}, fmt.Errorf("email not found in memory cache: %s", emailID)
+	entry, err := m.lookup(emailID)
+	if err != nil {
+		return EmailHeader{}, err
 	}
-	return header, nil
+	return entry.header, nil
 }
 
 func (m *memoryStorage) GetBodyVersion(emailID string, version EmailVersionType) (string, error) {
@@ -182,13 +383,14 @@ func (m *memoryStorage) GetBodyVersion(emailID string, version EmailVersionType)
 		// Raw is served from filesystem — not cached in memory
 		return "", newUnimplementedMethodInLayerError("GetBodyVersion(raw)", "memoryStorage")
 	}
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	versions, ok := m.bodies[emailID]
-	if !ok {
-		return "", fmt.Errorf("email not found in memory cache: %s", emailID)
+	if m.headersOnly {
+		return "", newUnimplementedMethodInLayerError("GetBodyVersion(headers only)", "memoryStorage")
+	}
+	entry, err := m.lookup(emailID)
+	if err != nil {
+		return "", err
 	}
-	body, ok := versions[version]
+	body, ok := entry.bodies[version]
 	if !ok {
 		return "", nil // version doesn't exist for this email
 	}
@@ -196,21 +398,27 @@ func (m *memoryStorage) GetBodyVersion(emailID string, version EmailVersionType)
 }
 
 func (m *memoryStorage) GetAttachments(emailID string) ([]AttachmentHeader, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	atts, ok := m.attachments[emailID]
-	if !ok {
-		return nil, fmt.Errorf("email not found in memory cache: %s", emailID)
+	if m.headersOnly {
+		return nil, newUnimplementedMethodInLayerError("GetAttachments(headers only)", "memoryStorage")
+	}
+	entry, err := m.lookup(emailID)
+	if err != nil {
+		return nil, err
 	}
-	return atts, nil
+	return entry.attachments, nil
 }
 
 func (m *memoryStorage) GetAttachment(emailID string, attachmentID string) (Attachment, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	att, ok := m.attachment[emailID+"/"+attachmentID]
+	if m.headersOnly {
+		return Attachment{}, newUnimplementedMethodInLayerError("GetAttachment(headers only)", "memoryStorage")
+	}
+	entry, err := m.lookup(emailID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	att, ok := entry.attachment[attachmentID]
 	if !ok {
-		return Attachment{}, fmt.Errorf("attachment not found in memory cache: %s/%s", emailID, attachmentID)
+		return Attachment{}, newAttachmentNotFoundError("memory cache", emailID, attachmentID)
 	}
 	return att, nil
 }
@@ -220,57 +428,78 @@ func (m *memoryStorage) GetAttachment(emailID string, attachmentID string) (Atta
 func (m *memoryStorage) DeleteAllEmails() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.headers = make(map[string]EmailHeader)
-	m.bodies = make(map[string]map[EmailVersionType]string)
-	m.attachments = make(map[string][]AttachmentHeader)
-	m.attachment = make(map[string]Attachment)
-	m.rawEmails = make(map[string][]byte)
+	m.entries = make(map[string]*list.Element)
+	m.lru.Init()
+	m.blobs = newBlobStore()
+	m.size = 0
+	m.deletions++
 	return nil
 }
 
 func (m *memoryStorage) DeleteEmailByID(emailID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	// Clean up attachment entries
-	if atts, ok := m.attachments[emailID]; ok {
-		for _, att := range atts {
-			delete(m.attachment, emailID+"/"+att.ID)
-		}
+	// counted even when not cached, the email being read from the root storage
+	m.deletions++
+	if _, ok := m.entries[emailID]; !ok {
+		return newEmailNotFoundError("memory cache", emailID)
 	}
-	delete(m.headers, emailID)
-	delete(m.bodies, emailID)
-	delete(m.attachments, emailID)
-	delete(m.rawEmails, emailID)
+	m.remove(emailID)
 	return nil
 }
 
-// --- Not implemented (handled by other layers) ---
+// --- Search (only when holding every email) ---
 
 func (m *memoryStorage) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return m.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage, checking the context between emails.
+func (m *memoryStorage) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	if m.isBounded() {
+		return nil, 0, newUnimplementedMethodInLayerError("SearchEmails(bounded)", "memoryStorage")
+	}
 	matchers, err := matcher.ParseQuery(query)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	// the entries are not changed once inserted: they are matched without the lock
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	entries := make([]*memoryEntry, 0, len(m.entries))
+	for _, element := range m.entries {
+		entries = append(entries, element.Value.(*memoryEntry))
+	}
+	m.mu.RUnlock()
 
+	now := time.Now()
 	var results []EmailHeader
-	for id := range m.headers {
-		raw, ok := m.rawEmails[id]
-		if !ok {
-			continue
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
 		}
-		msg, err := mail.ReadMessage(bytes.NewReader(raw))
-		if err != nil {
-			continue
+		// the header matchers are checked on the cached header, the raw email is
+		// only parsed for the other ones
+		matched := true
+		var bodyMatchers []interface{}
+		for _, m := range matchers {
+			if hashMatcher, ok := m.(matcher.AttachmentHashMatch); ok {
+				matched = matchAttachmentHash(entry.attachments, hashMatcher)
+			} else if headerMatched, ok := matchHeader(entry.header, m, now); ok {
+				matched = headerMatched
+			} else {
+				bodyMatchers = append(bodyMatchers, m)
+			}
+			if !matched {
+				break
+			}
 		}
-		mp, err := multipart.New(msg)
-		if err != nil {
-			continue
+		if matched && len(bodyMatchers) > 0 {
+			mp, err := multipart.ParseEmailFromBytes(entry.rawEmail())
+			matched = err == nil && mp.MatchAll(bodyMatchers)
 		}
-		if mp.MatchAll(matchers) {
-			results = append(results, m.headers[id])
+		if matched {
+			results = append(results, entry.header)
 		}
 	}
 
@@ -297,16 +526,32 @@ func (m *memoryStorage) SearchEmails(query string, page int, pageSize int) ([]Em
 }
 
 func (m *memoryStorage) GetMailboxes() ([]Mailbox, error) {
+	return m.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage. The listing reads the headers in
+// memory: the context is only checked before.
+func (m *memoryStorage) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	if m.isBounded() {
+		return nil, newUnimplementedMethodInLayerError("GetMailboxes(bounded)", "memoryStorage")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	recipients := make(map[string]bool)
-	for _, header := range m.headers {
+	for _, element := range m.entries {
+		header := element.Value.(*memoryEntry).header
 		for _, to := range header.Tos {
 			if to.Address != "" {
 				recipients[to.Address] = true
 			}
 		}
+		for _, mailbox := range header.DeliveredTo {
+			recipients[mailbox] = true
+		}
 	}
 
 	mailboxes := make([]Mailbox, 0, len(recipients))
@@ -320,13 +565,14 @@ func (m *memoryStorage) GetMailboxes() ([]Mailbox, error) {
 }
 
 func (m *memoryStorage) GetRawEmail(emailID string) ([]byte, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	raw, ok := m.rawEmails[emailID]
-	if !ok {
-		return nil, fmt.Errorf("raw email not found in memory cache: %s", emailID)
+	if m.headersOnly {
+		return nil, newUnimplementedMethodInLayerError("GetRawEmail(headers only)", "memoryStorage")
+	}
+	entry, err := m.lookup(emailID)
+	if err != nil {
+		return nil, err
 	}
-	return raw, nil
+	return entry.rawEmail(), nil
 }
 
 // newEmailHeaderFromMultipart builds an EmailHeader from a parsed Multipart.
@@ -350,6 +596,7 @@ func newEmailHeaderFromMultipart(ID string, mp *multipart.Multipart) EmailHeader
 		From:           EmailAddress{Name: from.Name, Address: from.Address},
 		Tos:            tosAddrs,
 		CCs:            ccsAddrs,
+		DeliveredTo:    mp.GetPlacementMailboxes(),
 		Subject:        mp.GetSubject(),
 		Date:           mp.GetDate(),
 		HasAttachments: mp.HasAttachments(),
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBoundedTestEngine returns an engine with a bounded memory layer in front of
+// a filesystem layer holding count emails.
+func newBoundedTestEngine(t *testing.T, parameters map[string]string, count int) (*Engine, *memoryStorage) {
+	root, err := newFilesystemStorage(t.TempDir(), "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := root.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memory, err := newMemoryStorageFromParameters(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(memory, root)
+	if err := engine.load(root); err != nil {
+		t.Fatal(err)
+	}
+	return engine, memory
+}
+
+func TestMemoryStorageParameters(t *testing.T) {
+	testCases := []struct {
+		parameters map[string]string
+		maxEmails  int
+		maxSize    int64
+		isError    bool
+	}{
+		{map[string]string{}, 0, 0, false},
+		{map[string]string{"max_emails": "100"}, 100, 0, false},
+		{map[string]string{"max_size": "64MB"}, 0, 64 << 20, false},
+		{map[string]string{"max_size": "512 kb"}, 0, 512 << 10, false},
+		{map[string]string{"max_size": "2048"}, 0, 2048, false},
+		{map[string]string{"max_emails": "-1"}, 0, 0, true},
+		{map[string]string{"max_size": "lots"}, 0, 0, true},
+		{map[string]string{"headers_only": "maybe"}, 0, 0, true},
+	}
+	for _, data := range testCases {
+		memory, err := newMemoryStorageFromParameters(data.parameters)
+		if data.isError {
+			if err == nil {
+				t.Errorf("expected an error for %v", data.parameters)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", data.parameters, err)
+			continue
+		}
+		if memory.maxEmails != data.maxEmails || memory.maxSize != data.maxSize {
+			t.Errorf("%v: expected limits %v/%v, got %v/%v", data.parameters, data.maxEmails, data.maxSize, memory.maxEmails, memory.maxSize)
+		}
+	}
+
+	bounded, _ := newMemoryStorageFromParameters(map[string]string{"max_emails": "10"})
+	if err := bounded.load(nil); err == nil {
+		t.Errorf("a bounded memory storage should not be accepted as root")
+	}
+}
+
+func TestMemoryStorageLRU(t *testing.T) {
+	engine, memory := newBoundedTestEngine(t, map[string]string{"max_emails": "2"}, 4)
+	if stats := memory.stats(); stats.Emails != 0 {
+		t.Fatalf("a bounded memory storage should be filled on demand, got %+v", stats)
+	}
+
+	for _, id := range []string{"email-0", "email-1", "email-0", "email-2"} {
+		header, err := engine.GetEmailByID(id)
+		if err != nil || header.ID != id {
+			t.Fatalf("unexpected result for %v: %+v, %v", id, header, err)
+		}
+	}
+	// email-1 is the least recently used one
+	memory.mu.RLock()
+	_, cached0 := memory.entries["email-0"]
+	_, cached1 := memory.entries["email-1"]
+	memory.mu.RUnlock()
+	if !cached0 || cached1 {
+		t.Errorf("expected email-1 to be evicted (email-0 cached: %v, email-1 cached: %v)", cached0, cached1)
+	}
+	stats := memory.stats()
+	if stats.Emails != 2 || stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	body, err := engine.GetBodyVersion("email-3", EmailVersionPlainText)
+	if err != nil || body == "" {
+		t.Errorf("expected the body to be read through, got %q, %v", body, err)
+	}
+	if _, err := engine.GetEmailByID("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown email")
+	}
+
+	// searches are left to the root, which holds every email
+	_, total, err := engine.SearchEmails("", 1, 10)
+	if err != nil || total != 4 {
+		t.Errorf("expected 4 emails from the root, got %v, %v", total, err)
+	}
+
+	if err := engine.DeleteEmailByID("email-3"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := memory.stats(); stats.Emails != 1 {
+		t.Errorf("expected the deleted email to leave the cache, got %+v", stats)
+	}
+}
+
+func TestMemoryStorageMaxSize(t *testing.T) {
+	_, memory := newBoundedTestEngine(t, map[string]string{"max_size": "1KB"}, 0)
+	for i := 0; i < 10; i++ {
+		if err := memory.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := memory.stats()
+	if stats.Size > 1024 || stats.Emails == 0 || stats.Evictions == 0 {
+		t.Errorf("expected the cache to stay under 1KB, got %+v", stats)
+	}
+}
+
+func TestMemoryStorageHeadersOnly(t *testing.T) {
+	engine, memory := newBoundedTestEngine(t, map[string]string{"headers_only": "true"}, 1)
+	header, err := engine.GetEmailByID("email-0")
+	if err != nil || header.Subject != "email 0" {
+		t.Fatalf("unexpected header %+v, %v", header, err)
+	}
+	if _, err := memory.GetBodyVersion("email-0", EmailVersionPlainText); !isUnimplemented(err) {
+		t.Errorf("a headers only storage should not serve bodies, got %v", err)
+	}
+	body, err := engine.GetBodyVersion("email-0", EmailVersionPlainText)
+	if err != nil || body == "" {
+		t.Errorf("expected the body from the root, got %q, %v", body, err)
+	}
+	if raw, err := engine.GetRawEmail("email-0"); err != nil || len(raw) == 0 {
+		t.Errorf("expected the raw email from the root, got %v", err)
+	}
+}
+
+// readHookStorage calls onRead before reading a raw email from the storage.
+type readHookStorage struct {
+	Storage
+	onRead func(emailID string)
+}
+
+func (s readHookStorage) GetRawEmail(emailID string) ([]byte, error) {
+	s.onRead(emailID)
+	return s.Storage.GetRawEmail(emailID)
+}
+
+func TestMemoryStorageMissDuringDelete(t *testing.T) {
+	_, memory := newBoundedTestEngine(t, map[string]string{"max_emails": "10"}, 1)
+	// deleted while read from the root storage, before being cached
+	memory.root = readHookStorage{Storage: memory.root, onRead: func(emailID string) {
+		memory.DeleteEmailByID(emailID)
+	}}
+	if _, err := memory.GetEmailByID("email-0"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := memory.stats(); stats.Emails != 0 {
+		t.Errorf("expected the deleted email not to be cached, got %+v", stats)
+	}
+}
+
+func TestMemoryStorageConcurrentReads(t *testing.T) {
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := memory.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if _, total, err := memory.SearchEmails("body", 1, -1); err != nil || total < 20 {
+				t.Errorf("unexpected search result: %v, %v", total, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := memory.GetEmailByID(fmt.Sprintf("email-%d", i)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := memory.setWithID(fmt.Sprintf("email-%d", 20+i), memoryTestEmail(20+i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// invoiceEmail returns an email attaching the same invoice as the others.
+func invoiceEmail(index int) []byte {
+	return []byte(fmt.Sprintf("From: billing@example.com\r\nTo: customer%d@example.com\r\nSubject: invoice %d\r\nDate: %v\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nYour invoice.\r\n--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"invoice.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQKJcOkw7zDtsOf\r\n--b--\r\n", index, index, testEmailDate(index).Format(time.RFC1123Z)))
+}
+
+// invoiceHash is the SHA-256 of the decoded invoice of invoiceEmail.
+const invoiceHash = "22f01a80f124de7418017c913ab8fa213c0e4be1ed32ba8fcd335d467838dc5a"
+
+func TestMemoryStorageSharedAttachments(t *testing.T) {
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := memory.setWithID(fmt.Sprintf("invoice-%d", i), invoiceEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attachments, err := memory.GetAttachments("invoice-0")
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("unexpected attachments %+v: %v", attachments, err)
+	}
+	first, err := memory.GetAttachment("invoice-0", attachments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Hash != invoiceHash || string(first.Data[:4]) != "%PDF" {
+		t.Errorf("unexpected attachment %+v", first.AttachmentHeader)
+	}
+	last, _ := memory.GetAttachment("invoice-2", attachments[0].ID)
+	if &first.Data[0] != &last.Data[0] {
+		t.Errorf("expected the emails to share the attachment data")
+	}
+	if stats := memory.stats(); stats.Attachments != 1 {
+		t.Errorf("expected one shared attachment, got %+v", stats)
+	}
+	if got, _ := searchIDs(t, memory, "attachment_hash:"+invoiceHash); len(got) != 3 {
+		t.Errorf("expected the 3 emails attaching the invoice, got %v", got)
+	}
+
+	// the attachment is freed with the last email referring to it
+	memory.DeleteEmailByID("invoice-0")
+	memory.DeleteEmailByID("invoice-1")
+	if stats := memory.stats(); stats.Attachments != 1 {
+		t.Errorf("expected the attachment to remain, got %+v", stats)
+	}
+	memory.DeleteEmailByID("invoice-2")
+	if stats := memory.stats(); stats.Attachments != 0 || stats.Size != 0 {
+		t.Errorf("expected no attachment left, got %+v", stats)
+	}
+}
+
+// attachmentEmail returns an email attaching the data in base64, wrapped at the
+// line length with the line ending.
+func attachmentEmail(index int, data []byte, lineLength int, lineEnding string) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(encoded) > lineLength {
+		lines = append(lines, encoded[:lineLength])
+		encoded = encoded[lineLength:]
+	}
+	lines = append(lines, encoded)
+	return []byte(strings.ReplaceAll(fmt.Sprintf("From: billing@example.com\r\nTo: customer%d@example.com\r\nSubject: report %d\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nYour report.\r\n--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"report.bin\"\r\nContent-Transfer-Encoding: base64\r\n\r\n%v\r\n--b--\r\n", index, index, strings.Join(lines, "\r\n")), "\r\n", lineEnding))
+}
+
+func TestMemoryStorageRawSharesAttachments(t *testing.T) {
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	emails := [][]byte{
+		attachmentEmail(0, data, 76, "\r\n"),
+		attachmentEmail(1, data, 76, "\n"),
+		attachmentEmail(2, data, 64, "\r\n"), // not the encoding rebuilt: kept as sent
+		attachmentEmail(3, data, 76, "\r\n"),
+	}
+	for i, raw := range emails {
+		if err := memory.setWithID(fmt.Sprintf("report-%d", i), raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, raw := range emails {
+		got, err := memory.GetRawEmail(fmt.Sprintf("report-%d", i))
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("email %d: expected the raw email as sent, got %d bytes (%v)", i, len(got), err)
+		}
+	}
+	if got, _ := searchIDs(t, memory, "report.bin"); len(got) != len(emails) {
+		t.Errorf("expected the %d emails to be found, got %v", len(emails), got)
+	}
+	// the attachment is held once with each of its encodings, and in the raw
+	// email sent with other lines
+	shared := len(data) + len(encodeBase64Lines(data, "\r\n")) + len(encodeBase64Lines(data, "\n"))
+	if stats := memory.stats(); stats.Size > int64(shared)+int64(len(emails[2]))+4096 {
+		t.Errorf("expected the attachment to be shared by the raw emails, got %+v", stats)
+	}
+}
@@ -0,0 +1,695 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mock-my-mta/log"
+	"mock-my-mta/storage/matcher"
+	"mock-my-mta/storage/multipart"
+)
+
+// Suffixes of the objects of an email: the raw email and its metadata.
+const (
+	s3EmailSuffix    = ".eml"
+	s3MetadataSuffix = ".json"
+)
+
+// s3Credentials signs the requests; without an access key they are anonymous.
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// s3Metadata is the JSON object stored next to each raw email, so that listing
+// and searching the headers do not download the emails.
+type s3Metadata struct {
+	EmailHeader
+	Attachments []AttachmentHeader `json:"attachments"`
+	Size        int                `json:"size"`
+}
+
+// s3CachedMetadata is a metadata object already downloaded, valid while its ETag
+// is listed.
+type s3CachedMetadata struct {
+	etag     string
+	metadata s3Metadata
+}
+
+// s3Storage keeps each email as two objects of an S3-compatible bucket:
+// <prefix><id>.eml, the raw email, and <prefix><id>.json, its metadata. The
+// requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	client      *http.Client
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	pathStyle   bool
+	credentials s3Credentials
+
+	mutex    sync.Mutex
+	metadata map[string]s3CachedMetadata // by metadata key
+}
+
+// s3Storage implements the storageLayer interface
+var _ storageLayer = &s3Storage{}
+
+// newS3StorageFromParameters creates an S3 storage from the layer parameters. The
+// credentials and the region default to the AWS environment variables.
+func newS3StorageFromParameters(parameters map[string]string) (*s3Storage, error) {
+	bucket := parameters["bucket"]
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket parameter for S3 storage")
+	}
+	parameterOrEnv := func(name string, env string, defaultValue string) string {
+		if value := parameters[name]; value != "" {
+			return value
+		}
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+	region := parameterOrEnv("region", "AWS_REGION", "us-east-1")
+	endpoint, err := url.Parse(parameterOrEnv("endpoint", "AWS_ENDPOINT_URL_S3", "https://s3."+region+".amazonaws.com"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint parameter for S3 storage: %q", parameters["endpoint"])
+	}
+	var pathStyle bool
+	if value, ok := parameters["path_style"]; ok {
+		if pathStyle, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid path_style parameter for S3 storage: %q", value)
+		}
+	}
+	prefix := strings.TrimPrefix(parameters["prefix"], "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	credentials := s3Credentials{
+		accessKeyID:     parameterOrEnv("access_key_id", "AWS_ACCESS_KEY_ID", ""),
+		secretAccessKey: parameterOrEnv("secret_access_key", "AWS_SECRET_ACCESS_KEY", ""),
+		sessionToken:    parameterOrEnv("session_token", "AWS_SESSION_TOKEN", ""),
+	}
+	if (credentials.accessKeyID == "") != (credentials.secretAccessKey == "") {
+		return nil, fmt.Errorf("the S3 storage requires both an access key ID and a secret access key")
+	}
+	log.Logf(log.INFO, "using S3 storage with bucket %v at %v", bucket, endpoint)
+	return &s3Storage{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		endpoint:    endpoint,
+		bucket:      bucket,
+		prefix:      prefix,
+		region:      region,
+		pathStyle:   pathStyle,
+		credentials: credentials,
+		metadata:    make(map[string]s3CachedMetadata),
+	}, nil
+}
+
+// --- S3 requests ---
+
+// s3Error is the XML error of a failed S3 request.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// isS3NotFound returns true for the error of a missing object.
+func isS3NotFound(err error) bool {
+	s3err, ok := err.(*s3Error)
+	return ok && s3err.StatusCode == http.StatusNotFound
+}
+
+// objectURL returns the URL of an object, or of the bucket for an empty key.
+func (s *s3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+		if key != "" {
+			path += "/" + key
+		}
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		path += "/" + key
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	return &u
+}
+
+// do sends a signed request and returns the response of a successful one; the
+// caller closes its body.
+func (s *s3Storage) do(ctx context.Context, method string, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	signS3Request(request, hex.EncodeToString(sum[:]), s.credentials, s.region, time.Now())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		s3err := &s3Error{StatusCode: response.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+		xml.Unmarshal(data, s3err)
+		return nil, s3err
+	}
+	return response, nil
+}
+
+// getObject returns the content of an object and its ETag.
+func (s *s3Storage) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	response, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	return data, response.Header.Get("ETag"), err
+}
+
+// putObject writes an object and returns its ETag.
+func (s *s3Storage) putObject(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	response, err := s.do(ctx, http.MethodPut, key, nil, data, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	return response.Header.Get("ETag"), nil
+}
+
+func (s *s3Storage) deleteObject(ctx context.Context, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// s3Object is an object listed by ListObjectsV2.
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+}
+
+// listObjects lists the objects of the prefix, following the continuation tokens.
+func (s *s3Storage) listObjects(ctx context.Context) ([]s3Object, error) {
+	var objects []s3Object
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		response, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode S3 object list: %v", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// --- Signature Version 4 ---
+
+// signS3Request adds the AWS Signature Version 4 headers to the request, signing
+// its host and the headers already set. Anonymous credentials leave it unsigned.
+func signS3Request(request *http.Request, payloadHash string, credentials s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.accessKeyID == "" {
+		return
+	}
+	if credentials.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+	signedHeaders := []string{"host"}
+	for name := range request.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaders)
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	signature := s3Signature(request, signedHeaders, payloadHash, credentials.secretAccessKey, scope, amzDate)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.accessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// s3Signature returns the signature of the request, whose headers hold the
+// signed ones.
+func s3Signature(request *http.Request, signedHeaders []string, payloadHash string, secretAccessKey string, scope string, amzDate string) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := request.Header.Get(name)
+		if name == "host" {
+			value = request.Host
+			if value == "" {
+				value = request.URL.Host
+			}
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery returns the query sorted by name, with the S3 escaping.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes all but the unreserved characters, and the slashes unless
+// escapeSlash is true.
+func s3Escape(value string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// --- Objects of the emails ---
+
+func (s *s3Storage) emailKey(emailID string) string {
+	return s.prefix + emailID + s3EmailSuffix
+}
+
+func (s *s3Storage) metadataKey(emailID string) string {
+	return s.prefix + emailID + s3MetadataSuffix
+}
+
+// getMetadata downloads the metadata of an email.
+func (s *s3Storage) getMetadata(ctx context.Context, emailID string) (s3Metadata, error) {
+	data, _, err := s.getObject(ctx, s.metadataKey(emailID))
+	if err != nil {
+		if isS3NotFound(err) {
+			return s3Metadata{}, newEmailNotFoundError("s3", emailID)
+		}
+		return s3Metadata{}, err
+	}
+	var metadata s3Metadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return s3Metadata{}, fmt.Errorf("cannot decode S3 metadata of %v: %v", emailID, err)
+	}
+	return metadata, nil
+}
+
+// listMetadata returns the metadata of all the emails of the bucket prefix,
+// downloading only the objects changed since the previous listing.
+func (s *s3Storage) listMetadata(ctx context.Context) ([]s3Metadata, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	cached := s.metadata
+	s.mutex.Unlock()
+	listed := make(map[string]s3CachedMetadata)
+	var emails []s3Metadata
+	for _, object := range objects {
+		emailID, ok := strings.CutSuffix(strings.TrimPrefix(object.Key, s.prefix), s3MetadataSuffix)
+		if !ok || strings.Contains(emailID, "/") {
+			continue
+		}
+		entry, ok := cached[object.Key]
+		if !ok || entry.etag != object.ETag {
+			metadata, err := s.getMetadata(ctx, emailID)
+			if err != nil {
+				if IsNotFound(err) {
+					continue // deleted meanwhile
+				}
+				return nil, err
+			}
+			entry = s3CachedMetadata{etag: object.ETag, metadata: metadata}
+		}
+		listed[object.Key] = entry
+		emails = append(emails, entry.metadata)
+	}
+	s.mutex.Lock()
+	s.metadata = listed
+	s.mutex.Unlock()
+	return emails, nil
+}
+
+func (s *s3Storage) parseEmail(ctx context.Context, emailID string) (*multipart.Multipart, error) {
+	raw, err := s.getRawEmail(ctx, emailID)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := multipart.ParseEmailFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse email %v: %v", emailID, err)
+	}
+	return mp, nil
+}
+
+// load checks that the bucket can be listed, and hydrates from root storage (if
+// this is not the root) when the prefix holds no email.
+func (s *s3Storage) load(rootStorage Storage) error {
+	emails, err := s.listMetadata(context.Background())
+	if err != nil {
+		return fmt.Errorf("cannot list S3 bucket %v: %v", s.bucket, err)
+	}
+	if rootStorage == nil || len(emails) > 0 {
+		return nil
+	}
+	log.Logf(log.INFO, "S3 storage: loading from root storage")
+	headers, _, err := rootStorage.SearchEmails("", 1, -1)
+	if err != nil {
+		log.Logf(log.WARNING, "S3 storage: could not load from root: %v", err)
+		return nil
+	}
+	for _, header := range headers {
+		raw, err := rootStorage.GetRawEmail(header.ID)
+		if err == nil {
+			err = s.putEmail(header.ID, raw, header.ReceivedAt)
+		}
+		if err != nil {
+			log.Logf(log.WARNING, "S3 storage: cannot load email %v from root: %v", header.ID, err)
+		}
+	}
+	return nil
+}
+
+// setWithID writes the raw email, then its metadata: an email is listed once
+// both are written.
+func (s *s3Storage) setWithID(emailID string, rawEmail []byte) error {
+	return s.putEmail(emailID, rawEmail, time.Now().UTC())
+}
+
+// putEmail writes an email received at the given time.
+func (s *s3Storage) putEmail(emailID string, rawEmail []byte, receivedAt time.Time) error {
+	mp, err := multipart.ParseEmailFromBytes(rawEmail)
+	if err != nil {
+		return fmt.Errorf("S3 storage: cannot parse email %s: %v", emailID, err)
+	}
+	metadata := s3Metadata{EmailHeader: newEmailHeaderFromMultipart(emailID, mp), Size: len(rawEmail)}
+	metadata.ReceivedAt = receivedAt
+	for attachmentID, node := range mp.GetAttachments() {
+		metadata.Attachments = append(metadata.Attachments, newAttachmentHeader(attachmentID, node))
+	}
+	sort.Slice(metadata.Attachments, func(i, j int) bool {
+		return metadata.Attachments[i].ID < metadata.Attachments[j].ID
+	})
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if _, err := s.putObject(context.Background(), s.emailKey(emailID), rawEmail, "message/rfc822"); err != nil {
+		return err
+	}
+	etag, err := s.putObject(context.Background(), s.metadataKey(emailID), data, "application/json")
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.metadata[s.metadataKey(emailID)] = s3CachedMetadata{etag: etag, metadata: metadata}
+	s.mutex.Unlock()
+	return nil
+}
+
+// --- Read methods ---
+
+func (s *s3Storage) GetEmailByID(emailID string) (EmailHeader, error) {
+	metadata, err := s.getMetadata(context.Background(), emailID)
+	if err != nil {
+		return EmailHeader{}, err
+	}
+	return metadata.EmailHeader, nil
+}
+
+func (s *s3Storage) GetRawEmail(emailID string) ([]byte, error) {
+	return s.getRawEmail(context.Background(), emailID)
+}
+
+// GetRawEmailContext implements RawContextStorage, cancelling the download.
+func (s *s3Storage) GetRawEmailContext(ctx context.Context, emailID string) ([]byte, error) {
+	return s.getRawEmail(ctx, emailID)
+}
+
+func (s *s3Storage) getRawEmail(ctx context.Context, emailID string) ([]byte, error) {
+	raw, _, err := s.getObject(ctx, s.emailKey(emailID))
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, newEmailNotFoundError("s3", emailID)
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (s *s3Storage) GetBodyVersion(emailID string, version EmailVersionType) (string, error) {
+	if version == EmailVersionRaw {
+		raw, err := s.GetRawEmail(emailID)
+		return string(raw), err
+	}
+	mp, err := s.parseEmail(context.Background(), emailID)
+	if err != nil {
+		return "", err
+	}
+	versionStr, err := emailVersionToString(version)
+	if err != nil {
+		return "", err
+	}
+	return mp.GetBody(versionStr)
+}
+
+func (s *s3Storage) GetAttachments(emailID string) ([]AttachmentHeader, error) {
+	metadata, err := s.getMetadata(context.Background(), emailID)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Attachments, nil
+}
+
+func (s *s3Storage) GetAttachment(emailID string, attachmentID string) (Attachment, error) {
+	mp, err := s.parseEmail(context.Background(), emailID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	node, found := mp.GetAttachment(attachmentID)
+	if !found {
+		return Attachment{}, newAttachmentNotFoundError("s3", emailID, attachmentID)
+	}
+	return Attachment{
+		AttachmentHeader: newAttachmentHeader(attachmentID, node),
+		Data:             []byte(node.GetDecodedBody()),
+	}, nil
+}
+
+// --- Search methods ---
+
+func (s *s3Storage) GetMailboxes() ([]Mailbox, error) {
+	return s.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage: the requests are canceled
+// with the context.
+func (s *s3Storage) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	emails, err := s.listMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recipients := make(map[string]bool)
+	for _, email := range emails {
+		for _, address := range append(email.Tos, email.CCs...) {
+			recipients[address.Address] = true
+		}
+		for _, mailbox := range email.DeliveredTo {
+			recipients[mailbox] = true
+		}
+	}
+	mailboxes := make([]Mailbox, 0, len(recipients))
+	for address := range recipients {
+		mailboxes = append(mailboxes, Mailbox{Name: address})
+	}
+	sort.Slice(mailboxes, func(i, j int) bool {
+		return mailboxes[i].Name < mailboxes[j].Name
+	})
+	return mailboxes, nil
+}
+
+// SearchEmails checks the matchers on the listed metadata, attachment hashes
+// included, and downloads the raw emails only for the matchers needing the body.
+func (s *s3Storage) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return s.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage: the requests are canceled with
+// the context.
+func (s *s3Storage) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	if page < 1 {
+		return nil, 0, fmt.Errorf("invalid page number: %v", page)
+	}
+	matchers, err := matcher.ParseQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	emails, err := s.listMetadata(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	var results []EmailHeader
+	for _, email := range emails {
+		matched := true
+		var bodyMatchers []interface{}
+		for _, m := range matchers {
+			if hashMatcher, ok := m.(matcher.AttachmentHashMatch); ok {
+				if !matchAttachmentHash(email.Attachments, hashMatcher) {
+					matched = false
+					break
+				}
+				continue
+			}
+			headerMatched, ok := matchHeader(email.EmailHeader, m, now)
+			if !ok {
+				bodyMatchers = append(bodyMatchers, m)
+			} else if !headerMatched {
+				matched = false
+				break
+			}
+		}
+		if matched && len(bodyMatchers) > 0 {
+			mp, err := s.parseEmail(ctx, email.ID)
+			if err != nil {
+				if !IsNotFound(err) {
+					log.Logf(log.WARNING, "skipping unreadable email %v: %v", email.ID, err)
+				}
+				continue
+			}
+			matched = mp.MatchAll(bodyMatchers)
+		}
+		if matched {
+			results = append(results, email.EmailHeader)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Date.After(results[j].Date)
+	})
+	return paginateHeaders(results, page, pageSize)
+}
+
+// --- Write methods ---
+
+func (s *s3Storage) DeleteAllEmails() error {
+	objects, err := s.listObjects(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if strings.Contains(name, "/") || !(strings.HasSuffix(name, s3EmailSuffix) || strings.HasSuffix(name, s3MetadataSuffix)) {
+			continue // not an object of this storage
+		}
+		if err := s.deleteObject(context.Background(), object.Key); err != nil && !isS3NotFound(err) {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	s.metadata = make(map[string]s3CachedMetadata)
+	s.mutex.Unlock()
+	return nil
+}
+
+// DeleteEmailByID deletes the metadata, then the raw email. Deleting a missing
+// object succeeds in S3, so the metadata is checked first.
+func (s *s3Storage) DeleteEmailByID(emailID string) error {
+	response, err := s.do(context.Background(), http.MethodHead, s.metadataKey(emailID), nil, nil, nil)
+	if err != nil {
+		if isS3NotFound(err) {
+			return newEmailNotFoundError("s3", emailID)
+		}
+		return err
+	}
+	response.Body.Close()
+	if err := s.deleteObject(context.Background(), s.metadataKey(emailID)); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	delete(s.metadata, s.metadataKey(emailID))
+	s.mutex.Unlock()
+	return s.deleteObject(context.Background(), s.emailKey(emailID))
+}
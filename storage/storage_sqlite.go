@@ -1,12 +1,18 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"html"
+	"io"
 	"net/mail"
 	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"mock-my-mta/log"
 	"mock-my-mta/storage/matcher"
@@ -40,8 +46,16 @@ func newSqliteStorage(databaseFilename string) (*sqliteStorage, error) {
 	if err := createTables(db); err != nil {
 		return nil, err
 	}
+	if err := migrateTables(db); err != nil {
+		return nil, fmt.Errorf("cannot migrate sqlite database %s: %v", databaseFilename, err)
+	}
 
-	return &sqliteStorage{db: db, databaseFilename: databaseFilename}, nil
+	s := &sqliteStorage{db: db, databaseFilename: databaseFilename}
+	// Databases created before the full-text index have to be indexed once
+	if err := s.reindexFullText(false); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func createTables(db *sql.DB) error {
@@ -56,16 +70,219 @@ func createTables(db *sql.DB) error {
 			preview TEXT DEFAULT '',
 			recipients_json TEXT DEFAULT '[]',
 			ccs_json TEXT DEFAULT '[]',
+			delivered_to_json TEXT DEFAULT '[]',
 			body_versions_json TEXT DEFAULT '[]',
-			raw_email BLOB
+			raw_email BLOB,
+			timestamp INTEGER DEFAULT 0,
+			received INTEGER DEFAULT 0
 		);
 		CREATE INDEX IF NOT EXISTS idx_emails_date ON emails(date);
 		CREATE INDEX IF NOT EXISTS idx_emails_sender ON emails(sender_address);
 		CREATE INDEX IF NOT EXISTS idx_emails_subject ON emails(subject);
+		CREATE TABLE IF NOT EXISTS email_recipients (
+			email_id TEXT NOT NULL,
+			address TEXT NOT NULL,
+			PRIMARY KEY (email_id, address)
+		);
+		CREATE INDEX IF NOT EXISTS idx_email_recipients_address ON email_recipients(address COLLATE NOCASE);
+	` + createFullTextTable)
+	return err
+}
+
+// createFullTextTable creates the full-text index of the searchDocument of the emails.
+const createFullTextTable = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5(
+		id UNINDEXED,
+		subject,
+		addresses,
+		body,
+		html_text,
+		attachments,
+		html,
+		tokenize = 'trigram'
+	);
+`
+
+// migrateTables upgrades the databases created by previous versions, tracked by
+// the user_version pragma. Version 1 added the timestamp column (the date column
+// holds text that does not sort across time zones) and the email_recipients table,
+// version 2 the received column, unknown (0) for the emails already stored, and
+// version 3 the delivered_to_json column of the mailboxes Sieve filed the emails for,
+// and version 4 the html column of emails_fts, the table being rebuilt when opened.
+func migrateTables(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version < 1 {
+		var hasTimestamp bool
+		db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('emails') WHERE name = 'timestamp'").Scan(&hasTimestamp)
+		if !hasTimestamp {
+			if _, err := db.Exec("ALTER TABLE emails ADD COLUMN timestamp INTEGER DEFAULT 0"); err != nil {
+				return err
+			}
+		}
+		if err := backfillSearchColumns(db); err != nil {
+			return err
+		}
+		if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		var hasReceived bool
+		db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('emails') WHERE name = 'received'").Scan(&hasReceived)
+		if !hasReceived {
+			if _, err := db.Exec("ALTER TABLE emails ADD COLUMN received INTEGER DEFAULT 0"); err != nil {
+				return err
+			}
+		}
+		if _, err := db.Exec("PRAGMA user_version = 2"); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		var hasDeliveredTo bool
+		db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('emails') WHERE name = 'delivered_to_json'").Scan(&hasDeliveredTo)
+		if !hasDeliveredTo {
+			if _, err := db.Exec("ALTER TABLE emails ADD COLUMN delivered_to_json TEXT DEFAULT '[]'"); err != nil {
+				return err
+			}
+		}
+		if err := backfillDeliveredTo(db); err != nil {
+			return err
+		}
+		if _, err := db.Exec("PRAGMA user_version = 3"); err != nil {
+			return err
+		}
+	}
+	if version < 4 {
+		var hasHTML bool
+		db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('emails_fts') WHERE name = 'html'").Scan(&hasHTML)
+		if !hasHTML {
+			if _, err := db.Exec("DROP TABLE emails_fts;" + createFullTextTable); err != nil {
+				return err
+			}
+		}
+		if _, err := db.Exec("PRAGMA user_version = 4"); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_emails_timestamp ON emails(timestamp);
+		CREATE INDEX IF NOT EXISTS idx_emails_sender_nocase ON emails(sender_address COLLATE NOCASE);
 	`)
 	return err
 }
 
+// backfillSearchColumns fills the timestamp column and the email_recipients table
+// from the stored headers.
+func backfillSearchColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, date, recipients_json, ccs_json FROM emails")
+	if err != nil {
+		return err
+	}
+	var headers []EmailHeader
+	for rows.Next() {
+		var h EmailHeader
+		var recipientsJSON, ccsJSON string
+		if err := rows.Scan(&h.ID, sqliteDate{&h.Date}, &recipientsJSON, &ccsJSON); err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(recipientsJSON), &h.Tos)
+		json.Unmarshal([]byte(ccsJSON), &h.CCs)
+		headers = append(headers, h)
+	}
+	rows.Close()
+	if len(headers) == 0 {
+		return nil
+	}
+
+	log.Logf(log.INFO, "sqlite storage: indexing dates and recipients of %d emails", len(headers))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, header := range headers {
+		if _, err := tx.Exec("UPDATE emails SET timestamp = ? WHERE id = ?", header.Date.UnixMicro(), header.ID); err != nil {
+			return err
+		}
+		if err := insertRecipients(tx, header); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// backfillDeliveredTo fills the delivered_to_json column and adds the mailboxes
+// to the email_recipients table, for the emails filed by Sieve.
+func backfillDeliveredTo(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, recipients_json, ccs_json, raw_email FROM emails WHERE instr(raw_email, ?) > 0", multipart.FolderHeader+":")
+	if err != nil {
+		return err
+	}
+	var headers []EmailHeader
+	for rows.Next() {
+		var h EmailHeader
+		var recipientsJSON, ccsJSON string
+		var raw []byte
+		if err := rows.Scan(&h.ID, &recipientsJSON, &ccsJSON, &raw); err != nil {
+			continue
+		}
+		mp, err := multipart.ParseEmailFromBytes(raw)
+		if err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(recipientsJSON), &h.Tos)
+		json.Unmarshal([]byte(ccsJSON), &h.CCs)
+		h.DeliveredTo = mp.GetPlacementMailboxes()
+		headers = append(headers, h)
+	}
+	rows.Close()
+	if len(headers) == 0 {
+		return nil
+	}
+
+	log.Logf(log.INFO, "sqlite storage: indexing the Sieve mailboxes of %d emails", len(headers))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, header := range headers {
+		deliveredToJSON, _ := json.Marshal(header.DeliveredTo)
+		if _, err := tx.Exec("UPDATE emails SET delivered_to_json = ? WHERE id = ?", string(deliveredToJSON), header.ID); err != nil {
+			return err
+		}
+		if err := insertRecipients(tx, header); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertRecipients normalizes the To and Cc addresses, and the mailboxes Sieve
+// delivered the email to, matched by mailbox:.
+func insertRecipients(tx *sql.Tx, header EmailHeader) error {
+	if _, err := tx.Exec("DELETE FROM email_recipients WHERE email_id = ?", header.ID); err != nil {
+		return err
+	}
+	var addresses []string
+	for _, recipient := range append(append([]EmailAddress{}, header.Tos...), header.CCs...) {
+		addresses = append(addresses, recipient.Address)
+	}
+	for _, address := range append(addresses, header.DeliveredTo...) {
+		if address == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO email_recipients (email_id, address) VALUES (?, ?)", header.ID, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // load hydrates from root storage (if this is not the root).
 func (s *sqliteStorage) load(rootStorage Storage) error {
 	if rootStorage == nil {
@@ -76,7 +293,7 @@ func (s *sqliteStorage) load(rootStorage Storage) error {
 	var count int
 	s.db.QueryRow("SELECT COUNT(*) FROM emails").Scan(&count)
 	if count > 0 {
-		log.Logf(log.INFO, "sqlite storage: already has %d emails, skipping reload from root", count)
+		log.Logf(log.INFO, "sqlite storage: already has %d emails, skipping reload from root (reindex picks up the changes of the root)", count)
 		return nil
 	}
 
@@ -89,26 +306,46 @@ func (s *sqliteStorage) load(rootStorage Storage) error {
 
 	for _, header := range emails {
 		raw, _ := rootStorage.GetRawEmail(header.ID)
-		s.insertEmailHeader(header, raw)
+		var document searchDocument
+		if mp, err := multipart.ParseEmailFromBytes(raw); err == nil {
+			document = newSearchDocument(mp)
+		}
+		s.insertEmailHeader(header, raw, document)
 	}
 
 	log.Logf(log.INFO, "sqlite storage: loaded %d emails from root", len(emails))
 	return nil
 }
 
-func (s *sqliteStorage) insertEmailHeader(header EmailHeader, raw []byte) error {
+func (s *sqliteStorage) insertEmailHeader(header EmailHeader, raw []byte, document searchDocument) error {
 	recipientsJSON, _ := json.Marshal(header.Tos)
 	ccsJSON, _ := json.Marshal(header.CCs)
+	deliveredToJSON, _ := json.Marshal(header.DeliveredTo)
 	versionsJSON, _ := json.Marshal(header.BodyVersions)
 
-	_, err := s.db.Exec(`
-		INSERT OR REPLACE INTO emails (id, sender_name, sender_address, subject, date, has_attachments, preview, recipients_json, ccs_json, body_versions_json, raw_email)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO emails (id, sender_name, sender_address, subject, date, has_attachments, preview, recipients_json, ccs_json, delivered_to_json, body_versions_json, raw_email, timestamp, received)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		header.ID, header.From.Name, header.From.Address, header.Subject,
 		header.Date, header.HasAttachments, header.Preview,
-		string(recipientsJSON), string(ccsJSON), string(versionsJSON), raw,
+		string(recipientsJSON), string(ccsJSON), string(deliveredToJSON), string(versionsJSON), raw,
+		header.Date.UnixMicro(), sqliteMicros{&header.ReceivedAt},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := insertRecipients(tx, header); err != nil {
+		return err
+	}
+	if err := insertSearchDocument(tx, header.ID, document); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // setWithID stores email metadata and raw bytes in SQLite.
@@ -124,54 +361,145 @@ func (s *sqliteStorage) setWithID(emailID string, rawEmail []byte) error {
 	}
 
 	header := newEmailHeaderFromMultipart(emailID, mp)
-	return s.insertEmailHeader(header, rawEmail)
+	header.ReceivedAt = time.Now().UTC()
+	return s.insertEmailHeader(header, rawEmail, newSearchDocument(mp))
+}
+
+// --- Full-text index ---
+
+// searchDocument is the decoded text of an email indexed in emails_fts, the
+// text matched by the free text searches of the other layers.
+type searchDocument struct {
+	subject     string
+	addresses   string
+	body        string
+	htmlText    string
+	html        string
+	attachments string
+}
+
+func newSearchDocument(mp *multipart.Multipart) searchDocument {
+	text := mp.GetSearchText()
+	return searchDocument{
+		subject:     text.Subject,
+		addresses:   text.Addresses,
+		body:        text.Body,
+		htmlText:    text.HTMLText,
+		html:        text.HTML,
+		attachments: text.Attachments,
+	}
+}
+
+func insertSearchDocument(tx *sql.Tx, emailID string, document searchDocument) error {
+	if _, err := tx.Exec("DELETE FROM emails_fts WHERE id = ?", emailID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO emails_fts (id, subject, addresses, body, html_text, attachments, html) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		emailID, document.subject, document.addresses, document.body, document.htmlText, document.attachments, document.html)
+	return err
+}
+
+// reindexFullText rebuilds the full-text index from the raw emails. Unless forced,
+// nothing is done when every email is already indexed.
+func (s *sqliteStorage) reindexFullText(force bool) error {
+	if !force {
+		var emails, documents int
+		s.db.QueryRow("SELECT COUNT(*) FROM emails").Scan(&emails)
+		s.db.QueryRow("SELECT COUNT(*) FROM emails_fts").Scan(&documents)
+		if emails == documents {
+			return nil
+		}
+	}
+	log.Logf(log.INFO, "sqlite storage: rebuilding the full-text index")
+	rows, err := s.db.Query("SELECT id, raw_email FROM emails")
+	if err != nil {
+		return err
+	}
+	documents := make(map[string]searchDocument)
+	for rows.Next() {
+		var id string
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			continue
+		}
+		if mp, err := multipart.ParseEmailFromBytes(raw); err == nil {
+			documents[id] = newSearchDocument(mp)
+		} else {
+			documents[id] = searchDocument{}
+		}
+	}
+	rows.Close()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM emails_fts"); err != nil {
+		return err
+	}
+	for id, document := range documents {
+		if err := insertSearchDocument(tx, id, document); err != nil {
+			return err
+		}
+	}
+	log.Logf(log.INFO, "sqlite storage: indexed %d emails", len(documents))
+	return tx.Commit()
 }
 
 // --- Search methods ---
 
 func (s *sqliteStorage) SearchEmails(query string, page int, pageSize int) ([]EmailHeader, int, error) {
+	return s.SearchEmailsContext(context.Background(), query, page, pageSize)
+}
+
+// SearchEmailsContext implements ContextStorage: the driver interrupts the
+// running query when the context is done.
+func (s *sqliteStorage) SearchEmailsContext(ctx context.Context, query string, page int, pageSize int) ([]EmailHeader, int, error) {
 	if page < 1 {
 		return nil, 0, fmt.Errorf("invalid page number: %v", page)
 	}
 
-	// For complex queries with matchers, we fall back to loading all and filtering
-	// because the matcher system uses multipart parsing not SQL
 	matchers, err := matcher.ParseQuery(query)
 	if err != nil {
 		return nil, 0, err
 	}
+	search := newSQLSearch(matchers, time.Now())
 
-	// Simple case: no query — use SQL pagination directly
-	if len(matchers) == 0 {
-		return s.searchAllSQL(page, pageSize)
+	// Matchers that cannot be expressed in SQL are checked on the parsed raw emails
+	if len(search.goMatchers) > 0 {
+		return s.searchWithGoMatchers(ctx, search, page, pageSize)
 	}
 
-	// Complex case: load all headers, filter with matchers using raw email
-	return s.searchWithMatchers(matchers, page, pageSize)
-}
-
-func (s *sqliteStorage) searchAllSQL(page, pageSize int) ([]EmailHeader, int, error) {
 	var total int
-	s.db.QueryRow("SELECT COUNT(*) FROM emails").Scan(&total)
-
-	var rows *sql.Rows
-	var err error
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+search.from()+search.where(), search.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit, offset := pageSize, (page-1)*pageSize
 	if pageSize < 0 {
-		rows, err = s.db.Query("SELECT id, sender_name, sender_address, subject, date, has_attachments, preview, recipients_json, ccs_json, body_versions_json FROM emails ORDER BY date DESC")
-	} else {
-		offset := (page - 1) * pageSize
-		rows, err = s.db.Query("SELECT id, sender_name, sender_address, subject, date, has_attachments, preview, recipients_json, ccs_json, body_versions_json FROM emails ORDER BY date DESC LIMIT ? OFFSET ?", pageSize, offset)
+		limit, offset = -1, 0 // no limit
 	}
+	rows, err := s.db.QueryContext(ctx, search.selectHeaders("")+" LIMIT ? OFFSET ?", append(search.args, limit, offset)...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
-	return s.scanEmailHeaders(rows, total)
+	var headers []EmailHeader
+	for rows.Next() {
+		header, err := scanSearchResult(rows)
+		if err != nil {
+			continue
+		}
+		headers = append(headers, header)
+	}
+	return headers, total, rows.Err()
 }
 
-func (s *sqliteStorage) searchWithMatchers(matchers []interface{}, page, pageSize int) ([]EmailHeader, int, error) {
-	rows, err := s.db.Query("SELECT id, raw_email FROM emails ORDER BY date DESC")
+// searchWithGoMatchers narrows the candidates in SQL, then filters them with the
+// remaining matchers and paginates the results.
+func (s *sqliteStorage) searchWithGoMatchers(ctx context.Context, search sqlSearch, page, pageSize int) ([]EmailHeader, int, error) {
+	rows, err := s.db.QueryContext(ctx, search.selectHeaders(", e.raw_email"), search.args...)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -179,27 +507,27 @@ func (s *sqliteStorage) searchWithMatchers(matchers []interface{}, page, pageSiz
 
 	var allResults []EmailHeader
 	for rows.Next() {
-		var id string
 		var raw []byte
-		if err := rows.Scan(&id, &raw); err != nil {
+		header, err := scanSearchResult(rows, &raw)
+		if err != nil || raw == nil {
 			continue
 		}
-		if raw == nil {
-			continue
-		}
-		msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
-		if err != nil {
-			continue
-		}
-		mp, err := multipart.New(msg)
+		mp, err := multipart.ParseEmailFromBytes(raw)
 		if err != nil {
 			continue
 		}
-		if mp.MatchAll(matchers) {
-			allResults = append(allResults, newEmailHeaderFromMultipart(id, mp))
+		if mp.MatchAll(search.goMatchers) {
+			allResults = append(allResults, header)
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return paginateHeaders(allResults, page, pageSize)
+}
 
+// paginateHeaders returns the requested page of the results and the total number of results.
+func paginateHeaders(allResults []EmailHeader, page, pageSize int) ([]EmailHeader, int, error) {
 	totalMatches := len(allResults)
 	start := (page - 1) * pageSize
 	end := start + pageSize
@@ -216,27 +544,164 @@ func (s *sqliteStorage) searchWithMatchers(matchers []interface{}, page, pageSiz
 	return allResults[start:end], totalMatches, nil
 }
 
-func (s *sqliteStorage) scanEmailHeaders(rows *sql.Rows, total int) ([]EmailHeader, int, error) {
-	var headers []EmailHeader
-	for rows.Next() {
-		var h EmailHeader
-		var recipientsJSON, ccsJSON, versionsJSON string
-		err := rows.Scan(&h.ID, &h.From.Name, &h.From.Address, &h.Subject,
-			&h.Date, &h.HasAttachments, &h.Preview,
-			&recipientsJSON, &ccsJSON, &versionsJSON)
-		if err != nil {
-			continue
+// sqlSearch is a search query translated to SQL. Free text and subjects are
+// answered by emails_fts, sorted by relevance with a highlighted snippet; the
+// other matchers become conditions on the indexed columns of emails.
+type sqlSearch struct {
+	phrases    []string      // FTS5 query, the trigram tokenizer matching substrings
+	conditions []string      // conditions on emails (e) and emails_fts
+	args       []interface{} // bound parameters: the MATCH query, then the conditions
+	goMatchers []interface{} // matchers that cannot be expressed in SQL
+}
+
+func newSQLSearch(matchers []interface{}, now time.Time) sqlSearch {
+	var search sqlSearch
+	for _, m := range matchers {
+		switch mt := m.(type) {
+		case matcher.PlainTextMatch:
+			if phrase, ok := fullTextPhrase(mt.GetText()); ok {
+				search.phrases = append(search.phrases, phrase)
+				continue
+			}
+			// texts too short for trigrams
+			var columns []string
+			for _, column := range []string{"subject", "addresses", "body", "html_text", "attachments", "html"} {
+				columns = append(columns, "emails_fts."+column+` LIKE ? ESCAPE '\'`)
+				search.args = append(search.args, likePattern(mt.GetText()))
+			}
+			search.conditions = append(search.conditions, "("+strings.Join(columns, " OR ")+")")
+		case matcher.SubjectMatch:
+			if phrase, ok := fullTextPhrase(mt.GetSubject()); ok {
+				search.phrases = append(search.phrases, "subject : "+phrase)
+				continue
+			}
+			search.addCondition(`emails_fts.subject LIKE ? ESCAPE '\'`, likePattern(mt.GetSubject()))
+		case matcher.FromMatch:
+			search.addCondition("e.sender_address = ? COLLATE NOCASE", mt.GetFrom())
+		case matcher.MailboxMatch:
+			search.addCondition("e.id IN (SELECT email_id FROM email_recipients WHERE address = ? COLLATE NOCASE)", mt.GetMailbox())
+		case matcher.AttachmentMatch:
+			search.addCondition("e.has_attachments")
+		case matcher.BeforeMatch:
+			search.addCondition("e.timestamp < ?", mt.GetDate().UnixMicro())
+		case matcher.AfterMatch:
+			search.addCondition("e.timestamp > ?", mt.GetDate().UnixMicro())
+		case matcher.NewerThanMatch:
+			search.addCondition("e.timestamp > ?", now.Add(-mt.GetDuration()).UnixMicro())
+		case matcher.OlderThanMatch:
+			search.addCondition("e.timestamp < ?", now.Add(-mt.GetDuration()).UnixMicro())
+		default:
+			search.goMatchers = append(search.goMatchers, m)
 		}
-		json.Unmarshal([]byte(recipientsJSON), &h.Tos)
-		json.Unmarshal([]byte(ccsJSON), &h.CCs)
-		json.Unmarshal([]byte(versionsJSON), &h.BodyVersions)
-		headers = append(headers, h)
 	}
-	return headers, total, nil
+	if len(search.phrases) > 0 {
+		search.args = append([]interface{}{strings.Join(search.phrases, " AND ")}, search.args...)
+	}
+	return search
+}
+
+func (search *sqlSearch) addCondition(condition string, args ...interface{}) {
+	search.conditions = append(search.conditions, condition)
+	search.args = append(search.args, args...)
+}
+
+func (search sqlSearch) usesFullText() bool {
+	return len(search.phrases) > 0 || strings.Contains(strings.Join(search.conditions, " "), "emails_fts.")
+}
+
+func (search sqlSearch) from() string {
+	if search.usesFullText() {
+		return "emails e JOIN emails_fts ON emails_fts.id = e.id"
+	}
+	return "emails e"
+}
+
+// where returns the WHERE clause, the MATCH being bound by the first parameter.
+func (search sqlSearch) where() string {
+	conditions := search.conditions
+	if len(search.phrases) > 0 {
+		conditions = append([]string{"emails_fts MATCH ?"}, conditions...)
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// selectHeaders returns the query of the sorted email headers, followed by the
+// snippet and the extra columns.
+func (search sqlSearch) selectHeaders(extraColumns string) string {
+	snippet, order := "''", "e.timestamp DESC"
+	if len(search.phrases) > 0 {
+		// bm25 and snippet are only available for a MATCH query
+		snippet = fullTextSnippet
+		order = "bm25(emails_fts, " + fullTextWeights + "), e.timestamp DESC"
+	}
+	return "SELECT e.id, e.sender_name, e.sender_address, e.subject, e.date, e.received, e.has_attachments, e.preview, e.recipients_json, e.ccs_json, e.delivered_to_json, e.body_versions_json, " +
+		snippet + extraColumns + " FROM " + search.from() + search.where() + " ORDER BY " + order
+}
+
+// fullTextSnippet is the snippet of the best matching column, the HTML text
+// rather than the HTML as written when both match.
+var fullTextSnippet = func() string {
+	column := func(index int) string {
+		return fmt.Sprintf("snippet(emails_fts, %d, char(2), char(3), '…', 64)", index)
+	}
+	return "CASE WHEN " + column(-1) + " = " + column(6) + " AND instr(" + column(4) + ", char(2)) > 0 THEN " +
+		column(4) + " ELSE " + column(-1) + " END"
+}()
+
+// fullTextWeights ranks the matches of the subject, addresses and attachment
+// names above the matches of the body (id, subject, addresses, body, html_text, attachments, html).
+const fullTextWeights = "0, 10, 5, 1, 1, 5, 1"
+
+// fullTextPhrase quotes a text as an FTS5 phrase. The trigram tokenizer needs at
+// least three characters.
+func fullTextPhrase(text string) (string, bool) {
+	if utf8.RuneCountInString(text) < 3 {
+		return "", false
+	}
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`, true
+}
+
+func likePattern(text string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + escaper.Replace(text) + "%"
+}
+
+// highlightSnippet escapes a snippet for HTML, the matches delimited by \x02 and
+// \x03 becoming <mark> elements.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, "\x02", "<mark>")
+	return strings.ReplaceAll(snippet, "\x03", "</mark>")
+}
+
+// scanSearchResult scans a row of sqlSearch.selectHeaders, with its extra columns.
+func scanSearchResult(rows *sql.Rows, extra ...interface{}) (EmailHeader, error) {
+	var h EmailHeader
+	var recipientsJSON, ccsJSON, deliveredToJSON, versionsJSON string
+	dest := []interface{}{&h.ID, &h.From.Name, &h.From.Address, &h.Subject,
+		sqliteDate{&h.Date}, sqliteMicros{&h.ReceivedAt}, &h.HasAttachments, &h.Preview,
+		&recipientsJSON, &ccsJSON, &deliveredToJSON, &versionsJSON, &h.Snippet}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return EmailHeader{}, err
+	}
+	json.Unmarshal([]byte(recipientsJSON), &h.Tos)
+	json.Unmarshal([]byte(ccsJSON), &h.CCs)
+	json.Unmarshal([]byte(deliveredToJSON), &h.DeliveredTo)
+	json.Unmarshal([]byte(versionsJSON), &h.BodyVersions)
+	h.Snippet = highlightSnippet(h.Snippet)
+	return h, nil
 }
 
 func (s *sqliteStorage) GetMailboxes() ([]Mailbox, error) {
-	rows, err := s.db.Query("SELECT DISTINCT recipients_json FROM emails")
+	return s.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext implements ContextStorage.
+func (s *sqliteStorage) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT recipients_json, delivered_to_json FROM emails")
 	if err != nil {
 		return nil, err
 	}
@@ -244,8 +709,8 @@ func (s *sqliteStorage) GetMailboxes() ([]Mailbox, error) {
 
 	recipients := make(map[string]bool)
 	for rows.Next() {
-		var recipientsJSON string
-		if err := rows.Scan(&recipientsJSON); err != nil {
+		var recipientsJSON, deliveredToJSON string
+		if err := rows.Scan(&recipientsJSON, &deliveredToJSON); err != nil {
 			continue
 		}
 		var addrs []EmailAddress
@@ -255,6 +720,11 @@ func (s *sqliteStorage) GetMailboxes() ([]Mailbox, error) {
 				recipients[a.Address] = true
 			}
 		}
+		var mailboxes []string
+		json.Unmarshal([]byte(deliveredToJSON), &mailboxes)
+		for _, mailbox := range mailboxes {
+			recipients[mailbox] = true
+		}
 	}
 
 	mailboxes := make([]Mailbox, 0, len(recipients))
@@ -270,18 +740,22 @@ func (s *sqliteStorage) GetMailboxes() ([]Mailbox, error) {
 // --- Read methods (for root/all scope) ---
 
 func (s *sqliteStorage) GetEmailByID(emailID string) (EmailHeader, error) {
-	row := s.db.QueryRow("SELECT id, sender_name, sender_address, subject, date, has_attachments, preview, recipients_json, ccs_json, body_versions_json FROM emails WHERE id = ?", emailID)
+	row := s.db.QueryRow("SELECT id, sender_name, sender_address, subject, date, received, has_attachments, preview, recipients_json, ccs_json, delivered_to_json, body_versions_json FROM emails WHERE id = ?", emailID)
 
 	var h EmailHeader
-	var recipientsJSON, ccsJSON, versionsJSON string
+	var recipientsJSON, ccsJSON, deliveredToJSON, versionsJSON string
 	err := row.Scan(&h.ID, &h.From.Name, &h.From.Address, &h.Subject,
-		&h.Date, &h.HasAttachments, &h.Preview,
-		&recipientsJSON, &ccsJSON, &versionsJSON)
+		sqliteDate{&h.Date}, sqliteMicros{&h.ReceivedAt}, &h.HasAttachments, &h.Preview,
+		&recipientsJSON, &ccsJSON, &deliveredToJSON, &versionsJSON)
+	if err == sql.ErrNoRows {
+		return EmailHeader{}, newEmailNotFoundError("sqlite", emailID)
+	}
 	if err != nil {
-		return EmailHeader{}, fmt.Errorf("email not found in sqlite: %s", emailID)
+		return EmailHeader{}, err
 	}
 	json.Unmarshal([]byte(recipientsJSON), &h.Tos)
 	json.Unmarshal([]byte(ccsJSON), &h.CCs)
+	json.Unmarshal([]byte(deliveredToJSON), &h.DeliveredTo)
 	json.Unmarshal([]byte(versionsJSON), &h.BodyVersions)
 	return h, nil
 }
@@ -322,10 +796,7 @@ func (s *sqliteStorage) GetAttachments(emailID string) ([]AttachmentHeader, erro
 	}
 	var headers []AttachmentHeader
 	for id, node := range mp.GetAttachments() {
-		headers = append(headers, AttachmentHeader{
-			ID: id, ContentType: node.GetContentType(),
-			Filename: node.GetFilename(), Size: node.GetSize(),
-		})
+		headers = append(headers, newAttachmentHeader(id, node))
 	}
 	return headers, nil
 }
@@ -345,41 +816,161 @@ func (s *sqliteStorage) GetAttachment(emailID string, attachmentID string) (Atta
 	}
 	node, found := mp.GetAttachment(attachmentID)
 	if !found {
-		return Attachment{}, fmt.Errorf("attachment not found: %s/%s", emailID, attachmentID)
+		return Attachment{}, newAttachmentNotFoundError("sqlite", emailID, attachmentID)
 	}
 	return Attachment{
-		AttachmentHeader: AttachmentHeader{
-			ID: attachmentID, ContentType: node.GetContentType(),
-			Filename: node.GetFilename(), Size: node.GetSize(),
-		},
-		Data: []byte(node.GetDecodedBody()),
+		AttachmentHeader: newAttachmentHeader(attachmentID, node),
+		Data:             []byte(node.GetDecodedBody()),
 	}, nil
 }
 
 func (s *sqliteStorage) GetRawEmail(emailID string) ([]byte, error) {
+	return s.GetRawEmailContext(context.Background(), emailID)
+}
+
+// GetRawEmailContext implements RawContextStorage, interrupting the query.
+func (s *sqliteStorage) GetRawEmailContext(ctx context.Context, emailID string) ([]byte, error) {
 	var raw []byte
-	err := s.db.QueryRow("SELECT raw_email FROM emails WHERE id = ?", emailID).Scan(&raw)
+	err := s.db.QueryRowContext(ctx, "SELECT raw_email FROM emails WHERE id = ?", emailID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, newEmailNotFoundError("sqlite", emailID)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("raw email not found in sqlite: %s", emailID)
+		return nil, err
 	}
 	return raw, nil
 }
 
+// sqliteChunkSize is the size of the raw email chunks read by OpenRawEmail.
+// SQLite reads the whole value to take a substring of it, so the chunks are
+// large enough for a few queries per email, and small enough to keep the Go
+// memory bounded.
+const sqliteChunkSize = 4 << 20
+
+// OpenRawEmail implements StreamingStorage, reading the raw email by chunks.
+func (s *sqliteStorage) OpenRawEmail(emailID string) (io.ReadSeekCloser, error) {
+	var size int64
+	err := s.db.QueryRow("SELECT length(raw_email) FROM emails WHERE id = ?", emailID).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil, newEmailNotFoundError("sqlite", emailID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := &sqliteRawEmail{db: s.db, emailID: emailID}
+	return sectionContent{io.NewSectionReader(reader, 0, size), reader}, nil
+}
+
+// OpenAttachment implements StreamingStorage.
+func (s *sqliteStorage) OpenAttachment(emailID string, attachmentID string) (AttachmentHeader, io.ReadSeekCloser, error) {
+	raw, err := s.OpenRawEmail(emailID)
+	if err != nil {
+		return AttachmentHeader{}, nil, err
+	}
+	defer raw.Close()
+	return openAttachmentFrom(raw, "sqlite", emailID, attachmentID, false)
+}
+
+// sqliteRawEmail reads the raw email column at an offset, keeping the last chunk
+// read for the next sequential reads.
+type sqliteRawEmail struct {
+	db          *sql.DB
+	emailID     string
+	chunk       []byte
+	chunkOffset int64
+}
+
+func (r *sqliteRawEmail) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		position := off + int64(read)
+		if position < r.chunkOffset || position >= r.chunkOffset+int64(len(r.chunk)) {
+			if err := r.readChunk(position - position%sqliteChunkSize); err != nil {
+				return read, err
+			}
+			if position >= r.chunkOffset+int64(len(r.chunk)) {
+				return read, io.EOF
+			}
+		}
+		read += copy(p[read:], r.chunk[position-r.chunkOffset:])
+	}
+	return read, nil
+}
+
+func (r *sqliteRawEmail) readChunk(offset int64) error {
+	var chunk []byte
+	// substr counts from 1
+	err := r.db.QueryRow("SELECT substr(raw_email, ?, ?) FROM emails WHERE id = ?", offset+1, sqliteChunkSize, r.emailID).Scan(&chunk)
+	if err == sql.ErrNoRows {
+		return newEmailNotFoundError("sqlite", r.emailID)
+	}
+	if err != nil {
+		return err
+	}
+	r.chunk = chunk
+	r.chunkOffset = offset
+	return nil
+}
+
+// Close releases the chunk read.
+func (r *sqliteRawEmail) Close() error {
+	r.chunk = nil
+	return nil
+}
+
 // --- Write methods ---
 
 func (s *sqliteStorage) DeleteAllEmails() error {
+	if _, err := s.db.Exec("DELETE FROM emails_fts; DELETE FROM email_recipients"); err != nil {
+		return err
+	}
 	_, err := s.db.Exec("DELETE FROM emails")
 	return err
 }
 
 func (s *sqliteStorage) DeleteEmailByID(emailID string) error {
+	if _, err := s.db.Exec("DELETE FROM emails_fts WHERE id = ?", emailID); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("DELETE FROM email_recipients WHERE email_id = ?", emailID); err != nil {
+		return err
+	}
 	result, err := s.db.Exec("DELETE FROM emails WHERE id = ?", emailID)
 	if err != nil {
 		return err
 	}
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("email not found in sqlite: %s", emailID)
+		return newEmailNotFoundError("sqlite", emailID)
+	}
+	return nil
+}
+
+// sqliteDate scans the date column, written by the driver with time.Time.String.
+// The driver only parses it back for named time zones ("+0000 UTC", not "+0700 +0700").
+type sqliteDate struct {
+	date *time.Time
+}
+
+func (d sqliteDate) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d.date = time.Time{}
+	case time.Time:
+		*d.date = v
+	case string:
+		// "2006-01-02 15:04:05.999999999 -0700 MST", without the zone name
+		fields := strings.Fields(v)
+		if len(fields) < 3 {
+			return fmt.Errorf("cannot parse date %q", v)
+		}
+		date, err := time.Parse("2006-01-02 15:04:05.999999999 -0700", strings.Join(fields[:3], " "))
+		if err != nil {
+			return fmt.Errorf("cannot parse date %q: %v", v, err)
+		}
+		*d.date = date
+	default:
+		return fmt.Errorf("cannot scan %T as a date", value)
 	}
 	return nil
 }
@@ -399,3 +990,27 @@ func emailVersionToString(v EmailVersionType) (string, error) {
 		return "", fmt.Errorf("unknown version type: %d", v)
 	}
 }
+
+// sqliteMicros stores a time as Unix microseconds, 0 for the zero time.
+type sqliteMicros struct {
+	time *time.Time
+}
+
+func (m sqliteMicros) Value() (driver.Value, error) {
+	if m.time.IsZero() {
+		return int64(0), nil
+	}
+	return m.time.UnixMicro(), nil
+}
+
+func (m sqliteMicros) Scan(value interface{}) error {
+	micros, ok := value.(int64)
+	if value != nil && !ok {
+		return fmt.Errorf("cannot scan %T as a time", value)
+	}
+	*m.time = time.Time{}
+	if micros != 0 {
+		*m.time = time.UnixMicro(micros).UTC()
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fullTextEmails = []string{
+	"From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: Quarterly report\r\nDate: Mon, 01 Jan 2024 10:00:00 +0000\r\n\r\nThe numbers are in the spreadsheet.\r\n",
+	"From: carol@example.com\r\nTo: bob@example.com\r\nSubject: Lunch\r\nDate: Tue, 02 Jan 2024 10:00:00 +0000\r\nContent-Type: text/html\r\n\r\n<p>About the <b>report</b>: see you at <i>noon</i> &amp; bring it</p>\r\n",
+	"From: dave@example.com\r\nTo: erin@example.com\r\nSubject: Files\r\nDate: Wed, 03 Jan 2024 10:00:00 +0000\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"invoice-42.pdf\"\r\n\r\nPDF\r\n--b--\r\n",
+}
+
+func newFullTextTestStorage(t *testing.T) (*sqliteStorage, []string) {
+	t.Helper()
+	storage, err := newSqliteStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.db.Close() })
+	ids := []string{"2024-01-01-a", "2024-01-02-c", "2024-01-03-d"}
+	for i, raw := range fullTextEmails {
+		if err := storage.setWithID(ids[i], []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage, ids
+}
+
+func searchIDs(t *testing.T, storage Storage, query string) ([]string, []EmailHeader) {
+	t.Helper()
+	headers, total, err := storage.SearchEmails(query, 1, -1)
+	if err != nil {
+		t.Fatalf("search %q: %v", query, err)
+	}
+	if total != len(headers) {
+		t.Errorf("search %q: total %d for %d results", query, total, len(headers))
+	}
+	var ids []string
+	for _, header := range headers {
+		ids = append(ids, header.ID)
+	}
+	return ids, headers
+}
+
+func TestSqliteFullTextSearch(t *testing.T) {
+	storage, ids := newFullTextTestStorage(t)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"spreadsheet", []string{ids[0]}},
+		{"NOON", []string{ids[1]}},           // HTML text, case insensitive
+		{"invoice-42", []string{ids[2]}},     // attachment filename
+		{"Alice", []string{ids[0]}},          // sender name
+		{"erin@example", []string{ids[2]}},   // recipient address
+		{"subject:report", []string{ids[0]}}, // subject only
+		{"report from:carol@example.com", []string{ids[1]}},
+		{"b>", []string{ids[1]}},                 // tags, as written
+		{"ee", []string{ids[2], ids[1], ids[0]}}, // too short for trigrams, by date
+	}
+	for _, test := range tests {
+		got, _ := searchIDs(t, storage, test.query)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("search %q: expected %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	// the subject match ranks first, with a highlighted snippet
+	got, headers := searchIDs(t, storage, "report")
+	if len(got) != 2 || got[0] != ids[0] {
+		t.Fatalf("expected the subject match first, got %v", got)
+	}
+	if headers[0].Snippet != "Quarterly <mark>report</mark>" {
+		t.Errorf("unexpected snippet %q", headers[0].Snippet)
+	}
+	if !strings.Contains(headers[1].Snippet, "<mark>report</mark> : see you at noon &amp; bring it") {
+		t.Errorf("snippet should be HTML-escaped, got %q", headers[1].Snippet)
+	}
+
+	if err := storage.DeleteEmailByID(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := searchIDs(t, storage, "spreadsheet"); len(got) != 0 {
+		t.Errorf("deleted email should not be found, got %v", got)
+	}
+}
+
+// TestSqliteFullTextAsMemory checks that the full-text index matches the same
+// emails as the free text matcher of the memory storage.
+func TestSqliteFullTextAsMemory(t *testing.T) {
+	storage, ids := newFullTextTestStorage(t)
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, raw := range fullTextEmails {
+		if err := memory.setWithID(ids[i], []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []string{
+		"spreadsheet",
+		"noon",           // HTML text
+		"amp",            // HTML entity
+		"b>",             // HTML tag
+		"<i>noon</i>",    // HTML markup
+		"invoice-42.pdf", // attachment filename
+		"PDF",            // attachment content
+		"alice",          // sender name
+		"erin@example",   // recipient address
+		"see",
+	} {
+		expected, _ := searchIDs(t, memory, query)
+		got, _ := searchIDs(t, storage, query)
+		sort.Strings(expected)
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("search %q: expected %v, got %v", query, expected, got)
+		}
+	}
+}
+
+func TestSqliteFullTextReindex(t *testing.T) {
+	storage, ids := newFullTextTestStorage(t)
+	// a database created before the full-text index
+	if _, err := storage.db.Exec("DELETE FROM emails_fts"); err != nil {
+		t.Fatal(err)
+	}
+	storage.db.Close()
+
+	reopened, err := newSqliteStorage(storage.databaseFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.db.Close()
+	if got, _ := searchIDs(t, reopened, "spreadsheet"); len(got) != 1 || got[0] != ids[0] {
+		t.Errorf("emails should be reindexed when opening the database, got %v", got)
+	}
+}
+
+func TestSqliteFullTextMigration(t *testing.T) {
+	storage, ids := newFullTextTestStorage(t)
+	// a database created before the HTML bodies were indexed as written
+	if _, err := storage.db.Exec(`DROP TABLE emails_fts;
+		CREATE VIRTUAL TABLE emails_fts USING fts5(id UNINDEXED, subject, addresses, body, html_text, attachments, tokenize = 'trigram');
+		PRAGMA user_version = 3`); err != nil {
+		t.Fatal(err)
+	}
+	storage.db.Close()
+
+	reopened, err := newSqliteStorage(storage.databaseFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.db.Close()
+	if got, _ := searchIDs(t, reopened, "<b>report</b>"); len(got) != 1 || got[0] != ids[1] {
+		t.Errorf("the HTML bodies should be indexed when opening the database, got %v", got)
+	}
+}
+
+// TestSqliteMatchersInSQL checks that the matchers translated to SQL select the
+// same emails as the Go matchers of the memory storage.
+func TestSqliteMatchersInSQL(t *testing.T) {
+	files, err := filepath.Glob("../e2e/testdata/emails/*.eml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test emails: %v", err)
+	}
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := newSqliteStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := filepath.Base(file)
+		if err := memory.setWithID(id, raw); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.setWithID(id, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"from:sender@example.com",
+		"from:SENDER@EXAMPLE.COM",
+		"mailbox:receiver@example.com",
+		"mailbox:Recipient1@example.com",
+		"has:attachment",
+		"before:2020-01-01",
+		"after:2020-01-01",
+		"older_than:1y",
+		"newer_than:1y",
+		"has:attachment mailbox:recipient@example.com",
+		"from:sender@example.com after:2013-09-08",
+		"in:spam",
+	} {
+		expected, _ := searchIDs(t, memory, query)
+		got, _ := searchIDs(t, storage, query)
+		sort.Strings(expected)
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("search %q: expected %v, got %v", query, expected, got)
+		}
+	}
+
+	// pagination runs in SQL
+	headers, total, err := storage.SearchEmails("from:sender@example.com", 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := searchIDs(t, storage, "from:sender@example.com")
+	if total != len(all) || len(headers) != 5 || headers[0].ID != all[5] {
+		t.Errorf("unexpected page 2: %d results of %d", len(headers), total)
+	}
+}
+
+func TestSqliteMigration(t *testing.T) {
+	databaseFilename := filepath.Join(t.TempDir(), "test.db")
+	// a database of the first version, without timestamp and recipients
+	db, err := sql.Open("sqlite", databaseFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE emails (id TEXT PRIMARY KEY, sender_name TEXT DEFAULT '', sender_address TEXT DEFAULT '', subject TEXT DEFAULT '', date DATETIME, has_attachments BOOLEAN DEFAULT FALSE, preview TEXT DEFAULT '', recipients_json TEXT DEFAULT '[]', ccs_json TEXT DEFAULT '[]', body_versions_json TEXT DEFAULT '[]', raw_email BLOB);
+		INSERT INTO emails (id, sender_address, date, recipients_json, raw_email) VALUES (?, 'alice@example.com', ?, '[{"name":"","address":"bob@example.com"}]', ?);
+	`, "old", time.Date(2024, 1, 1, 10, 0, 0, 0, time.FixedZone("", 3600)), fullTextEmails[0])
+	if err == nil {
+		// an email filed by Sieve for carol, who is not a recipient
+		_, err = db.Exec(`INSERT INTO emails (id, sender_address, date, recipients_json, raw_email) VALUES ('redirected', 'sender@example.com', ?, '[{"name":"","address":"bob@example.com"}]', ?)`,
+			testEmailDate(1), sieveTestEmail)
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := newSqliteStorage(databaseFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	for query, expected := range map[string]string{
+		"mailbox:bob@example.com spreadsheet":                       "old",
+		"from:alice@example.com after:2023-12-31 before:2024-01-02": "old",
+		"spreadsheet":               "old",
+		"mailbox:carol@example.com": "redirected",
+	} {
+		if got, _ := searchIDs(t, storage, query); len(got) != 1 || got[0] != expected {
+			t.Errorf("search %q: expected the migrated email %v, got %v", query, expected, got)
+		}
+	}
+	// the receive time of the emails already stored is unknown
+	if header, err := storage.GetEmailByID("old"); err != nil || !header.ReceivedAt.IsZero() {
+		t.Errorf("expected no receive time, got %v (%v)", header.ReceivedAt, err)
+	}
+}
@@ -1,6 +1,30 @@
 package storage
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEmailDate returns the date of the email index of the tests, index seconds
+// after 2024-01-01 10:00 UTC.
+func testEmailDate(index int) time.Time {
+	return time.Date(2024, 1, 1, 10, 0, index, 0, time.UTC)
+}
+
+// testEmail returns a plain text email to the recipients, received at the date.
+func testEmail(index int, date time.Time, recipients ...string) []byte {
+	return []byte(fmt.Sprintf("From: sender@example.com\r\nTo: %v\r\nSubject: email %d\r\nDate: %v\r\n\r\nBody of email %d.\r\n",
+		strings.Join(recipients, ", "), index, date.Format(time.RFC1123Z), index))
+}
+
+// memoryTestEmail returns the email index to rcpt<index>@example.com.
+func memoryTestEmail(index int) []byte {
+	return testEmail(index, testEmailDate(index), fmt.Sprintf("rcpt%d@example.com", index))
+}
 
 func TestParseEmailVersionType(t *testing.T) {
 	tests := []struct {
@@ -31,3 +55,38 @@ func TestParseEmailVersionType(t *testing.T) {
 		t.Errorf("Expected error, got nil")
 	}
 }
+
+// sieveTestEmail is an email to bob, filed into Work for bob and redirected by
+// his script to carol, who is not a recipient.
+var sieveTestEmail = append([]byte("X-Mailbox-Folder: <bob@example.com> Work\r\nX-Mailbox-Folder: <carol@example.com> Inbox\r\n"),
+	testEmail(1, testEmailDate(1), "bob@example.com")...)
+
+func TestSieveMailboxes(t *testing.T) {
+	for name, newLayer := range testLayers() {
+		t.Run(name, func(t *testing.T) {
+			layer := newLayer(t)
+			if err := layer.load(nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := layer.setWithID("redirected", sieveTestEmail); err != nil {
+				t.Fatal(err)
+			}
+			for query, expected := range map[string]int{
+				"mailbox:carol@example.com":          1,
+				"mailbox:CAROL@example.com in:inbox": 1,
+				"mailbox:carol@example.com in:work":  0,
+				"mailbox:carol@example.com Body":     1,
+				"mailbox:bob@example.com in:work":    1,
+				"mailbox:dave@example.com":           0,
+			} {
+				if got, _ := searchIDs(t, layer, query); len(got) != expected {
+					t.Errorf("search %q: expected %d emails, got %v", query, expected, got)
+				}
+			}
+			mailboxes, err := layer.GetMailboxesContext(context.Background())
+			if err != nil || !slices.Contains(mailboxes, Mailbox{Name: "carol@example.com"}) {
+				t.Errorf("expected the mailbox of carol, got %v (%v)", mailboxes, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+
+	"mock-my-mta/storage/multipart"
+)
+
+// StreamingStorage is a storage opening raw emails and attachment contents as
+// streams, without loading them whole. The streams are seekable, for HTTP range
+// requests, and the caller closes them.
+type StreamingStorage interface {
+	// OpenRawEmail opens the raw email content by ID.
+	OpenRawEmail(emailID string) (io.ReadSeekCloser, error)
+	// OpenAttachment opens the decoded content of an attachment by ID.
+	OpenAttachment(emailID string, attachmentID string) (AttachmentHeader, io.ReadSeekCloser, error)
+}
+
+// OpenRawEmail opens the raw email of the storage: as a stream if it is a
+// StreamingStorage, else from the bytes of GetRawEmail.
+func OpenRawEmail(s Storage, emailID string) (io.ReadSeekCloser, error) {
+	if streaming, ok := s.(StreamingStorage); ok {
+		return streaming.OpenRawEmail(emailID)
+	}
+	raw, err := s.GetRawEmail(emailID)
+	if err != nil {
+		return nil, err
+	}
+	return newBytesContent(raw), nil
+}
+
+// OpenAttachment opens an attachment of the storage: as a stream if it is a
+// StreamingStorage, else from the data of GetAttachment.
+func OpenAttachment(s Storage, emailID string, attachmentID string) (AttachmentHeader, io.ReadSeekCloser, error) {
+	if streaming, ok := s.(StreamingStorage); ok {
+		return streaming.OpenAttachment(emailID, attachmentID)
+	}
+	attachment, err := s.GetAttachment(emailID, attachmentID)
+	if err != nil {
+		return AttachmentHeader{}, nil, err
+	}
+	return attachment.AttachmentHeader, newBytesContent(attachment.Data), nil
+}
+
+// bytesContent is a content already in memory.
+type bytesContent struct {
+	*bytes.Reader
+}
+
+func newBytesContent(data []byte) io.ReadSeekCloser {
+	return bytesContent{bytes.NewReader(data)}
+}
+
+func (bytesContent) Close() error {
+	return nil
+}
+
+// sectionContent is a part of an opened file.
+type sectionContent struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// tempContent is a content spooled to a temporary file, removed once closed.
+// A sealed content is decrypted as it is read. The file is not embedded: its
+// ReadAt and WriteTo methods would bypass the decryption.
+type tempContent struct {
+	file   *os.File
+	cipher *tempCipher // nil when not sealed
+	stream cipher.Stream
+}
+
+func (c *tempContent) Read(p []byte) (int, error) {
+	n, err := c.file.Read(p)
+	if c.cipher != nil {
+		c.stream.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *tempContent) Seek(offset int64, whence int) (int64, error) {
+	position, err := c.file.Seek(offset, whence)
+	if err == nil && c.cipher != nil {
+		c.stream = c.cipher.stream(position)
+	}
+	return position, err
+}
+
+func (c *tempContent) Close() error {
+	err := c.file.Close()
+	os.Remove(c.file.Name())
+	return err
+}
+
+// tempCipher seals the temporary files of the storages encrypting the emails at
+// rest, so that the decoded contents are never written in plaintext. AES-CTR
+// keeps them seekable; the random key is only kept in memory, the files being
+// read back by the process that wrote them.
+type tempCipher struct {
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+}
+
+func newTempCipher() (*tempCipher, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &tempCipher{block: block}
+	if _, err := rand.Read(c.iv[:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// stream returns the key stream from an offset of the file.
+func (c *tempCipher) stream(offset int64) cipher.Stream {
+	// the counter is the low 64 bits of the IV, wrapping around like CTR does
+	iv := c.iv
+	counter := binary.BigEndian.Uint64(iv[8:]) + uint64(offset/aes.BlockSize)
+	if counter < binary.BigEndian.Uint64(iv[8:]) {
+		binary.BigEndian.PutUint64(iv[:8], binary.BigEndian.Uint64(iv[:8])+1)
+	}
+	binary.BigEndian.PutUint64(iv[8:], counter)
+	stream := cipher.NewCTR(c.block, iv[:])
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// writer returns a writer sealing the content written from the start of the file.
+func (c *tempCipher) writer(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return cipher.StreamWriter{S: c.stream(0), W: w}
+}
+
+// spoolContent copies the reader to a temporary file, sealed when seal is set,
+// returning its content positioned at the start and the hexadecimal SHA-256 of
+// the bytes.
+func spoolContent(r io.Reader, seal bool) (*tempContent, string, error) {
+	var sealer *tempCipher
+	if seal {
+		var err error
+		if sealer, err = newTempCipher(); err != nil {
+			return nil, "", err
+		}
+	}
+	file, err := os.CreateTemp("", "mock-my-mta-attachment-*")
+	if err != nil {
+		return nil, "", err
+	}
+	content := &tempContent{file: file, cipher: sealer}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sealer.writer(file), hash), r); err != nil {
+		content.Close()
+		return nil, "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		content.Close()
+		return nil, "", err
+	}
+	return content, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// openAttachmentFrom reads the raw email stream of a layer until its attachment,
+// and decodes the attachment to a temporary file, so that neither the email nor
+// the attachment are held in memory. The layers encrypting the emails set seal.
+func openAttachmentFrom(raw io.Reader, layer string, emailID string, attachmentID string, seal bool) (AttachmentHeader, io.ReadSeekCloser, error) {
+	message, err := mail.ReadMessage(raw)
+	if err != nil {
+		return AttachmentHeader{}, nil, fmt.Errorf("cannot parse email %v: %v", emailID, err)
+	}
+	node, body, found, err := multipart.FindAttachment(message, attachmentID)
+	if err != nil {
+		return AttachmentHeader{}, nil, fmt.Errorf("cannot parse email %v: %v", emailID, err)
+	}
+	if !found {
+		return AttachmentHeader{}, nil, newAttachmentNotFoundError(layer, emailID, attachmentID)
+	}
+	content, hash, err := spoolContent(body, seal)
+	if err != nil {
+		return AttachmentHeader{}, nil, fmt.Errorf("cannot read attachment %v of email %v: %v", attachmentID, emailID, err)
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		content.Close()
+		return AttachmentHeader{}, nil, err
+	}
+	// like GetDecodedBody, a decoder failing leaves the content as it was
+	for _, decoder := range node.GetDecoders() {
+		decoded, decodedHash, err := spoolContent(decoder(content), seal)
+		if err != nil {
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				content.Close()
+				return AttachmentHeader{}, nil, err
+			}
+			continue
+		}
+		content.Close()
+		content, hash = decoded, decodedHash
+	}
+	header := AttachmentHeader{
+		ID:          attachmentID,
+		ContentType: node.GetContentType(),
+		Filename:    node.GetFilename(),
+		Size:        int(size),
+		Hash:        hash,
+	}
+	return header, content, nil
+}
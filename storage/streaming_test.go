@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readContent reads a stream whole, then its end again after a seek.
+func readContent(t *testing.T, content io.ReadSeekCloser, tail int64) ([]byte, []byte) {
+	t.Helper()
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := content.Seek(-tail, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	end, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, end
+}
+
+func TestOpenRawEmail(t *testing.T) {
+	t.Setenv("TEST_STORAGE_KEY", strings.Repeat("0123456789abcdef", 4))
+	layers := map[string]func(t *testing.T) storageLayer{
+		"eml": func(t *testing.T) storageLayer {
+			s, _ := newFilesystemStorage(t.TempDir(), "eml")
+			return s
+		},
+		"mailhog": func(t *testing.T) storageLayer {
+			s, _ := newFilesystemStorage(t.TempDir(), "mailhog")
+			return s
+		},
+		"encrypted": func(t *testing.T) storageLayer {
+			s, err := newFilesystemStorageFromParameters(map[string]string{"folder": t.TempDir(), "type": "eml", "compression": "gzip", "encryption_key_env": "TEST_STORAGE_KEY"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"mbox": func(t *testing.T) storageLayer {
+			s, _ := newFilesystemStorage(t.TempDir(), "mbox")
+			return s
+		},
+		"sqlite": func(t *testing.T) storageLayer {
+			s, err := newSqliteStorage(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.db.Close() })
+			return s
+		},
+		"memory": func(t *testing.T) storageLayer {
+			s, _ := newMemoryStorage()
+			return s
+		},
+	}
+	for name, newLayer := range layers {
+		t.Run(name, func(t *testing.T) {
+			layer := newLayer(t)
+			if err := layer.load(nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := layer.setWithID("invoice", invoiceEmail(1)); err != nil {
+				t.Fatal(err)
+			}
+			expected, err := layer.GetRawEmail("invoice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := OpenRawEmail(layer, "invoice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, end := readContent(t, content, 8)
+			if !bytes.Equal(data, expected) || !bytes.Equal(end, expected[len(expected)-8:]) {
+				t.Errorf("unexpected raw email %q, ending with %q", data, end)
+			}
+			if _, err := OpenRawEmail(layer, "missing"); !IsNotFound(err) {
+				t.Errorf("expected a not found error, got %v", err)
+			}
+
+			attachments, err := layer.GetAttachments("invoice")
+			if err != nil || len(attachments) != 1 {
+				t.Fatalf("unexpected attachments %+v: %v", attachments, err)
+			}
+			header, content, err := OpenAttachment(layer, "invoice", attachments[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, end = readContent(t, content, 3)
+			if header.Hash != invoiceHash || header.Filename != "invoice.pdf" || !bytes.HasPrefix(data, []byte("%PDF")) || len(end) != 3 {
+				t.Errorf("unexpected attachment %+v: %q", header, data)
+			}
+			if _, _, err := OpenAttachment(layer, "invoice", "missing"); !IsNotFound(err) {
+				t.Errorf("expected a not found error, got %v", err)
+			}
+		})
+	}
+}
+
+// TestOpenAttachmentDecodesAsParsed checks that the attachments decoded from the
+// raw email streams are the attachments of the parsed emails.
+func TestOpenAttachmentDecodesAsParsed(t *testing.T) {
+	files, err := filepath.Glob("../e2e/testdata/emails/*.eml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test emails: %v", err)
+	}
+	storage, err := newFilesystemStorage(t.TempDir(), "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := map[string][]byte{
+		// the encoded body is served when it cannot be decoded
+		"invalid-base64": []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: invalid\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=\"notes.txt\"\r\nContent-Transfer-Encoding: base64\r\n\r\nnot base64!\r\n--b--\r\n"),
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emails[strings.TrimSuffix(filepath.Base(file), ".eml")] = raw
+	}
+	opened := 0
+	for emailID, raw := range emails {
+		if err := storage.setWithID(emailID, raw); err != nil {
+			t.Fatal(err)
+		}
+		attachments, err := storage.GetAttachments(emailID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, attachment := range attachments {
+			expected, err := storage.GetAttachment(emailID, attachment.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, content, err := storage.OpenAttachment(emailID, attachment.ID)
+			if err != nil {
+				t.Fatalf("%v: %v", emailID, err)
+			}
+			data, _ := readContent(t, content, 0)
+			if header != expected.AttachmentHeader || !bytes.Equal(data, expected.Data) {
+				t.Errorf("%v: expected attachment %+v, got %+v", emailID, expected.AttachmentHeader, header)
+			}
+			opened++
+		}
+	}
+	if opened < 3 {
+		t.Errorf("expected test emails with attachments, got %d attachments", opened)
+	}
+}
+
+func TestSpoolSealedContent(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef-"), 1000)
+	content, hash, err := spoolContent(bytes.NewReader(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, err := os.ReadFile(content.file.Name()); err != nil || bytes.Contains(onDisk, data[:32]) {
+		t.Errorf("expected the spooled file sealed, got %q (%v)", onDisk[:32], err)
+	}
+	if hash != fmt.Sprintf("%x", sha256.Sum256(data)) {
+		t.Errorf("expected the hash of the content, got %v", hash)
+	}
+	// the tail starts in the middle of a cipher block
+	got, end := readContent(t, content, 1000-5)
+	if !bytes.Equal(got, data) || !bytes.Equal(end, data[len(data)-995:]) {
+		t.Errorf("unexpected content %q, end %q", got[:32], end[:32])
+	}
+	if _, err := os.Stat(content.file.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the spooled file removed, got %v", err)
+	}
+}
+
+func TestSqliteOpenRawEmailChunks(t *testing.T) {
+	storage, err := newSqliteStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	// a body over two chunks
+	var raw bytes.Buffer
+	raw.WriteString("From: a@example.com\r\nTo: b@example.com\r\nSubject: large\r\n\r\n")
+	for i := 0; raw.Len() < 2*sqliteChunkSize+1000; i++ {
+		fmt.Fprintf(&raw, "line %d\r\n", i)
+	}
+	if err := storage.setWithID("large", raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	content, err := storage.OpenRawEmail("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, end := readContent(t, content, 100)
+	if !bytes.Equal(data, raw.Bytes()) || !bytes.Equal(end, raw.Bytes()[raw.Len()-100:]) {
+		t.Errorf("unexpected raw email of %d bytes", len(data))
+	}
+}
+
+func TestEngineOpenRawEmail(t *testing.T) {
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead, ScopeCache}},
+		{Type: "FILESYSTEM", Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.setWithID("invoice", invoiceEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := engine.OpenRawEmail("invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readContent(t, content, 1); !bytes.Equal(data, invoiceEmail(1)) {
+		t.Errorf("unexpected raw email %q", data)
+	}
+	attachments, _ := engine.GetAttachments("invoice")
+	header, content, err := engine.OpenAttachment("invoice", attachments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content.Close()
+	if header.Hash != invoiceHash {
+		t.Errorf("unexpected attachment %+v", header)
+	}
+	if _, err := engine.OpenRawEmail("missing"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
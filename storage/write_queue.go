@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mock-my-mta/log"
+)
+
+// defaultWriteQueueSize is the number of writes an async layer can lag behind
+// the synchronous ones before the writers wait.
+const defaultWriteQueueSize = 1000
+
+// writeKind is the kind of a write applied in the background.
+type writeKind int
+
+const (
+	writeSet writeKind = iota
+	writeDelete
+	writeDeleteAll
+	writeFlags
+	writeBarrier // applied once the previous writes are
+)
+
+// writeOperation is a write queued for an async layer.
+type writeOperation struct {
+	kind     writeKind
+	emailID  string
+	rawEmail []byte
+	flags    []string
+	queued   time.Time
+	done     chan struct{} // writeBarrier: closed when reached
+}
+
+// WriteQueueStats is the lag of an async layer behind the synchronous layers.
+type WriteQueueStats struct {
+	Layer      string  `json:"layer"`       // layer type
+	Index      int     `json:"index"`       // position of the layer in the configuration
+	Pending    int     `json:"pending"`     // writes queued or being applied
+	Capacity   int     `json:"capacity"`    // writes queued before the writers wait
+	LagSeconds float64 `json:"lag_seconds"` // age of the oldest pending write
+	Applied    uint64  `json:"applied"`
+	Failed     uint64  `json:"failed"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// writeQueue applies the writes of an async layer in the background, in the
+// order they were made. The queue is bounded: when the layer lags too far
+// behind, the writers wait.
+type writeQueue struct {
+	layer     storageLayer
+	layerType string
+	index     int
+	ops       chan writeOperation
+	stopped   chan struct{}
+
+	mu        sync.RWMutex // held for reading while queueing, for writing when closing
+	closed    bool
+	applying  atomic.Int64 // queue time of the write being applied, UnixNano, 0 when idle
+	applied   atomic.Uint64
+	failed    atomic.Uint64
+	lastError atomic.Value // string
+}
+
+func newWriteQueue(layer storageLayer, layerType string, index int, size int) *writeQueue {
+	if size <= 0 {
+		size = defaultWriteQueueSize
+	}
+	q := &writeQueue{
+		layer:     layer,
+		layerType: layerType,
+		index:     index,
+		ops:       make(chan writeOperation, size),
+		stopped:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *writeQueue) run() {
+	defer close(q.stopped)
+	for op := range q.ops {
+		q.applying.Store(op.queued.UnixNano())
+		q.apply(op)
+		q.applying.Store(0)
+	}
+}
+
+// enqueue queues the write, waiting while the queue is full. Once the queue is
+// closed, the write is applied by the caller.
+func (q *writeQueue) enqueue(op writeOperation) {
+	op.queued = time.Now()
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.apply(op)
+		return
+	}
+	select {
+	case q.ops <- op:
+	default:
+		log.Logf(log.WARNING, "write queue of %v storage (layer %d) is full, waiting", q.layerType, q.index)
+		q.ops <- op
+	}
+}
+
+// apply applies a write to the layer. Emails missing from the layer are not
+// failures: their deletion or flags have nothing to do.
+func (q *writeQueue) apply(op writeOperation) {
+	var err error
+	switch op.kind {
+	case writeSet:
+		err = q.layer.setWithID(op.emailID, op.rawEmail)
+	case writeDelete:
+		err = q.layer.DeleteEmailByID(op.emailID)
+	case writeDeleteAll:
+		err = q.layer.DeleteAllEmails()
+	case writeFlags:
+		if s, ok := q.layer.(flagLayer); ok {
+			err = s.saveFlags(op.emailID, op.flags)
+		}
+	case writeBarrier:
+		close(op.done)
+		return
+	}
+	if err != nil && !isUnimplemented(err) && !IsNotFound(err) {
+		q.failed.Add(1)
+		q.lastError.Store(err.Error())
+		log.Logf(log.ERROR, "cannot apply write of email %v to %v storage (layer %d): %v", op.emailID, q.layerType, q.index, err)
+		return
+	}
+	q.applied.Add(1)
+}
+
+// flush waits until the writes queued so far are applied.
+func (q *writeQueue) flush() {
+	barrier := writeOperation{kind: writeBarrier, done: make(chan struct{})}
+	q.enqueue(barrier)
+	<-barrier.done
+}
+
+// close applies the queued writes and stops the queue.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ops)
+	}
+	q.mu.Unlock()
+	<-q.stopped
+}
+
+func (q *writeQueue) stats() WriteQueueStats {
+	stats := WriteQueueStats{
+		Layer:    q.layerType,
+		Index:    q.index,
+		Pending:  len(q.ops),
+		Capacity: cap(q.ops),
+		Applied:  q.applied.Load(),
+		Failed:   q.failed.Load(),
+	}
+	if applying := q.applying.Load(); applying != 0 {
+		stats.Pending++
+		stats.LagSeconds = time.Since(time.Unix(0, applying)).Seconds()
+	}
+	if lastError, ok := q.lastError.Load().(string); ok {
+		stats.LastError = lastError
+	}
+	return stats
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// failingLayer is a memory layer whose writes fail on demand.
+type failingLayer struct {
+	*memoryStorage
+	setErr    error
+	deleteErr error
+	release   chan struct{} // when set, writes wait for it
+}
+
+func newFailingLayer(t *testing.T) *failingLayer {
+	memory, err := newMemoryStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &failingLayer{memoryStorage: memory}
+}
+
+func (s *failingLayer) setWithID(emailID string, rawEmail []byte) error {
+	if s.release != nil {
+		<-s.release
+	}
+	if s.setErr != nil {
+		return s.setErr
+	}
+	return s.memoryStorage.setWithID(emailID, rawEmail)
+}
+
+func (s *failingLayer) DeleteEmailByID(emailID string) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	return s.memoryStorage.DeleteEmailByID(emailID)
+}
+
+func holds(layer storageLayer, emailID string) bool {
+	_, err := layer.GetEmailByID(emailID)
+	return err == nil
+}
+
+func TestEngineSetRollsBack(t *testing.T) {
+	first, second, third := newFailingLayer(t), newFailingLayer(t), newFailingLayer(t)
+	third.setErr = errors.New("disk full")
+	engine := newTestEngine(first, second, third)
+
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err == nil || err.Error() != "disk full" {
+		t.Fatalf("expected the error of the third layer, got %v", err)
+	}
+	for i, layer := range []storageLayer{first, second, third} {
+		if holds(layer, "email-1") {
+			t.Errorf("layer %d still holds the email", i)
+		}
+	}
+}
+
+func TestEngineDeleteRestores(t *testing.T) {
+	first, second := newFailingLayer(t), newFailingLayer(t)
+	engine := newTestEngine(first, second)
+	engine.rawLayers = []storageLayer{first, second}
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	second.deleteErr = errors.New("read-only")
+	if err := engine.DeleteEmailByID("email-1"); err == nil {
+		t.Fatal("expected the error of the second layer")
+	}
+	if !holds(first, "email-1") || !holds(second, "email-1") {
+		t.Error("expected the email restored into every layer")
+	}
+
+	second.deleteErr = nil
+	if err := engine.DeleteEmailByID("email-1"); err != nil {
+		t.Fatal(err)
+	}
+	if holds(first, "email-1") || holds(second, "email-1") {
+		t.Error("expected the email deleted from every layer")
+	}
+	if err := engine.DeleteEmailByID("email-1"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestEngineAsyncLayer(t *testing.T) {
+	engine, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeAll}},
+		{Type: "FILESYSTEM", Scope: []string{ScopeWrite}, Async: true, QueueSize: 4, Parameters: map[string]string{"folder": t.TempDir(), "type": "eml"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	async := engine.allLayers[1]
+	if len(engine.writeLayers) != 1 || len(engine.writeQueues) != 1 {
+		t.Fatalf("expected one synchronous and one async layer, got %d and %d", len(engine.writeLayers), len(engine.writeQueues))
+	}
+
+	for i := 1; i <= 10; i++ {
+		if err := engine.setWithID(fmt.Sprintf("email-%d", i), memoryTestEmail(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := engine.DeleteEmailByID("email-3"); err != nil {
+		t.Fatal(err)
+	}
+	engine.flush()
+	if got, _ := searchIDs(t, async, "Body"); len(got) != 9 {
+		t.Errorf("expected the 9 emails in the async layer, got %v", got)
+	}
+
+	stats := engine.WriteQueueStats()
+	if len(stats) != 1 || stats[0].Layer != "FILESYSTEM" || stats[0].Index != 1 || stats[0].Capacity != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats[0].Pending != 0 || stats[0].Applied != 11 || stats[0].Failed != 0 {
+		t.Errorf("unexpected stats %+v", stats[0])
+	}
+}
+
+func TestEngineAsyncLayerLag(t *testing.T) {
+	sync, async := newFailingLayer(t), newFailingLayer(t)
+	engine := newTestEngine(sync)
+	queue := newWriteQueue(async, "MEMORY", 1, 2)
+	engine.writeQueues = []*writeQueue{queue}
+	engine.queues = map[storageLayer]*writeQueue{async: queue}
+	async.release = make(chan struct{})
+
+	if err := engine.setWithID("email-1", memoryTestEmail(1)); err != nil {
+		t.Fatal(err)
+	}
+	// the synchronous layer does not wait for the async one
+	if !holds(sync, "email-1") || holds(async, "email-1") {
+		t.Fatal("expected the email only in the synchronous layer")
+	}
+	time.Sleep(20 * time.Millisecond)
+	stats := engine.WriteQueueStats()[0]
+	if stats.Pending != 1 || stats.LagSeconds < 0.01 {
+		t.Errorf("expected the pending write to lag, got %+v", stats)
+	}
+
+	close(async.release)
+	engine.Close()
+	if !holds(async, "email-1") {
+		t.Error("expected Close to apply the queued write")
+	}
+	if stats := engine.WriteQueueStats()[0]; stats.Pending != 0 || stats.LagSeconds != 0 || stats.Applied != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// after Close, the async layers are written synchronously
+	async.setErr = errors.New("disk full")
+	if err := engine.setWithID("email-2", memoryTestEmail(2)); err != nil {
+		t.Errorf("async failures must not fail the write, got %v", err)
+	}
+	if stats := engine.WriteQueueStats()[0]; stats.Failed != 1 || stats.LastError != "disk full" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNewEngineAsyncRequiresWrite(t *testing.T) {
+	_, err := NewEngine([]StorageLayerConfiguration{
+		{Type: "MEMORY", Scope: []string{ScopeRead}, Async: true},
+	})
+	if err == nil {
+		t.Error("expected an error for an async layer without a writable scope")
+	}
+}